@@ -0,0 +1,350 @@
+// Package acl 访问控制: 用户, 密码, 允许执行的命令(按名称或类别), 允许访问的 key 与频道
+// 规则的语法与 redis 相同, eg: ACL SETUSER alice on >secret ~cache:* &news.* +@read -keys
+//
+// 命令的类别(@read, @write, @admin)由 database 中命令的 flags 得到, 命令涉及的 key 由命令的 PreFunc 得到
+// NODE 暂不支持子命令级别的规则(+config|get)以及读写分开的 key 模式(%R~ %W~)
+
+package acl
+
+import (
+	"memgo/config"
+	"memgo/database"
+	"memgo/interface/resp"
+	"memgo/redis/RESP/protocol"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultUser      = "default"
+	defaultLogMaxLen = 128
+)
+
+var categories = []string{database.CategoryRead, database.CategoryWrite, database.CategoryAdmin}
+
+func isCategory(name string) bool {
+	for _, c := range categories {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+type Manager struct {
+	mu    sync.RWMutex
+	users map[string]*User
+	file  string
+	log   *aclLog
+}
+
+// MakeManager 使用配置中的 requirepass 与 aclfile, aclfile 无法加载时退出
+func MakeManager() *Manager {
+	m, err := NewManager(config.Properties.RequirePass, config.Properties.AclFile, config.Properties.AclLogMaxLen)
+	if err != nil {
+		panic("load acl file failed: " + err.Error())
+	}
+	return m
+}
+
+// NewManager requirePass 作为 default 用户的密码; file 存在时从中加载所有用户
+func NewManager(requirePass, file string, logMaxLen int) (*Manager, error) {
+	if logMaxLen <= 0 {
+		logMaxLen = defaultLogMaxLen
+	}
+	m := &Manager{
+		users: map[string]*User{defaultUser: newDefaultUser(requirePass)},
+		file:  file,
+		log:   newACLLog(logMaxLen),
+	}
+	if file != "" {
+		if _, err := os.Stat(file); err == nil {
+			if err := m.load(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return m, nil
+}
+
+// User 用户不存在时返回 nil
+func (m *Manager) User(name string) *User {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.users[name]
+}
+
+// DefaultUser 新的连接自动以 default 用户认证, 除非 default 用户需要密码或者已禁用, 此时返回 nil
+func (m *Manager) DefaultUser() *User {
+	u := m.User(defaultUser)
+	if u == nil || !u.enabled || !u.nopass {
+		return nil
+	}
+	return u
+}
+
+// DefaultRequiresPassword AUTH password 只能用于设置了密码的 default 用户
+func (m *Manager) DefaultRequiresPassword() bool {
+	u := m.User(defaultUser)
+	return u != nil && !u.nopass
+}
+
+// Authenticate 用户不存在, 已禁用或者密码错误时返回 nil, 并记录到 ACL LOG
+func (m *Manager) Authenticate(name, password, clientInfo string) *User {
+	u := m.User(name)
+	if u == nil || !u.checkPassword(password) {
+		m.log.add("auth", "AUTH", name, clientInfo)
+		return nil
+	}
+	return u
+}
+
+// Check 检查用户是否可以执行该命令, 可以执行时返回 nil, 否则返回错误并记录到 ACL LOG
+func (m *Manager) Check(u *User, cmdLine [][]byte, clientInfo string) resp.ReplyIntf {
+	name := strings.ToLower(string(cmdLine[0]))
+	if !u.canRun(name) && !isPublicACLCommand(cmdLine) {
+		m.log.add("command", name, u.name, clientInfo)
+		return protocol.MakeErrReply("NOPERM User " + u.name + " has no permissions to run the '" + name + "' command")
+	}
+	if !u.allKeys() {
+		// 作用于整个 keyspace 的命令没有具体的 key, 只有可以访问所有 key 的用户才可以执行
+		if wholeKeyspaceCommands[name] {
+			m.log.add("key", "*", u.name, clientInfo)
+			return protocol.MakeErrReply("NOPERM No permissions to access a key")
+		}
+		for _, key := range database.GetRelatedKeys(cmdLine) {
+			if !u.canAccessKey(key) {
+				m.log.add("key", key, u.name, clientInfo)
+				return protocol.MakeErrReply("NOPERM No permissions to access a key")
+			}
+		}
+	}
+	channels, literal := channelsOf(name, cmdLine[1:])
+	for _, channel := range channels {
+		if !u.canAccessChannel(channel, literal) {
+			m.log.add("channel", channel, u.name, clientInfo)
+			return protocol.MakeErrReply("NOPERM No permissions to access a channel")
+		}
+	}
+	return nil
+}
+
+// wholeKeyspaceCommands 读取或者修改所有 key 的命令, 需要 ~* (allkeys)
+var wholeKeyspaceCommands = map[string]bool{
+	"flushdb":   true,
+	"flushall":  true,
+	"keys":      true,
+	"scan":      true,
+	"randomkey": true,
+	"swapdb":    true,
+}
+
+// isPublicACLCommand 与 redis 相同, ACL WHOAMI 与 ACL CAT 不属于 @admin, 所有用户都可以执行
+func isPublicACLCommand(cmdLine [][]byte) bool {
+	if len(cmdLine) < 2 || strings.ToLower(string(cmdLine[0])) != "acl" {
+		return false
+	}
+	sub := strings.ToLower(string(cmdLine[1]))
+	return sub == "whoami" || sub == "cat"
+}
+
+// channelsOf 发布订阅命令涉及的频道, PSUBSCRIBE 的参数是模式, 需要与允许的模式完全相同
+// NODE 发布订阅命令实现之后, 权限检查自动生效
+func channelsOf(name string, args [][]byte) ([]string, bool) {
+	var channels []string
+	switch name {
+	case "publish", "spublish":
+		if len(args) > 0 {
+			channels = append(channels, string(args[0]))
+		}
+	case "subscribe", "ssubscribe", "psubscribe":
+		for _, arg := range args {
+			channels = append(channels, string(arg))
+		}
+	}
+	return channels, name == "psubscribe"
+}
+
+// Exec ACL 命令, u 为当前连接的用户
+func (m *Manager) Exec(u *User, clientInfo string, args [][]byte) resp.ReplyIntf {
+	if len(args) == 0 {
+		return protocol.MakeArgNumErrReply("acl")
+	}
+	sub := strings.ToLower(string(args[0]))
+	args = args[1:]
+	switch {
+	case sub == "setuser" && len(args) >= 1:
+		return m.execSetUser(string(args[0]), toStrings(args[1:]))
+	case sub == "getuser" && len(args) == 1:
+		return m.execGetUser(string(args[0]))
+	case sub == "deluser" && len(args) >= 1:
+		return m.execDelUser(toStrings(args))
+	case sub == "list" && len(args) == 0:
+		return protocol.MakeMultiBulkReply(m.describeUsers())
+	case sub == "users" && len(args) == 0:
+		return protocol.MakeMultiBulkReply(m.userNames())
+	case sub == "whoami" && len(args) == 0:
+		return protocol.MakeBulkReply([]byte(u.name))
+	case sub == "cat" && len(args) <= 1:
+		return execCat(args)
+	case sub == "log" && len(args) <= 1:
+		return m.execLog(args)
+	case sub == "save" && len(args) == 0:
+		return m.execSave()
+	case sub == "load" && len(args) == 0:
+		return m.execLoad()
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand or wrong number of arguments for '" + sub + "'")
+}
+
+func (m *Manager) execSetUser(name string, rules []string) resp.ReplyIntf {
+	if name == "" || strings.ContainsAny(name, " \t\r\n") {
+		return protocol.MakeErrReply("ERR Usernames can't contain spaces or null characters")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := newUser(name)
+	if old := m.users[name]; old != nil {
+		u = old.clone()
+	}
+	if err := u.apply(rules); err != nil {
+		return protocol.MakeErrReply("ERR " + err.Error())
+	}
+	m.users[name] = u
+	return protocol.MakeOkReply()
+}
+
+func (m *Manager) execGetUser(name string) resp.ReplyIntf {
+	u := m.User(name)
+	if u == nil {
+		return protocol.MakeNullBulkReply()
+	}
+	patterns := func(prefix string, values []string) resp.ReplyIntf {
+		result := make([]string, len(values))
+		for i, v := range values {
+			result[i] = prefix + v
+		}
+		return protocol.MakeBulkReply([]byte(strings.Join(result, " ")))
+	}
+	return protocol.MakeMultiRawReply([]resp.ReplyIntf{
+		protocol.MakeBulkReply([]byte("flags")), protocol.MakeMultiBulkReply(toBytes(u.flags())),
+		protocol.MakeBulkReply([]byte("passwords")), protocol.MakeMultiBulkReply(toBytes(u.sortedPasswords())),
+		protocol.MakeBulkReply([]byte("commands")), protocol.MakeBulkReply([]byte(u.commandsString())),
+		protocol.MakeBulkReply([]byte("keys")), patterns("~", u.keys),
+		protocol.MakeBulkReply([]byte("channels")), patterns("&", u.channels),
+	})
+}
+
+func (m *Manager) execDelUser(names []string) resp.ReplyIntf {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var deleted int64
+	for _, name := range names {
+		if name == defaultUser {
+			return protocol.MakeErrReply("ERR The 'default' user cannot be removed")
+		}
+	}
+	for _, name := range names {
+		if _, ok := m.users[name]; ok {
+			delete(m.users, name)
+			deleted++
+		}
+	}
+	return protocol.MakeIntReply(deleted)
+}
+
+func (m *Manager) userNames() [][]byte {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	names := make([]string, 0, len(m.users))
+	for name := range m.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return toBytes(names)
+}
+
+// describeUsers 按用户名排序, 每个用户一行, 格式与 aclfile 相同
+func (m *Manager) describeUsers() [][]byte {
+	names := m.userNames()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	lines := make([][]byte, 0, len(names))
+	for _, name := range names {
+		if u := m.users[string(name)]; u != nil {
+			lines = append(lines, []byte(u.describe()))
+		}
+	}
+	return lines
+}
+
+// execCat ACL CAT [category]
+func execCat(args [][]byte) resp.ReplyIntf {
+	if len(args) == 0 {
+		return protocol.MakeMultiBulkReply(toBytes(categories))
+	}
+	category := strings.ToLower(string(args[0]))
+	if !isCategory(category) {
+		return protocol.MakeErrReply("ERR Unknown category '" + category + "'")
+	}
+	return protocol.MakeMultiBulkReply(toBytes(database.CommandsInCategory(category)))
+}
+
+// execLog ACL LOG [count | RESET]
+func (m *Manager) execLog(args [][]byte) resp.ReplyIntf {
+	count := -1
+	if len(args) == 1 {
+		if strings.ToLower(string(args[0])) == "reset" {
+			m.log.reset()
+			return protocol.MakeOkReply()
+		}
+		n, err := strconv.Atoi(string(args[0]))
+		if err != nil || n < 0 {
+			return protocol.MakeErrReply("ERR value is out of range, must be positive")
+		}
+		count = n
+	}
+	return m.log.reply(count)
+}
+
+func (m *Manager) execSave() resp.ReplyIntf {
+	if m.file == "" {
+		return errNoFileReply
+	}
+	if err := m.save(); err != nil {
+		return protocol.MakeErrReply("ERR There was an error trying to save the ACLs: " + err.Error())
+	}
+	return protocol.MakeOkReply()
+}
+
+// execLoad 文件中任何一行有错误时保留当前的用户
+func (m *Manager) execLoad() resp.ReplyIntf {
+	if m.file == "" {
+		return errNoFileReply
+	}
+	if err := m.load(); err != nil {
+		return protocol.MakeErrReply("ERR " + err.Error())
+	}
+	return protocol.MakeOkReply()
+}
+
+var errNoFileReply = protocol.MakeErrReply("ERR This instance is not configured to use an ACL file")
+
+func toStrings(args [][]byte) []string {
+	result := make([]string, len(args))
+	for i, arg := range args {
+		result[i] = string(arg)
+	}
+	return result
+}
+
+func toBytes(args []string) [][]byte {
+	result := make([][]byte, len(args))
+	for i, arg := range args {
+		result[i] = []byte(arg)
+	}
+	return result
+}
@@ -0,0 +1,117 @@
+package acl
+
+import (
+	"memgo/utils"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func do(m *Manager, args ...string) string {
+	return string(m.Exec(m.User(defaultUser), "", utils.ToCmdLine(args...)).ToBytes())
+}
+
+func check(m *Manager, user string, args ...string) string {
+	reply := m.Check(m.User(user), utils.ToCmdLine(args...), "addr=127.0.0.1:1")
+	if reply == nil {
+		return ""
+	}
+	return string(reply.ToBytes())
+}
+
+func TestPermissions(t *testing.T) {
+	m, err := NewManager("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.DefaultUser() == nil {
+		t.Fatal("default user should not require password")
+	}
+	if got := do(m, "SETUSER", "alice", "on", ">secret", "~cache:*", "&news.*", "+@read", "+set", "-keys"); got != "+OK\r\n" {
+		t.Fatal(got)
+	}
+	if m.Authenticate("alice", "wrong", "") != nil || m.Authenticate("alice", "secret", "") == nil {
+		t.Fatal("unexpected authentication result")
+	}
+	for _, c := range []struct {
+		args  []string
+		allow bool
+	}{
+		{[]string{"GET", "cache:1"}, true},
+		{[]string{"SET", "cache:1", "v"}, true},
+		{[]string{"GET", "user:1"}, false},
+		{[]string{"MGET", "cache:1"}, false}, // 未知的命令只有 +@all 允许
+		{[]string{"DEL", "cache:1"}, false},
+		{[]string{"KEYS", "*"}, false},
+		{[]string{"SAVE"}, false},
+		{[]string{"EXISTS", "cache:1", "user:1"}, false},
+		{[]string{"PUBLISH", "news.tech", "hi"}, false}, // publish 不属于任何类别
+	} {
+		if got := check(m, "alice", c.args...); (got == "") != c.allow {
+			t.Errorf("%v: expect allow=%v, got %q", c.args, c.allow, got)
+		}
+	}
+	do(m, "SETUSER", "alice", "+@all", "-@admin")
+	if check(m, "alice", "PUBLISH", "news.tech", "hi") != "" || check(m, "alice", "PUBLISH", "sports", "hi") == "" {
+		t.Error("channel permission")
+	}
+	if check(m, "alice", "PSUBSCRIBE", "news.*") != "" || check(m, "alice", "PSUBSCRIBE", "news.t*") == "" {
+		t.Error("psubscribe should require an identical pattern")
+	}
+	if check(m, "alice", "BGSAVE") == "" || check(m, "alice", "SET", "cache:1", "v") != "" {
+		t.Error("category permission")
+	}
+
+	if got := do(m, "SETUSER", "bob", "+nosuchcmd"); !strings.HasPrefix(got, "-ERR Error in ACL SETUSER modifier '+nosuchcmd'") {
+		t.Fatal(got)
+	}
+	if got := do(m, "DELUSER", "default"); !strings.HasPrefix(got, "-ERR") {
+		t.Fatal(got)
+	}
+	if got := do(m, "LOG", "1"); !strings.Contains(got, "$6\r\nreason\r\n$7\r\ncommand\r\n") ||
+		!strings.Contains(got, "$6\r\nobject\r\n$6\r\nbgsave\r\n") {
+		t.Fatal(got)
+	}
+
+	// 只能访问部分 key 的用户不能执行作用于整个 keyspace 的命令
+	for _, args := range [][]string{{"FLUSHDB"}, {"KEYS", "cache:*"}} {
+		if got := check(m, "alice", args...); got != "-NOPERM No permissions to access a key\r\n" {
+			t.Errorf("%v: expect NOPERM, got %q", args, got)
+		}
+	}
+	do(m, "SETUSER", "alice", "~*")
+	if check(m, "alice", "FLUSHDB") != "" {
+		t.Error("flushdb should be allowed with ~*")
+	}
+}
+
+func TestFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "users.acl")
+	m, err := NewManager("pw", file, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.DefaultUser() != nil || m.Authenticate(defaultUser, "pw", "") == nil {
+		t.Fatal("requirepass should be the password of the default user")
+	}
+	do(m, "SETUSER", "alice", "on", ">secret", "~a:*", "~b:*", "resetchannels", "+@read", "-keys")
+	if got := do(m, "SAVE"); got != "+OK\r\n" {
+		t.Fatal(got)
+	}
+	expect := do(m, "LIST")
+
+	// requirepass 不会覆盖文件中的 default 用户
+	loaded, err := NewManager("other", file, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := do(loaded, "LIST"); got != expect {
+		t.Fatalf("expect %q, got %q", expect, got)
+	}
+	if loaded.Authenticate("alice", "secret", "") == nil || check(loaded, "alice", "GET", "b:1") != "" {
+		t.Fatal("user not restored")
+	}
+	if strings.Contains(expect, "secret") {
+		t.Fatal("password should be hashed")
+	}
+}
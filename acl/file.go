@@ -0,0 +1,83 @@
+package acl
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// aclfile 每行一个用户, 与 ACL LIST 的输出相同: user <name> <rule> ...
+// 空行与 # 开头的行被忽略; 文件中没有 default 用户时创建一个不需要密码, 拥有全部权限的 default 用户
+
+// load 解析整个文件, 全部成功后才替换当前的用户
+func (m *Manager) load() error {
+	file, err := os.Open(m.file)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	users := make(map[string]*User)
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fail := func(msg string) error {
+			return errors.New(m.file + ":" + strconv.Itoa(lineNum) + ": " + msg)
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "user" {
+			return fail("line should start with user keyword")
+		}
+		name := fields[1]
+		if _, ok := users[name]; ok {
+			return fail("duplicate user '" + name + "' found")
+		}
+		u := newUser(name)
+		if err := u.apply(fields[2:]); err != nil {
+			return fail(err.Error())
+		}
+		users[name] = u
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if users[defaultUser] == nil {
+		users[defaultUser] = newDefaultUser("")
+	}
+	m.mu.Lock()
+	m.users = users
+	m.mu.Unlock()
+	return nil
+}
+
+// save 先写入临时文件再替换, 写入失败时原文件不受影响
+func (m *Manager) save() error {
+	var builder strings.Builder
+	for _, line := range m.describeUsers() {
+		builder.Write(line)
+		builder.WriteString("\n")
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(m.file), "temp-acl-*.acl")
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.WriteString(builder.String())
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), m.file)
+	}
+	if err != nil {
+		_ = os.Remove(tmpFile.Name())
+	}
+	return err
+}
@@ -0,0 +1,85 @@
+package acl
+
+import (
+	"memgo/interface/resp"
+	"memgo/redis/RESP/protocol"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 与 redis 相同, 相同的拒绝(原因, 对象, 用户都相同)在 groupInterval 内合并为一条记录, 只增加 count
+const groupInterval = 60 * time.Second
+
+type logEntry struct {
+	count      int64
+	reason     string // command, key, channel 或 auth
+	object     string // 被拒绝的命令, key 或频道
+	username   string
+	clientInfo string
+	created    time.Time
+	updated    time.Time
+}
+
+// aclLog 最近的记录在前, 超过 maxLen 时丢弃最旧的记录
+type aclLog struct {
+	mu      sync.Mutex
+	entries []*logEntry
+	maxLen  int
+}
+
+func newACLLog(maxLen int) *aclLog {
+	return &aclLog{maxLen: maxLen}
+}
+
+func (l *aclLog) add(reason, object, username, clientInfo string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for i, e := range l.entries {
+		if e.reason == reason && e.object == object && e.username == username && now.Sub(e.updated) < groupInterval {
+			e.count++
+			e.updated = now
+			e.clientInfo = clientInfo
+			copy(l.entries[1:i+1], l.entries[:i])
+			l.entries[0] = e
+			return
+		}
+	}
+	e := &logEntry{count: 1, reason: reason, object: object, username: username, clientInfo: clientInfo, created: now, updated: now}
+	l.entries = append([]*logEntry{e}, l.entries...)
+	if len(l.entries) > l.maxLen {
+		l.entries = l.entries[:l.maxLen]
+	}
+}
+
+func (l *aclLog) reset() {
+	l.mu.Lock()
+	l.entries = nil
+	l.mu.Unlock()
+}
+
+// reply count 小于 0 时返回全部记录
+func (l *aclLog) reply(count int) resp.ReplyIntf {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if count < 0 || count > len(l.entries) {
+		count = len(l.entries)
+	}
+	now := time.Now()
+	replies := make([]resp.ReplyIntf, 0, count)
+	for _, e := range l.entries[:count] {
+		age := strconv.FormatFloat(now.Sub(e.created).Seconds(), 'f', 3, 64)
+		fields := []string{
+			"count", strconv.FormatInt(e.count, 10),
+			"reason", e.reason,
+			"context", "toplevel",
+			"object", e.object,
+			"username", e.username,
+			"age-seconds", age,
+			"client-info", e.clientInfo,
+		}
+		replies = append(replies, protocol.MakeMultiBulkReply(toBytes(fields)))
+	}
+	return protocol.MakeMultiRawReply(replies)
+}
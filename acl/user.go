@@ -0,0 +1,296 @@
+package acl
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"memgo/database"
+	"memgo/utils/wildcard"
+	"sort"
+	"strings"
+)
+
+// User 创建之后不再修改, ACL SETUSER 在副本上应用规则后整体替换, 检查权限时不需要加锁
+type User struct {
+	name      string
+	enabled   bool
+	nopass    bool
+	passwords map[string]struct{} // 密码的 SHA256, 十六进制
+
+	// 按顺序应用的命令规则, eg: +@read -keys +set; 之后的规则覆盖之前的
+	commandRules []string
+	keys         []string
+	keyMatchers  []*wildcard.Pattern
+	channels     []string
+	chanMatchers []*wildcard.Pattern
+}
+
+// newUser 新用户没有任何权限, 与 ACL SETUSER name reset 相同
+func newUser(name string) *User {
+	return &User{name: name, passwords: make(map[string]struct{})}
+}
+
+// newDefaultUser password 为空时不需要密码
+func newDefaultUser(password string) *User {
+	u := newUser(defaultUser)
+	rules := []string{"on", "nopass", "allkeys", "allchannels", "allcommands"}
+	if password != "" {
+		rules[1] = ">" + password
+	}
+	if err := u.apply(rules); err != nil {
+		panic(err)
+	}
+	return u
+}
+
+func (u *User) Name() string {
+	return u.name
+}
+
+func (u *User) clone() *User {
+	c := *u
+	c.passwords = make(map[string]struct{}, len(u.passwords))
+	for h := range u.passwords {
+		c.passwords[h] = struct{}{}
+	}
+	c.commandRules = append([]string(nil), u.commandRules...)
+	c.keys = append([]string(nil), u.keys...)
+	c.keyMatchers = append([]*wildcard.Pattern(nil), u.keyMatchers...)
+	c.channels = append([]string(nil), u.channels...)
+	c.chanMatchers = append([]*wildcard.Pattern(nil), u.chanMatchers...)
+	return &c
+}
+
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+func isPasswordHash(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// checkPassword 逐个比较所有的哈希, 耗时与匹配的位置无关
+func (u *User) checkPassword(password string) bool {
+	if !u.enabled {
+		return false
+	}
+	if u.nopass {
+		return true
+	}
+	h := []byte(hashPassword(password))
+	matched := false
+	for stored := range u.passwords {
+		if subtle.ConstantTimeCompare(h, []byte(stored)) == 1 {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// apply 依次应用规则, 出错时 u 可能已被部分修改, 调用方应在副本上执行
+func (u *User) apply(rules []string) error {
+	for _, rule := range rules {
+		if err := u.applyRule(rule); err != nil {
+			return errors.New("Error in ACL SETUSER modifier '" + rule + "': " + err.Error())
+		}
+	}
+	return nil
+}
+
+var errSyntax = errors.New("Syntax error")
+
+func (u *User) applyRule(rule string) error {
+	switch strings.ToLower(rule) {
+	case "on":
+		u.enabled = true
+		return nil
+	case "off":
+		u.enabled = false
+		return nil
+	case "nopass":
+		u.nopass = true
+		u.passwords = make(map[string]struct{})
+		return nil
+	case "resetpass":
+		u.nopass = false
+		u.passwords = make(map[string]struct{})
+		return nil
+	case "allkeys":
+		return u.applyRule("~*")
+	case "resetkeys":
+		u.keys, u.keyMatchers = nil, nil
+		return nil
+	case "allchannels":
+		return u.applyRule("&*")
+	case "resetchannels":
+		u.channels, u.chanMatchers = nil, nil
+		return nil
+	case "allcommands":
+		return u.applyRule("+@all")
+	case "nocommands":
+		return u.applyRule("-@all")
+	case "reset":
+		return u.apply([]string{"resetpass", "resetkeys", "resetchannels", "off", "-@all"})
+	}
+	if rule == "" {
+		return errSyntax
+	}
+	arg := rule[1:]
+	switch rule[0] {
+	case '>':
+		u.nopass = false
+		u.passwords[hashPassword(arg)] = struct{}{}
+	case '<':
+		delete(u.passwords, hashPassword(arg))
+	case '#':
+		if !isPasswordHash(arg) {
+			return errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		u.nopass = false
+		u.passwords[strings.ToLower(arg)] = struct{}{}
+	case '!':
+		delete(u.passwords, strings.ToLower(arg))
+	case '~':
+		pattern, err := wildcard.CompilePattern(arg)
+		if err != nil {
+			return errSyntax
+		}
+		u.keys = append(u.keys, arg)
+		u.keyMatchers = append(u.keyMatchers, pattern)
+	case '&':
+		pattern, err := wildcard.CompilePattern(arg)
+		if err != nil {
+			return errSyntax
+		}
+		u.channels = append(u.channels, arg)
+		u.chanMatchers = append(u.chanMatchers, pattern)
+	case '+', '-':
+		return u.addCommandRule(rule[0], strings.ToLower(arg))
+	default:
+		return errSyntax
+	}
+	return nil
+}
+
+// addCommandRule +@all 与 -@all 覆盖之前所有的命令规则
+func (u *User) addCommandRule(sign byte, target string) error {
+	if strings.HasPrefix(target, "@") {
+		category := target[1:]
+		if category == "all" {
+			u.commandRules = []string{string(sign) + target}
+			return nil
+		}
+		if !isCategory(category) {
+			return errors.New("Unknown command or category name in ACL")
+		}
+	} else if _, ok := database.CommandCategories(target); !ok {
+		return errors.New("Unknown command or category name in ACL")
+	}
+	u.commandRules = append(u.commandRules, string(sign)+target)
+	return nil
+}
+
+func (u *User) canRun(name string) bool {
+	allowed := false
+	categories, _ := database.CommandCategories(name)
+	for _, rule := range u.commandRules {
+		target := rule[1:]
+		matched := target == name || target == "@all"
+		if !matched && target[0] == '@' {
+			for _, c := range categories {
+				if target[1:] == c {
+					matched = true
+				}
+			}
+		}
+		if matched {
+			allowed = rule[0] == '+'
+		}
+	}
+	return allowed
+}
+
+// allKeys 是否可以访问所有 key (~* 或者 allkeys)
+func (u *User) allKeys() bool {
+	for _, pattern := range u.keys {
+		if pattern == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) canAccessKey(key string) bool {
+	for _, pattern := range u.keyMatchers {
+		if pattern.IsMatch(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// canAccessChannel literal 为 true 时 channel 本身是模式(PSUBSCRIBE), 只有与允许的模式完全相同时才可以订阅
+func (u *User) canAccessChannel(channel string, literal bool) bool {
+	for i, pattern := range u.chanMatchers {
+		if u.channels[i] == "*" || (literal && u.channels[i] == channel) || (!literal && pattern.IsMatch(channel)) {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedPasswords 输出时按哈希排序, 保证 ACL LIST 与 aclfile 的内容稳定
+func (u *User) sortedPasswords() []string {
+	hashes := make([]string, 0, len(u.passwords))
+	for h := range u.passwords {
+		hashes = append(hashes, h)
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+func (u *User) flags() []string {
+	flags := []string{"off"}
+	if u.enabled {
+		flags[0] = "on"
+	}
+	if u.nopass {
+		flags = append(flags, "nopass")
+	}
+	return flags
+}
+
+func (u *User) commandsString() string {
+	if len(u.commandRules) == 0 {
+		return "-@all"
+	}
+	return strings.Join(u.commandRules, " ")
+}
+
+// rules 重新应用这些规则可以得到相同的用户, 用于 ACL LIST 与 aclfile
+func (u *User) rules() []string {
+	rules := u.flags()
+	for _, h := range u.sortedPasswords() {
+		rules = append(rules, "#"+h)
+	}
+	for _, key := range u.keys {
+		rules = append(rules, "~"+key)
+	}
+	if len(u.channels) == 0 {
+		rules = append(rules, "resetchannels")
+	}
+	for _, channel := range u.channels {
+		rules = append(rules, "&"+channel)
+	}
+	return append(rules, u.commandsString())
+}
+
+func (u *User) describe() string {
+	return "user " + u.name + " " + strings.Join(u.rules(), " ")
+}
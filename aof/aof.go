@@ -1,15 +1,23 @@
 package aof
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"memgo/compress"
+	"memgo/config"
+	"memgo/encrypt"
 	"memgo/interface/database"
 	"memgo/logger"
+	"memgo/rdb"
 	"memgo/redis/RESP/connection"
-	"memgo/redis/RESP/parser"
 	"memgo/redis/RESP/protocol"
 	"memgo/utils"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -20,6 +28,8 @@ type CmdLine = [][]byte
 
 const (
 	aofQueueSize = 1 << 16
+	// 重写时写入文件的缓冲大小, 加密时也是单个 frame 的大小
+	dumpBufferSize = 64 << 10
 
 	FsyncAlways = "always"
 
@@ -31,6 +41,8 @@ const (
 type payload struct {
 	cmdLine CmdLine
 	dbIndex int
+	// 不为 nil 时不是命令, 之前的命令写入文件后关闭, 见 drainQueue
+	barrier chan struct{}
 }
 
 // Persister
@@ -44,18 +56,60 @@ type Persister struct {
 	dbServer    database.DBEngine
 	aofChan     chan *payload
 	aofFile     *os.File
+	aofWriter   io.Writer // 写入 aofFile, 配置了密钥时为加密 writer
 	aofFinished chan struct{}
-	aofFilename string
 	currentDB   int
 
+	// multi-part aof: aofDir 下保存 base/incr 文件与 manifest, aofFile 为当前的 incr 文件
+	aofDir         string
+	aofFilename    string // 文件名前缀, eg: appendonly.aof
+	legacyFilename string // 旧版单文件 aof 的路径, 启动时升级为 base 文件
+	manifest       *aofManifest
+	usePreamble    bool
+
+	// fsync=always 时 并发写入的命令合并为一次 write+fsync
+	groupCommit groupCommit
+	fsyncStats  fsyncStats
+	// 写入或刷盘(fsync=always)失败后不再接受写命令, 与 redis 相同; 由 errMu 保护
+	errMu    sync.Mutex
+	writeErr error
+
+	// 配置 encryption-key-file 后, 新生成的 aof 文件均加密; 重写时重新读取密钥文件以轮换密钥
+	keyring *encrypt.Keyring
+	// 重写生成的 base 文件使用 gzip 压缩
+	rewriteCompression bool
+
+	timestampEnabled bool
+	lastTimestamp    int64 // 当前 incr 文件中最后一个时间戳注释
+
 	bufSize    int64
 	aofFsync   string     // 刷盘策略
 	pausingAof sync.Mutex // 暂停 Aof
+
+	// 后台重写的状态
+	rewrite   rewriteState
+	rewriteWg sync.WaitGroup
+	closed    bool // 已开始关闭, 由 pausingAof 保护
+
+	// 自动重写: baseSize 为上次重写后(或启动时)所有 aof 文件的大小, currentSize 为当前大小
+	autoRewritePerc    int
+	autoRewriteMinSize int64
+	baseSize           int64
+	currentSize        int64
 	// 刷盘策略
 	// =》 fsyncEverySecond 启协程 内含 ticker
 	// =》 fsyncAlways 每次将 从 aofChan读出时刷盘
 }
 
+const defaultAppendDirname = "appendonlydir"
+
+func appendDirname() string {
+	if config.Properties.AppendDirname == "" {
+		return defaultAppendDirname
+	}
+	return config.Properties.AppendDirname
+}
+
 func NewPersister(dbEngine database.DBEngine, load bool, filename, fsync string, tmpDBsvrMaker func() database.DBEngine) (*Persister, error) {
 	handler := &Persister{
 		ctx:           nil,
@@ -65,20 +119,53 @@ func NewPersister(dbEngine database.DBEngine, load bool, filename, fsync string,
 		aofChan:       make(chan *payload, aofQueueSize),
 		aofFile:       nil,
 		aofFinished:   make(chan struct{}),
-		aofFilename:   filename,
 		currentDB:     0,
 		bufSize:       0,
 		aofFsync:      strings.ToLower(fsync),
 		pausingAof:    sync.Mutex{},
+
+		autoRewritePerc:    config.Properties.AutoAofRewritePercentage,
+		autoRewriteMinSize: int64(config.Properties.AutoAofRewriteMinSize),
+
+		aofDir:         filepath.Join(filepath.Dir(filename), appendDirname()),
+		aofFilename:    filepath.Base(filename),
+		legacyFilename: filename,
+		usePreamble:    config.Properties.AofUseRdbPreamble,
+
+		timestampEnabled:   config.Properties.AofTimestampEnabled,
+		rewriteCompression: config.Properties.AofRewriteCompression,
+	}
+	keyring, err := encrypt.LoadKeyFile(config.Properties.EncryptionKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	handler.keyring = keyring
+	if err := handler.openAofDir(); err != nil {
+		return nil, err
 	}
 	if load {
-		handler.loadAof(-1)
+		if err := handler.load(); err != nil {
+			return nil, err
+		}
+	}
+	// 继续追加到最后一个 incr 文件; 还没有 incr 文件 或 其加密方式与当前配置不一致时新建一个
+	var aofFile *os.File
+	if n := len(handler.manifest.incrList); n > 0 && handler.canAppend(handler.aofPath(handler.manifest.incrList[n-1])) {
+		aofFile, err = os.OpenFile(handler.aofPath(handler.manifest.incrList[n-1]), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	} else {
+		aofFile, handler.manifest, err = handler.openNewIncrFile(handler.manifest)
 	}
-	aofFile, err := os.OpenFile(handler.aofFilename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
 	if err != nil {
 		return nil, err
 	}
-	handler.aofFile = aofFile
+	if err := handler.setAofFile(aofFile); err != nil {
+		_ = aofFile.Close()
+		return nil, err
+	}
+	// NODE 每个 aof 文件都从 db 0 开始加载
+	handler.currentDB = 0
+	handler.baseSize = handler.manifestSize(handler.manifest)
+	handler.currentSize = handler.baseSize
 	ctx, cancel := context.WithCancel(context.Background())
 	handler.ctx, handler.cancel = ctx, cancel
 	// 启一个协程 监听命令
@@ -89,12 +176,19 @@ func NewPersister(dbEngine database.DBEngine, load bool, filename, fsync string,
 	if handler.aofFsync == FsyncEverySec {
 		handler.fsyncEverySec()
 	}
+	if handler.autoRewritePerc > 0 {
+		go handler.autoRewriteCron()
+	}
 
 	return handler, nil
 }
 
 func (persister *Persister) listenCmd() {
 	for p := range persister.aofChan {
+		if p.barrier != nil {
+			close(p.barrier)
+			continue
+		}
 		persister.writeAof(p)
 	}
 	persister.aofFinished <- struct{}{}
@@ -110,38 +204,156 @@ func (persister *Persister) SaveCmdLine(dbIndex int, cmdLine CmdLine) {
 		dbIndex: dbIndex,
 	}
 	if persister.aofFsync == FsyncAlways {
-		persister.writeAof(p)
+		// 等待该命令刷盘后才返回, 调用方随后才会回复客户端; 失败时调用方通过 WriteError 得知
+		if err := persister.groupCommit.commit(persister, p); err != nil {
+			persister.failWrites(err)
+		}
 		return
 	}
 	persister.aofChan <- p
 }
 
 func (persister *Persister) writeAof(p *payload) {
+	if persister.WriteError() != nil {
+		return
+	}
+	if err := persister.writeRecords([]*payload{p}); err != nil {
+		persister.failWrites(err)
+	}
+}
+
+// failWrites 记录第一次写入失败的原因
+func (persister *Persister) failWrites(err error) {
+	persister.errMu.Lock()
+	defer persister.errMu.Unlock()
+	if persister.writeErr == nil {
+		logger.Error("aof write failed, refuse write commands from now on: ", err)
+		persister.writeErr = err
+	}
+}
+
+// WriteError 写入 aof 失败的原因, 不为 nil 时已有命令没有写入 aof, 调用方需拒绝写命令
+func (persister *Persister) WriteError() error {
+	persister.errMu.Lock()
+	defer persister.errMu.Unlock()
+	return persister.writeErr
+}
+
+// writeRecords 将一批命令编码后一次性写入 aof 文件; fsync=always 时随后刷盘
+func (persister *Persister) writeRecords(records []*payload) error {
 	persister.pausingAof.Lock()
 	defer persister.pausingAof.Unlock()
 
-	if p.dbIndex != persister.currentDB {
-		selectCmd := utils.ToCmdLine("select", strconv.Itoa(p.dbIndex))
-		data := protocol.MakeMultiBulkReply(selectCmd).ToBytes()
-		_, err := persister.aofFile.Write(data)
-		if err != nil {
-			logger.Warn("write aofFile fail: ", err)
-			return
+	var buf bytes.Buffer
+	for _, p := range records {
+		persister.encodeRecord(&buf, p)
+	}
+	n, err := persister.aofWriter.Write(buf.Bytes())
+	persister.currentSize += int64(n)
+	if err != nil {
+		return fmt.Errorf("write aof file: %w", err)
+	}
+	if persister.aofFsync == FsyncAlways {
+		if err := persister.syncAof(); err != nil {
+			return fmt.Errorf("fsync aof file: %w", err)
 		}
+	}
+	return nil
+}
 
-		persister.currentDB = p.dbIndex
+// canAppend 已有的 incr 文件能否继续追加: 明文文件只能追加明文, 加密文件只能追加密文
+func (persister *Persister) canAppend(filename string) bool {
+	info, err := os.Stat(filename)
+	if err != nil || info.Size() == 0 {
+		return true
 	}
-	data := protocol.MakeMultiBulkReply(p.cmdLine).ToBytes()
-	_, err := persister.aofFile.Write(data)
+	encrypted, err := encrypt.IsEncryptedFile(filename)
 	if err != nil {
-		logger.Warn("write aofFile fail: ", err)
+		return true
 	}
-	if persister.aofFsync == FsyncAlways {
-		err := persister.aofFile.Sync()
+	return encrypted == (persister.keyring != nil)
+}
+
+// setAofFile 设置当前写入的 incr 文件, 调用方需持有 pausingAof 或 处于启动阶段
+func (persister *Persister) setAofFile(file *os.File) error {
+	if persister.keyring == nil {
+		persister.aofFile, persister.aofWriter = file, file
+		return nil
+	}
+	writer, err := encrypt.OpenAppender(file, persister.keyring)
+	if err != nil {
+		return err
+	}
+	persister.aofFile, persister.aofWriter = file, writer
+	return nil
+}
+
+// dumpWriter 重写时写入文件: 缓冲 -> 压缩(可选) -> 加密(可选) -> 文件
+type dumpWriter struct {
+	*bufio.Writer
+	compressor *compress.Writer
+}
+
+// newDumpWriter 返回写入 file 的 writer, 写完后需要调用 Close
+func (persister *Persister) newDumpWriter(file *os.File) (*dumpWriter, error) {
+	var w io.Writer = file
+	if persister.keyring != nil {
+		encWriter, err := encrypt.NewWriter(file, persister.keyring)
 		if err != nil {
-			logger.Warn("aofFile Sync fail: ", err)
+			return nil, err
 		}
+		w = encWriter
 	}
+	dw := &dumpWriter{}
+	if persister.rewriteCompression {
+		dw.compressor = compress.NewWriter(w)
+		w = dw.compressor
+	}
+	dw.Writer = bufio.NewWriterSize(w, dumpBufferSize)
+	return dw, nil
+}
+
+// Close 写入缓冲与压缩中剩余的数据, 不关闭文件
+func (dw *dumpWriter) Close() error {
+	if err := dw.Flush(); err != nil {
+		return err
+	}
+	if dw.compressor != nil {
+		return dw.compressor.Close()
+	}
+	return nil
+}
+
+// compressionRatio 未压缩时为 0
+func (dw *dumpWriter) compressionRatio() float64 {
+	if dw.compressor == nil {
+		return 0
+	}
+	return dw.compressor.Ratio()
+}
+
+// encodeRecord 编码一条命令, 必要时在其之前加上时间戳注释与 select 命令
+func (persister *Persister) encodeRecord(buf *bytes.Buffer, p *payload) {
+	if persister.timestampEnabled {
+		if now := time.Now().Unix(); now != persister.lastTimestamp {
+			buf.Write(makeTimestampAnnotation(now))
+			persister.lastTimestamp = now
+		}
+	}
+	if p.dbIndex != persister.currentDB {
+		selectCmd := utils.ToCmdLine("select", strconv.Itoa(p.dbIndex))
+		buf.Write(protocol.MakeMultiBulkReply(selectCmd).ToBytes())
+		persister.currentDB = p.dbIndex
+	}
+	buf.Write(protocol.MakeMultiBulkReply(p.cmdLine).ToBytes())
+}
+
+// syncAof 刷盘并记录耗时, 调用方需持有 pausingAof
+func (persister *Persister) syncAof() error {
+	start := time.Now()
+	err := persister.aofFile.Sync()
+	persister.fsyncStats.record(time.Since(start))
+	return err
 }
 
 func (persister *Persister) fsyncEverySec() {
@@ -151,7 +363,7 @@ func (persister *Persister) fsyncEverySec() {
 			select {
 			case <-ticker.C:
 				persister.pausingAof.Lock()
-				if err := persister.aofFile.Sync(); err != nil {
+				if err := persister.syncAof(); err != nil {
 					logger.Error("fsync failed: ", err)
 				}
 				persister.pausingAof.Unlock()
@@ -163,6 +375,12 @@ func (persister *Persister) fsyncEverySec() {
 }
 
 func (persister *Persister) Close() {
+	// 先停止后台任务(定时刷盘、自动重写)并拒绝新的重写, 再等待正在进行的重写结束
+	persister.pausingAof.Lock()
+	persister.closed = true
+	persister.pausingAof.Unlock()
+	persister.cancel()
+	persister.rewriteWg.Wait()
 	if persister.aofFile != nil {
 		close(persister.aofChan)
 		<-persister.aofFinished
@@ -172,10 +390,38 @@ func (persister *Persister) Close() {
 			logger.Warn("aof close err: ", err)
 		}
 	}
-	persister.cancel()
 }
 
-func (persister *Persister) loadAof(limit int64) {
+// load 启动时加载 aof, 配置了恢复时间点时只加载到该时间点, 并以此时的数据重建 aof 文件
+func (persister *Persister) load() error {
+	target, err := recoverTargetFromConfig()
+	if err != nil {
+		return err
+	}
+	if target.enabled() && persister.manifest.recovered == target.String() {
+		// 已经恢复过, 之后写入的数据不能再被忽略
+		logger.Warn("aof has already been recovered to " + target.String() + ", please remove the recover options")
+		target = nil
+	} else if !target.enabled() {
+		target = nil
+	}
+	stopped, err := persister.loadAofFiles(persister.manifestFiles(persister.manifest), true, target)
+	if err != nil {
+		return err
+	}
+	if target == nil {
+		return nil
+	}
+	if !stopped {
+		logger.Warn("aof recover point " + target.String() + " is not reached, all data is loaded")
+	}
+	return persister.rebaseAfterRecovery(target)
+}
+
+// loadAofFiles 按顺序加载 base 与 incr 文件
+// truncateLast 为 true 且开启 aof-load-truncated 时, 最后一个文件结尾不完整的命令会被截断, 否则返回错误
+// target 不为 nil 时只加载到恢复的时间点, 到达时间点后 stopped 为 true
+func (persister *Persister) loadAofFiles(files []string, truncateLast bool, target *recoverTarget) (stopped bool, err error) {
 	// NODE 由于dbServer 运行时可能调用 loadAof 此时 dbServer里的每个 dbObj已经 和 addAof 绑定
 	// NODE 防止  loadAof 时执行的命令 又写入 aofFile中
 	aofChan := persister.aofChan
@@ -184,66 +430,83 @@ func (persister *Persister) loadAof(limit int64) {
 		persister.aofChan = aofChan
 	}(aofChan)
 
-	file, err := os.Open(persister.aofFilename)
-	if err != nil {
-		if _, ok := err.(*os.PathError); ok {
-			return
-		}
-		logger.Error(err)
-		return
-	}
-	defer file.Close()
-
-	var reader io.Reader
-	if limit > 0 {
-		reader = io.LimitReader(file, limit)
-	} else {
-		reader = file
-	}
-	// 解析 aof文件
-	ch := parser.ParseStream(reader)
-
-	// NODE 一个伪连接
-	fakeConn := &connection.Connection{}
-	for p := range ch {
-		// 1. payload中err不为nil =》 错误处理
-		if p.Err != nil {
-			// 客户端断开连接
-			if p.Err == io.EOF {
-				return
+	var fileStart int64 // 当前文件在所有文件拼接后的起始偏移
+	for i, filename := range files {
+		visitor := &aofVisitor{stopAt: -1}
+		if target != nil {
+			if target.offset > 0 {
+				if target.offset <= fileStart {
+					return true, nil
+				}
+				visitor.stopAt = target.offset - fileStart
+			}
+			if target.until > 0 {
+				visitor.onTimestamp = func(ts int64) error {
+					if ts > target.until {
+						return errStopReplay
+					}
+					return nil
+				}
 			}
-			logger.Error("parse error: " + p.Err.Error())
-			continue
 		}
-
-		// 2. payload中err为nil =》 db.Exec()
-		if p.Data == nil {
-			// 解析出来的数据是空的
-			logger.Error("empty payload")
-			continue
+		allowTruncated := truncateLast && i == len(files)-1 && config.Properties.AofLoadTruncated
+		size, err := persister.loadAof(filename, visitor, allowTruncated)
+		if err == errStopReplay {
+			logger.Warn("stop loading aof at " + filename + " offset " + strconv.FormatInt(size, 10) + " to recover to the requested point")
+			return true, nil
 		}
-		// 客户端传输的命令必须实现了 MultiBulkReply类型
-		mbReply, ok := p.Data.(*protocol.MultiBulkReply)
-		if !ok {
-			logger.Error("require multi bulk <load aof>: " + string(p.Data.ToBytes()))
-			continue
+		if err != nil {
+			return false, err
 		}
+		fileStart += size
+	}
+	return false, nil
+}
 
+// loadAof 加载单个文件, 返回成功加载的字节数
+func (persister *Persister) loadAof(filename string, visitor *aofVisitor, allowTruncated bool) (int64, error) {
+	start := time.Now()
+	var keys, cmds int
+	// NODE 一个伪连接, 每个文件都从 db 0 开始
+	fakeConn := &connection.Connection{}
+	visitor.onEntry = func(entry *rdb.Entry) error {
+		// NODE 开启 aof-use-rdb-preamble 后, 文件以二进制快照开头, 直接写入 dbServer
+		keys++
+		return persister.dbServer.LoadEntity(entry.DbIndex, entry.Key, entry.Entity, entry.ExpireAt)
+	}
+	visitor.onCmd = func(cmdLine CmdLine) error {
+		cmds++
 		// NODE 执行命令
-		execResultReply := persister.dbServer.Exec(fakeConn, mbReply.Args)
-
+		execResultReply := persister.dbServer.Exec(fakeConn, cmdLine)
 		if protocol.IsErrorReply(execResultReply) {
 			logger.Error("exec error in <load aof>: " + string(execResultReply.ToBytes()))
 		}
-
 		// NODE select命令还需要更改 handler中的 currentDB
-		if strings.ToLower(string(mbReply.Args[0])) == "select" {
-			dbIndex, err := strconv.Atoi(string(mbReply.Args[1]))
+		if strings.ToLower(string(cmdLine[0])) == "select" && len(cmdLine) > 1 {
+			dbIndex, err := strconv.Atoi(string(cmdLine[1]))
 			if err == nil {
 				persister.currentDB = dbIndex
 				fakeConn.SelectDB(dbIndex)
 			}
 		}
-
+		return nil
+	}
+	size, err := readAof(filename, persister.keyring, visitor)
+	var aofErr *AofError
+	if errors.As(err, &aofErr) {
+		if !aofErr.IsTruncated() || !allowTruncated {
+			return size, fmt.Errorf("%v, use memgo-check-aof --fix to repair it", err)
+		}
+		// 宕机时最后一条命令可能只写了一半, 丢弃这条命令即可
+		logger.Warn("aof file " + filename + " is truncated, discard the last incomplete command at offset " +
+			strconv.FormatInt(aofErr.ValidOffset, 10))
+		if err = TruncateAof(filename, persister.keyring, aofErr.ValidOffset); err != nil {
+			return size, err
+		}
+	} else if err != nil && err != errStopReplay {
+		return size, err
 	}
+	logger.Info("loaded " + filename + ": " + strconv.Itoa(keys) + " keys from preamble, " + strconv.Itoa(cmds) +
+		" commands in " + time.Since(start).String())
+	return size, err
 }
@@ -0,0 +1,66 @@
+package aof
+
+import (
+	"memgo/logger"
+	"time"
+)
+
+// 自动重写
+// aof 文件大小超过 autoRewriteMinSize, 且相比 baseSize 增长了 autoRewritePerc% 时, 触发后台重写
+// 每次重写结束后有一段冷却时间; 重写失败后按指数退避推迟下一次尝试, 防止磁盘满等情况下反复重写
+
+const (
+	autoRewriteCheckInterval = 100 * time.Millisecond
+	autoRewriteCooldown      = 10 * time.Second
+	autoRewriteMinBackoff    = 5 * time.Second
+	autoRewriteMaxBackoff    = 5 * time.Minute
+)
+
+func (persister *Persister) autoRewriteCron() {
+	ticker := time.NewTicker(autoRewriteCheckInterval)
+	defer ticker.Stop()
+	backoff := time.Duration(0)
+	var nextAttempt time.Time
+	for {
+		select {
+		case <-ticker.C:
+		case <-persister.ctx.Done():
+			return
+		}
+		if time.Now().Before(nextAttempt) || !persister.shouldAutoRewrite() {
+			continue
+		}
+		logger.Info("starting automatic aof rewrite")
+		// 同步等待本次重写结束, 以便根据结果计算下一次尝试的时间
+		err := persister.ReWrite()
+		if err == ErrRewriteInProgress || err == ErrPersisterClosed {
+			continue
+		}
+		if err != nil {
+			if backoff == 0 {
+				backoff = autoRewriteMinBackoff
+			} else if backoff *= 2; backoff > autoRewriteMaxBackoff {
+				backoff = autoRewriteMaxBackoff
+			}
+			logger.Warn("automatic aof rewrite failed, retry after ", backoff)
+			nextAttempt = time.Now().Add(backoff)
+			continue
+		}
+		backoff = 0
+		nextAttempt = time.Now().Add(autoRewriteCooldown)
+	}
+}
+
+func (persister *Persister) shouldAutoRewrite() bool {
+	persister.pausingAof.Lock()
+	defer persister.pausingAof.Unlock()
+	if persister.rewrite.inProgress || persister.currentSize < persister.autoRewriteMinSize {
+		return false
+	}
+	base := persister.baseSize
+	if base == 0 {
+		base = 1
+	}
+	growth := (persister.currentSize - base) * 100 / base
+	return growth >= int64(persister.autoRewritePerc)
+}
@@ -0,0 +1,322 @@
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"memgo/compress"
+	"memgo/encrypt"
+	"memgo/rdb"
+	"memgo/redis/RESP/parser"
+	"memgo/redis/RESP/protocol"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// NODE aof 文件的校验与修复
+// 进程在写入中途退出时, aof 文件的结尾可能是不完整的命令(truncated), 截断到最后一个完整命令即可恢复
+// 文件中间出现无法解析的内容则视为损坏(corrupted), 修复时同样截断, 但会丢失损坏位置之后的所有数据
+
+var ErrAofTruncated = errors.New("unexpected end of file")
+
+// AofError 描述 aof 文件中第一个无法解析的命令
+type AofError struct {
+	Filename    string
+	ValidOffset int64 // 最后一个完整命令结束的位置
+	Err         error
+}
+
+func (e *AofError) Error() string {
+	return fmt.Sprintf("bad aof file %s at offset %d: %v", e.Filename, e.ValidOffset, e.Err)
+}
+
+func (e *AofError) Unwrap() error {
+	return e.Err
+}
+
+// IsTruncated 文件只是结尾不完整, 之前的内容都是完整的
+func (e *AofError) IsTruncated() bool {
+	return e.Err == ErrAofTruncated
+}
+
+// countingReader 记录已读取的字节数, 用于计算快照前缀的长度
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// errStopReplay 回调返回该错误时 停止读取, 之后的内容被忽略
+var errStopReplay = errors.New("stop replay")
+
+// aofVisitor 读取 aof 文件时的回调, 均可为 nil
+type aofVisitor struct {
+	onEntry     func(entry *rdb.Entry) error // 开头的快照中的 key
+	onCmd       func(cmdLine CmdLine) error
+	onTimestamp func(ts int64) error // 时间戳注释 #TS:<unix秒>
+	// stopAt >= 0 时, 只读取在该偏移之前(含)结束的命令
+	stopAt int64
+}
+
+// readAof 解析单个 aof 文件, 返回成功读取到的位置:
+// 文件完整时为文件大小; 回调返回 errStopReplay 或超出 stopAt 时为停止处的位置, 返回 errStopReplay;
+// 文件不完整或损坏时为最后一个完整命令结束的位置, 返回 *AofError
+// NODE 加密或压缩的文件通过解密/解压 reader 读取, 返回的位置均为其中明文的位置
+func readAof(filename string, keyring *encrypt.Keyring, visitor *aofVisitor) (int64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	source, _, _, err := openAofReader(file, keyring)
+	if err != nil {
+		return 0, err
+	}
+	counter := &countingReader{r: source}
+	reader := bufio.NewReader(counter)
+	var preambleSize int64
+	if rdb.IsSnapshot(reader) || rdb.IsRedisRDB(reader) {
+		onEntry := visitor.onEntry
+		if onEntry == nil {
+			onEntry = func(entry *rdb.Entry) error { return nil }
+		}
+		if err := rdb.DecodeAny(reader, onEntry); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = ErrAofTruncated
+			}
+			return 0, &AofError{Filename: filename, Err: fmt.Errorf("bad preamble: %w", err)}
+		}
+		preambleSize = counter.n - int64(reader.Buffered())
+	}
+
+	validOffset := preambleSize
+	ch := parser.ParseStream(reader)
+	// NODE 第一个错误之后的内容都不可信, 提前返回; 解析协程在文件关闭后退出, 这里负责取走剩余的载荷
+	defer func() {
+		go func() {
+			for range ch {
+			}
+		}()
+	}()
+	for p := range ch {
+		if p.Err != nil {
+			if p.Err == io.EOF && preambleSize+p.Offset == validOffset {
+				return validOffset, nil
+			}
+			err := p.Err
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = ErrAofTruncated
+			}
+			return validOffset, &AofError{Filename: filename, ValidOffset: validOffset, Err: err}
+		}
+		end := preambleSize + p.Offset
+		if visitor.stopAt >= 0 && end > visitor.stopAt {
+			return validOffset, errStopReplay
+		}
+		mbReply, ok := p.Data.(*protocol.MultiBulkReply)
+		if !ok {
+			return validOffset, &AofError{Filename: filename, ValidOffset: validOffset, Err: errors.New("require multi bulk: " + strings.TrimSpace(string(p.Data.ToBytes())))}
+		}
+		if ts, ok := parseTimestampAnnotation(mbReply.Args); ok {
+			if visitor.onTimestamp != nil {
+				err = visitor.onTimestamp(ts)
+			}
+		} else if visitor.onCmd != nil {
+			err = visitor.onCmd(mbReply.Args)
+		}
+		if err != nil {
+			return validOffset, err
+		}
+		validOffset = end
+	}
+	return validOffset, nil
+}
+
+// openAofReader 识别文件的格式, 返回读取明文的 reader: 文件 -> 解密(可选) -> 解压(可选)
+func openAofReader(file *os.File, keyring *encrypt.Keyring) (reader *bufio.Reader, encrypted, compressed bool, err error) {
+	reader = bufio.NewReader(file)
+	if encrypted = encrypt.IsEncrypted(reader); encrypted {
+		if reader, err = encrypt.MaybeDecrypt(reader, keyring); err != nil {
+			// NODE 缺少密钥不代表文件损坏, 不能返回 AofError, 否则会被当作损坏的文件截断
+			if errors.Is(err, encrypt.ErrNoKey) {
+				return nil, encrypted, false, fmt.Errorf("%s: %w", file.Name(), err)
+			}
+			return nil, encrypted, false, &AofError{Filename: file.Name(), Err: fmt.Errorf("bad encryption header: %w", wrapEOF(err))}
+		}
+	}
+	if compressed = compress.IsCompressed(reader); compressed {
+		if reader, err = compress.MaybeDecompress(reader); err != nil {
+			return nil, encrypted, compressed, &AofError{Filename: file.Name(), Err: fmt.Errorf("bad gzip header: %w", wrapEOF(err))}
+		}
+	}
+	return reader, encrypted, compressed, nil
+}
+
+func wrapEOF(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrAofTruncated
+	}
+	return err
+}
+
+// DataSize 返回 aof 文件的大小, 加密或压缩的文件为其中明文的大小, 与 readAof 返回的位置一致
+// NODE 压缩的文件需要完整地解压一遍
+func DataSize(filename string, keyring *encrypt.Keyring) (int64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	reader, encrypted, compressed, err := openAofReader(file, keyring)
+	if err != nil {
+		return 0, err
+	}
+	if compressed {
+		return io.Copy(io.Discard, reader)
+	}
+	if encrypted {
+		return encrypt.PlainSize(filename)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// CheckResult 校验单个 aof 文件的结果
+type CheckResult struct {
+	Filename   string
+	Size       int64 // 见 DataSize
+	Encrypted  bool
+	Compressed bool
+	Commands   int
+	Keys       int // 快照前缀中的 key 数
+	Err        *AofError
+
+	// 文件中第一个与最后一个时间戳注释, 没有时为 0
+	FirstTimestamp int64
+	LastTimestamp  int64
+}
+
+// CheckAof 校验单个 aof 文件, 加密的文件需要提供 keyring
+func CheckAof(filename string, keyring *encrypt.Keyring) (*CheckResult, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	_, encrypted, compressed, err := openAofReader(file, keyring)
+	_ = file.Close()
+	if err != nil && !errors.As(err, new(*AofError)) {
+		return nil, err
+	}
+	size, err := DataSize(filename, keyring)
+	if err != nil {
+		// 文件头已损坏时 以文件大小代替
+		info, statErr := os.Stat(filename)
+		if statErr != nil {
+			return nil, statErr
+		}
+		size = info.Size()
+	}
+	result := &CheckResult{Filename: filename, Size: size, Encrypted: encrypted, Compressed: compressed}
+	_, err = readAof(filename, keyring, &aofVisitor{
+		onEntry: func(entry *rdb.Entry) error {
+			result.Keys++
+			return nil
+		},
+		onCmd: func(cmdLine CmdLine) error {
+			result.Commands++
+			return nil
+		},
+		onTimestamp: func(ts int64) error {
+			if result.FirstTimestamp == 0 {
+				result.FirstTimestamp = ts
+			}
+			result.LastTimestamp = ts
+			return nil
+		},
+		stopAt: -1,
+	})
+	if aofErr, ok := err.(*AofError); ok {
+		result.Err = aofErr
+		return result, nil
+	}
+	return result, err
+}
+
+// FindTimestampOffset 返回文件中第一个晚于 ts 的时间戳注释的位置, 截断到该位置即可恢复到 ts 时刻的数据
+// 没有晚于 ts 的注释时 found 为 false
+func FindTimestampOffset(filename string, keyring *encrypt.Keyring, ts int64) (offset int64, found bool, err error) {
+	offset, err = readAof(filename, keyring, &aofVisitor{
+		onTimestamp: func(annotated int64) error {
+			if annotated > ts {
+				return errStopReplay
+			}
+			return nil
+		},
+		stopAt: -1,
+	})
+	if err == errStopReplay {
+		return offset, true, nil
+	}
+	return 0, false, err
+}
+
+// AlignOffset 返回不超过 offset 的最后一个完整命令结束的位置
+func AlignOffset(filename string, keyring *encrypt.Keyring, offset int64) (int64, error) {
+	aligned, err := readAof(filename, keyring, &aofVisitor{stopAt: offset})
+	if err == errStopReplay {
+		err = nil
+	}
+	return aligned, err
+}
+
+// TruncateAof 将 aof 文件截断到 offset 并刷盘, 加密的文件中 offset 为明文中的位置
+// 压缩的文件只由重写生成, 不支持截断
+func TruncateAof(filename string, keyring *encrypt.Keyring, offset int64) error {
+	file, err := os.OpenFile(filename, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, encrypted, compressed, err := openAofReader(file, keyring)
+	if err != nil && !errors.As(err, new(*AofError)) {
+		return err
+	}
+	if compressed {
+		return errors.New("can not truncate compressed aof file " + filename)
+	}
+	if encrypted {
+		err = encrypt.Truncate(file, keyring, offset)
+	} else {
+		err = file.Truncate(offset)
+	}
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// ManifestFiles 解析 manifest 文件, 按加载顺序返回 base 与 incr 文件的路径
+func ManifestFiles(manifestPath string) ([]string, error) {
+	file, err := os.Open(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	m, err := decodeManifest(file)
+	if err != nil {
+		return nil, err
+	}
+	persister := &Persister{aofDir: filepath.Dir(manifestPath)}
+	return persister.manifestFiles(m), nil
+}
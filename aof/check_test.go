@@ -0,0 +1,73 @@
+package aof
+
+import (
+	"bytes"
+	"memgo/interface/database"
+	"memgo/rdb"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckAof(t *testing.T) {
+	preamble := &bytes.Buffer{}
+	enc := rdb.NewEncoder(preamble)
+	_ = enc.WriteHeader()
+	_ = enc.WriteDBHeader(0)
+	_ = enc.WriteEntry("k", &database.DataEntity{Data: []byte("v")}, nil)
+	_ = enc.WriteEnd()
+	cmd := "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n"
+	valid := int64(preamble.Len() + len(cmd))
+
+	tests := []struct {
+		name      string
+		tail      string
+		truncated bool
+	}{
+		{name: "ok"},
+		{name: "truncated", tail: "*3\r\n$3\r\nSET\r\n$1", truncated: true},
+		{name: "corrupted", tail: "*3\r\nXX\r\n" + cmd},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		filename := filepath.Join(dir, tt.name+".aof")
+		if err := os.WriteFile(filename, []byte(preamble.String()+cmd+tt.tail), 0600); err != nil {
+			t.Fatal(err)
+		}
+		result, err := CheckAof(filename, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Keys != 1 || result.Commands != 1 {
+			t.Errorf("%s: expect 1 key and 1 command, actual %d %d", tt.name, result.Keys, result.Commands)
+		}
+		if tt.tail == "" {
+			if result.Err != nil {
+				t.Errorf("%s: unexpected error %v", tt.name, result.Err)
+			}
+			continue
+		}
+		if result.Err == nil || result.Err.ValidOffset != valid || result.Err.IsTruncated() != tt.truncated {
+			t.Errorf("%s: wrong result %+v", tt.name, result.Err)
+		}
+	}
+}
+
+func TestFindTimestampOffset(t *testing.T) {
+	cmd := "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n"
+	content := "#TS:100\r\n" + cmd + "#TS:200\r\n" + cmd
+	filename := filepath.Join(t.TempDir(), "ts.aof")
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	offset, found, err := FindTimestampOffset(filename, nil, 150)
+	if err != nil || !found || offset != int64(len("#TS:100\r\n"+cmd)) {
+		t.Errorf("wrong offset %d %v %v", offset, found, err)
+	}
+	if _, found, _ = FindTimestampOffset(filename, nil, 200); found {
+		t.Error("expect no record after 200")
+	}
+	if aligned, err := AlignOffset(filename, nil, 20); err != nil || aligned != 9 {
+		t.Errorf("wrong aligned offset %d %v", aligned, err)
+	}
+}
@@ -0,0 +1,113 @@
+package aof
+
+import (
+	"sync"
+	"time"
+)
+
+// NODE group commit, fsync=always 时使用
+// 每条命令刷盘一次时, 吞吐量受限于磁盘的 fsync 延迟
+// 并发写入的客户端将命令追加到 pending 队列, 第一个到达的客户端成为 leader, 负责把队列中的所有命令
+// 一次性写入并刷盘, 其余客户端(follower)等待自己的命令刷盘后返回; leader 刷盘期间到达的命令由它在下一轮处理
+// 客户端的回复总是在其命令刷盘之后才发出, 与逐条刷盘的持久性保证相同
+// 写入或刷盘失败时 durable 不前进, 该批次及之后的所有命令都返回错误, 不再写入 aof, 防止 aof 中出现空洞
+
+type groupCommit struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	pending  []*payload
+	appended uint64 // 已进入队列的命令数
+	durable  uint64 // 已刷盘的命令数
+	flushing bool   // 是否有 leader 正在刷盘
+	err      error  // 写入或刷盘失败的原因, 之后的提交都直接失败
+
+	batches uint64 // 刷盘的批次数, 用于统计平均批大小
+}
+
+// commit 提交一条命令, 返回 nil 时该命令已经写入并刷盘
+func (gc *groupCommit) commit(persister *Persister, p *payload) error {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	if gc.cond == nil {
+		gc.cond = sync.NewCond(&gc.mu)
+	}
+	if gc.err != nil {
+		return gc.err
+	}
+	gc.pending = append(gc.pending, p)
+	gc.appended++
+	seq := gc.appended
+	if gc.flushing {
+		// follower: 等待 leader 将本条命令刷盘
+		for gc.durable < seq && gc.err == nil {
+			gc.cond.Wait()
+		}
+		if gc.durable < seq {
+			return gc.err
+		}
+		return nil
+	}
+	// leader: 循环处理队列, 直到本条命令以及期间到达的命令都已刷盘
+	gc.flushing = true
+	for len(gc.pending) > 0 && gc.err == nil {
+		batch := gc.pending
+		gc.pending = nil
+		last := gc.appended
+		gc.mu.Unlock()
+
+		err := persister.writeRecords(batch)
+
+		gc.mu.Lock()
+		if err != nil {
+			gc.err = err
+			gc.pending = nil
+		} else {
+			gc.durable = last
+			gc.batches++
+		}
+		gc.cond.Broadcast()
+	}
+	gc.flushing = false
+	if gc.durable < seq {
+		return gc.err
+	}
+	return nil
+}
+
+func (gc *groupCommit) avgBatchSize() float64 {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	if gc.batches == 0 {
+		return 0
+	}
+	return float64(gc.durable) / float64(gc.batches)
+}
+
+// fsyncStats 记录 fsync 的延迟
+type fsyncStats struct {
+	mu    sync.Mutex
+	count int64
+	total time.Duration
+	max   time.Duration
+	last  time.Duration
+}
+
+func (stats *fsyncStats) record(latency time.Duration) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	stats.count++
+	stats.total += latency
+	stats.last = latency
+	if latency > stats.max {
+		stats.max = latency
+	}
+}
+
+func (stats *fsyncStats) snapshot() (count int64, avg, max, last time.Duration) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	if stats.count > 0 {
+		avg = stats.total / time.Duration(stats.count)
+	}
+	return stats.count, avg, stats.max, stats.last
+}
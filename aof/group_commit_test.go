@@ -0,0 +1,64 @@
+package aof
+
+import (
+	"errors"
+	"memgo/utils"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+// 写入失败的批次不能被确认, 之后的提交也都失败
+func TestGroupCommitWriteFailure(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "appendonly.aof"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	persister := &Persister{aofFsync: FsyncAlways, aofFile: file, aofWriter: file}
+	commit := func() error {
+		return persister.groupCommit.commit(persister, &payload{cmdLine: utils.ToCmdLine("SET", "k", "v")})
+	}
+	if err := commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	persister.aofWriter = failingWriter{}
+	const n = 50
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = commit()
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err == nil {
+			t.Fatalf("commit %d acknowledged after a failed write", i)
+		}
+	}
+	if persister.groupCommit.durable != 1 {
+		t.Fatalf("durable advanced to %d by a failed batch", persister.groupCommit.durable)
+	}
+
+	// 恢复写入后依然拒绝, 否则 aof 中会缺少失败批次的命令
+	persister.aofWriter = file
+	if err := commit(); err == nil {
+		t.Fatal("commit after a failed write should fail")
+	}
+	persister.aofChan = make(chan *payload)
+	persister.SaveCmdLine(0, utils.ToCmdLine("SET", "k", "v"))
+	if persister.WriteError() == nil {
+		t.Fatal("write error not recorded")
+	}
+}
@@ -0,0 +1,322 @@
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"memgo/logger"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// NODE multi-part aof, 参考 redis 7
+// aof 目录中包含一个 base 文件、若干 incr 文件 以及 manifest 文件
+//   base: 重写生成的文件, 开启 aof-use-rdb-preamble 时为快照格式(.base.rdb), 否则为 RESP 格式(.base.aof)
+//   incr: 上次重写开始后追加的命令, 最后一个 incr 文件为当前正在写入的文件
+//   manifest: 记录上述文件及其顺序, 每次修改都先写临时文件再 rename, 保证原子性
+// 重写开始时切换到新的 incr 文件, 重写完成时只需更新 manifest, 旧的 base/incr 文件标记为 history 后删除
+//
+// manifest 每行描述一个文件 eg:
+//   file appendonly.aof.2.base.rdb seq 2 type b
+//   file appendonly.aof.3.incr.aof seq 3 type i
+
+const (
+	aofTypeBase    = "b"
+	aofTypeIncr    = "i"
+	aofTypeHistory = "h"
+
+	manifestSuffix = ".manifest"
+	tempFilePrefix = "temp-"
+
+	manifestRecoveredPrefix = "# recovered "
+)
+
+type aofInfo struct {
+	fileName string
+	fileSeq  int64
+	fileType string
+}
+
+type aofManifest struct {
+	base     *aofInfo
+	incrList []*aofInfo
+	history  []*aofInfo
+
+	currBaseSeq int64
+	currIncrSeq int64
+
+	recovered string // 最近一次时间点恢复的目标, 见 recover.go
+}
+
+func (m *aofManifest) copy() *aofManifest {
+	dup := &aofManifest{
+		base:        m.base,
+		incrList:    append([]*aofInfo(nil), m.incrList...),
+		history:     append([]*aofInfo(nil), m.history...),
+		currBaseSeq: m.currBaseSeq,
+		currIncrSeq: m.currIncrSeq,
+		recovered:   m.recovered,
+	}
+	return dup
+}
+
+func (m *aofManifest) encode() []byte {
+	var builder strings.Builder
+	if m.recovered != "" {
+		builder.WriteString(manifestRecoveredPrefix + m.recovered + "\n")
+	}
+	write := func(info *aofInfo, fileType string) {
+		builder.WriteString(fmt.Sprintf("file %s seq %d type %s\n", info.fileName, info.fileSeq, fileType))
+	}
+	if m.base != nil {
+		write(m.base, aofTypeBase)
+	}
+	for _, info := range m.history {
+		write(info, aofTypeHistory)
+	}
+	for _, info := range m.incrList {
+		write(info, aofTypeIncr)
+	}
+	return []byte(builder.String())
+}
+
+// decodeManifest 解析 manifest 文件, 不认识的字段会被忽略
+func decodeManifest(file *os.File) (*aofManifest, error) {
+	m := &aofManifest{}
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, manifestRecoveredPrefix) {
+			m.recovered = strings.TrimPrefix(line, manifestRecoveredPrefix)
+			continue
+		}
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return nil, fmt.Errorf("invalid manifest line %d: %s", lineNum, line)
+		}
+		info := &aofInfo{}
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				info.fileName = fields[i+1]
+			case "seq":
+				seq, err := strconv.ParseInt(fields[i+1], 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid manifest line %d: %s", lineNum, line)
+				}
+				info.fileSeq = seq
+			case "type":
+				info.fileType = fields[i+1]
+			}
+		}
+		// 文件名不能包含路径, 防止 manifest 引用目录之外的文件
+		if info.fileName == "" || filepath.Base(info.fileName) != info.fileName {
+			return nil, fmt.Errorf("invalid file name in manifest line %d: %s", lineNum, line)
+		}
+		switch info.fileType {
+		case aofTypeBase:
+			if m.base != nil {
+				return nil, errors.New("found duplicate base file in manifest")
+			}
+			m.base = info
+			m.currBaseSeq = info.fileSeq
+		case aofTypeIncr:
+			if info.fileSeq <= m.currIncrSeq {
+				return nil, errors.New("incr files in manifest are out of order")
+			}
+			m.incrList = append(m.incrList, info)
+			m.currIncrSeq = info.fileSeq
+		case aofTypeHistory:
+			m.history = append(m.history, info)
+		default:
+			return nil, fmt.Errorf("unknown file type in manifest line %d: %s", lineNum, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (persister *Persister) manifestPath() string {
+	return filepath.Join(persister.aofDir, persister.aofFilename+manifestSuffix)
+}
+
+func (persister *Persister) aofPath(info *aofInfo) string {
+	return filepath.Join(persister.aofDir, info.fileName)
+}
+
+func (persister *Persister) baseFileName(seq int64) string {
+	ext := ".base.aof"
+	if persister.usePreamble {
+		ext = ".base.rdb"
+	}
+	return persister.aofFilename + "." + strconv.FormatInt(seq, 10) + ext
+}
+
+func (persister *Persister) incrFileName(seq int64) string {
+	return persister.aofFilename + "." + strconv.FormatInt(seq, 10) + ".incr.aof"
+}
+
+// loadManifest 读取 manifest, 不存在时返回 nil
+func (persister *Persister) loadManifest() (*aofManifest, error) {
+	file, err := os.Open(persister.manifestPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	return decodeManifest(file)
+}
+
+// persistManifest 原子地替换 manifest 文件
+func (persister *Persister) persistManifest(m *aofManifest) error {
+	tmpFile, err := os.CreateTemp(persister.aofDir, tempFilePrefix+"*"+manifestSuffix)
+	if err != nil {
+		return err
+	}
+	tmpName := tmpFile.Name()
+	_, err = tmpFile.Write(m.encode())
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, persister.manifestPath())
+	}
+	if err != nil {
+		_ = os.Remove(tmpName)
+		return err
+	}
+	return fsyncDir(persister.aofDir)
+}
+
+// fsyncDir 刷盘目录, 保证 rename/创建文件 在宕机后依然可见
+func fsyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// openAofDir 启动时准备 aof 目录与 manifest:
+// 1. manifest 存在: 完成可能中断的旧版文件升级, 清理重写残留的临时文件与 history 文件
+// 2. manifest 不存在但旧版单文件 aof 存在: 将其升级为 base 文件
+// 3. 都不存在: 新建空的 manifest
+func (persister *Persister) openAofDir() error {
+	if err := os.MkdirAll(persister.aofDir, 0755); err != nil {
+		return err
+	}
+	m, err := persister.loadManifest()
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		m = &aofManifest{}
+		if info, err := os.Stat(persister.legacyFilename); err == nil && !info.IsDir() {
+			// NODE 先写 manifest 再移动旧文件; 若在两步之间宕机, 下次启动时在下方完成移动
+			m.base = &aofInfo{fileName: persister.aofFilename + ".1.base.aof", fileSeq: 1, fileType: aofTypeBase}
+			m.currBaseSeq = 1
+			if err := persister.persistManifest(m); err != nil {
+				return err
+			}
+		}
+	}
+	if m.base != nil {
+		basePath := persister.aofPath(m.base)
+		if _, err := os.Stat(basePath); os.IsNotExist(err) {
+			if _, err := os.Stat(persister.legacyFilename); err == nil {
+				if err := os.Rename(persister.legacyFilename, basePath); err != nil {
+					return err
+				}
+				if err := fsyncDir(persister.aofDir); err != nil {
+					return err
+				}
+				logger.Info("upgraded legacy aof file " + persister.legacyFilename + " to " + basePath)
+			}
+		}
+	}
+	persister.cleanupAofDir(m)
+	persister.manifest = m
+	return nil
+}
+
+// cleanupAofDir 删除重写残留的临时文件与 history 文件
+func (persister *Persister) cleanupAofDir(m *aofManifest) {
+	entries, err := os.ReadDir(persister.aofDir)
+	if err == nil {
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), tempFilePrefix) {
+				_ = os.Remove(filepath.Join(persister.aofDir, entry.Name()))
+			}
+		}
+	}
+	persister.removeHistory(m)
+}
+
+// removeHistory 删除 history 文件, 删除后下一次更新 manifest 时不再记录它们
+func (persister *Persister) removeHistory(m *aofManifest) {
+	for _, info := range m.history {
+		if err := os.Remove(persister.aofPath(info)); err != nil && !os.IsNotExist(err) {
+			logger.Warn("remove history aof file failed: ", err)
+		}
+	}
+	m.history = nil
+}
+
+// openNewIncrFile 创建新的 incr 文件并写入 manifest, 返回新文件与新的 manifest
+func (persister *Persister) openNewIncrFile(m *aofManifest) (*os.File, *aofManifest, error) {
+	newManifest := m.copy()
+	newManifest.currIncrSeq++
+	info := &aofInfo{
+		fileName: persister.incrFileName(newManifest.currIncrSeq),
+		fileSeq:  newManifest.currIncrSeq,
+		fileType: aofTypeIncr,
+	}
+	file, err := os.OpenFile(persister.aofPath(info), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	newManifest.incrList = append(newManifest.incrList, info)
+	if err := persister.persistManifest(newManifest); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return nil, nil, err
+	}
+	return file, newManifest, nil
+}
+
+// manifestFiles 返回需要按顺序加载的文件
+func (persister *Persister) manifestFiles(m *aofManifest) []string {
+	var files []string
+	if m.base != nil {
+		files = append(files, persister.aofPath(m.base))
+	}
+	for _, info := range m.incrList {
+		files = append(files, persister.aofPath(info))
+	}
+	return files
+}
+
+func (persister *Persister) manifestSize(m *aofManifest) int64 {
+	var size int64
+	for _, name := range persister.manifestFiles(m) {
+		if info, err := os.Stat(name); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
@@ -0,0 +1,119 @@
+package aof
+
+import (
+	"os"
+)
+
+// rebase 以 dbServer 当前的数据生成新的 base 文件与空的 incr 文件, 之前的文件不再被 manifest 引用
+// keepOld 为 true 时保留旧文件以便排查, 否则将其标记为 history 后删除; recovered 为空时沿用 manifest 中原有的记录
+// 返回新的 incr 文件, 调用方需保证期间没有写命令
+func (persister *Persister) rebase(recovered string, keepOld bool) (*os.File, error) {
+	tmpFile, err := os.CreateTemp(persister.aofDir, tempFilePrefix+"rebase-*.aof")
+	if err != nil {
+		return nil, err
+	}
+	tmpName := tmpFile.Name()
+	writer, err := persister.newDumpWriter(tmpFile)
+	if err == nil {
+		err = persister.dumpDataset(writer, persister.dbServer)
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpName)
+		return nil, err
+	}
+
+	old := persister.manifest
+	if recovered == "" {
+		recovered = old.recovered
+	}
+	manifest := &aofManifest{
+		currBaseSeq: old.currBaseSeq + 1,
+		currIncrSeq: old.currIncrSeq,
+		recovered:   recovered,
+	}
+	manifest.base = &aofInfo{
+		fileName: persister.baseFileName(manifest.currBaseSeq),
+		fileSeq:  manifest.currBaseSeq,
+		fileType: aofTypeBase,
+	}
+	if !keepOld {
+		if old.base != nil {
+			manifest.history = append(manifest.history, old.base)
+		}
+		manifest.history = append(manifest.history, old.incrList...)
+	}
+	if err := os.Rename(tmpName, persister.aofPath(manifest.base)); err != nil {
+		_ = os.Remove(tmpName)
+		return nil, err
+	}
+	aofFile, manifest, err := persister.openNewIncrFile(manifest)
+	if err != nil {
+		return nil, err
+	}
+	persister.removeHistory(manifest)
+	persister.manifest = manifest
+	return aofFile, nil
+}
+
+// Rebase 以内存中的数据重建 aof, 之前的 aof 文件全部废弃
+// 用于从节点全量同步之后: 之前的 aof 文件描述的是同步之前的数据
+// 调用方需保证期间没有写命令
+func (persister *Persister) Rebase() error {
+	// 等待进行中的重写结束, 防止它之后用旧的数据覆盖新的 base 文件; 期间标记为重写中, 阻止开始新的重写
+	for {
+		persister.rewriteWg.Wait()
+		persister.pausingAof.Lock()
+		if !persister.rewrite.inProgress {
+			break
+		}
+		persister.pausingAof.Unlock()
+	}
+	persister.rewrite.inProgress = true
+	persister.rewrite.phase = rewritePhaseDumping
+	persister.pausingAof.Unlock()
+	defer func() {
+		persister.pausingAof.Lock()
+		persister.rewrite.inProgress = false
+		persister.rewrite.phase = rewritePhaseNone
+		persister.pausingAof.Unlock()
+	}()
+
+	persister.drainQueue()
+	aofFile, err := persister.rebase("", false)
+	if err != nil {
+		return err
+	}
+
+	persister.pausingAof.Lock()
+	defer persister.pausingAof.Unlock()
+	oldFile := persister.aofFile
+	if err := persister.setAofFile(aofFile); err != nil {
+		_ = aofFile.Close()
+		return err
+	}
+	_ = oldFile.Close()
+	persister.currentDB = 0
+	persister.lastTimestamp = 0
+	persister.baseSize = persister.manifestSize(persister.manifest)
+	persister.currentSize = persister.baseSize
+	return nil
+}
+
+// drainQueue 等待 aofChan 中已有的命令全部写入文件
+func (persister *Persister) drainQueue() {
+	if persister.aofFsync == FsyncAlways || persister.aofChan == nil {
+		return
+	}
+	done := make(chan struct{})
+	persister.aofChan <- &payload{barrier: done}
+	<-done
+}
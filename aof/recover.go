@@ -0,0 +1,94 @@
+package aof
+
+import (
+	"errors"
+	"memgo/config"
+	"memgo/logger"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NODE 时间戳注释与时间点恢复
+// 开启 aof-timestamp-enabled 后, 每一秒内第一条写入 aof 的命令之前会写入一行注释 "#TS:<unix秒>\r\n"
+// 误操作(eg: FLUSHDB)之后, 可以通过以下任一方式恢复到误操作之前:
+//   1. 启动选项 aof-recover-until-time / aof-recover-until-offset: 加载到指定时间或偏移后停止,
+//      随后以内存中的数据生成新的 base 文件, 被忽略的旧文件保留在 aof 目录中以便排查
+//   2. 离线工具 memgo-check-aof -truncate-to-timestamp / -truncate-to-offset: 直接截断 aof 文件
+// NODE 重写会把误操作之后的状态写入 base 文件, 因此只能恢复到最近一次重写之后的时间点
+
+const timestampPrefix = "#TS:"
+
+func makeTimestampAnnotation(ts int64) []byte {
+	return []byte(timestampPrefix + strconv.FormatInt(ts, 10) + "\r\n")
+}
+
+// parseTimestampAnnotation 识别以 '#' 开头的注释; 时间戳注释返回其时间, 其他注释返回 -1
+func parseTimestampAnnotation(args CmdLine) (int64, bool) {
+	if len(args) != 1 || len(args[0]) == 0 || args[0][0] != '#' {
+		return 0, false
+	}
+	raw := string(args[0])
+	if !strings.HasPrefix(raw, timestampPrefix) {
+		return -1, true
+	}
+	ts, err := strconv.ParseInt(strings.TrimPrefix(raw, timestampPrefix), 10, 64)
+	if err != nil {
+		return -1, true
+	}
+	return ts, true
+}
+
+// ParseRecoverTime 解析恢复的时间点, 支持 unix 秒 以及 RFC3339 / "2006-01-02 15:04:05"(本地时间) 格式
+func ParseRecoverTime(raw string) (int64, error) {
+	raw = strings.Trim(raw, "\" ")
+	if ts, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return ts, nil
+	}
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t.Unix(), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02 15:04:05", raw, time.Local); err == nil {
+		return t.Unix(), nil
+	}
+	return 0, errors.New("invalid recover time: " + raw)
+}
+
+// recoverTarget 时间点恢复的目标, until 与 offset 为 0 时表示不限制
+type recoverTarget struct {
+	until  int64 // unix 秒, 只重放时间戳注释不晚于该时间的命令
+	offset int64 // 按 manifest 顺序拼接所有文件后的字节偏移
+}
+
+func (target *recoverTarget) enabled() bool {
+	return target.until > 0 || target.offset > 0
+}
+
+func (target *recoverTarget) String() string {
+	return "time=" + strconv.FormatInt(target.until, 10) + ",offset=" + strconv.FormatInt(target.offset, 10)
+}
+
+func recoverTargetFromConfig() (*recoverTarget, error) {
+	target := &recoverTarget{offset: int64(config.Properties.AofRecoverUntilOffset)}
+	if config.Properties.AofRecoverUntilTime != "" {
+		until, err := ParseRecoverTime(config.Properties.AofRecoverUntilTime)
+		if err != nil {
+			return nil, err
+		}
+		target.until = until
+	}
+	return target, nil
+}
+
+// rebaseAfterRecovery 时间点恢复后, 以当前数据生成新的 base 文件与空的 incr 文件
+// 旧文件不再被 manifest 引用, 但不会被删除; manifest 中记录恢复的目标, 防止重启时再次恢复而丢弃新写入的数据
+func (persister *Persister) rebaseAfterRecovery(target *recoverTarget) error {
+	oldFiles := persister.manifestFiles(persister.manifest)
+	aofFile, err := persister.rebase(target.String(), true)
+	if err != nil {
+		return err
+	}
+	_ = aofFile.Close()
+	logger.Warn("aof recovered to the requested point, ignored files are kept for inspection: " + strings.Join(oldFiles, ", "))
+	return nil
+}
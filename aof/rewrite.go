@@ -1,53 +1,117 @@
 package aof
 
 import (
+	"bufio"
+	"errors"
 	"io"
 	"memgo/config"
+	"memgo/encrypt"
 	"memgo/interface/database"
 	"memgo/logger"
+	"memgo/rdb"
 	"memgo/redis/RESP/protocol"
 	"memgo/utils"
 	"os"
 	"strconv"
+	"sync/atomic"
 	"time"
 )
 
 // rewrite逻辑
-// 1.暂停aof持久化, 设置进行重写准备工作(生成 ReWriteCtx), 恢复aof持久化
-// 2.通过 tmpDBsvrMaker 生成 tmpDBsvr, 重放 aofFile 生成 DB副本 NODE 不直接拷贝是因为防止阻塞
-// 3.根据 tmpDBsvr中的数据快照, 生成 set命令 的 resp报文（重写aof文件）
-// 4.暂停aof持久化 将开始重写后的 新追加的aof文件 追加到 aof重写文件后; 替换aof文件 恢复aof持久化
+// 1.暂停aof持久化, 切换到新的 incr 文件并更新 manifest, 记录切换前的 base/incr 文件, 恢复aof持久化
+// 2.通过 tmpDBsvrMaker 生成 tmpDBsvr, 重放切换前的 aof 文件 生成 DB副本 NODE 不直接拷贝是因为防止阻塞
+// 3.根据 tmpDBsvr中的数据快照, 生成 set命令 的 resp报文 写入新的 base 文件
+//   开启 aof-use-rdb-preamble 时 改为写入二进制快照
+// 4.更新 manifest: 新的 base 文件 + 切换后的 incr 文件, 切换前的文件成为 history 并被删除
+// NODE 重写开始后的命令直接写入新的 incr 文件, 不需要在内存中缓冲; 2、3 两步在后台协程中执行
+
+var (
+	ErrRewriteInProgress = errors.New("ERR Background append only file rewriting already in progress")
+	ErrPersisterClosed   = errors.New("ERR aof persister is closing")
+)
+
+// 重写所处的阶段, 通过 INFO persistence 展示
+const (
+	rewritePhaseNone    = ""
+	rewritePhaseLoading = "loading"
+	rewritePhaseDumping = "dumping"
+	rewritePhaseFinish  = "finishing"
+)
 
 type RewriteCtx struct {
-	tmpFile     *os.File // aof重写文件
-	filePointer int64    // 记录开始aof重写时 aof文件写到哪里了
-	dbIdx       int      // 记录开始aof重写时的 dbidx
+	tmpFile *os.File // aof重写文件
+	files   []string // 开始重写时需要重放的 base/incr 文件
+	incrSeq int64    // 开始重写时新建的 incr 文件序号, 之前的 incr 文件都会被新的 base 文件取代
+}
+
+// rewriteState 记录后台重写的进度与结果
+type rewriteState struct {
+	inProgress  bool
+	phase       string
+	startTime   time.Time
+	dumpedKeys  int64 // 已写入重写文件的 key 数, 原子操作
+	lastElapsed time.Duration
+	lastErr     error
+	// 最近一次重写生成的 base 文件的压缩比, 未压缩时为 0
+	compressionRatio float64
 }
 
 func (persister *Persister) newReWriteHandler() *Persister {
-	handler := &Persister{}
-	handler.aofFilename = persister.aofFilename
+	handler := &Persister{keyring: persister.keyring}
 	handler.dbServer = persister.tmpDBsvrMaker()
 	return handler
 }
 
+// ReWrite 同步执行 aof重写
 func (persister *Persister) ReWrite() error {
 	ctx, err := persister.prepReWrite()
 	if err != nil {
 		return err
 	}
-	err = persister.genTmpDBsvrAndReplayAof(ctx)
+	defer persister.rewriteWg.Done()
+	return persister.doReWrite(ctx)
+}
+
+// BGReWrite 在后台协程中执行 aof重写, 立即返回; 已有重写在进行时返回 ErrRewriteInProgress
+func (persister *Persister) BGReWrite() error {
+	ctx, err := persister.prepReWrite()
 	if err != nil {
 		return err
 	}
-	persister.appendTmpAof(ctx)
+	go func() {
+		defer persister.rewriteWg.Done()
+		_ = persister.doReWrite(ctx)
+	}()
 	return nil
 }
 
+func (persister *Persister) doReWrite(ctx *RewriteCtx) (err error) {
+	defer func() {
+		if err != nil {
+			logger.Error("aof rewrite failed: " + err.Error())
+			persister.abortReWrite(ctx)
+		}
+		persister.finishRewriteState(err)
+	}()
+	if err = persister.genTmpDBsvrAndReplayAof(ctx); err != nil {
+		return err
+	}
+	return persister.installReWrite(ctx)
+}
+
+// prepReWrite 成功时已计入 rewriteWg, 调用方在重写结束后需调用 rewriteWg.Done
 func (persister *Persister) prepReWrite() (*RewriteCtx, error) {
 	persister.pausingAof.Lock()
 	defer persister.pausingAof.Unlock()
 
+	// NODE Close 开始之后不再开始新的重写, 否则 Close 等待重写结束时可能漏掉它
+	if persister.closed {
+		return nil, ErrPersisterClosed
+	}
+	if persister.rewrite.inProgress {
+		return nil, ErrRewriteInProgress
+	}
+
 	// 先将没刷盘的aof文件刷盘
 	err := persister.aofFile.Sync()
 	if err != nil {
@@ -55,97 +119,284 @@ func (persister *Persister) prepReWrite() (*RewriteCtx, error) {
 		return nil, err
 	}
 
-	fileInfo, _ := os.Stat(persister.aofFilename)
-	filePointer := fileInfo.Size()
-
-	file, err := os.CreateTemp("./", "*.aof")
+	// NODE 临时文件与aof文件放在同一目录下, 保证 rename 是原子的
+	file, err := os.CreateTemp(persister.aofDir, tempFilePrefix+"rewriteaof-*.aof")
 	if err != nil {
 		logger.Error("tmp file create failed")
 		return nil, err
 	}
+
+	// NODE 重新读取密钥文件, 重写生成的 base 文件与新的 incr 文件使用其中最新的密钥
+	keyring, err := encrypt.LoadKeyFile(config.Properties.EncryptionKeyFile)
+	if err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return nil, err
+	}
+	oldKeyring := persister.keyring
+	persister.keyring = keyring
+
+	// 之后的命令写入新的 incr 文件
+	files := persister.manifestFiles(persister.manifest)
+	incrFile, manifest, err := persister.openNewIncrFile(persister.manifest)
+	if err == nil {
+		oldFile := persister.aofFile
+		if err = persister.setAofFile(incrFile); err == nil {
+			_ = oldFile.Close()
+		} else {
+			_ = incrFile.Close()
+		}
+	}
+	if err != nil {
+		persister.keyring = oldKeyring
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return nil, err
+	}
+	persister.manifest = manifest
+	persister.currentDB = 0
+	persister.lastTimestamp = 0
+
+	persister.rewrite = rewriteState{
+		inProgress:  true,
+		phase:       rewritePhaseLoading,
+		startTime:   time.Now(),
+		lastElapsed: persister.rewrite.lastElapsed,
+		lastErr:     persister.rewrite.lastErr,
+
+		compressionRatio: persister.rewrite.compressionRatio,
+	}
+	// 与 closed 的检查在同一把锁内, 保证 Close 中的 Wait 一定能等到本次重写
+	persister.rewriteWg.Add(1)
 	return &RewriteCtx{
-		tmpFile:     file,
-		filePointer: filePointer,
-		dbIdx:       persister.currentDB,
+		tmpFile: file,
+		files:   files,
+		incrSeq: manifest.currIncrSeq,
 	}, nil
 }
 
+// abortReWrite 重写失败时 删除临时文件; 新建的 incr 文件保留在 manifest 中, 不影响数据
+func (persister *Persister) abortReWrite(ctx *RewriteCtx) {
+	tmpFileName := ctx.tmpFile.Name()
+	_ = ctx.tmpFile.Close()
+	if err := os.Remove(tmpFileName); err != nil && !os.IsNotExist(err) {
+		logger.Warn("remove tmp aof file failed: ", err)
+	}
+}
+
+func (persister *Persister) finishRewriteState(err error) {
+	persister.pausingAof.Lock()
+	defer persister.pausingAof.Unlock()
+	persister.rewrite.inProgress = false
+	persister.rewrite.phase = rewritePhaseNone
+	persister.rewrite.lastElapsed = time.Since(persister.rewrite.startTime)
+	persister.rewrite.lastErr = err
+}
+
+func (persister *Persister) setRewritePhase(phase string) {
+	persister.pausingAof.Lock()
+	persister.rewrite.phase = phase
+	persister.pausingAof.Unlock()
+}
+
 func (persister *Persister) genTmpDBsvrAndReplayAof(ctx *RewriteCtx) error {
 	tmpAofHandler := persister.newReWriteHandler()
-	tmpAofHandler.loadAof(ctx.filePointer)
+	if _, err := tmpAofHandler.loadAofFiles(ctx.files, false, nil); err != nil {
+		return err
+	}
+	persister.setRewritePhase(rewritePhaseDumping)
+	writer, err := persister.newDumpWriter(ctx.tmpFile)
+	if err != nil {
+		return err
+	}
+	if err := persister.dumpDataset(writer, tmpAofHandler.dbServer); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	persister.pausingAof.Lock()
+	persister.rewrite.compressionRatio = writer.compressionRatio()
+	persister.pausingAof.Unlock()
+	return nil
+}
 
-	// NODE replay AOF
+// dumpDataset 将 dbServer 中的数据写入 w, 开启 aof-use-rdb-preamble 时使用快照格式
+func (persister *Persister) dumpDataset(w io.Writer, dbServer database.DBEngine) error {
+	if persister.usePreamble {
+		return persister.dumpPreamble(w, dbServer)
+	}
 	for i := 0; i < config.Properties.Databases; i++ {
 		data := protocol.MakeMultiBulkReply(utils.ToCmdLine("select", strconv.Itoa(i))).ToBytes()
-		_, err := ctx.tmpFile.Write(data)
+		_, err := w.Write(data)
 		if err != nil {
 			return err
 		}
 		// dump db
 		// aof重写的逻辑并不是扫描原Aof文件中的key，并将其合并
 		// 而是通过 aof重写前的 aof文件，进行重放，随后对重放之后的 db里的数据，挨个生成set命令即可
-		tmpAofHandler.dbServer.ForEach(i, func(key string, entity *database.DataEntity, expireAt *time.Time) bool {
-			cmd := utils.EntityToCmd(key, entity)
-			if cmd != nil {
-				_, _ = ctx.tmpFile.Write(cmd.ToBytes())
+		var dumpErr error
+		dbServer.ForEach(i, func(key string, entity *database.DataEntity, expireAt *time.Time) bool {
+			cmds, err := utils.EntityToCmd(key, entity)
+			if err != nil {
+				dumpErr = err
+				return false
+			}
+			for _, cmd := range cmds {
+				if _, err = w.Write(cmd.ToBytes()); err != nil {
+					dumpErr = err
+					return false
+				}
 			}
 			if expireAt != nil {
 				cmd := utils.MakeExpireCmd(key, *expireAt)
-				if cmd != nil {
-					_, _ = ctx.tmpFile.Write(cmd.ToBytes())
+				if _, err = w.Write(cmd.ToBytes()); err != nil {
+					dumpErr = err
+					return false
 				}
 			}
+			atomic.AddInt64(&persister.rewrite.dumpedKeys, 1)
 			return true
 		})
+		if dumpErr != nil {
+			return dumpErr
+		}
 	}
 	return nil
 }
 
-func (persister *Persister) appendTmpAof(ctx *RewriteCtx) {
-	persister.pausingAof.Lock()
-	defer persister.pausingAof.Unlock()
-
-	srcAof, err := os.Open(persister.aofFilename)
-	if err != nil {
-		logger.Error("open aofFile fail: ", err)
-		return
+// dumpPreamble 以快照格式写入重写文件, 加载时无需逐条执行命令
+func (persister *Persister) dumpPreamble(w io.Writer, dbServer database.DBEngine) error {
+	writer := bufio.NewWriter(w)
+	enc := rdb.NewEncoder(writer)
+	if err := enc.WriteHeader(); err != nil {
+		return err
 	}
-	defer srcAof.Close()
-
-	_, err = srcAof.Seek(ctx.filePointer, 0)
-	if err != nil {
-		logger.Error("seek aofFile fail: ", err)
+	if err := enc.WriteAux("aof-preamble", "1"); err != nil {
+		return err
 	}
-	// 同步 aof重写时的 dbidx
-	data := protocol.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(ctx.dbIdx))).ToBytes()
-	_, err = ctx.tmpFile.Write(data)
-	if err != nil {
-		logger.Error("tmp file rewrite failed: " + err.Error())
-		return
+	for i := 0; i < config.Properties.Databases; i++ {
+		if err := enc.WriteDBHeader(i); err != nil {
+			return err
+		}
+		var dumpErr error
+		dbServer.ForEach(i, func(key string, entity *database.DataEntity, expireAt *time.Time) bool {
+			if dumpErr = enc.WriteEntry(key, entity, expireAt); dumpErr != nil {
+				return false
+			}
+			atomic.AddInt64(&persister.rewrite.dumpedKeys, 1)
+			return true
+		})
+		if dumpErr != nil {
+			return dumpErr
+		}
+	}
+	if err := enc.WriteEnd(); err != nil {
+		return err
 	}
+	return writer.Flush()
+}
 
-	_, err = io.Copy(ctx.tmpFile, srcAof)
-	if err != nil {
-		logger.Error("copy aof file to Rewrite aof file error: ", err)
+// installReWrite 将重写文件作为新的 base 文件, 并更新 manifest
+func (persister *Persister) installReWrite(ctx *RewriteCtx) error {
+	persister.setRewritePhase(rewritePhaseFinish)
+	if err := ctx.tmpFile.Sync(); err != nil {
+		return err
 	}
 	tmpFileName := ctx.tmpFile.Name()
-	_ = ctx.tmpFile.Close()
-	_ = persister.aofFile.Close()
-	if err := os.Rename(tmpFileName, persister.aofFilename); err != nil {
-		logger.Info("<appendTmpAof> rename:", err.Error())
+	if err := ctx.tmpFile.Close(); err != nil {
+		return err
 	}
 
-	// 重新打开文件
-	aofFile, err := os.OpenFile(persister.aofFilename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
-	if err != nil {
-		panic("aofFile rewrite over, try open new aof file failed: " + err.Error())
+	persister.pausingAof.Lock()
+	defer persister.pausingAof.Unlock()
+	manifest := persister.manifest.copy()
+	manifest.currBaseSeq++
+	newBase := &aofInfo{
+		fileName: persister.baseFileName(manifest.currBaseSeq),
+		fileSeq:  manifest.currBaseSeq,
+		fileType: aofTypeBase,
+	}
+	if err := os.Rename(tmpFileName, persister.aofPath(newBase)); err != nil {
+		return err
+	}
+	// 新的 base 文件包含了开始重写前的所有数据, 旧的 base 与之前的 incr 文件成为 history
+	if manifest.base != nil {
+		manifest.history = append(manifest.history, manifest.base)
+	}
+	manifest.base = newBase
+	var incrList []*aofInfo
+	for _, info := range manifest.incrList {
+		if info.fileSeq < ctx.incrSeq {
+			manifest.history = append(manifest.history, info)
+		} else {
+			incrList = append(incrList, info)
+		}
+	}
+	manifest.incrList = incrList
+	if err := persister.persistManifest(manifest); err != nil {
+		// manifest 更新失败时 新的 base 文件不会被引用, 删除即可
+		_ = os.Remove(persister.aofPath(newBase))
+		return err
 	}
-	persister.aofFile = aofFile
+	persister.removeHistory(manifest)
+	persister.manifest = manifest
+	persister.baseSize = persister.manifestSize(manifest)
+	persister.currentSize = persister.baseSize
+	return nil
+}
 
-	// 同步 aof重写完成时的 dbidx
-	data = protocol.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(persister.currentDB))).ToBytes()
-	_, err = persister.aofFile.Write(data)
-	if err != nil {
-		panic("aofFile rewrite over, write new aof file failed: " + err.Error())
+// Info aof持久化的状态信息, 用于 INFO persistence
+type Info struct {
+	RewriteInProgress     bool
+	RewritePhase          string
+	RewriteDumpedKeys     int64
+	CurrentRewriteTimeSec int64
+	LastRewriteTimeSec    int64
+	LastBgRewriteStatus   string
+	LastWriteStatus       string // 写入 aof 失败后为 err, 此后拒绝写命令
+	CurrentSize           int64
+	BaseSize              int64
+
+	Fsync               string
+	FsyncCount          int64
+	FsyncLatencyAvg     time.Duration
+	FsyncLatencyMax     time.Duration
+	FsyncLatencyLast    time.Duration
+	GroupCommitAvgBatch float64 // fsync=always 时每次刷盘平均包含的命令数
+
+	BaseCompressionRatio float64 // 最近一次重写生成的 base 文件压缩前后的大小之比
+}
+
+func (persister *Persister) GetInfo() *Info {
+	persister.pausingAof.Lock()
+	defer persister.pausingAof.Unlock()
+	info := &Info{
+		RewriteInProgress:     persister.rewrite.inProgress,
+		RewritePhase:          persister.rewrite.phase,
+		RewriteDumpedKeys:     atomic.LoadInt64(&persister.rewrite.dumpedKeys),
+		CurrentRewriteTimeSec: -1,
+		LastRewriteTimeSec:    -1,
+		LastBgRewriteStatus:   "ok",
+		LastWriteStatus:       "ok",
+		CurrentSize:           persister.currentSize,
+		BaseSize:              persister.baseSize,
+		Fsync:                 persister.aofFsync,
+		BaseCompressionRatio:  persister.rewrite.compressionRatio,
+	}
+	info.FsyncCount, info.FsyncLatencyAvg, info.FsyncLatencyMax, info.FsyncLatencyLast = persister.fsyncStats.snapshot()
+	info.GroupCommitAvgBatch = persister.groupCommit.avgBatchSize()
+	if persister.rewrite.inProgress {
+		info.CurrentRewriteTimeSec = int64(time.Since(persister.rewrite.startTime) / time.Second)
+	}
+	if !persister.rewrite.startTime.IsZero() && !persister.rewrite.inProgress {
+		info.LastRewriteTimeSec = int64(persister.rewrite.lastElapsed / time.Second)
+	}
+	if persister.rewrite.lastErr != nil {
+		info.LastBgRewriteStatus = "err"
+	}
+	if persister.WriteError() != nil {
+		info.LastWriteStatus = "err"
 	}
+	return info
 }
@@ -0,0 +1,255 @@
+// Package cluster 集群模式, 参考 redis cluster
+// 16384 个槽分布在各个节点上, 客户端访问不属于本节点的槽时返回 MOVED 重定向
+// 节点之间每秒互相发送 CLUSTER PING 交换节点与槽的信息(gossip), 并据此检测节点下线
+// 迁移槽时源节点处于 MIGRATING 状态, 已经迁走的 key 返回 ASK 重定向, 客户端先发送 ASKING 再在目标节点执行
+// NODE redis 使用单独的二进制集群总线端口, memgo 的 gossip 使用 RESP 命令, 与客户端共用端口
+
+package cluster
+
+import (
+	"memgo/config"
+	"memgo/database"
+	databaseIntf "memgo/interface/database"
+	"memgo/interface/resp"
+	"memgo/logger"
+	"memgo/redis/RESP/protocol"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultNodeTimeout = 15 * time.Second
+
+// Cluster 在单机的 MemgoServer 之上实现集群, 实现 DBServerIntf
+type Cluster struct {
+	db          *database.MemgoServer
+	self        *node
+	nodeTimeout time.Duration
+
+	mu           sync.RWMutex
+	nodes        map[string]*node // id -> 节点
+	slots        [SlotCount]*node
+	migrating    map[int]*node // 本节点负责的槽正在迁出到的节点
+	importing    map[int]*node // 正在从该节点迁入的槽
+	currentEpoch int64
+	stateOK      bool
+	configFile   string
+	configDirty  bool // 节点或槽的信息有变化, 需要保存到 configFile
+
+	// 发送了 ASKING 的连接, 只对下一条命令有效
+	asking sync.Map
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// MakeCluster 集群的成员为配置中的 self 与 peers, 槽按地址排序后平均分配
+// 没有配置 peers 的节点不负责任何槽, 通过 CLUSTER MEET 加入已有的集群, 或者 CLUSTER ADDSLOTS 分配槽
+func MakeCluster() *Cluster {
+	c := &Cluster{
+		db:          database.NewMemgoServer(),
+		nodeTimeout: defaultNodeTimeout,
+		nodes:       make(map[string]*node),
+		migrating:   make(map[int]*node),
+		importing:   make(map[int]*node),
+		configFile:  config.Properties.ClusterConfigFile,
+		closing:     make(chan struct{}),
+	}
+	if c.configFile == "" {
+		c.configFile = defaultConfigFile
+	}
+	if config.Properties.ClusterNodeTimeout > 0 {
+		c.nodeTimeout = time.Duration(config.Properties.ClusterNodeTimeout) * time.Millisecond
+	}
+	selfAddr := config.Properties.Self
+	if selfAddr == "" {
+		host := config.Properties.Bind
+		if host == "" || host == "0.0.0.0" {
+			host = "127.0.0.1"
+		}
+		selfAddr = net.JoinHostPort(host, strconv.Itoa(config.Properties.Port))
+	}
+	c.self = newNode(nodeID(selfAddr), selfAddr)
+	c.nodes[c.self.id] = c.self
+	// 重启后从保存的配置恢复, 迁移过的槽不会回到初始的分配
+	if err := c.loadConfig(); err == nil {
+		c.updateState()
+		logger.Info("cluster: loaded " + c.configFile + ", " + strconv.Itoa(len(c.nodes)) + " nodes")
+		c.wg.Add(1)
+		go c.cron()
+		return c
+	} else if !os.IsNotExist(err) {
+		logger.Warn("cluster: ignore " + c.configFile + ": " + err.Error())
+	}
+
+	var addrs []string
+	for _, peer := range config.Properties.Peers {
+		if peer = strings.TrimSpace(peer); peer != "" && peer != selfAddr {
+			addrs = append(addrs, peer)
+		}
+	}
+	if len(addrs) > 0 || len(config.Properties.Peers) > 0 {
+		addrs = append(addrs, selfAddr)
+	}
+	sort.Strings(addrs)
+	for i, addr := range addrs {
+		n := c.nodes[nodeID(addr)]
+		if n == nil {
+			n = newNode(nodeID(addr), addr)
+			c.nodes[n.id] = n
+		}
+		for slot := i * SlotCount / len(addrs); slot < (i+1)*SlotCount/len(addrs); slot++ {
+			c.slots[slot] = n
+		}
+	}
+	c.updateState()
+	c.saveConfig()
+	logger.Info("cluster: myself " + c.self.id + " " + selfAddr + ", " + strconv.Itoa(len(addrs)) + " nodes")
+
+	c.wg.Add(1)
+	go c.cron()
+	return c
+}
+
+func (c *Cluster) Exec(client resp.ConnectionIntf, cmdLine databaseIntf.CmdLine) resp.ReplyIntf {
+	_, asking := c.asking.LoadAndDelete(client)
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	switch cmdName {
+	case "asking":
+		c.asking.Store(client, true)
+		return protocol.MakeOkReply()
+	case "cluster":
+		if len(cmdLine) < 2 {
+			return protocol.MakeArgNumErrReply("cluster")
+		}
+		return c.execCluster(strings.ToLower(string(cmdLine[1])), cmdLine[2:])
+	case "select":
+		// 集群模式只有 0 号数据库
+		if len(cmdLine) == 2 && string(cmdLine[1]) != "0" {
+			return protocol.MakeErrReply("ERR SELECT is not allowed in cluster mode")
+		}
+	}
+	// MIGRATE 发送的 RESTORE-ASKING 相当于 ASKING 之后的 RESTORE
+	reply, slot, target := c.route(cmdLine, asking || cmdName == "restore-asking")
+	if reply != nil {
+		return reply
+	}
+	if target != nil {
+		// 正在迁出的槽: 在持有 key 锁时检查 key 是否已经迁走, 检查与执行之间 MIGRATE 无法迁走这些 key
+		// 否则写命令可能在源节点重新创建已经迁走的 key, 之后的 MIGRATE REPLACE 会覆盖目标节点上的完整数据
+		return c.db.ExecWithCheck(client, cmdLine, func(exists func(key string) bool) resp.ReplyIntf {
+			return askOrTryAgain(database.GetRelatedKeys(cmdLine), slot, target, exists)
+		})
+	}
+	return c.db.Exec(client, cmdLine)
+}
+
+// askOrTryAgain 全部 key 都已迁走(或不存在)时由目标节点处理, 部分迁走时客户端需要稍后重试
+func askOrTryAgain(keys []string, slot int, target *node, exists func(key string) bool) resp.ReplyIntf {
+	missing := 0
+	for _, key := range keys {
+		if !exists(key) {
+			missing++
+		}
+	}
+	if missing == len(keys) {
+		return protocol.MakeErrReply("ASK " + strconv.Itoa(slot) + " " + target.addr)
+	}
+	if missing > 0 {
+		return protocol.MakeErrReply("TRYAGAIN Multiple keys request during rehashing of slot")
+	}
+	return nil
+}
+
+// route 检查命令的 key 是否都属于本节点负责的同一个槽, 否则返回重定向或错误
+// 槽正在迁出时返回迁移的目标节点, 由调用方在持有 key 锁时决定是否重定向
+// 不涉及 key 的命令(PING, INFO, KEYS 等)在本节点执行
+func (c *Cluster) route(cmdLine databaseIntf.CmdLine, asking bool) (resp.ReplyIntf, int, *node) {
+	keys := database.GetRelatedKeys(cmdLine)
+	if len(keys) == 0 {
+		return nil, 0, nil
+	}
+	slot := KeySlot(keys[0])
+	for _, key := range keys[1:] {
+		if KeySlot(key) != slot {
+			return protocol.MakeErrReply("CROSSSLOT Keys in request don't hash to the same slot"), slot, nil
+		}
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.stateOK {
+		return protocol.MakeErrReply("CLUSTERDOWN The cluster is down"), slot, nil
+	}
+	owner := c.slots[slot]
+	if owner == nil {
+		return protocol.MakeErrReply("CLUSTERDOWN Hash slot not served"), slot, nil
+	}
+	if owner == c.self {
+		return nil, slot, c.migrating[slot]
+	}
+	if asking && c.importing[slot] != nil {
+		return nil, slot, nil
+	}
+	return protocol.MakeErrReply("MOVED " + strconv.Itoa(slot) + " " + owner.addr), slot, nil
+}
+
+// slotsOf 每个节点负责的槽, 调用方需持有 c.mu
+func (c *Cluster) slotsOf() map[*node][]int {
+	result := make(map[*node][]int)
+	for slot, owner := range c.slots {
+		if owner != nil {
+			result[owner] = append(result[owner], slot)
+		}
+	}
+	return result
+}
+
+// updateState 所有槽都有正常的节点负责, 且本节点能连接到多数主节点时集群可用, 调用方需持有 c.mu
+func (c *Cluster) updateState() {
+	ok := true
+	for _, owner := range c.slots {
+		if owner == nil || owner.flags&flagFail != 0 {
+			ok = false
+			break
+		}
+	}
+	// 本节点只能连接到少数主节点时, 可能位于网络分区的少数一方, 拒绝服务以免写入丢失
+	masters := c.slotsOf()
+	reachable := 0
+	for n := range masters {
+		if n.flags&(flagPFail|flagFail) == 0 {
+			reachable++
+		}
+	}
+	if reachable < len(masters)/2+1 {
+		ok = false
+	}
+	if ok != c.stateOK {
+		c.stateOK = ok
+		if ok {
+			logger.Info("cluster: state changed to ok")
+		} else {
+			logger.Warn("cluster: state changed to fail")
+		}
+	}
+}
+
+func (c *Cluster) Close() {
+	close(c.closing)
+	c.wg.Wait()
+	c.mu.Lock()
+	for _, n := range c.nodes {
+		n.close()
+	}
+	c.mu.Unlock()
+	c.db.Close()
+}
+
+func (c *Cluster) AfterClientClose(conn resp.ConnectionIntf) {
+	c.asking.Delete(conn)
+	c.db.AfterClientClose(conn)
+}
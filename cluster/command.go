@@ -0,0 +1,198 @@
+package cluster
+
+import (
+	"memgo/interface/resp"
+	"memgo/redis/RESP/protocol"
+	"memgo/utils"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// execCluster CLUSTER 子命令
+func (c *Cluster) execCluster(sub string, args [][]byte) resp.ReplyIntf {
+	switch sub {
+	case "keyslot":
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("cluster keyslot")
+		}
+		return protocol.MakeIntReply(int64(KeySlot(string(args[0]))))
+	case "myid":
+		return protocol.MakeBulkReply([]byte(c.self.id))
+	case "info":
+		return c.execClusterInfo()
+	case "nodes":
+		return c.execClusterNodes()
+	case "slots":
+		return c.execClusterSlots()
+	case "shards":
+		return c.execClusterShards()
+	case "addslots":
+		if len(args) == 0 {
+			return protocol.MakeArgNumErrReply("cluster addslots")
+		}
+		return c.execAddSlots(args)
+	case "setslot":
+		return c.execSetSlot(args)
+	case "getkeysinslot":
+		return c.execGetKeysInSlot(args)
+	case "countkeysinslot":
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply("cluster countkeysinslot")
+		}
+		slot, ok := parseSlot(args[0])
+		if !ok {
+			return protocol.MakeErrReply("ERR Invalid slot")
+		}
+		return protocol.MakeIntReply(int64(len(c.keysInSlot(slot, -1))))
+	case "meet":
+		if len(args) != 2 {
+			return protocol.MakeArgNumErrReply("cluster meet")
+		}
+		if _, err := strconv.Atoi(string(args[1])); err != nil {
+			return protocol.MakeErrReply("ERR Invalid node address specified: " + string(args[0]) + ":" + string(args[1]))
+		}
+		addr := net.JoinHostPort(string(args[0]), string(args[1]))
+		c.mu.Lock()
+		c.learnNode(nodeID(addr), addr)
+		c.saveConfig()
+		c.mu.Unlock()
+		return protocol.MakeOkReply()
+	case "ping":
+		// 节点之间的 gossip, 回复本节点的信息
+		msg := make([]string, len(args))
+		for i, arg := range args {
+			msg[i] = string(arg)
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if err := c.processGossip(msg); err != nil {
+			return protocol.MakeErrReply("ERR " + err.Error())
+		}
+		return protocol.MakeMultiBulkReply(utils.ToCmdLine(c.buildGossip()...))
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + sub + "'. Try CLUSTER HELP.")
+}
+
+// execAddSlots CLUSTER ADDSLOTS slot [slot ...] 由本节点负责尚未分配的槽
+func (c *Cluster) execAddSlots(args [][]byte) resp.ReplyIntf {
+	slots := make([]int, len(args))
+	for i, arg := range args {
+		slot, ok := parseSlot(arg)
+		if !ok {
+			return protocol.MakeErrReply("ERR Invalid or out of range slot")
+		}
+		slots[i] = slot
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, slot := range slots {
+		if c.slots[slot] != nil {
+			return protocol.MakeErrReply("ERR Slot " + strconv.Itoa(slot) + " is already busy")
+		}
+	}
+	for _, slot := range slots {
+		c.slots[slot] = c.self
+	}
+	c.updateState()
+	c.saveConfig()
+	return protocol.MakeOkReply()
+}
+
+func (c *Cluster) execClusterInfo() resp.ReplyIntf {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	state := "fail"
+	if c.stateOK {
+		state = "ok"
+	}
+	var assigned, pfail, fail int
+	for _, owner := range c.slots {
+		if owner == nil {
+			continue
+		}
+		assigned++
+		if owner.flags&flagFail != 0 {
+			fail++
+		} else if owner.flags&flagPFail != 0 {
+			pfail++
+		}
+	}
+	var builder strings.Builder
+	builder.WriteString("cluster_enabled:1\r\ncluster_state:" + state + "\r\n")
+	builder.WriteString("cluster_slots_assigned:" + strconv.Itoa(assigned) + "\r\n")
+	builder.WriteString("cluster_slots_ok:" + strconv.Itoa(assigned-pfail-fail) + "\r\n")
+	builder.WriteString("cluster_slots_pfail:" + strconv.Itoa(pfail) + "\r\n")
+	builder.WriteString("cluster_slots_fail:" + strconv.Itoa(fail) + "\r\n")
+	builder.WriteString("cluster_known_nodes:" + strconv.Itoa(len(c.nodes)) + "\r\n")
+	builder.WriteString("cluster_size:" + strconv.Itoa(len(c.slotsOf())) + "\r\n")
+	builder.WriteString("cluster_current_epoch:" + strconv.FormatInt(c.currentEpoch, 10) + "\r\n")
+	builder.WriteString("cluster_my_epoch:" + strconv.FormatInt(c.self.configEpoch, 10) + "\r\n")
+	return protocol.MakeBulkReply([]byte(builder.String()))
+}
+
+func (c *Cluster) execClusterNodes() resp.ReplyIntf {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return protocol.MakeBulkReply([]byte(c.describeNodes()))
+}
+
+// execClusterSlots 每个连续的槽区间: [start, end, [ip, port, id]]
+func (c *Cluster) execClusterSlots() resp.ReplyIntf {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var replies []resp.ReplyIntf
+	for start := 0; start < SlotCount; {
+		owner := c.slots[start]
+		end := start
+		for end+1 < SlotCount && c.slots[end+1] == owner {
+			end++
+		}
+		if owner != nil {
+			host, port := owner.hostPort()
+			replies = append(replies, protocol.MakeMultiRawReply([]resp.ReplyIntf{
+				protocol.MakeIntReply(int64(start)),
+				protocol.MakeIntReply(int64(end)),
+				protocol.MakeMultiRawReply([]resp.ReplyIntf{
+					protocol.MakeBulkReply([]byte(host)),
+					protocol.MakeIntReply(int64(port)),
+					protocol.MakeBulkReply([]byte(owner.id)),
+				}),
+			}))
+		}
+		start = end + 1
+	}
+	return protocol.MakeMultiRawReply(replies)
+}
+
+// execClusterShards 每个主节点一个分片: ["slots", [start, end, ...], "nodes", [[id, port, ip, ...]]]
+func (c *Cluster) execClusterShards() resp.ReplyIntf {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	slots := c.slotsOf()
+	var shards []resp.ReplyIntf
+	for _, n := range c.sortedNodes() {
+		var ranges []resp.ReplyIntf
+		for _, r := range toRanges(slots[n]) {
+			ranges = append(ranges, protocol.MakeIntReply(int64(r.start)), protocol.MakeIntReply(int64(r.end)))
+		}
+		host, port := n.hostPort()
+		health := "online"
+		if n.flags&flagFail != 0 {
+			health = "failed"
+		}
+		info := protocol.MakeMultiRawReply([]resp.ReplyIntf{
+			protocol.MakeBulkReply([]byte("id")), protocol.MakeBulkReply([]byte(n.id)),
+			protocol.MakeBulkReply([]byte("port")), protocol.MakeIntReply(int64(port)),
+			protocol.MakeBulkReply([]byte("ip")), protocol.MakeBulkReply([]byte(host)),
+			protocol.MakeBulkReply([]byte("endpoint")), protocol.MakeBulkReply([]byte(host)),
+			protocol.MakeBulkReply([]byte("role")), protocol.MakeBulkReply([]byte("master")),
+			protocol.MakeBulkReply([]byte("health")), protocol.MakeBulkReply([]byte(health)),
+		})
+		shards = append(shards, protocol.MakeMultiRawReply([]resp.ReplyIntf{
+			protocol.MakeBulkReply([]byte("slots")), protocol.MakeMultiRawReply(ranges),
+			protocol.MakeBulkReply([]byte("nodes")), protocol.MakeMultiRawReply([]resp.ReplyIntf{info}),
+		}))
+	}
+	return protocol.MakeMultiRawReply(shards)
+}
@@ -0,0 +1,248 @@
+package cluster
+
+import (
+	"errors"
+	"memgo/logger"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	cronPeriod  = time.Second
+	pingTimeout = time.Second
+	// 每个节点在 gossip 中占用的参数个数: id addr flags config-epoch slots
+	gossipFields = 5
+)
+
+var errInvalidGossip = errors.New("invalid gossip message")
+
+func (c *Cluster) cron() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(cronPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.closing:
+			return
+		}
+		c.pingNodes()
+		c.mu.Lock()
+		c.checkFailures(time.Now())
+		if c.configDirty {
+			c.saveConfig()
+		}
+		c.mu.Unlock()
+	}
+}
+
+// pingNodes 向所有其他节点发送 CLUSTER PING, 回复中包含对方的信息
+// NODE redis 每次只 PING 部分节点, 且 gossip 中只包含部分节点; memgo 的集群规模较小, 全部发送
+func (c *Cluster) pingNodes() {
+	c.mu.Lock()
+	msg := append([]string{"CLUSTER", "PING"}, c.buildGossip()...)
+	var targets []*node
+	now := time.Now()
+	for _, n := range c.nodes {
+		if n == c.self {
+			continue
+		}
+		if n.pingSent.IsZero() {
+			n.pingSent = now
+		}
+		targets = append(targets, n)
+	}
+	c.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, n := range targets {
+		wg.Add(1)
+		go func(n *node) {
+			defer wg.Done()
+			reply, err := n.ping(pingTimeout, msg...)
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			n.linkUp = err == nil
+			if err != nil {
+				return
+			}
+			if err = c.processGossip(reply); err != nil {
+				logger.Warn("cluster: bad gossip from " + n.addr + ": " + err.Error())
+			}
+		}(n)
+	}
+	wg.Wait()
+}
+
+// buildGossip 消息格式: 本节点的 id addr config-epoch current-epoch slots, 之后是其他节点的 id addr flags config-epoch slots
+// 调用方需持有 c.mu
+func (c *Cluster) buildGossip() []string {
+	slots := c.slotsOf()
+	msg := []string{c.self.id, c.self.addr, strconv.FormatInt(c.self.configEpoch, 10),
+		strconv.FormatInt(c.currentEpoch, 10), formatRanges(toRanges(slots[c.self]))}
+	for _, n := range c.sortedNodes() {
+		if n == c.self {
+			continue
+		}
+		msg = append(msg, n.id, n.addr, n.flagString(c.self, true),
+			strconv.FormatInt(n.configEpoch, 10), formatRanges(toRanges(slots[n])))
+	}
+	return msg
+}
+
+func (c *Cluster) sortedNodes() []*node {
+	nodes := make([]*node, 0, len(c.nodes))
+	for _, n := range c.nodes {
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].addr < nodes[j].addr
+	})
+	return nodes
+}
+
+// processGossip 处理收到的 PING 或 PING 的回复, 调用方需持有 c.mu
+func (c *Cluster) processGossip(msg []string) error {
+	if len(msg) < 5 || (len(msg)-5)%gossipFields != 0 {
+		return errInvalidGossip
+	}
+	configEpoch, err1 := strconv.ParseInt(msg[2], 10, 64)
+	currentEpoch, err2 := strconv.ParseInt(msg[3], 10, 64)
+	slots, ok := parseRanges(msg[4])
+	if err1 != nil || err2 != nil || !ok {
+		return errInvalidGossip
+	}
+	sender := c.learnNode(msg[0], msg[1])
+	if sender == c.self {
+		return nil
+	}
+	now := time.Now()
+	sender.lastPong = now
+	sender.pingSent = time.Time{}
+	if sender.flags&(flagPFail|flagFail) != 0 {
+		logger.Info("cluster: node " + sender.addr + " is reachable again")
+		sender.flags &^= flagPFail | flagFail
+		sender.failReports = make(map[string]time.Time)
+	}
+	if currentEpoch > c.currentEpoch {
+		c.currentEpoch = currentEpoch
+		c.configDirty = true
+	}
+	c.updateSlots(sender, configEpoch, slots)
+	// 只有负责槽的主节点的报告计入下线的判断
+	senderIsMaster := c.ownsSlots(sender)
+
+	for i := 5; i < len(msg); i += gossipFields {
+		id, addr, flags := msg[i], msg[i+1], msg[i+2]
+		epoch, err := strconv.ParseInt(msg[i+3], 10, 64)
+		slots, ok := parseRanges(msg[i+4])
+		if err != nil || !ok {
+			return errInvalidGossip
+		}
+		n := c.learnNode(id, addr)
+		// 其他节点对本节点的看法不影响本节点
+		if n == c.self || n == sender {
+			continue
+		}
+		c.updateSlots(n, epoch, slots)
+		if senderIsMaster {
+			if hasFlag(flags, "pfail") || hasFlag(flags, "fail") {
+				n.failReports[sender.id] = now
+			} else {
+				delete(n.failReports, sender.id)
+			}
+		}
+		// 其他节点已经确认下线, 且本节点也有一段时间没有收到它的回复
+		if hasFlag(flags, "fail") && n.flags&flagFail == 0 && now.Sub(n.lastPong) > c.nodeTimeout {
+			n.flags = n.flags&^flagPFail | flagFail
+			logger.Warn("cluster: node " + n.addr + " marked as fail by " + sender.addr)
+		}
+	}
+	c.updateState()
+	return nil
+}
+
+// learnNode 返回 id 对应的节点, 未知的节点加入集群
+func (c *Cluster) learnNode(id, addr string) *node {
+	n, ok := c.nodes[id]
+	if !ok {
+		n = newNode(id, addr)
+		c.nodes[id] = n
+		c.configDirty = true
+		logger.Info("cluster: discovered node " + id + " " + addr)
+	}
+	n.addr = addr
+	return n
+}
+
+// updateSlots n 在 epoch 中声明负责 slots, 槽的归属以 config epoch 较大的声明为准
+// NODE 不处理 config epoch 相同的冲突, 槽的迁移总是使用新的 epoch
+func (c *Cluster) updateSlots(n *node, epoch int64, slots []int) {
+	if epoch > n.configEpoch {
+		n.configEpoch = epoch
+		c.configDirty = true
+	}
+	if epoch > c.currentEpoch {
+		c.currentEpoch = epoch
+	}
+	for _, slot := range slots {
+		owner := c.slots[slot]
+		if owner == n || (owner != nil && owner.configEpoch >= epoch) {
+			continue
+		}
+		if owner == c.self {
+			logger.Info("cluster: slot " + strconv.Itoa(slot) + " taken over by " + n.addr)
+			delete(c.migrating, slot)
+		}
+		delete(c.importing, slot)
+		c.slots[slot] = n
+		c.configDirty = true
+	}
+}
+
+func (c *Cluster) ownsSlots(n *node) bool {
+	for _, owner := range c.slots {
+		if owner == n {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFailures 超过 node-timeout 没有回复的节点标记为 pfail, 多数主节点认为 pfail 时标记为 fail
+// 调用方需持有 c.mu
+func (c *Cluster) checkFailures(now time.Time) {
+	masters := c.slotsOf()
+	for _, n := range c.nodes {
+		if n == c.self {
+			continue
+		}
+		if !n.pingSent.IsZero() && now.Sub(n.pingSent) > c.nodeTimeout && n.flags&(flagPFail|flagFail) == 0 {
+			n.flags |= flagPFail
+			logger.Warn("cluster: node " + n.addr + " possibly failing")
+		}
+		if n.flags&flagPFail == 0 {
+			continue
+		}
+		reports := 0
+		if _, ok := masters[c.self]; ok {
+			reports++
+		}
+		for id, t := range n.failReports {
+			if now.Sub(t) > 2*c.nodeTimeout {
+				delete(n.failReports, id)
+				continue
+			}
+			if reporter := c.nodes[id]; reporter != nil && len(masters[reporter]) > 0 {
+				reports++
+			}
+		}
+		if reports >= len(masters)/2+1 {
+			n.flags = n.flags&^flagPFail | flagFail
+			logger.Warn("cluster: node " + n.addr + " marked as fail, " + strconv.Itoa(reports) + " reports")
+		}
+	}
+	c.updateState()
+}
@@ -0,0 +1,128 @@
+package cluster
+
+import (
+	"memgo/interface/database"
+	"memgo/interface/resp"
+	"memgo/redis/RESP/protocol"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 迁移一个槽的步骤(与 redis 相同, 由 memgo-cli reshard 完成):
+//  1. 目标节点 CLUSTER SETSLOT slot IMPORTING <源节点 id>
+//  2. 源节点 CLUSTER SETSLOT slot MIGRATING <目标节点 id>
+//  3. 源节点 CLUSTER GETKEYSINSLOT 取出 key, MIGRATE 到目标节点, 直到没有 key
+//  4. 目标节点与源节点 CLUSTER SETSLOT slot NODE <目标节点 id>
+//     目标节点使用新的 config epoch 声明该槽, 其他节点通过 gossip 得知
+
+func parseSlot(arg []byte) (int, bool) {
+	slot, err := strconv.Atoi(string(arg))
+	return slot, err == nil && slot >= 0 && slot < SlotCount
+}
+
+// keysInSlot 返回本节点中属于 slot 的最多 count 个 key, count 为负数时返回全部
+// NODE 没有维护槽到 key 的索引, 需要遍历整个数据库
+func (c *Cluster) keysInSlot(slot int, count int) []string {
+	var keys []string
+	c.db.ForEach(0, func(key string, entity *database.DataEntity, expireAt *time.Time) bool {
+		if count >= 0 && len(keys) >= count {
+			return false
+		}
+		if KeySlot(key) == slot && (expireAt == nil || expireAt.After(time.Now())) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys
+}
+
+// CLUSTER GETKEYSINSLOT slot count
+func (c *Cluster) execGetKeysInSlot(args [][]byte) resp.ReplyIntf {
+	if len(args) != 2 {
+		return protocol.MakeArgNumErrReply("cluster getkeysinslot")
+	}
+	slot, ok := parseSlot(args[0])
+	if !ok {
+		return protocol.MakeErrReply("ERR Invalid slot")
+	}
+	count, err := strconv.Atoi(string(args[1]))
+	if err != nil || count < 0 {
+		return protocol.MakeErrReply("ERR Invalid number of keys")
+	}
+	keys := c.keysInSlot(slot, count)
+	result := make([][]byte, len(keys))
+	for i, key := range keys {
+		result[i] = []byte(key)
+	}
+	return protocol.MakeMultiBulkReply(result)
+}
+
+// CLUSTER SETSLOT slot IMPORTING|MIGRATING|NODE node-id
+// CLUSTER SETSLOT slot STABLE
+func (c *Cluster) execSetSlot(args [][]byte) resp.ReplyIntf {
+	if len(args) < 2 {
+		return protocol.MakeArgNumErrReply("cluster setslot")
+	}
+	slot, ok := parseSlot(args[0])
+	if !ok {
+		return protocol.MakeErrReply("ERR Invalid or out of range slot")
+	}
+	action := strings.ToLower(string(args[1]))
+	if action == "stable" {
+		c.mu.Lock()
+		delete(c.migrating, slot)
+		delete(c.importing, slot)
+		c.mu.Unlock()
+		return protocol.MakeOkReply()
+	}
+	if len(args) != 3 {
+		return protocol.MakeArgNumErrReply("cluster setslot")
+	}
+	// 分配给其他节点前确认本节点中已经没有该槽的 key, 遍历数据库不持有 c.mu
+	hasKeys := action == "node" && len(c.keysInSlot(slot, 1)) > 0
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.nodes[string(args[2])]
+	if n == nil {
+		return protocol.MakeErrReply("ERR I don't know about node " + string(args[2]))
+	}
+	owner := c.slots[slot]
+	switch action {
+	case "migrating":
+		if owner != c.self {
+			return protocol.MakeErrReply("ERR I'm not the owner of hash slot " + strconv.Itoa(slot))
+		}
+		if n == c.self {
+			return protocol.MakeErrReply("ERR I'm already the owner of hash slot " + strconv.Itoa(slot))
+		}
+		c.migrating[slot] = n
+	case "importing":
+		if owner == c.self {
+			return protocol.MakeErrReply("ERR I'm already the owner of hash slot " + strconv.Itoa(slot))
+		}
+		c.importing[slot] = n
+	case "node":
+		if n == c.self {
+			// 迁入完成, 使用新的 config epoch 声明该槽, 使其他节点的 gossip 接受新的归属
+			if owner != c.self {
+				c.currentEpoch++
+				c.self.configEpoch = c.currentEpoch
+			}
+			delete(c.importing, slot)
+		} else {
+			if owner == c.self && hasKeys {
+				return protocol.MakeErrReply("ERR Can't assign hashslot " + strconv.Itoa(slot) +
+					" to a different node while I still hold keys for this hash slot.")
+			}
+			delete(c.migrating, slot)
+		}
+		c.slots[slot] = n
+		c.updateState()
+		c.saveConfig()
+	default:
+		return protocol.MakeSyntaxErrReply()
+	}
+	return protocol.MakeOkReply()
+}
@@ -0,0 +1,107 @@
+package cluster
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"memgo/config"
+	"memgo/redis/client"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	flagPFail = 1 << iota // 本节点在 node-timeout 内没有收到它的 PONG
+	flagFail              // 多数主节点认为它下线
+)
+
+// node 集群中的一个节点(包括本节点), 除 client 外的字段由 Cluster.mu 保护
+// NODE 目前只支持主节点, 每个节点负责一部分槽
+type node struct {
+	id          string
+	addr        string
+	configEpoch int64 // 槽的归属冲突时, config epoch 较大的节点获胜
+	flags       int
+
+	// client 只在 gossip 中使用, 同一个节点的 PING 不会并发
+	client   *client.Client
+	pingSent time.Time // 还没有收到回复的 PING 的发送时间, 收到回复后清零
+	lastPong time.Time
+	linkUp   bool // 最近一次 PING 是否成功
+
+	// 其他主节点报告该节点 pfail/fail 的时间, 主节点 id -> 时间
+	failReports map[string]time.Time
+}
+
+// nodeID 节点 id 由地址生成, 集群的成员由配置中的地址决定, 不需要保存 id
+func nodeID(addr string) string {
+	sum := sha1.Sum([]byte(addr))
+	return hex.EncodeToString(sum[:])
+}
+
+func newNode(id, addr string) *node {
+	return &node{
+		id:          id,
+		addr:        addr,
+		lastPong:    time.Now(),
+		failReports: make(map[string]time.Time),
+	}
+}
+
+func (n *node) hostPort() (string, int) {
+	host, portStr, _ := net.SplitHostPort(n.addr)
+	port, _ := strconv.Atoi(portStr)
+	return host, port
+}
+
+// flagString 与 CLUSTER NODES 的 flags 相同 eg: "myself,master" "master,fail?"
+// NODE gossip 中使用 "pfail" 表示 fail?
+func (n *node) flagString(self *node, gossip bool) string {
+	flags := []string{"master"}
+	if n == self {
+		flags = []string{"myself", "master"}
+	}
+	if n.flags&flagFail != 0 {
+		flags = append(flags, "fail")
+	} else if n.flags&flagPFail != 0 {
+		if gossip {
+			flags = append(flags, "pfail")
+		} else {
+			flags = append(flags, "fail?")
+		}
+	}
+	return strings.Join(flags, ",")
+}
+
+func hasFlag(flags string, flag string) bool {
+	for _, f := range strings.Split(flags, ",") {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *node) ping(timeout time.Duration, args ...string) ([]string, error) {
+	if n.client == nil {
+		c, err := client.DialAuth(n.addr, timeout, config.Properties.RequirePass)
+		if err != nil {
+			return nil, err
+		}
+		n.client = c
+	}
+	reply, err := n.client.Do(args...)
+	if err != nil {
+		n.close()
+		return nil, err
+	}
+	return client.Strings(reply)
+}
+
+func (n *node) close() {
+	if n.client != nil {
+		_ = n.client.Close()
+		n.client = nil
+	}
+}
@@ -0,0 +1,139 @@
+package cluster
+
+import (
+	"bufio"
+	"errors"
+	"memgo/logger"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const defaultConfigFile = "nodes.conf"
+
+// describeNodes CLUSTER NODES 的输出, 每行一个节点:
+// <id> <ip:port@cport> <flags> <master> <ping-sent> <pong-recv> <config-epoch> <link-state> <slot> <slot> ...
+// 调用方需持有 c.mu
+func (c *Cluster) describeNodes() string {
+	slots := c.slotsOf()
+	var builder strings.Builder
+	for _, n := range c.sortedNodes() {
+		_, port := n.hostPort()
+		var pingSent, pongRecv int64
+		linkState := "connected"
+		if n != c.self {
+			if !n.pingSent.IsZero() {
+				pingSent = n.pingSent.UnixMilli()
+			}
+			pongRecv = n.lastPong.UnixMilli()
+			if !n.linkUp {
+				linkState = "disconnected"
+			}
+		}
+		builder.WriteString(n.id + " " + n.addr + "@" + strconv.Itoa(port) + " " + n.flagString(c.self, false) + " - " +
+			strconv.FormatInt(pingSent, 10) + " " + strconv.FormatInt(pongRecv, 10) + " " +
+			strconv.FormatInt(n.configEpoch, 10) + " " + linkState)
+		for _, r := range toRanges(slots[n]) {
+			builder.WriteString(" " + formatRanges([]slotRange{r}))
+		}
+		builder.WriteString("\n")
+	}
+	return builder.String()
+}
+
+// saveConfig 与 redis 的 nodes.conf 相同, 保存 CLUSTER NODES 的输出与 currentEpoch, 调用方需持有 c.mu
+// NODE 正在迁移的槽(MIGRATING/IMPORTING)不保存, 重启后需要重新设置
+func (c *Cluster) saveConfig() {
+	c.configDirty = false
+	content := c.describeNodes() + "vars currentEpoch " + strconv.FormatInt(c.currentEpoch, 10) + "\n"
+	tmpFile, err := os.CreateTemp(filepath.Dir(c.configFile), "temp-nodes-*.conf")
+	if err != nil {
+		logger.Warn("cluster: save config failed: " + err.Error())
+		return
+	}
+	_, err = tmpFile.WriteString(content)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), c.configFile)
+	}
+	if err != nil {
+		_ = os.Remove(tmpFile.Name())
+		logger.Warn("cluster: save config failed: " + err.Error())
+	}
+}
+
+// loadConfig 从 configFile 恢复节点, 槽与 epoch; 文件中的本节点地址与当前配置不同时返回错误
+func (c *Cluster) loadConfig() error {
+	file, err := os.Open(c.configFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	invalid := errors.New("invalid cluster config file")
+	nodes := map[string]*node{c.self.id: c.self}
+	var slots [SlotCount]*node
+	var currentEpoch int64
+	foundSelf := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "vars" {
+			if len(fields) == 3 && fields[1] == "currentEpoch" {
+				if currentEpoch, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+					return invalid
+				}
+			}
+			continue
+		}
+		if len(fields) < 8 {
+			return invalid
+		}
+		id, addr := fields[0], fields[1]
+		if idx := strings.IndexByte(addr, '@'); idx >= 0 {
+			addr = addr[:idx]
+		}
+		epoch, err := strconv.ParseInt(fields[6], 10, 64)
+		if err != nil {
+			return invalid
+		}
+		n := nodes[id]
+		if hasFlag(fields[2], "myself") {
+			if n != c.self || addr != c.self.addr {
+				return errors.New("myself " + id + " " + addr + " does not match " + c.self.addr)
+			}
+			foundSelf = true
+		} else if n == nil {
+			n = newNode(id, addr)
+			nodes[id] = n
+		}
+		n.configEpoch = epoch
+		for _, text := range fields[8:] {
+			owned, ok := parseRanges(text)
+			if !ok {
+				return invalid
+			}
+			for _, slot := range owned {
+				slots[slot] = n
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if !foundSelf {
+		return invalid
+	}
+	c.nodes = nodes
+	c.slots = slots
+	c.currentEpoch = currentEpoch
+	return nil
+}
@@ -0,0 +1,108 @@
+package cluster
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SlotCount 与 redis cluster 相同, key 通过 CRC16(key) % 16384 映射到槽
+const SlotCount = 16384
+
+// crc16 CRC16-CCITT(XMODEM), 多项式 0x1021, 初始值 0
+var crc16Table [256]uint16
+
+func init() {
+	for i := range crc16Table {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		crc16Table[i] = crc
+	}
+}
+
+func crc16(data string) uint16 {
+	var crc uint16
+	for i := 0; i < len(data); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^data[i]]
+	}
+	return crc
+}
+
+// KeySlot 计算 key 所属的槽
+// key 中包含非空的 {hashtag} 时只对第一个 {} 中的内容计算, 使相关的 key 位于同一个槽 eg: {user1000}.following
+func KeySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) & (SlotCount - 1)
+}
+
+// slotRange 连续的槽 [start, end]
+type slotRange struct {
+	start, end int
+}
+
+// toRanges 将有序的槽合并为连续的区间
+func toRanges(slots []int) []slotRange {
+	var ranges []slotRange
+	for _, slot := range slots {
+		if n := len(ranges); n > 0 && ranges[n-1].end+1 == slot {
+			ranges[n-1].end = slot
+			continue
+		}
+		ranges = append(ranges, slotRange{slot, slot})
+	}
+	return ranges
+}
+
+// formatRanges 与 CLUSTER NODES 相同的格式 eg: "0-5460,10923", 没有槽时为 "-"
+func formatRanges(ranges []slotRange) string {
+	if len(ranges) == 0 {
+		return "-"
+	}
+	parts := make([]string, len(ranges))
+	for i, r := range ranges {
+		parts[i] = strconv.Itoa(r.start)
+		if r.end != r.start {
+			parts[i] += "-" + strconv.Itoa(r.end)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseRanges 解析 formatRanges 的输出, 返回有序的槽
+func parseRanges(text string) ([]int, bool) {
+	if text == "-" {
+		return nil, true
+	}
+	var slots []int
+	for _, part := range strings.Split(text, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		start, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, false
+		}
+		end := start
+		if len(bounds) == 2 {
+			if end, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, false
+			}
+		}
+		if start < 0 || end >= SlotCount || start > end {
+			return nil, false
+		}
+		for slot := start; slot <= end; slot++ {
+			slots = append(slots, slot)
+		}
+	}
+	sort.Ints(slots)
+	return slots, true
+}
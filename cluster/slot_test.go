@@ -0,0 +1,36 @@
+package cluster
+
+import "testing"
+
+func TestKeySlot(t *testing.T) {
+	if crc := crc16("123456789"); crc != 0x31C3 {
+		t.Fatalf("crc16 = %#x", crc)
+	}
+	cases := map[string]int{
+		"foo":                  12182,
+		"bar":                  5061,
+		"{user1000}.following": KeySlot("user1000"),
+		"{user1000}.followers": KeySlot("user1000"),
+		"foo{}{bar}":           int(crc16("foo{}{bar}")) & (SlotCount - 1),
+		"foo{{bar}}zap":        KeySlot("{bar"),
+	}
+	for key, slot := range cases {
+		if got := KeySlot(key); got != slot {
+			t.Errorf("KeySlot(%q) = %d, want %d", key, got, slot)
+		}
+	}
+}
+
+func TestSlotRanges(t *testing.T) {
+	text := formatRanges(toRanges([]int{0, 1, 2, 5, 7, 8}))
+	if text != "0-2,5,7-8" {
+		t.Fatalf("formatRanges = %q", text)
+	}
+	slots, ok := parseRanges(text)
+	if !ok || len(slots) != 6 || slots[3] != 5 {
+		t.Fatalf("parseRanges(%q) = %v, %v", text, slots, ok)
+	}
+	if _, ok := parseRanges("10-5"); ok {
+		t.Fatal("invalid range should fail")
+	}
+}
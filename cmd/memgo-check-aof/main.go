@@ -0,0 +1,187 @@
+// memgo-check-aof 校验 aof 文件, 报告第一个无法解析的命令所在的位置
+// 参数可以是单个 aof 文件, 也可以是 multi-part aof 的 manifest 文件(依次校验其中的所有文件)
+// 指定 -fix 时将出错的文件截断到最后一个完整命令
+// 指定 -truncate-to-timestamp / -truncate-to-offset 时, 将 aof 截断到该时间点(需开启 aof-timestamp-enabled)或偏移,
+// 用于误操作后的时间点恢复; 偏移按 manifest 顺序拼接所有文件计算
+// 加密的 aof 需要通过 -key-file 指定密钥文件; 加密或压缩的文件, 所有的大小与偏移均为其中明文的位置
+//
+// eg: memgo-check-aof -fix appendonlydir/appendonly.aof.manifest
+//     memgo-check-aof -truncate-to-timestamp "2024-05-17 12:00:00" appendonlydir/appendonly.aof.manifest
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"memgo/aof"
+	"memgo/encrypt"
+	"os"
+	"strings"
+	"time"
+)
+
+func main() {
+	fix := flag.Bool("fix", false, "truncate the broken file to the last complete command")
+	yes := flag.Bool("y", false, "do not ask for confirmation before discarding data")
+	toTimestamp := flag.String("truncate-to-timestamp", "", "truncate the aof to the given time (unix seconds or \"2006-01-02 15:04:05\")")
+	toOffset := flag.Int64("truncate-to-offset", -1, "truncate the aof to the given byte offset")
+	keyFile := flag.String("key-file", "", "encryption key file, required for encrypted aof files")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: memgo-check-aof [options] <file.aof | file.manifest>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	keyring, err := encrypt.LoadKeyFile(*keyFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "load key file failed: "+err.Error())
+		os.Exit(2)
+	}
+	files := []string{flag.Arg(0)}
+	if strings.HasSuffix(flag.Arg(0), ".manifest") {
+		if files, err = aof.ManifestFiles(flag.Arg(0)); err != nil {
+			fmt.Fprintln(os.Stderr, "read manifest failed: "+err.Error())
+			os.Exit(1)
+		}
+	}
+	switch {
+	case *toTimestamp != "":
+		ts, err := aof.ParseRecoverTime(*toTimestamp)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(2)
+		}
+		os.Exit(truncateToTimestamp(files, keyring, ts, *yes))
+	case *toOffset >= 0:
+		os.Exit(truncateToOffset(files, keyring, *toOffset, *yes))
+	default:
+		os.Exit(check(files, keyring, *fix, *yes))
+	}
+}
+
+func check(files []string, keyring *encrypt.Keyring, fix, yes bool) int {
+	var fileStart int64
+	for i, filename := range files {
+		result, err := aof.CheckAof(filename, keyring)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "check "+filename+" failed: "+err.Error())
+			return 1
+		}
+		format := ""
+		if result.Encrypted {
+			format += ", encrypted"
+		}
+		if result.Compressed {
+			format += ", compressed"
+		}
+		fmt.Printf("%s: size %d (offset %d%s), %d keys in preamble, %d commands\n",
+			filename, result.Size, fileStart, format, result.Keys, result.Commands)
+		if result.FirstTimestamp > 0 {
+			fmt.Printf("  timestamps from %s to %s\n", formatTime(result.FirstTimestamp), formatTime(result.LastTimestamp))
+		}
+		fileStart += result.Size
+		if result.Err == nil {
+			fmt.Println("  OK")
+			continue
+		}
+		discard := result.Size - result.Err.ValidOffset
+		fmt.Println("  " + strings.TrimSpace(result.Err.Err.Error()))
+		fmt.Printf("  first bad command at offset %d, %d bytes after it\n", result.Err.ValidOffset, discard)
+		if !fix {
+			return 1
+		}
+		// NODE 只有最后一个文件允许截断, 之前的文件出错意味着中间的数据已经丢失
+		if i != len(files)-1 {
+			fmt.Println("  only the last file can be fixed, the remaining files depend on this one")
+			return 1
+		}
+		if !result.Err.IsTruncated() && !yes && !confirm(fmt.Sprintf("  this will discard %d bytes of data, continue? [y/N] ", discard)) {
+			return 1
+		}
+		if err := aof.TruncateAof(filename, keyring, result.Err.ValidOffset); err != nil {
+			fmt.Fprintln(os.Stderr, "truncate failed: "+err.Error())
+			return 1
+		}
+		fmt.Printf("  truncated to %d bytes\n", result.Err.ValidOffset)
+	}
+	return 0
+}
+
+func truncateToTimestamp(files []string, keyring *encrypt.Keyring, ts int64, yes bool) int {
+	for i, filename := range files {
+		offset, found, err := aof.FindTimestampOffset(filename, keyring, ts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "read "+filename+" failed: "+err.Error())
+			return 1
+		}
+		if !found {
+			continue
+		}
+		return truncateFile(files, keyring, i, offset, yes)
+	}
+	fmt.Println("no record after " + formatTime(ts) + ", nothing to truncate")
+	return 0
+}
+
+func truncateToOffset(files []string, keyring *encrypt.Keyring, offset int64, yes bool) int {
+	var fileStart int64
+	for i, filename := range files {
+		size, err := aof.DataSize(filename, keyring)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+		if offset < fileStart+size {
+			// 对齐到完整命令的结尾, 防止截断出半条命令
+			aligned, err := aof.AlignOffset(filename, keyring, offset-fileStart)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "read "+filename+" failed: "+err.Error())
+				return 1
+			}
+			return truncateFile(files, keyring, i, aligned, yes)
+		}
+		fileStart += size
+	}
+	fmt.Println("offset is beyond the end of aof, nothing to truncate")
+	return 0
+}
+
+func truncateFile(files []string, keyring *encrypt.Keyring, idx int, offset int64, yes bool) int {
+	filename := files[idx]
+	// NODE 截断之后的文件同样需要丢弃, 但它们仍被 manifest 引用; 这种情况使用启动选项 aof-recover-until-* 恢复
+	if idx != len(files)-1 {
+		fmt.Println("the recover point is in " + filename + " which is not the last file, " +
+			"use the aof-recover-until-time / aof-recover-until-offset startup options instead")
+		return 1
+	}
+	size, err := aof.DataSize(filename, keyring)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	discard := size - offset
+	if !yes && !confirm(fmt.Sprintf("truncate %s to %d bytes, discarding %d bytes, continue? [y/N] ", filename, offset, discard)) {
+		return 1
+	}
+	if err := aof.TruncateAof(filename, keyring, offset); err != nil {
+		fmt.Fprintln(os.Stderr, "truncate failed: "+err.Error())
+		return 1
+	}
+	fmt.Printf("truncated %s to %d bytes\n", filename, offset)
+	return 0
+}
+
+func formatTime(ts int64) string {
+	return time.Unix(ts, 0).Format("2006-01-02 15:04:05")
+}
+
+func confirm(prompt string) bool {
+	fmt.Print(prompt)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
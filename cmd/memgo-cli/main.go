@@ -0,0 +1,322 @@
+// memgo-cli 集群管理工具, 通过任意一个节点获取集群的拓扑:
+//   rebalance  在所有负责槽或者 -to 指定的主节点之间平均分配槽
+//   reshard    将 -slots 个槽从 -from 节点迁移到 -to 节点
+//
+// 每个槽的迁移与 redis-cli --cluster 相同: SETSLOT IMPORTING/MIGRATING, 分批 MIGRATE 槽中的 key, 最后 SETSLOT NODE
+//
+// eg: memgo-cli -addr 127.0.0.1:7001 rebalance
+//     memgo-cli -addr 127.0.0.1:7001 -from <id> -to <id> -slots 100 reshard
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"memgo/interface/resp"
+	"memgo/redis/RESP/protocol"
+	"memgo/redis/client"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const slotCount = 16384
+
+type clusterNode struct {
+	id    string
+	addr  string
+	slots []int
+}
+
+type move struct {
+	slot     int
+	from, to *clusterNode
+}
+
+type manager struct {
+	nodes    []*clusterNode
+	clients  map[string]*client.Client
+	timeout  time.Duration
+	batch    int
+	password string // 各节点的 requirepass, 同时用于 MIGRATE 连接目标节点
+}
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:6379", "address of any node in the cluster")
+	from := flag.String("from", "", "reshard: source node id")
+	to := flag.String("to", "", "reshard: target node id; rebalance: comma separated node ids to balance across")
+	slots := flag.Int("slots", 0, "reshard: number of slots to move")
+	batch := flag.Int("pipeline", 10, "number of keys migrated by each MIGRATE")
+	timeout := flag.Int("timeout", 60000, "MIGRATE timeout in milliseconds")
+	password := flag.String("a", "", "password of the cluster nodes")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	m := &manager{
+		clients:  make(map[string]*client.Client),
+		timeout:  time.Duration(*timeout) * time.Millisecond,
+		batch:    *batch,
+		password: *password,
+	}
+	defer m.close()
+	if err := m.loadNodes(*addr); err != nil {
+		fmt.Fprintln(os.Stderr, "load cluster nodes failed: "+err.Error())
+		os.Exit(1)
+	}
+	var moves []move
+	var err error
+	switch flag.Arg(0) {
+	case "rebalance":
+		moves, err = m.planRebalance(*to)
+	case "reshard":
+		moves, err = m.planReshard(*from, *to, *slots)
+	default:
+		err = fmt.Errorf("unknown command %s", flag.Arg(0))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(2)
+	}
+	for i, mv := range moves {
+		if err := m.moveSlot(mv); err != nil {
+			fmt.Fprintf(os.Stderr, "move slot %d from %s to %s failed: %s\n", mv.slot, mv.from.addr, mv.to.addr, err.Error())
+			os.Exit(1)
+		}
+		if (i+1)%100 == 0 || i+1 == len(moves) {
+			fmt.Printf("moved %d/%d slots\n", i+1, len(moves))
+		}
+	}
+	if len(moves) == 0 {
+		fmt.Println("nothing to do")
+	}
+}
+
+func (m *manager) client(addr string) (*client.Client, error) {
+	if c, ok := m.clients[addr]; ok {
+		return c, nil
+	}
+	c, err := client.DialAuth(addr, m.timeout, m.password)
+	if err != nil {
+		return nil, err
+	}
+	m.clients[addr] = c
+	return c, nil
+}
+
+func (m *manager) close() {
+	for _, c := range m.clients {
+		_ = c.Close()
+	}
+}
+
+// do 执行命令, 错误回复作为 error 返回
+func (m *manager) do(addr string, args ...string) (resp.ReplyIntf, error) {
+	c, err := m.client(addr)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.Do(args...)
+	if err != nil {
+		return nil, err
+	}
+	if errReply, ok := reply.(*protocol.StandardErrorReply); ok {
+		return nil, errors.New(errReply.Status)
+	}
+	return reply, nil
+}
+
+// loadNodes 解析 CLUSTER NODES, 忽略已经下线的节点
+func (m *manager) loadNodes(addr string) error {
+	reply, err := m.do(addr, "CLUSTER", "NODES")
+	if err != nil {
+		return err
+	}
+	text, err := client.String(reply)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(text, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 8 {
+			continue
+		}
+		if strings.Contains(fields[2], "fail") {
+			continue
+		}
+		n := &clusterNode{id: fields[0], addr: fields[1]}
+		if idx := strings.IndexByte(n.addr, '@'); idx >= 0 {
+			n.addr = n.addr[:idx]
+		}
+		for _, r := range fields[8:] {
+			start, end, ok := strings.Cut(r, "-")
+			if !ok {
+				end = start
+			}
+			s, err1 := strconv.Atoi(start)
+			e, err2 := strconv.Atoi(end)
+			if err1 != nil || err2 != nil {
+				return fmt.Errorf("invalid slot range %s", r)
+			}
+			for slot := s; slot <= e; slot++ {
+				n.slots = append(n.slots, slot)
+			}
+		}
+		m.nodes = append(m.nodes, n)
+	}
+	if len(m.nodes) == 0 {
+		return errors.New("no node found")
+	}
+	return nil
+}
+
+func (m *manager) find(id string) *clusterNode {
+	for _, n := range m.nodes {
+		if n.id == id || n.addr == id {
+			return n
+		}
+	}
+	return nil
+}
+
+// planReshard 从 from 的最后几个槽开始迁移
+func (m *manager) planReshard(from, to string, count int) ([]move, error) {
+	src, dst := m.find(from), m.find(to)
+	if src == nil || dst == nil {
+		return nil, errors.New("reshard requires valid -from and -to node")
+	}
+	if src == dst {
+		return nil, errors.New("source and target are the same node")
+	}
+	if count <= 0 || count > len(src.slots) {
+		return nil, fmt.Errorf("-slots must be between 1 and %d", len(src.slots))
+	}
+	var moves []move
+	for _, slot := range src.slots[len(src.slots)-count:] {
+		moves = append(moves, move{slot, src, dst})
+	}
+	return moves, nil
+}
+
+// planRebalance 每个节点分到 slotCount/n 个槽, 余数分给前面的节点; 多出槽的节点将多余的槽迁移给不足的节点
+func (m *manager) planRebalance(to string) ([]move, error) {
+	members := make(map[*clusterNode]bool)
+	for _, id := range strings.Split(to, ",") {
+		if id == "" {
+			continue
+		}
+		n := m.find(id)
+		if n == nil {
+			return nil, fmt.Errorf("unknown node %s", id)
+		}
+		members[n] = true
+	}
+	for _, n := range m.nodes {
+		if len(n.slots) > 0 {
+			members[n] = true
+		}
+	}
+	var nodes []*clusterNode
+	for n := range members {
+		nodes = append(nodes, n)
+	}
+	if len(nodes) == 0 {
+		return nil, errors.New("no node to balance across, use -to to specify nodes")
+	}
+	// 槽多的节点排在前面, 分到余数, 减少迁移的槽数
+	sort.Slice(nodes, func(i, j int) bool {
+		if len(nodes[i].slots) != len(nodes[j].slots) {
+			return len(nodes[i].slots) > len(nodes[j].slots)
+		}
+		return nodes[i].addr < nodes[j].addr
+	})
+	var surplus []move // to 尚未确定
+	want := make(map[*clusterNode]int)
+	for i, n := range nodes {
+		want[n] = slotCount / len(nodes)
+		if i < slotCount%len(nodes) {
+			want[n]++
+		}
+		if extra := len(n.slots) - want[n]; extra > 0 {
+			for _, slot := range n.slots[len(n.slots)-extra:] {
+				surplus = append(surplus, move{slot: slot, from: n})
+			}
+		}
+	}
+	var moves []move
+	for _, n := range nodes {
+		for need := want[n] - len(n.slots); need > 0 && len(surplus) > 0; need-- {
+			mv := surplus[0]
+			surplus = surplus[1:]
+			mv.to = n
+			moves = append(moves, mv)
+		}
+	}
+	return moves, nil
+}
+
+// moveSlot 迁移一个槽, 迁移过程中访问该槽的客户端由源节点通过 ASK 重定向到目标节点
+func (m *manager) moveSlot(mv move) error {
+	slot := strconv.Itoa(mv.slot)
+	if _, err := m.do(mv.to.addr, "CLUSTER", "SETSLOT", slot, "IMPORTING", mv.from.id); err != nil {
+		return err
+	}
+	if _, err := m.do(mv.from.addr, "CLUSTER", "SETSLOT", slot, "MIGRATING", mv.to.id); err != nil {
+		return err
+	}
+	host, port, err := net.SplitHostPort(mv.to.addr)
+	if err != nil {
+		return err
+	}
+	for {
+		reply, err := m.do(mv.from.addr, "CLUSTER", "GETKEYSINSLOT", slot, strconv.Itoa(m.batch))
+		if err != nil {
+			return err
+		}
+		keys, err := client.Strings(reply)
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			break
+		}
+		args := []string{"MIGRATE", host, port, "", "0", strconv.FormatInt(m.timeout.Milliseconds(), 10), "REPLACE"}
+		if m.password != "" {
+			args = append(args, "AUTH", m.password)
+		}
+		args = append(args, "KEYS")
+		if _, err := m.do(mv.from.addr, append(args, keys...)...); err != nil {
+			return err
+		}
+	}
+	// 先通知目标节点, 目标节点以新的 config epoch 声明该槽, 其他节点通过 gossip 得知, 这里直接通知加快收敛
+	if _, err := m.do(mv.to.addr, "CLUSTER", "SETSLOT", slot, "NODE", mv.to.id); err != nil {
+		return err
+	}
+	if _, err := m.do(mv.from.addr, "CLUSTER", "SETSLOT", slot, "NODE", mv.to.id); err != nil {
+		return err
+	}
+	for _, n := range m.nodes {
+		if n != mv.from && n != mv.to {
+			_, _ = m.do(n.addr, "CLUSTER", "SETSLOT", slot, "NODE", mv.to.id)
+		}
+	}
+	mv.from.slots = removeSlot(mv.from.slots, mv.slot)
+	mv.to.slots = append(mv.to.slots, mv.slot)
+	return nil
+}
+
+func removeSlot(slots []int, slot int) []int {
+	for i, s := range slots {
+		if s == slot {
+			return append(slots[:i], slots[i+1:]...)
+		}
+	}
+	return slots
+}
@@ -0,0 +1,147 @@
+// memgo-rdb 离线转换快照文件
+// 输入可以是 memgo 快照或 redis rdb 文件(自动识别), 输出格式由 -to 指定:
+//   memgo  memgo 快照
+//   redis  redis 能够加载的 rdb 文件 (版本 9)
+//   aof    RESP 命令序列, 可直接作为 aof 文件或通过 redis-cli --pipe 导入
+//
+// 加密的输入文件需要通过 -key-file 指定密钥文件, 压缩的输入文件自动识别; 输出不加密也不压缩
+// redis rdb 中有 memgo 不支持的类型(list, zset, stream)时转换失败, -skip-unsupported 丢弃这些 key
+//
+// eg: memgo-rdb -in dump.rdb -out memgo.rdb -to memgo
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"memgo/compress"
+	"memgo/encrypt"
+	"memgo/rdb"
+	"memgo/redis/RESP/protocol"
+	"memgo/utils"
+	"os"
+	"strconv"
+)
+
+func main() {
+	in := flag.String("in", "", "input snapshot file (memgo or redis rdb)")
+	out := flag.String("out", "", "output file")
+	to := flag.String("to", "memgo", "output format: memgo, redis or aof")
+	keyFile := flag.String("key-file", "", "encryption key file, required for encrypted input")
+	skipUnsupported := flag.Bool("skip-unsupported", false, "drop keys of types memgo does not support instead of failing")
+	flag.Parse()
+	if *in == "" || *out == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	keyring, err := encrypt.LoadKeyFile(*keyFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "load key file failed: "+err.Error())
+		os.Exit(2)
+	}
+	if err := convert(*in, *out, *to, keyring, rdb.DecodeOptions{SkipUnsupported: *skipUnsupported}); err != nil {
+		fmt.Fprintln(os.Stderr, "convert failed: "+err.Error())
+		os.Exit(1)
+	}
+}
+
+func convert(in, out, to string, keyring *encrypt.Keyring, opts rdb.DecodeOptions) error {
+	src, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	reader, err := encrypt.MaybeDecrypt(bufio.NewReader(src), keyring)
+	if err != nil {
+		return err
+	}
+	if reader, err = compress.MaybeDecompress(reader); err != nil {
+		return err
+	}
+
+	dst, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(dst)
+	var count int
+	switch to {
+	case "memgo", "redis":
+		count, err = toSnapshot(reader, writer, to, opts)
+	case "aof":
+		count, err = toAof(reader, writer, opts)
+	default:
+		err = fmt.Errorf("unknown output format %s", to)
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(out)
+		return err
+	}
+	fmt.Println("converted " + strconv.Itoa(count) + " keys")
+	return nil
+}
+
+func toSnapshot(src *bufio.Reader, w io.Writer, format string, opts rdb.DecodeOptions) (int, error) {
+	var enc rdb.SnapshotEncoder = rdb.NewEncoder(w)
+	if format == "redis" {
+		enc = rdb.NewRedisEncoder(w)
+	}
+	if err := enc.WriteHeader(); err != nil {
+		return 0, err
+	}
+	count := 0
+	currentDB := -1
+	err := rdb.DecodeAnyWith(src, opts, func(entry *rdb.Entry) error {
+		if entry.DbIndex != currentDB {
+			if err := enc.WriteDBHeader(entry.DbIndex); err != nil {
+				return err
+			}
+			currentDB = entry.DbIndex
+		}
+		count++
+		return enc.WriteEntry(entry.Key, entry.Entity, entry.ExpireAt)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, enc.WriteEnd()
+}
+
+func toAof(src *bufio.Reader, w io.Writer, opts rdb.DecodeOptions) (int, error) {
+	count := 0
+	currentDB := -1
+	err := rdb.DecodeAnyWith(src, opts, func(entry *rdb.Entry) error {
+		if entry.DbIndex != currentDB {
+			selectCmd := utils.ToCmdLine("SELECT", strconv.Itoa(entry.DbIndex))
+			if _, err := w.Write(protocol.MakeMultiBulkReply(selectCmd).ToBytes()); err != nil {
+				return err
+			}
+			currentDB = entry.DbIndex
+		}
+		cmds, err := utils.EntityToCmd(entry.Key, entry.Entity)
+		if err != nil {
+			return err
+		}
+		for _, cmd := range cmds {
+			if _, err = w.Write(cmd.ToBytes()); err != nil {
+				return err
+			}
+		}
+		if entry.ExpireAt != nil {
+			if _, err = w.Write(utils.MakeExpireCmd(entry.Key, *entry.ExpireAt).ToBytes()); err != nil {
+				return err
+			}
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
@@ -0,0 +1,89 @@
+package compress
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+)
+
+// NODE 重写生成的 aof 与快照文件可以使用 gzip(标准库, deflate) 压缩
+// aof 中大部分内容是重复的 RESP 协议头与相似的字符串, 压缩效果明显
+// 读取时根据 gzip 的 magic 自动识别, 因此压缩与未压缩的文件可以混用, 开关压缩不需要转换已有的文件
+// NODE incr 文件需要不断追加, 不压缩; 同时开启加密时 先压缩再加密
+
+const magic = "\x1f\x8b"
+
+// IsCompressed 判断 reader 的内容是否为压缩的数据, 不消耗数据
+func IsCompressed(r *bufio.Reader) bool {
+	head, err := r.Peek(len(magic))
+	return err == nil && string(head) == magic
+}
+
+// MaybeDecompress 内容为压缩的数据时返回解压后的 reader, 否则原样返回
+func MaybeDecompress(r *bufio.Reader) (*bufio.Reader, error) {
+	if !IsCompressed(r) {
+		return r, nil
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	// 只读取一个 gzip member, 之后的内容视为损坏
+	gz.Multistream(false)
+	return bufio.NewReader(gz), nil
+}
+
+// Writer 压缩写入 并记录压缩前后的字节数
+type Writer struct {
+	gz  *gzip.Writer
+	out *countingWriter
+	in  int64
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+func NewWriter(w io.Writer) *Writer {
+	out := &countingWriter{w: w}
+	gz, _ := gzip.NewWriterLevel(out, gzip.BestSpeed)
+	return &Writer{gz: gz, out: out}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	n, err := w.gz.Write(p)
+	w.in += int64(n)
+	return n, err
+}
+
+// Close 写入剩余的压缩数据, 不关闭底层的 writer
+func (w *Writer) Close() error {
+	return w.gz.Close()
+}
+
+// Ratio 压缩前后的大小之比, Close 之后调用
+func (w *Writer) Ratio() float64 {
+	if w.out.n == 0 {
+		return 0
+	}
+	return float64(w.in) / float64(w.out.n)
+}
+
+// WriteAll 压缩 data 并写入 w, 返回压缩比
+func WriteAll(w io.Writer, data []byte) (float64, error) {
+	cw := NewWriter(w)
+	if _, err := cw.Write(data); err != nil {
+		return 0, err
+	}
+	if err := cw.Close(); err != nil {
+		return 0, err
+	}
+	return cw.Ratio(), nil
+}
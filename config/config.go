@@ -20,25 +20,72 @@ var (
 // ServerProperties defines global config properties
 type ServerProperties struct {
 	// for Public configuration
-	RunID             string `cfg:"runid"` // runID always different at every exec.
-	Bind              string `cfg:"bind"`
-	Port              int    `cfg:"port"`
-	AppendOnly        bool   `cfg:"appendonly"`
-	AppendFilename    string `cfg:"appendfilename"`
-	AppendFsync       string `cfg:"appendfsync"`
-	MaxClients        int    `cfg:"maxclients"`
-	RequirePass       string `cfg:"requirepass"`
-	Databases         int    `cfg:"databases"`
-	RDBFilename       string `cfg:"dbfilename"`
-	MasterAuth        string `cfg:"masterauth"`
-	SlaveAnnouncePort int    `cfg:"slave-announce-port"`
-	SlaveAnnounceIP   string `cfg:"slave-announce-ip"`
-	ReplTimeout       int    `cfg:"repl-timeout"`
+	RunID              string `cfg:"runid"` // runID always different at every exec.
+	Bind               string `cfg:"bind"`
+	Port               int    `cfg:"port"`
+	AppendOnly         bool   `cfg:"appendonly"`
+	AppendFilename     string `cfg:"appendfilename"`
+	AppendDirname      string `cfg:"appenddirname"` // multi-part aof 的目录, 与 appendfilename 位于同一目录下
+	AppendFsync        string `cfg:"appendfsync"`
+	MaxClients         int    `cfg:"maxclients"`
+	RequirePass        string `cfg:"requirepass"`
+	AuthMaxFailures    int    `cfg:"auth-max-failures"` // 同一 IP 连续认证失败超过该次数后, 之后的失败延迟回复, 默认 5
+	AuthFailDelay      int    `cfg:"auth-fail-delay"`   // 单位毫秒, 超过次数后每多失败一次延迟增加该值, 最多 10 秒, 默认 1000
+	AclFile            string `cfg:"aclfile"`           // 保存 ACL 用户的文件, 启动时加载, ACL SAVE 写入; 设置后 requirepass 只在文件不存在时生效
+	AclLogMaxLen       int    `cfg:"acllog-max-len"`    // ACL LOG 最多保存的记录数, 默认 128
+	Databases          int    `cfg:"databases"`
+	RDBFilename        string `cfg:"dbfilename"`
+	Save               string `cfg:"save"`                 // 快照规则 eg: "900 1 300 10" 表示 900秒内至少1次修改 或 300秒内至少10次修改
+	RDBRedisFormat     bool   `cfg:"rdb-redis-format"`     // SAVE/BGSAVE 写出 redis 能够加载的 rdb 文件
+	RDBFileCompression bool   `cfg:"rdb-file-compression"` // 快照文件整体使用 gzip 压缩, redis 格式的快照不压缩
+	MasterAuth         string `cfg:"masterauth"`
+	SlaveAnnouncePort  int    `cfg:"slave-announce-port"`
+	SlaveAnnounceIP    string `cfg:"slave-announce-ip"`
+	ReplTimeout        int    `cfg:"repl-timeout"`
+	ReplicaOf          string `cfg:"replicaof"`         // 启动时作为从节点连接的主节点 eg: "127.0.0.1 6379"
+	ReplicaReadOnly    string `cfg:"replica-read-only"` // 从节点拒绝客户端的写命令, 默认 yes
+	ReplPingPeriod     int    `cfg:"repl-ping-replica-period"`
+	ReplBacklogSize    int    `cfg:"repl-backlog-size"`     // 复制积压缓冲的大小, 默认 1mb
+	MinReplicasToWrite int    `cfg:"min-replicas-to-write"` // ACK 延迟不超过 max-lag 的从节点少于该数量时拒绝写命令, 0 表示关闭
+	MinReplicasMaxLag  int    `cfg:"min-replicas-max-lag"`  // 单位秒, 默认 10
+	Hz                 int    `cfg:"hz"`                    // 每秒执行定期删除等后台任务的次数
+
+	// aof 文件大小超过 min-size, 且相比上次重写后的大小增长超过 percentage% 时 自动触发重写; percentage 为 0 时关闭
+	AutoAofRewritePercentage int `cfg:"auto-aof-rewrite-percentage"`
+	AutoAofRewriteMinSize    int `cfg:"auto-aof-rewrite-min-size"`
+	// 重写后的 aof 文件以二进制快照开头, 之后是增量的 RESP 命令
+	AofUseRdbPreamble bool `cfg:"aof-use-rdb-preamble"`
+	// 重写生成的 base 文件使用 gzip 压缩, 加载时自动识别
+	AofRewriteCompression bool `cfg:"aof-rewrite-compression"`
+	// 启动时最后一个 aof 文件结尾的命令不完整, 截断后继续加载; 关闭时拒绝启动
+	AofLoadTruncated bool `cfg:"aof-load-truncated"`
+	// 每秒第一条命令之前写入时间戳注释, 用于时间点恢复
+	AofTimestampEnabled bool `cfg:"aof-timestamp-enabled"`
+	// 时间点恢复: 启动时只加载到指定时间(unix 秒或 "2006-01-02 15:04:05") / 字节偏移, 之后的命令被忽略
+	AofRecoverUntilTime   string `cfg:"aof-recover-until-time"`
+	AofRecoverUntilOffset int    `cfg:"aof-recover-until-offset"`
+
+	// 密钥文件, 配置后 aof 与快照文件使用 AES-256-GCM 加密; 每行一个密钥 "<keyID> <64位十六进制>", 最后一个用于加密
+	EncryptionKeyFile string `cfg:"encryption-key-file"`
 
 	// for cluster mode configuration
-	ClusterEnabled string   `cfg:"cluster-enabled"` // Not used at present.
-	Peers          []string `cfg:"peers"`
-	Self           string   `cfg:"self"`
+	ClusterEnabled     string   `cfg:"cluster-enabled"`      // yes 时以集群模式启动
+	Peers              []string `cfg:"peers"`                // 集群中其他节点的地址, 逗号分隔 eg: "127.0.0.1:7001,127.0.0.1:7002"
+	Self               string   `cfg:"self"`                 // 本节点在集群中的地址, 默认为 bind:port
+	ClusterNodeTimeout int      `cfg:"cluster-node-timeout"` // 单位毫秒, 节点超过该时间没有回复则认为可能下线, 默认 15000
+	ClusterConfigFile  string   `cfg:"cluster-config-file"`  // 保存节点与槽的分配, 默认 nodes.conf
+
+	// for raft mode configuration, 成员同样为 self 与 peers
+	RaftEnabled           string `cfg:"raft-enabled"`            // yes 时 self 与 peers 组成 raft 组, 写命令提交后才执行
+	RaftDir               string `cfg:"raft-dir"`                // 保存 raft 日志, 状态与快照的目录, 默认 raft
+	RaftElectionTimeout   int    `cfg:"raft-election-timeout"`   // 单位毫秒, 实际的超时在 [t, 2t) 之间随机, 默认 1000
+	RaftReadMode          string `cfg:"raft-read-mode"`          // readindex(默认) 或 lease
+	RaftSnapshotThreshold int    `cfg:"raft-snapshot-threshold"` // 上次快照之后应用的日志数超过该值时生成快照, 默认 10000
+
+	// for crdt mode configuration, 其他站点同样为 peers
+	CrdtEnabled          string `cfg:"crdt-enabled"`           // yes 时以多主模式启动, 各站点都接受写命令
+	CrdtDir              string `cfg:"crdt-dir"`               // 保存站点 id, 快照与操作日志的目录, 默认 crdt
+	CrdtRewriteThreshold int    `cfg:"crdt-rewrite-threshold"` // 上次快照之后的操作数超过该值时重写快照并清空操作日志, 默认 10000
 
 	// config file path
 	CfPath string `cfg:"cf,omitempty"`
@@ -108,7 +155,7 @@ func parse(src io.Reader) *ServerProperties {
 			case reflect.String:
 				fieldVal.SetString(value)
 			case reflect.Int:
-				intValue, err := strconv.ParseInt(value, 10, 64)
+				intValue, err := parseInt(value)
 				if err == nil {
 					fieldVal.SetInt(intValue)
 				}
@@ -126,6 +173,28 @@ func parse(src io.Reader) *ServerProperties {
 	return config
 }
 
+// parseInt 解析整数, 支持 redis 风格的内存单位 eg: 64mb 1gb
+func parseInt(value string) (int64, error) {
+	lower := strings.ToLower(value)
+	units := []struct {
+		suffix string
+		factor int64
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+	}
+	for _, unit := range units {
+		if strings.HasSuffix(lower, unit.suffix) {
+			num, err := strconv.ParseInt(strings.TrimSuffix(lower, unit.suffix), 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			return num * unit.factor, nil
+		}
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
 // SetupConfig read config file and store properties into Properties
 func SetupConfig(configFilename string) {
 	file, err := os.Open(configFilename)
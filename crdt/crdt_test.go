@@ -0,0 +1,166 @@
+package crdt
+
+import (
+	"math/rand"
+	"memgo/utils"
+	"strings"
+	"testing"
+)
+
+func exec(s *Server, args ...string) string {
+	return string(s.Exec(nil, utils.ToCmdLine(args...)).ToBytes())
+}
+
+// dump 所有 key 的可见状态, 用于比较不同站点是否一致
+func dump(s *Server) string {
+	var sb strings.Builder
+	keys := exec(s, "KEYS", "*")
+	sb.WriteString(keys)
+	for _, key := range []string{"str", "cnt", "set", "hash", "mixed"} {
+		sb.WriteString(exec(s, "TYPE", key))
+		switch strings.TrimSpace(strings.TrimPrefix(exec(s, "TYPE", key), "+")) {
+		case "string":
+			sb.WriteString(exec(s, "GET", key))
+		case "set":
+			sb.WriteString(exec(s, "SMEMBERS", key))
+		case "hash":
+			sb.WriteString(exec(s, "HGETALL", key))
+		}
+	}
+	return sb.String()
+}
+
+func TestHLC(t *testing.T) {
+	wall := int64(100)
+	c := NewClock("a")
+	c.now = func() int64 { return wall }
+	t1 := c.Now()
+	t2 := c.Now()
+	if !t2.After(t1) {
+		t.Fatalf("%s should be after %s", t2, t1)
+	}
+	// 其他站点的时钟较快, 之后本站点的时间戳仍然递增
+	remote := Timestamp{Wall: 200, Logical: 5, Site: "b"}
+	c.Update(remote)
+	if t3 := c.Now(); !t3.After(remote) {
+		t.Fatalf("%s should be after %s", t3, remote)
+	}
+	parsed, err := ParseTimestamp(remote.String())
+	if err != nil || parsed != remote {
+		t.Fatalf("parse %s: %v %v", remote, parsed, err)
+	}
+}
+
+// TestConvergence 各站点并发执行命令, 操作以任意顺序合并后结果相同
+func TestConvergence(t *testing.T) {
+	sites := []*Server{NewServer("a", nil), NewServer("b", nil), NewServer("c", nil)}
+	exec(sites[0], "SET", "str", "a")
+	exec(sites[1], "SET", "str", "b")
+	exec(sites[0], "INCRBY", "cnt", "10")
+	exec(sites[1], "DECR", "cnt")
+	exec(sites[2], "INCR", "cnt")
+	exec(sites[0], "SADD", "set", "x", "y")
+	exec(sites[1], "SADD", "set", "y", "z")
+	exec(sites[0], "SREM", "set", "y")
+	exec(sites[0], "HSET", "hash", "f1", "a", "f2", "a")
+	exec(sites[2], "HSET", "hash", "f3", "c")
+	exec(sites[2], "HDEL", "hash", "f3")
+	exec(sites[1], "SADD", "mixed", "m")
+	exec(sites[2], "SET", "mixed", "v")
+	exec(sites[0], "DEL", "cnt")
+	exec(sites[2], "INCR", "cnt")
+
+	var ops []*Op
+	for _, s := range sites {
+		ops = append(ops, s.log[s.site].ops...)
+	}
+	var expect string
+	for round := 0; round < 20; round++ {
+		rand.Shuffle(len(ops), func(i, j int) { ops[i], ops[j] = ops[j], ops[i] })
+		r := NewServer("r", nil)
+		for _, op := range ops {
+			e := r.entries[op.Key]
+			if e == nil {
+				e = newEntry()
+				r.entries[op.Key] = e
+			}
+			op.apply(e)
+		}
+		got := dump(r)
+		if round == 0 {
+			expect = got
+		} else if got != expect {
+			t.Fatalf("diverged:\n%q\n%q", expect, got)
+		}
+	}
+	// a 的 DEL 只删除观察到的计数; b 添加的 y 与 a 的删除并发, 保留; c 删除了自己添加的 f3
+	r := NewServer("r", nil)
+	r.handleOps(ops)
+	for _, s := range sites {
+		r.handleOps(s.log[s.site].ops)
+	}
+	for args, want := range map[string]string{
+		"GET str":         "$1\r\nb\r\n",
+		"GET cnt":         "$1\r\n1\r\n",
+		"SMEMBERS set":    "*3\r\n$1\r\nx\r\n$1\r\ny\r\n$1\r\nz\r\n",
+		"HGETALL hash":    "*4\r\n$2\r\nf1\r\n$1\r\na\r\n$2\r\nf2\r\n$1\r\na\r\n",
+		"GET mixed":       "$1\r\nv\r\n",
+		"SISMEMBER set y": ":1\r\n",
+	} {
+		if got := exec(r, strings.Fields(args)...); got != want {
+			t.Errorf("%s: expect %q, got %q", args, want, got)
+		}
+	}
+	// 合并各站点的完整状态与应用所有操作的结果相同
+	merged := NewServer("m", nil)
+	for _, s := range sites {
+		s.mu.RLock()
+		records := s.encodeState()
+		s.mu.RUnlock()
+		merged.handleState(records)
+	}
+	if got, want := dump(merged), dump(r); got != want {
+		t.Fatalf("state merge diverged:\n%q\n%q", want, got)
+	}
+}
+
+// 重启之后使用原来的站点 id, 从快照与操作日志恢复数据, 本站点的操作编号继续递增
+func TestPersistence(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewPersistentServer(dir, "a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec(s, "SET", "str", "v")
+	exec(s, "SADD", "set", "x", "y")
+	s.mu.Lock()
+	if err := s.rewrite(); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Unlock()
+	exec(s, "SREM", "set", "x")
+	exec(s, "INCR", "cnt")
+	exec(s, "HSET", "hash", "f", "v")
+	want := dump(s)
+	s.Close()
+
+	s, err = NewPersistentServer(dir, "b", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.site != "a" {
+		t.Fatalf("expect site a after restart, got %s", s.site)
+	}
+	if got := dump(s); got != want {
+		t.Fatalf("expect %q after restart, got %q", want, got)
+	}
+	// 没有 peer 时所有操作都可以截断
+	exec(s, "DEL", "str")
+	s.mu.Lock()
+	s.compact()
+	s.mu.Unlock()
+	if s.applied("a") != 7 || len(s.log["a"].ops) != 0 {
+		t.Fatalf("expect 7 compacted operations, got %d retained %d", s.applied("a"), len(s.log["a"].ops))
+	}
+}
@@ -0,0 +1,83 @@
+package crdt
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timestamp 混合逻辑时钟(HLC): 物理时间(毫秒) + 逻辑计数, 相同时按站点 id 比较, 所有站点的时间戳全序
+type Timestamp struct {
+	Wall    int64
+	Logical int64
+	Site    string
+}
+
+func (t Timestamp) After(other Timestamp) bool {
+	if t.Wall != other.Wall {
+		return t.Wall > other.Wall
+	}
+	if t.Logical != other.Logical {
+		return t.Logical > other.Logical
+	}
+	return t.Site > other.Site
+}
+
+func (t Timestamp) String() string {
+	return strconv.FormatInt(t.Wall, 10) + "." + strconv.FormatInt(t.Logical, 10) + "." + t.Site
+}
+
+func ParseTimestamp(s string) (Timestamp, error) {
+	parts := strings.SplitN(s, ".", 3)
+	if len(parts) != 3 {
+		return Timestamp{}, errors.New("invalid timestamp " + s)
+	}
+	wall, err1 := strconv.ParseInt(parts[0], 10, 64)
+	logical, err2 := strconv.ParseInt(parts[1], 10, 64)
+	if err1 != nil || err2 != nil {
+		return Timestamp{}, errors.New("invalid timestamp " + s)
+	}
+	return Timestamp{Wall: wall, Logical: logical, Site: parts[2]}, nil
+}
+
+// Clock 本站点的 HLC, 本地事件调用 Now, 收到其他站点的操作时调用 Update
+// 保证因果相关的操作时间戳递增, 同时与物理时间的偏差有界
+type Clock struct {
+	mu   sync.Mutex
+	site string
+	last Timestamp
+	now  func() int64
+}
+
+func NewClock(site string) *Clock {
+	return &Clock{site: site, last: Timestamp{Site: site}, now: func() int64 { return time.Now().UnixMilli() }}
+}
+
+func (c *Clock) Now() Timestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if pt := c.now(); pt > c.last.Wall {
+		c.last.Wall, c.last.Logical = pt, 0
+	} else {
+		c.last.Logical++
+	}
+	return c.last
+}
+
+func (c *Clock) Update(remote Timestamp) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pt := c.now()
+	switch {
+	case pt > c.last.Wall && pt > remote.Wall:
+		c.last.Wall, c.last.Logical = pt, 0
+	case remote.Wall > c.last.Wall:
+		c.last.Wall, c.last.Logical = remote.Wall, remote.Logical+1
+	case remote.Wall == c.last.Wall && remote.Logical >= c.last.Logical:
+		c.last.Logical = remote.Logical + 1
+	default:
+		c.last.Logical++
+	}
+}
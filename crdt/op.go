@@ -0,0 +1,126 @@
+package crdt
+
+import (
+	"errors"
+	"strconv"
+)
+
+// 操作的类型, 每条客户端命令转换为一个或多个操作, 本地与远程的操作使用相同的方式应用
+const (
+	opSet    = "set"    // key value
+	opRegDel = "regdel" // key
+	opIncr   = "incr"   // key delta, 计入来源站点
+	opCntDel = "cntdel" // key p|n site total ..., 观察到的各站点的总量
+	opSAdd   = "sadd"   // key member, tag 为操作 id
+	opSRem   = "srem"   // key member tag ...
+	opHSet   = "hset"   // key field value
+	opHDel   = "hdel"   // key field tag ...
+)
+
+// 编码后每个操作的固定字段: origin seq time kind key argc, 之后是 argc 个参数
+const opHeaderFields = 6
+
+var errInvalidOp = errors.New("invalid crdt operation")
+
+// Op 每个站点的操作从 1 开始编号, 其他站点按编号顺序应用, 据此去重
+type Op struct {
+	Origin string
+	Seq    int64
+	Time   Timestamp
+	Kind   string
+	Key    string
+	Args   [][]byte
+}
+
+// tag 操作的唯一 id, 用作 OR-set 中添加的 tag
+func (op *Op) tag() string {
+	return op.Origin + ":" + strconv.FormatInt(op.Seq, 10)
+}
+
+func (op *Op) encode() [][]byte {
+	args := [][]byte{[]byte(op.Origin), []byte(strconv.FormatInt(op.Seq, 10)), []byte(op.Time.String()),
+		[]byte(op.Kind), []byte(op.Key), []byte(strconv.Itoa(len(op.Args)))}
+	return append(args, op.Args...)
+}
+
+// decodeOps 解析依次排列的多个操作
+func decodeOps(args [][]byte) ([]*Op, error) {
+	var ops []*Op
+	for len(args) > 0 {
+		if len(args) < opHeaderFields {
+			return nil, errInvalidOp
+		}
+		seq, err1 := strconv.ParseInt(string(args[1]), 10, 64)
+		ts, err2 := ParseTimestamp(string(args[2]))
+		argc, err3 := strconv.Atoi(string(args[5]))
+		if err1 != nil || err2 != nil || err3 != nil || argc < 0 || len(args) < opHeaderFields+argc {
+			return nil, errInvalidOp
+		}
+		ops = append(ops, &Op{
+			Origin: string(args[0]),
+			Seq:    seq,
+			Time:   ts,
+			Kind:   string(args[3]),
+			Key:    string(args[4]),
+			Args:   args[opHeaderFields : opHeaderFields+argc],
+		})
+		args = args[opHeaderFields+argc:]
+	}
+	return ops, nil
+}
+
+// apply 将操作合并到 e 中, 参数错误的操作被忽略
+func (op *Op) apply(e *entry) {
+	switch op.Kind {
+	case opSet:
+		if len(op.Args) == 1 {
+			e.reg.assign(op.Args[0], true, op.Time)
+		}
+	case opRegDel:
+		e.reg.assign(nil, false, op.Time)
+	case opIncr:
+		if len(op.Args) == 1 {
+			if delta, err := strconv.ParseInt(string(op.Args[0]), 10, 64); err == nil {
+				e.counter.add(op.Origin, delta)
+			}
+		}
+	case opCntDel:
+		observedP, observedN := make(map[string]int64), make(map[string]int64)
+		for i := 0; i+2 < len(op.Args); i += 3 {
+			total, err := strconv.ParseInt(string(op.Args[i+2]), 10, 64)
+			if err != nil {
+				return
+			}
+			if string(op.Args[i]) == "p" {
+				observedP[string(op.Args[i+1])] = total
+			} else {
+				observedN[string(op.Args[i+1])] = total
+			}
+		}
+		e.counter.remove(observedP, observedN)
+	case opSAdd:
+		if len(op.Args) == 1 {
+			e.set.add(string(op.Args[0]), op.tag())
+		}
+	case opSRem:
+		if len(op.Args) >= 1 {
+			e.set.remove(string(op.Args[0]), toStrings(op.Args[1:]))
+		}
+	case opHSet:
+		if len(op.Args) == 2 {
+			e.hash.set(string(op.Args[0]), op.Args[1], op.tag(), op.Time)
+		}
+	case opHDel:
+		if len(op.Args) >= 1 {
+			e.hash.fields.remove(string(op.Args[0]), toStrings(op.Args[1:]))
+		}
+	}
+}
+
+func toStrings(args [][]byte) []string {
+	result := make([]string, len(args))
+	for i, arg := range args {
+		result[i] = string(arg)
+	}
+	return result
+}
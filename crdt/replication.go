@@ -0,0 +1,317 @@
+package crdt
+
+import (
+	"memgo/config"
+	"memgo/interface/resp"
+	"memgo/logger"
+	"memgo/redis/RESP/protocol"
+	"memgo/redis/client"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 站点之间通过 RESP 交换操作:
+//   CRDT OPS site op...         -> [origin applied-seq ...]
+//   CRDT STATE site record...   -> [origin applied-seq ...]
+// 回复为接收方已应用的各来源站点的操作数, 发送方据此确定之后需要发送的操作;
+// 收到的操作同样会转发给其他站点, 站点之间不需要全部直连
+// 所有 peer 都已应用的操作从日志中截断; peer 需要的操作已被截断时(新加入或者落后太多), 改为发送完整的状态
+
+const (
+	replicateInterval = time.Second
+	replicateTimeout  = 5 * time.Second
+	maxBatch          = 1000 // 每次最多发送的操作数
+	// 某个 peer 长时间不可用时, 每个来源站点最多保留的操作数, 超出的部分截断, 该 peer 恢复后接收完整的状态
+	maxRetainedOps = 100000
+)
+
+type peer struct {
+	addr    string
+	client  *client.Client
+	trigger chan struct{}
+
+	// 以下字段只由该站点的 replicator 访问
+	vector map[string]int64 // 对方已应用的各来源站点的操作数
+	known  bool             // vector 是否来自对方最近一次的回复
+
+	acked map[string]int64 // vector 的副本, 由 Server.mu 保护, 用于截断日志
+}
+
+func newPeer(addr string) *peer {
+	return &peer{addr: addr, trigger: make(chan struct{}, 1), vector: make(map[string]int64)}
+}
+
+func (p *peer) notify() {
+	select {
+	case p.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (p *peer) close() {
+	if p.client != nil {
+		_ = p.client.Close()
+	}
+}
+
+func (s *Server) notifyPeers() {
+	for _, p := range s.peers {
+		p.notify()
+	}
+}
+
+// replicator 有新的操作时或者每隔 replicateInterval 向 p 发送对方缺少的操作
+func (s *Server) replicator(p *peer) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(replicateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-p.trigger:
+		case <-ticker.C:
+			// 定时发送空的 OPS 以得到对方最新的 vector
+			p.known = false
+		}
+		for {
+			if s.needsState(p) {
+				if err := s.sendState(p); err != nil {
+					logger.Warn("crdt: send state to " + p.addr + " failed: " + err.Error())
+					p.known = false
+					break
+				}
+				continue
+			}
+			ops := s.pendingOps(p)
+			if len(ops) == 0 && p.known {
+				break
+			}
+			if err := s.sendOps(p, ops); err != nil {
+				logger.Warn("crdt: replicate to " + p.addr + " failed: " + err.Error())
+				p.known = false
+				break
+			}
+			// 空的 OPS 只是刷新了 vector, 继续发送缺少的操作
+			if len(ops) > 0 && len(ops) < maxBatch {
+				break
+			}
+		}
+	}
+}
+
+// needsState 对方缺少的操作已经从日志中截断
+func (s *Server) needsState(p *peer) bool {
+	if !p.known {
+		return false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for origin, l := range s.log {
+		if p.vector[origin] < l.base {
+			return true
+		}
+	}
+	return false
+}
+
+// pendingOps 按 vector 找出对方缺少的操作, 同一来源站点的操作按编号顺序发送
+func (s *Server) pendingOps(p *peer) []*Op {
+	if !p.known {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var ops []*Op
+	for origin, l := range s.log {
+		for seq := p.vector[origin]; seq < l.applied() && len(ops) < maxBatch; seq++ {
+			ops = append(ops, l.ops[seq-l.base])
+		}
+	}
+	return ops
+}
+
+func (s *Server) sendOps(p *peer, ops []*Op) error {
+	args := [][]byte{[]byte("CRDT"), []byte("OPS"), []byte(s.site)}
+	for _, op := range ops {
+		args = append(args, op.encode()...)
+	}
+	return s.send(p, args)
+}
+
+func (s *Server) sendState(p *peer) error {
+	s.mu.RLock()
+	records := s.encodeState()
+	s.mu.RUnlock()
+	logger.Info("crdt: send state to " + p.addr + ", " + strconv.Itoa(len(records)) + " records")
+	return s.send(p, append([][]byte{[]byte("CRDT"), []byte("STATE"), []byte(s.site)}, flattenRecords(records)...))
+}
+
+// send 发送 CRDT OPS 或 CRDT STATE, 根据回复更新对方的 vector, 并截断所有 peer 都已应用的操作
+func (s *Server) send(p *peer, args [][]byte) error {
+	if p.client == nil {
+		c, err := client.DialAuth(p.addr, replicateTimeout, config.Properties.RequirePass)
+		if err != nil {
+			return err
+		}
+		p.client = c
+	}
+	reply, err := p.client.DoBytes(args)
+	var fields []string
+	if err == nil {
+		fields, err = client.Strings(reply)
+	}
+	if err == nil && len(fields)%2 != 0 {
+		err = errInvalidOp
+	}
+	if err != nil {
+		_ = p.client.Close()
+		p.client = nil
+		return err
+	}
+	vector := make(map[string]int64, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seq, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil {
+			return err
+		}
+		vector[fields[i]] = seq
+	}
+	p.vector, p.known = vector, true
+	s.mu.Lock()
+	p.acked = vector
+	s.compact()
+	s.mu.Unlock()
+	return nil
+}
+
+// compact 截断所有 peer 都已应用的操作, 调用方需持有 mu 的写锁
+// 没有回复过的 peer 视为没有应用任何操作, 日志超过 maxRetainedOps 时仍然截断
+func (s *Server) compact() {
+	for origin, l := range s.log {
+		keep := l.applied()
+		for _, p := range s.peers {
+			if acked := p.acked[origin]; acked < keep {
+				keep = acked
+			}
+		}
+		if floor := l.applied() - maxRetainedOps; keep < floor {
+			keep = floor
+		}
+		if n := keep - l.base; n > 0 {
+			// 复制剩余的操作, 释放截断部分占用的内存
+			l.ops = append([]*Op(nil), l.ops[n:]...)
+			l.base = keep
+		}
+	}
+}
+
+// handleOps 只应用编号连续的操作, 重复或者缺少前序的操作被忽略, 发送方根据回复的 vector 重新发送
+func (s *Server) handleOps(ops []*Op) resp.ReplyIntf {
+	s.mu.Lock()
+	var applied bool
+	for _, op := range ops {
+		if op.Origin == s.site || op.Seq != s.applied(op.Origin)+1 {
+			continue
+		}
+		s.clock.Update(op.Time)
+		s.applyOp(op)
+		applied = true
+	}
+	vector := s.vectorReply()
+	s.mu.Unlock()
+	if applied {
+		s.notifyPeers()
+	}
+	return vector
+}
+
+// handleState 合并其他站点的完整状态, 持久化时立即重写快照, 因为操作日志中没有这些数据
+func (s *Server) handleState(records [][][]byte) resp.ReplyIntf {
+	vector, entries, err := decodeState(records)
+	if err != nil {
+		return protocol.MakeErrReply("ERR " + err.Error())
+	}
+	s.mu.Lock()
+	s.mergeState(vector, entries)
+	if s.store != nil {
+		if err := s.rewrite(); err != nil {
+			logger.Error("crdt: rewrite snapshot failed: " + err.Error())
+		}
+	}
+	reply := s.vectorReply()
+	s.mu.Unlock()
+	s.notifyPeers()
+	return reply
+}
+
+// vectorReply 本站点已应用的各来源站点的操作数, 调用方需持有 mu
+func (s *Server) vectorReply() resp.ReplyIntf {
+	origins := make([]string, 0, len(s.log))
+	for origin := range s.log {
+		origins = append(origins, origin)
+	}
+	sort.Strings(origins)
+	vector := make([][]byte, 0, 2*len(origins))
+	for _, origin := range origins {
+		vector = append(vector, []byte(origin), []byte(strconv.FormatInt(s.log[origin].applied(), 10)))
+	}
+	return protocol.MakeMultiBulkReply(vector)
+}
+
+func (s *Server) status() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var total int64
+	var retained int
+	for _, l := range s.log {
+		total += l.applied()
+		retained += len(l.ops)
+	}
+	keys := 0
+	for _, e := range s.entries {
+		if e.kind() != typeNone {
+			keys++
+		}
+	}
+	return "site:" + s.site + "\r\n" +
+		"clock:" + s.clock.Now().String() + "\r\n" +
+		"local_ops:" + strconv.FormatInt(s.applied(s.site), 10) + "\r\n" +
+		"total_ops:" + strconv.FormatInt(total, 10) + "\r\n" +
+		"retained_ops:" + strconv.Itoa(retained) + "\r\n" +
+		"origins:" + strconv.Itoa(len(s.log)) + "\r\n" +
+		"keys:" + strconv.Itoa(keys) + "\r\n" +
+		"peers:" + strconv.Itoa(len(s.peers)) + "\r\n"
+}
+
+// execCrdt CRDT 命令, 包括站点之间的 CRDT OPS 以及查看状态的 CRDT STATUS
+func (s *Server) execCrdt(args [][]byte) resp.ReplyIntf {
+	if len(args) == 0 {
+		return protocol.MakeArgNumErrReply("crdt")
+	}
+	switch strings.ToLower(string(args[0])) {
+	case "ops":
+		if len(args) < 2 {
+			return protocol.MakeArgNumErrReply("crdt ops")
+		}
+		ops, err := decodeOps(args[2:])
+		if err != nil {
+			return protocol.MakeErrReply("ERR " + err.Error())
+		}
+		return s.handleOps(ops)
+	case "state":
+		if len(args) < 2 {
+			return protocol.MakeArgNumErrReply("crdt state")
+		}
+		records, err := unflattenRecords(args[2:])
+		if err != nil {
+			return protocol.MakeErrReply("ERR " + err.Error())
+		}
+		return s.handleState(records)
+	case "status":
+		return protocol.MakeBulkReply([]byte(s.status()))
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try CRDT STATUS.")
+}
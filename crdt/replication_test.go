@@ -0,0 +1,68 @@
+package crdt_test
+
+import (
+	"memgo/crdt"
+	"memgo/redis/RESP/handler"
+	"memgo/redis/client"
+	"memgo/tcp"
+	"net"
+	"testing"
+	"time"
+)
+
+func get(t *testing.T, addr string, args ...string) string {
+	c, err := client.Dial(addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	reply, err := c.Do(args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(reply.ToBytes())
+}
+
+func TestReplication(t *testing.T) {
+	var addrs []string
+	var listeners []net.Listener
+	for i := 0; i < 3; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, l)
+		addrs = append(addrs, l.Addr().String())
+	}
+	// 链式拓扑 0 - 1 - 2, 0 与 2 的操作经由 1 转发
+	peers := [][]string{{addrs[1]}, {addrs[0], addrs[2]}, {addrs[1]}}
+	var closing []chan struct{}
+	for i, l := range listeners {
+		ch := make(chan struct{})
+		go tcp.ListenAndServe(l, handler.MakeHandlerWith(crdt.NewServer(addrs[i], peers[i])), ch)
+		closing = append(closing, ch)
+	}
+	defer func() {
+		for _, ch := range closing {
+			close(ch)
+		}
+	}()
+
+	get(t, addrs[0], "SET", "str", "a")
+	get(t, addrs[2], "SADD", "set", "c")
+	get(t, addrs[0], "INCR", "cnt")
+	get(t, addrs[2], "INCR", "cnt")
+	deadline := time.Now().Add(5 * time.Second)
+	for _, addr := range addrs {
+		for {
+			str, set, cnt := get(t, addr, "GET", "str"), get(t, addr, "SMEMBERS", "set"), get(t, addr, "GET", "cnt")
+			if str == "$1\r\na\r\n" && set == "*1\r\n$1\r\nc\r\n" && cnt == "$1\r\n2\r\n" {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s not converged: %q %q %q", addr, str, set, cnt)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+}
@@ -0,0 +1,608 @@
+// Package crdt 多主(active-active)模式: 每个站点都接受写命令, 命令转换为 CRDT 操作后在本地应用,
+// 并通过 RESP 发送给其他站点; 操作的合并与顺序无关, 所有站点收到相同的操作后数据一致
+//
+// 支持的类型: 字符串(LWW register), 计数器(PN-counter, INCR/DECR 系列), 集合(OR-set), 哈希(OR-map)
+// 状态与操作保存在 crdt-dir 中(快照 + 操作日志, 与 aof 类似), 重启的站点使用原来的站点 id 并恢复数据
+// NODE 只支持 0 号数据库, 不支持过期时间
+
+package crdt
+
+import (
+	"memgo/config"
+	"memgo/database"
+	databaseIntf "memgo/interface/database"
+	"memgo/interface/resp"
+	"memgo/redis/RESP/protocol"
+	"memgo/utils/wildcard"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const defaultDir = "crdt"
+
+type Server struct {
+	site  string
+	clock *Clock
+
+	mu      sync.RWMutex
+	entries map[string]*entry
+	// 每个站点(包括本站点)已应用的操作, 转发给其他站点; 所有 peer 都已应用的操作被截断,
+	// 需要已截断操作的 peer 改为接收完整的状态
+	log   map[string]*originLog
+	peers []*peer
+	// store 为 nil 时数据只保存在内存中
+	store *storage
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+type command struct {
+	exec  func(s *Server, args [][]byte) resp.ReplyIntf
+	arity int // 包括命令名, 负数表示至少
+	write bool
+}
+
+var commands = make(map[string]*command)
+
+func registerCommand(name string, exec func(s *Server, args [][]byte) resp.ReplyIntf, arity int, write bool) {
+	commands[strings.ToLower(name)] = &command{exec: exec, arity: arity, write: write}
+	database.RegisterCommandFlags(name, write)
+}
+
+// originLog 一个来源站点的操作, ops[i] 的编号为 base+i+1
+type originLog struct {
+	base int64 // 已截断(或者包含在合并的状态中)的操作数
+	ops  []*Op
+}
+
+// applied 已应用的该站点的操作数
+func (l *originLog) applied() int64 {
+	return l.base + int64(len(l.ops))
+}
+
+// originLog 调用方需持有 mu 的写锁
+func (s *Server) originLog(origin string) *originLog {
+	l := s.log[origin]
+	if l == nil {
+		l = &originLog{}
+		s.log[origin] = l
+	}
+	return l
+}
+
+// applied 调用方需持有 mu
+func (s *Server) applied(origin string) int64 {
+	if l := s.log[origin]; l != nil {
+		return l.applied()
+	}
+	return 0
+}
+
+// MakeServer 其他站点为配置中的 peers; 第一次启动时站点 id 为本站点地址加上 runid 的前缀, 之后从 crdt-dir 中读取
+func MakeServer() *Server {
+	selfAddr := config.Properties.Self
+	if selfAddr == "" {
+		host := config.Properties.Bind
+		if host == "" || host == "0.0.0.0" {
+			host = "127.0.0.1"
+		}
+		selfAddr = net.JoinHostPort(host, strconv.Itoa(config.Properties.Port))
+	}
+	var peers []string
+	for _, peer := range config.Properties.Peers {
+		if peer = strings.TrimSpace(peer); peer != "" && peer != selfAddr {
+			peers = append(peers, peer)
+		}
+	}
+	runID := config.Properties.RunID
+	if len(runID) > 8 {
+		runID = runID[:8]
+	}
+	dir := config.Properties.CrdtDir
+	if dir == "" {
+		dir = defaultDir
+	}
+	s, err := NewPersistentServer(dir, selfAddr+"#"+runID, peers)
+	if err != nil {
+		panic("start crdt failed: " + err.Error())
+	}
+	return s
+}
+
+// NewServer 数据只保存在内存中
+func NewServer(site string, peers []string) *Server {
+	s := newServer(site, peers)
+	s.start()
+	return s
+}
+
+// NewPersistentServer dir 中保存了站点 id 时使用保存的 id 并恢复数据, 否则以 site 作为站点 id
+func NewPersistentServer(dir, site string, peers []string) (*Server, error) {
+	store, err := openStorage(dir)
+	if err != nil {
+		return nil, err
+	}
+	if site, err = store.loadSite(site); err != nil {
+		return nil, err
+	}
+	s := newServer(site, peers)
+	if err = s.load(store); err != nil {
+		store.close()
+		return nil, err
+	}
+	s.store = store
+	s.start()
+	return s, nil
+}
+
+func newServer(site string, peers []string) *Server {
+	s := &Server{
+		site:    site,
+		clock:   NewClock(site),
+		entries: make(map[string]*entry),
+		log:     make(map[string]*originLog),
+		closing: make(chan struct{}),
+	}
+	for _, addr := range peers {
+		s.peers = append(s.peers, newPeer(addr))
+	}
+	return s
+}
+
+func (s *Server) start() {
+	s.wg.Add(len(s.peers))
+	for _, p := range s.peers {
+		go s.replicator(p)
+	}
+	s.wg.Add(1)
+	go s.cron()
+}
+
+func (s *Server) Exec(client resp.ConnectionIntf, cmdLine databaseIntf.CmdLine) resp.ReplyIntf {
+	name := strings.ToLower(string(cmdLine[0]))
+	args := cmdLine[1:]
+	switch name {
+	case "crdt":
+		return s.execCrdt(args)
+	case "ping":
+		return protocol.MakePongReply()
+	case "select":
+		if len(args) != 1 {
+			return protocol.MakeArgNumErrReply(name)
+		}
+		if string(args[0]) != "0" {
+			return protocol.MakeErrReply("ERR only db 0 is supported in crdt mode")
+		}
+		return protocol.MakeOkReply()
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		return protocol.MakeErrReply("ERR unknown command")
+	}
+	if (cmd.arity >= 0 && len(cmdLine) != cmd.arity) || (cmd.arity < 0 && len(cmdLine) < -cmd.arity) {
+		return protocol.MakeArgNumErrReply(name)
+	}
+	if !cmd.write {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return cmd.exec(s, args)
+	}
+	s.mu.Lock()
+	reply := cmd.exec(s, args)
+	s.mu.Unlock()
+	s.notifyPeers()
+	return reply
+}
+
+func (s *Server) Close() {
+	close(s.closing)
+	s.wg.Wait()
+	for _, p := range s.peers {
+		p.close()
+	}
+	if s.store != nil {
+		s.mu.Lock()
+		s.store.close()
+		s.mu.Unlock()
+	}
+}
+
+func (s *Server) AfterClientClose(c resp.ConnectionIntf) {
+}
+
+// applyOp 合并操作并记录到日志, 调用方需持有 mu 的写锁
+// NODE 删除后的 key 仍然保留, 其中的墓碑保证之后到达的旧操作不会生效
+func (s *Server) applyOp(op *Op) {
+	e := s.entries[op.Key]
+	if e == nil {
+		e = newEntry()
+		s.entries[op.Key] = e
+	}
+	op.apply(e)
+	l := s.originLog(op.Origin)
+	l.ops = append(l.ops, op)
+	if s.store != nil {
+		s.store.appendOp(op)
+	}
+}
+
+// emit 生成本站点的操作并立即应用, 调用方需持有 mu 的写锁
+func (s *Server) emit(kind, key string, args ...[]byte) {
+	s.applyOp(&Op{
+		Origin: s.site,
+		Seq:    s.applied(s.site) + 1,
+		Time:   s.clock.Now(),
+		Kind:   kind,
+		Key:    key,
+		Args:   args,
+	})
+}
+
+// lookup 不存在的 key 返回 typeNone
+func (s *Server) lookup(key string) (*entry, string) {
+	e := s.entries[key]
+	if e == nil {
+		return nil, typeNone
+	}
+	return e, e.kind()
+}
+
+// deleteKey 删除 key 中观察到的所有类型的值, 返回删除前是否存在
+func (s *Server) deleteKey(key string) bool {
+	e, kind := s.lookup(key)
+	if kind == typeNone {
+		return false
+	}
+	if e.reg.present {
+		s.emit(opRegDel, key)
+	}
+	if e.counter.exists() {
+		var args [][]byte
+		for site, total := range e.counter.p {
+			args = append(args, []byte("p"), []byte(site), []byte(strconv.FormatInt(total, 10)))
+		}
+		for site, total := range e.counter.n {
+			args = append(args, []byte("n"), []byte(site), []byte(strconv.FormatInt(total, 10)))
+		}
+		s.emit(opCntDel, key, args...)
+	}
+	for _, member := range e.set.members() {
+		s.emit(opSRem, key, append([][]byte{[]byte(member)}, toArgs(e.set.tags(member)...)...)...)
+	}
+	for _, field := range e.hash.fields.members() {
+		s.emit(opHDel, key, append([][]byte{[]byte(field)}, toArgs(e.hash.fields.tags(field)...)...)...)
+	}
+	return true
+}
+
+func toArgs(args ...string) [][]byte {
+	result := make([][]byte, len(args))
+	for i, arg := range args {
+		result[i] = []byte(arg)
+	}
+	return result
+}
+
+// SET key value, 覆盖其他类型的值
+func execSet(s *Server, args [][]byte) resp.ReplyIntf {
+	key := string(args[0])
+	// 并发写入的其他类型的值同样删除
+	if e := s.entries[key]; e != nil && (e.counter.exists() || len(e.set.adds) > 0 || len(e.hash.fields.adds) > 0) {
+		s.deleteKey(key)
+	}
+	s.emit(opSet, key, args[1])
+	return protocol.MakeOkReply()
+}
+
+func execGet(s *Server, args [][]byte) resp.ReplyIntf {
+	e, kind := s.lookup(string(args[0]))
+	switch kind {
+	case typeNone:
+		return protocol.MakeNullBulkReply()
+	case typeString:
+		return protocol.MakeBulkReply(e.reg.value)
+	case typeCounter:
+		return protocol.MakeBulkReply([]byte(strconv.FormatInt(e.counter.value(), 10)))
+	}
+	return &protocol.WrongTypeErrReply{}
+}
+
+func execDel(s *Server, args [][]byte) resp.ReplyIntf {
+	var deleted int64
+	for _, key := range args {
+		if s.deleteKey(string(key)) {
+			deleted++
+		}
+	}
+	return protocol.MakeIntReply(deleted)
+}
+
+func execExists(s *Server, args [][]byte) resp.ReplyIntf {
+	var count int64
+	for _, key := range args {
+		if _, kind := s.lookup(string(key)); kind != typeNone {
+			count++
+		}
+	}
+	return protocol.MakeIntReply(count)
+}
+
+func execType(s *Server, args [][]byte) resp.ReplyIntf {
+	_, kind := s.lookup(string(args[0]))
+	if kind == typeCounter {
+		kind = typeString
+	}
+	return protocol.MakeStatusReply(kind)
+}
+
+func execKeys(s *Server, args [][]byte) resp.ReplyIntf {
+	pattern, err := wildcard.CompilePattern(string(args[0]))
+	if err != nil {
+		return protocol.MakeErrReply("illegal pattern")
+	}
+	keys := make([]string, 0)
+	for key, e := range s.entries {
+		if e.kind() != typeNone && pattern.IsMatch(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return protocol.MakeMultiBulkReply(toArgs(keys...))
+}
+
+// incrBy 计数器与字符串分开保存, 不能对 SET 写入的字符串执行 INCR
+func incrBy(s *Server, key string, delta int64) resp.ReplyIntf {
+	e, kind := s.lookup(key)
+	if kind != typeNone && kind != typeCounter {
+		return &protocol.WrongTypeErrReply{}
+	}
+	s.emit(opIncr, key, []byte(strconv.FormatInt(delta, 10)))
+	if e == nil {
+		e = s.entries[key]
+	}
+	return protocol.MakeIntReply(e.counter.value())
+}
+
+func execIncr(s *Server, args [][]byte) resp.ReplyIntf {
+	return incrBy(s, string(args[0]), 1)
+}
+
+func execDecr(s *Server, args [][]byte) resp.ReplyIntf {
+	return incrBy(s, string(args[0]), -1)
+}
+
+func execIncrBy(s *Server, args [][]byte) resp.ReplyIntf {
+	delta, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	return incrBy(s, string(args[0]), delta)
+}
+
+func execDecrBy(s *Server, args [][]byte) resp.ReplyIntf {
+	delta, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	return incrBy(s, string(args[0]), -delta)
+}
+
+// checkType 写入前检查 key 的类型, 不存在或者类型为 want 时返回 nil
+func (s *Server) checkType(key string, want string) (*entry, resp.ReplyIntf) {
+	e, kind := s.lookup(key)
+	if kind != typeNone && kind != want {
+		return nil, &protocol.WrongTypeErrReply{}
+	}
+	return e, nil
+}
+
+func execSAdd(s *Server, args [][]byte) resp.ReplyIntf {
+	key := string(args[0])
+	e, errReply := s.checkType(key, typeSet)
+	if errReply != nil {
+		return errReply
+	}
+	var added int64
+	for _, member := range args[1:] {
+		if e != nil && e.set.contains(string(member)) {
+			continue
+		}
+		s.emit(opSAdd, key, member)
+		e = s.entries[key]
+		added++
+	}
+	return protocol.MakeIntReply(added)
+}
+
+func execSRem(s *Server, args [][]byte) resp.ReplyIntf {
+	key := string(args[0])
+	e, errReply := s.checkType(key, typeSet)
+	if errReply != nil || e == nil {
+		if errReply != nil {
+			return errReply
+		}
+		return protocol.MakeIntReply(0)
+	}
+	var removed int64
+	for _, member := range args[1:] {
+		if !e.set.contains(string(member)) {
+			continue
+		}
+		s.emit(opSRem, key, append([][]byte{member}, toArgs(e.set.tags(string(member))...)...)...)
+		removed++
+	}
+	return protocol.MakeIntReply(removed)
+}
+
+// readSet 读取集合, 不存在时返回 nil
+func (s *Server) readSet(key string) (*orSet, resp.ReplyIntf) {
+	e, kind := s.lookup(key)
+	switch kind {
+	case typeNone:
+		return nil, nil
+	case typeSet:
+		return e.set, nil
+	}
+	return nil, &protocol.WrongTypeErrReply{}
+}
+
+func execSMembers(s *Server, args [][]byte) resp.ReplyIntf {
+	set, errReply := s.readSet(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if set == nil {
+		return protocol.MakeEmptyMultiBulkReply()
+	}
+	return protocol.MakeMultiBulkReply(toArgs(set.members()...))
+}
+
+func execSIsMember(s *Server, args [][]byte) resp.ReplyIntf {
+	set, errReply := s.readSet(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if set != nil && set.contains(string(args[1])) {
+		return protocol.MakeIntReply(1)
+	}
+	return protocol.MakeIntReply(0)
+}
+
+func execSCard(s *Server, args [][]byte) resp.ReplyIntf {
+	set, errReply := s.readSet(string(args[0]))
+	if errReply != nil || set == nil {
+		if errReply != nil {
+			return errReply
+		}
+		return protocol.MakeIntReply(0)
+	}
+	return protocol.MakeIntReply(int64(len(set.adds)))
+}
+
+func execHSet(s *Server, args [][]byte) resp.ReplyIntf {
+	if len(args)%2 != 1 {
+		return protocol.MakeArgNumErrReply("hset")
+	}
+	key := string(args[0])
+	e, errReply := s.checkType(key, typeHash)
+	if errReply != nil {
+		return errReply
+	}
+	var added int64
+	for i := 1; i < len(args); i += 2 {
+		if e == nil || !e.hash.fields.contains(string(args[i])) {
+			added++
+		}
+		s.emit(opHSet, key, args[i], args[i+1])
+		e = s.entries[key]
+	}
+	return protocol.MakeIntReply(added)
+}
+
+// readHash 读取哈希, 不存在时返回 nil
+func (s *Server) readHash(key string) (*orMap, resp.ReplyIntf) {
+	e, kind := s.lookup(key)
+	switch kind {
+	case typeNone:
+		return nil, nil
+	case typeHash:
+		return e.hash, nil
+	}
+	return nil, &protocol.WrongTypeErrReply{}
+}
+
+func execHGet(s *Server, args [][]byte) resp.ReplyIntf {
+	hash, errReply := s.readHash(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if hash != nil {
+		if value, ok := hash.get(string(args[1])); ok {
+			return protocol.MakeBulkReply(value)
+		}
+	}
+	return protocol.MakeNullBulkReply()
+}
+
+func execHDel(s *Server, args [][]byte) resp.ReplyIntf {
+	key := string(args[0])
+	hash, errReply := s.readHash(key)
+	if errReply != nil {
+		return errReply
+	}
+	var deleted int64
+	for _, field := range args[1:] {
+		if hash == nil || !hash.fields.contains(string(field)) {
+			continue
+		}
+		s.emit(opHDel, key, append([][]byte{field}, toArgs(hash.fields.tags(string(field))...)...)...)
+		deleted++
+	}
+	return protocol.MakeIntReply(deleted)
+}
+
+func execHGetAll(s *Server, args [][]byte) resp.ReplyIntf {
+	hash, errReply := s.readHash(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if hash == nil {
+		return protocol.MakeEmptyMultiBulkReply()
+	}
+	var result [][]byte
+	for _, field := range hash.fields.members() {
+		value, _ := hash.get(field)
+		result = append(result, []byte(field), value)
+	}
+	return protocol.MakeMultiBulkReply(result)
+}
+
+func execHLen(s *Server, args [][]byte) resp.ReplyIntf {
+	hash, errReply := s.readHash(string(args[0]))
+	if errReply != nil || hash == nil {
+		if errReply != nil {
+			return errReply
+		}
+		return protocol.MakeIntReply(0)
+	}
+	return protocol.MakeIntReply(int64(len(hash.fields.adds)))
+}
+
+func execHExists(s *Server, args [][]byte) resp.ReplyIntf {
+	hash, errReply := s.readHash(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	if hash != nil && hash.fields.contains(string(args[1])) {
+		return protocol.MakeIntReply(1)
+	}
+	return protocol.MakeIntReply(0)
+}
+
+func init() {
+	registerCommand("SET", execSet, 3, true)
+	registerCommand("GET", execGet, 2, false)
+	registerCommand("DEL", execDel, -2, true)
+	registerCommand("EXISTS", execExists, -2, false)
+	registerCommand("TYPE", execType, 2, false)
+	registerCommand("KEYS", execKeys, 2, false)
+	registerCommand("INCR", execIncr, 2, true)
+	registerCommand("DECR", execDecr, 2, true)
+	registerCommand("INCRBY", execIncrBy, 3, true)
+	registerCommand("DECRBY", execDecrBy, 3, true)
+	registerCommand("SADD", execSAdd, -3, true)
+	registerCommand("SREM", execSRem, -3, true)
+	registerCommand("SMEMBERS", execSMembers, 2, false)
+	registerCommand("SISMEMBER", execSIsMember, 3, false)
+	registerCommand("SCARD", execSCard, 2, false)
+	registerCommand("HSET", execHSet, -4, true)
+	registerCommand("HGET", execHGet, 3, false)
+	registerCommand("HDEL", execHDel, -3, true)
+	registerCommand("HGETALL", execHGetAll, 2, false)
+	registerCommand("HLEN", execHLen, 2, false)
+	registerCommand("HEXISTS", execHExists, 3, false)
+}
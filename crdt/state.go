@@ -0,0 +1,202 @@
+package crdt
+
+import (
+	"sort"
+	"strconv"
+)
+
+// 完整的状态编码为多条记录, 每条记录为一个字符串数组:
+//   origin site applied            已应用的该站点的操作数
+//   reg key value present ts       字符串
+//   cnt key p|n|rp|rn site total   计数器
+//   sadd key member tag / srem key tag          集合
+//   hadd key field tag / hrem key tag / hval key field value ts   哈希
+// 保存快照时每条记录写为一个 RESP 数组; CRDT STATE 中每条记录之前加上参数个数, 依次排列
+
+// encodeState 调用方需持有 mu 的读锁
+func (s *Server) encodeState() [][][]byte {
+	var records [][][]byte
+	record := func(args ...string) {
+		records = append(records, toArgs(args...))
+	}
+	origins := make([]string, 0, len(s.log))
+	for origin := range s.log {
+		origins = append(origins, origin)
+	}
+	sort.Strings(origins)
+	for _, origin := range origins {
+		record("origin", origin, strconv.FormatInt(s.log[origin].applied(), 10))
+	}
+	for key, e := range s.entries {
+		if e.reg.ts != (Timestamp{}) {
+			present := "0"
+			if e.reg.present {
+				present = "1"
+			}
+			// 删除之后 value 为 nil, RESP 中需要编码为空字符串
+			value := append([]byte{}, e.reg.value...)
+			records = append(records, [][]byte{[]byte("reg"), []byte(key), value, []byte(present), []byte(e.reg.ts.String())})
+		}
+		for kind, totals := range map[string]map[string]int64{"p": e.counter.p, "n": e.counter.n, "rp": e.counter.removedP, "rn": e.counter.removedN} {
+			for site, total := range totals {
+				record("cnt", key, kind, site, strconv.FormatInt(total, 10))
+			}
+		}
+		encodeSet := func(add, rem string, set *orSet) {
+			for member, tags := range set.adds {
+				for tag := range tags {
+					record(add, key, member, tag)
+				}
+			}
+			for tag := range set.removed {
+				record(rem, key, tag)
+			}
+		}
+		encodeSet("sadd", "srem", e.set)
+		encodeSet("hadd", "hrem", e.hash.fields)
+		for field, r := range e.hash.values {
+			records = append(records, [][]byte{[]byte("hval"), []byte(key), []byte(field), r.value, []byte(r.ts.String())})
+		}
+	}
+	return records
+}
+
+// decodeState 解析 encodeState 的记录, 返回各站点已应用的操作数以及所有 key 的状态
+func decodeState(records [][][]byte) (map[string]int64, map[string]*entry, error) {
+	vector := make(map[string]int64)
+	entries := make(map[string]*entry)
+	get := func(key []byte) *entry {
+		e := entries[string(key)]
+		if e == nil {
+			e = newEntry()
+			entries[string(key)] = e
+		}
+		return e
+	}
+	for _, r := range records {
+		if len(r) < 3 {
+			return nil, nil, errInvalidOp
+		}
+		switch string(r[0]) {
+		case "origin":
+			applied, err := strconv.ParseInt(string(r[2]), 10, 64)
+			if err != nil {
+				return nil, nil, errInvalidOp
+			}
+			vector[string(r[1])] = applied
+		case "reg":
+			if len(r) != 5 {
+				return nil, nil, errInvalidOp
+			}
+			ts, err := ParseTimestamp(string(r[4]))
+			if err != nil {
+				return nil, nil, err
+			}
+			get(r[1]).reg.assign(r[2], string(r[3]) == "1", ts)
+		case "cnt":
+			if len(r) != 5 {
+				return nil, nil, errInvalidOp
+			}
+			total, err := strconv.ParseInt(string(r[4]), 10, 64)
+			if err != nil {
+				return nil, nil, errInvalidOp
+			}
+			c := get(r[1]).counter
+			totals := map[string]map[string]int64{"p": c.p, "n": c.n, "rp": c.removedP, "rn": c.removedN}[string(r[2])]
+			if totals == nil {
+				return nil, nil, errInvalidOp
+			}
+			totals[string(r[3])] = total
+		case "sadd", "hadd":
+			if len(r) != 4 {
+				return nil, nil, errInvalidOp
+			}
+			e := get(r[1])
+			set := e.set
+			if string(r[0]) == "hadd" {
+				set = e.hash.fields
+			}
+			set.add(string(r[2]), string(r[3]))
+		case "srem", "hrem":
+			e := get(r[1])
+			set := e.set
+			if string(r[0]) == "hrem" {
+				set = e.hash.fields
+			}
+			set.removed[string(r[2])] = struct{}{}
+		case "hval":
+			if len(r) != 5 {
+				return nil, nil, errInvalidOp
+			}
+			ts, err := ParseTimestamp(string(r[4]))
+			if err != nil {
+				return nil, nil, err
+			}
+			e := get(r[1])
+			e.hash.values[string(r[2])] = &lwwRegister{value: r[3], present: true, ts: ts}
+		default:
+			return nil, nil, errInvalidOp
+		}
+	}
+	// 记录的顺序任意, 添加之后才读到的删除同样生效
+	for _, e := range entries {
+		for _, set := range []*orSet{e.set, e.hash.fields} {
+			for member, tags := range set.adds {
+				for tag := range tags {
+					if _, ok := set.removed[tag]; ok {
+						delete(tags, tag)
+					}
+				}
+				if len(tags) == 0 {
+					delete(set.adds, member)
+				}
+			}
+		}
+	}
+	return vector, entries, nil
+}
+
+// mergeState 合并其他站点(或者快照)的状态, 调用方需持有 mu 的写锁
+// 状态中已包含的操作不再需要, 该来源站点的日志从 vector 之后开始
+func (s *Server) mergeState(vector map[string]int64, entries map[string]*entry) {
+	for key, other := range entries {
+		e := s.entries[key]
+		if e == nil {
+			e = newEntry()
+			s.entries[key] = e
+		}
+		e.merge(other)
+		if other.reg.ts != (Timestamp{}) {
+			s.clock.Update(other.reg.ts)
+		}
+	}
+	for origin, applied := range vector {
+		l := s.originLog(origin)
+		if applied > l.applied() {
+			l.base, l.ops = applied, nil
+		}
+	}
+}
+
+// flattenRecords 每条记录之前加上参数个数, 用于 CRDT STATE
+func flattenRecords(records [][][]byte) [][]byte {
+	var args [][]byte
+	for _, r := range records {
+		args = append(args, []byte(strconv.Itoa(len(r))))
+		args = append(args, r...)
+	}
+	return args
+}
+
+func unflattenRecords(args [][]byte) ([][][]byte, error) {
+	var records [][][]byte
+	for len(args) > 0 {
+		argc, err := strconv.Atoi(string(args[0]))
+		if err != nil || argc < 0 || len(args) < 1+argc {
+			return nil, errInvalidOp
+		}
+		records = append(records, args[1:1+argc])
+		args = args[1+argc:]
+	}
+	return records, nil
+}
@@ -0,0 +1,226 @@
+package crdt
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"memgo/config"
+	"memgo/logger"
+	"memgo/redis/RESP/protocol"
+	"memgo/redis/client"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	siteFile     = "site"     // 站点 id, 第一次启动时写入
+	snapshotFile = "snapshot" // 完整的状态, 每条记录编码为一个 RESP 数组
+	opsFile      = "ops"      // 快照之后应用的操作, 每个操作编码为一个 RESP 数组, 与 aof 类似
+
+	defaultRewriteThreshold = 10000
+	syncInterval            = time.Second
+)
+
+// storage 与 appendfsync everysec 相同, 操作日志每秒刷盘一次, 宕机最多丢失 1 秒内本站点的操作;
+// 其他站点的操作在重启后由对方重新发送
+// NODE 除 close 外, 调用方需持有 Server.mu 的写锁
+type storage struct {
+	dir     string
+	ops     *os.File
+	pending int // 上次快照之后写入的操作数
+}
+
+func openStorage(dir string) (*storage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &storage{dir: dir}, nil
+}
+
+func (st *storage) path(name string) string {
+	return filepath.Join(st.dir, name)
+}
+
+// writeFile 先写入临时文件, 刷盘后原子地替换
+func (st *storage) writeFile(name string, data []byte) error {
+	tmpFile, err := os.CreateTemp(st.dir, "temp-"+name+"-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.Write(data)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), st.path(name))
+	}
+	if err != nil {
+		_ = os.Remove(tmpFile.Name())
+	}
+	return err
+}
+
+// loadSite 第一次启动时保存 site 并返回, 之后返回保存的站点 id
+func (st *storage) loadSite(site string) (string, error) {
+	data, err := os.ReadFile(st.path(siteFile))
+	if os.IsNotExist(err) {
+		return site, st.writeFile(siteFile, []byte(site+"\n"))
+	} else if err != nil {
+		return "", err
+	}
+	if saved := strings.TrimSpace(string(data)); saved != "" {
+		return saved, nil
+	}
+	return "", errors.New("invalid crdt site file")
+}
+
+// readRecords 读取依次排列的 RESP 数组, 同时返回完整记录的字节数, 末尾不完整的记录被忽略
+func readRecords(data []byte) ([][][]byte, int64, error) {
+	src := bytes.NewReader(data)
+	reader := bufio.NewReader(src)
+	var records [][][]byte
+	var valid int64
+	for {
+		reply, err := client.ReadReply(reader)
+		if err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			logger.Warn("crdt: truncate incomplete record at the end of " + opsFile)
+			break
+		} else if err != nil {
+			return nil, 0, err
+		}
+		args, err := client.Strings(reply)
+		if err != nil {
+			return nil, 0, err
+		}
+		records = append(records, toArgs(args...))
+		valid = int64(len(data)) - int64(src.Len()) - int64(reader.Buffered())
+	}
+	return records, valid, nil
+}
+
+// load 从快照与操作日志恢复, 并打开操作日志用于追加
+func (s *Server) load(st *storage) error {
+	data, err := os.ReadFile(st.path(snapshotFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	records, _, err := readRecords(data)
+	if err != nil {
+		return err
+	}
+	vector, entries, err := decodeState(records)
+	if err != nil {
+		return errors.New("invalid crdt snapshot: " + err.Error())
+	}
+	s.mergeState(vector, entries)
+
+	if data, err = os.ReadFile(st.path(opsFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	records, valid, err := readRecords(data)
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		ops, err := decodeOps(r)
+		if err != nil || len(ops) != 1 {
+			return errors.New("invalid crdt operation log")
+		}
+		// 快照之前已经包含的操作被跳过
+		if op := ops[0]; op.Seq == s.applied(op.Origin)+1 {
+			s.clock.Update(op.Time)
+			s.applyOp(op)
+		}
+	}
+	st.pending = len(records)
+
+	if st.ops, err = os.OpenFile(st.path(opsFile), os.O_CREATE|os.O_WRONLY, 0644); err != nil {
+		return err
+	}
+	if err = st.ops.Truncate(valid); err == nil {
+		_, err = st.ops.Seek(valid, io.SeekStart)
+	}
+	logger.Info("crdt: site " + s.site + " loaded " + strconv.Itoa(len(s.entries)) + " keys and " +
+		strconv.Itoa(len(records)) + " operations")
+	return err
+}
+
+func (st *storage) appendOp(op *Op) {
+	if _, err := st.ops.Write(protocol.MakeMultiBulkReply(op.encode()).ToBytes()); err != nil {
+		logger.Error("crdt: append operation log failed: " + err.Error())
+	}
+	st.pending++
+}
+
+// rewrite 保存完整的状态并清空操作日志, 调用方需持有 mu 的写锁
+// NODE 编码与写入期间阻塞其他命令, 通过 crdt-rewrite-threshold 控制频率
+func (s *Server) rewrite() error {
+	var buf bytes.Buffer
+	for _, r := range s.encodeState() {
+		buf.Write(protocol.MakeMultiBulkReply(r).ToBytes())
+	}
+	st := s.store
+	if err := st.writeFile(snapshotFile, buf.Bytes()); err != nil {
+		return err
+	}
+	// 快照替换之后宕机时操作日志中的操作已包含在快照中, 重放时被跳过
+	if err := st.writeFile(opsFile, nil); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(st.path(opsFile), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_ = st.ops.Close()
+	st.ops, st.pending = file, 0
+	return nil
+}
+
+// cron 每秒截断一次日志(没有 peer 时不会在发送之后截断), 持久化时刷盘, 操作日志过长时重写快照
+func (s *Server) cron() {
+	defer s.wg.Done()
+	threshold := config.Properties.CrdtRewriteThreshold
+	if threshold <= 0 {
+		threshold = defaultRewriteThreshold
+	}
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		s.compact()
+		if s.store == nil {
+			s.mu.Unlock()
+			continue
+		}
+		if err := s.store.ops.Sync(); err != nil {
+			logger.Error("crdt: sync operation log failed: " + err.Error())
+		}
+		if s.store.pending >= threshold {
+			if err := s.rewrite(); err != nil {
+				logger.Error("crdt: rewrite snapshot failed: " + err.Error())
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (st *storage) close() {
+	if st.ops != nil {
+		_ = st.ops.Sync()
+		_ = st.ops.Close()
+	}
+}
@@ -0,0 +1,258 @@
+package crdt
+
+import "sort"
+
+// 所有类型的合并都满足交换律, 结合律与幂等, 不同站点的操作以任意顺序应用后结果相同
+// NODE 删除留下的墓碑(removed)不会回收, 站点数与删除次数较多时内存持续增长
+
+// lwwRegister 字符串, 时间戳较大的写入(或删除)生效
+type lwwRegister struct {
+	value   []byte
+	present bool
+	ts      Timestamp
+}
+
+func (r *lwwRegister) assign(value []byte, present bool, ts Timestamp) {
+	if ts.After(r.ts) {
+		r.value, r.present, r.ts = value, present, ts
+	}
+}
+
+// pnCounter 每个站点分别记录增加与减少的总量; 删除时记录观察到的各站点的总量, 之后只计算超出的部分
+type pnCounter struct {
+	p, n               map[string]int64
+	removedP, removedN map[string]int64
+}
+
+func newPNCounter() *pnCounter {
+	return &pnCounter{
+		p:        make(map[string]int64),
+		n:        make(map[string]int64),
+		removedP: make(map[string]int64),
+		removedN: make(map[string]int64),
+	}
+}
+
+func (c *pnCounter) add(site string, delta int64) {
+	if delta >= 0 {
+		c.p[site] += delta
+	} else {
+		c.n[site] -= delta
+	}
+}
+
+func (c *pnCounter) value() int64 {
+	var v int64
+	for site, p := range c.p {
+		v += p - c.removedP[site]
+	}
+	for site, n := range c.n {
+		v -= n - c.removedN[site]
+	}
+	return v
+}
+
+// exists 删除之后有新的增减操作
+func (c *pnCounter) exists() bool {
+	for site, p := range c.p {
+		if p > c.removedP[site] {
+			return true
+		}
+	}
+	for site, n := range c.n {
+		if n > c.removedN[site] {
+			return true
+		}
+	}
+	return false
+}
+
+// remove observedP/observedN 为删除时观察到的各站点的总量, 取最大值保证合并与顺序无关
+func (c *pnCounter) remove(observedP, observedN map[string]int64) {
+	for site, v := range observedP {
+		if v > c.removedP[site] {
+			c.removedP[site] = v
+		}
+	}
+	for site, v := range observedN {
+		if v > c.removedN[site] {
+			c.removedN[site] = v
+		}
+	}
+}
+
+// orSet 每次添加使用唯一的 tag, 删除只删除观察到的 tag, 与删除并发的添加保留(add-wins)
+// 已删除的 tag 记录在 removed 中, 删除先于对应的添加到达时添加不再生效
+type orSet struct {
+	adds    map[string]map[string]struct{}
+	removed map[string]struct{}
+}
+
+func newORSet() *orSet {
+	return &orSet{adds: make(map[string]map[string]struct{}), removed: make(map[string]struct{})}
+}
+
+func (s *orSet) add(member, tag string) {
+	if _, ok := s.removed[tag]; ok {
+		return
+	}
+	tags := s.adds[member]
+	if tags == nil {
+		tags = make(map[string]struct{})
+		s.adds[member] = tags
+	}
+	tags[tag] = struct{}{}
+}
+
+func (s *orSet) remove(member string, tags []string) {
+	for _, tag := range tags {
+		s.removed[tag] = struct{}{}
+		delete(s.adds[member], tag)
+	}
+	if len(s.adds[member]) == 0 {
+		delete(s.adds, member)
+	}
+}
+
+func (s *orSet) contains(member string) bool {
+	return len(s.adds[member]) > 0
+}
+
+// tags 删除 member 时需要的 tag
+func (s *orSet) tags(member string) []string {
+	tags := make([]string, 0, len(s.adds[member]))
+	for tag := range s.adds[member] {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func (s *orSet) members() []string {
+	members := make([]string, 0, len(s.adds))
+	for member := range s.adds {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// orMap field 是否存在由 orSet 决定, field 的值为 lwwRegister
+type orMap struct {
+	fields *orSet
+	values map[string]*lwwRegister
+}
+
+func newORMap() *orMap {
+	return &orMap{fields: newORSet(), values: make(map[string]*lwwRegister)}
+}
+
+func (m *orMap) set(field string, value []byte, tag string, ts Timestamp) {
+	m.fields.add(field, tag)
+	r := m.values[field]
+	if r == nil {
+		r = &lwwRegister{}
+		m.values[field] = r
+	}
+	r.assign(value, true, ts)
+}
+
+func (m *orMap) get(field string) ([]byte, bool) {
+	if !m.fields.contains(field) {
+		return nil, false
+	}
+	return m.values[field].value, true
+}
+
+// entry 一个 key 的值, 不同类型分别合并; 并发地以不同类型写入同一个 key 时各类型都保留,
+// 读取时按 string, set, hash 的顺序确定类型
+type entry struct {
+	reg     lwwRegister
+	counter *pnCounter
+	set     *orSet
+	hash    *orMap
+}
+
+func newEntry() *entry {
+	return &entry{counter: newPNCounter(), set: newORSet(), hash: newORMap()}
+}
+
+const (
+	typeNone    = "none"
+	typeString  = "string"
+	typeCounter = "counter"
+	typeSet     = "set"
+	typeHash    = "hash"
+)
+
+// kind 计数器对客户端同样表现为 string, 内部区分以拒绝对字符串执行 INCR
+func (e *entry) kind() string {
+	switch {
+	case e.reg.present:
+		return typeString
+	case e.counter.exists():
+		return typeCounter
+	case len(e.set.adds) > 0:
+		return typeSet
+	case len(e.hash.fields.adds) > 0:
+		return typeHash
+	}
+	return typeNone
+}
+
+// 以下为状态的合并, 用于从快照恢复以及向新加入(或者落后太多)的站点发送完整的状态, 同样与顺序无关
+
+func (c *pnCounter) merge(other *pnCounter) {
+	mergeMax := func(dst, src map[string]int64) {
+		for site, v := range src {
+			if v > dst[site] {
+				dst[site] = v
+			}
+		}
+	}
+	mergeMax(c.p, other.p)
+	mergeMax(c.n, other.n)
+	mergeMax(c.removedP, other.removedP)
+	mergeMax(c.removedN, other.removedN)
+}
+
+// merge 两边任意一方删除的 tag 都不再生效
+func (s *orSet) merge(other *orSet) {
+	for tag := range other.removed {
+		s.removed[tag] = struct{}{}
+	}
+	for member, tags := range s.adds {
+		for tag := range tags {
+			if _, ok := other.removed[tag]; ok {
+				delete(tags, tag)
+			}
+		}
+		if len(tags) == 0 {
+			delete(s.adds, member)
+		}
+	}
+	for member, tags := range other.adds {
+		for tag := range tags {
+			s.add(member, tag)
+		}
+	}
+}
+
+func (m *orMap) merge(other *orMap) {
+	m.fields.merge(other.fields)
+	for field, r := range other.values {
+		own := m.values[field]
+		if own == nil {
+			own = &lwwRegister{}
+			m.values[field] = own
+		}
+		own.assign(r.value, r.present, r.ts)
+	}
+}
+
+func (e *entry) merge(other *entry) {
+	e.reg.assign(other.reg.value, other.reg.present, other.reg.ts)
+	e.counter.merge(other.counter)
+	e.set.merge(other.set)
+	e.hash.merge(other.hash)
+}
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"errors"
 	"fmt"
 	"memgo/aof"
 	"memgo/config"
@@ -11,12 +12,28 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type MemgoServer struct {
 	dbSet     []*DbObject
 	persister *aof.Persister
+
+	// 关闭时通知后台任务(定期删除等)退出
+	closing     chan struct{}
+	expireStats expireStats
+
+	// 普通命令持有读锁; 开始快照(之后由 snapshotWriter 写时复制)与整体替换数据时持有写锁
+	snapshotLock sync.RWMutex
+	dirty        int64 // 上次保存快照之后的修改次数
+	snapshot     snapshotState
+	repl         replicationState
+
+	// 正在生成的快照(BGSAVE 与全量同步), 没有时为 nil; 由 writersMu 保护修改, 写命令无锁读取
+	snapshotWriters atomic.Pointer[[]*snapshotWriter]
+	writersMu       sync.Mutex
 }
 
 func TmpDbSvrMaker() database.DBEngine {
@@ -31,6 +48,15 @@ func TmpDbSvrMaker() database.DBEngine {
 }
 
 func NewMemgoServer() *MemgoServer {
+	return newMemgoServer(true)
+}
+
+// NewMemgoServerInMemory 不加载也不写入 aof 与快照文件, 数据的持久化由调用方负责(raft 模式)
+func NewMemgoServerInMemory() *MemgoServer {
+	return newMemgoServer(false)
+}
+
+func newMemgoServer(persistent bool) *MemgoServer {
 	server := &MemgoServer{}
 
 	// 先初始化 MemgoServer的每一个 DbObject
@@ -45,36 +71,59 @@ func NewMemgoServer() *MemgoServer {
 		server.dbSet[i] = dbObject
 	}
 
-	if config.Properties.AppendOnly {
+	if persistent && config.Properties.AppendOnly {
 		// 创建 aof persister
 		aofHandler, err := aof.NewPersister(server, true, config.Properties.AppendFilename, config.Properties.AppendFsync,
 			TmpDbSvrMaker)
 		if err != nil {
 			panic("new aof persister failer: " + err.Error())
 		}
-		// 绑定 aof persister
-		for i := range server.dbSet {
-			dbIdx := i
-			addAof := func(cmdline CmdLine) {
-				aofHandler.SaveCmdLine(dbIdx, cmdline)
-			}
-			server.dbSet[i].addAof = addAof
-		}
 		server.persister = aofHandler
+	} else if persistent {
+		// 未开启 aof 时 从快照文件恢复数据
+		server.loadSnapshot()
+	}
+
+	// 绑定 写命令的出口
+	// NODE 必须在加载 aof/快照 之后绑定, 防止加载时执行的命令被重复记录
+	for i := range server.dbSet {
+		dbIdx := i
+		server.dbSet[i].addAof = func(cmdLine CmdLine) {
+			server.propagate(dbIdx, cmdLine)
+		}
+		dbObj := server.dbSet[i]
+		dbObj.beforeWrite = func(keys []string) {
+			server.saveBeforeWrite(dbObj, keys)
+		}
 	}
 
+	server.closing = make(chan struct{})
+	server.startActiveExpire()
+	if persistent {
+		server.startSnapshotCron()
+	}
+	server.initReplication()
 	return server
 }
 
+// propagate 所有写命令的出口: 记录修改次数(用于 save 规则), 追加到 aof 与复制流
+func (server *MemgoServer) propagate(dbIdx int, cmdLine CmdLine) {
+	atomic.AddInt64(&server.dirty, 1)
+	if server.persister != nil {
+		server.persister.SaveCmdLine(dbIdx, cmdLine)
+	}
+	server.feedReplicas(dbIdx, cmdLine)
+}
+
 func BGRewriteAof(server *MemgoServer, args CmdLine) resp.ReplyIntf {
 	if server.persister == nil {
 		return protocol.MakeErrReply("Aof persistence is not enabled")
 	}
-	err := server.persister.ReWrite()
+	err := server.persister.BGReWrite()
 	if err != nil {
 		return protocol.MakeErrReply(err.Error())
 	}
-	return protocol.MakeOkReply()
+	return protocol.MakeStatusReply("Background append only file rewriting started")
 }
 
 func (server *MemgoServer) Exec(client resp.ConnectionIntf, cmdLine database.CmdLine) (result resp.ReplyIntf) {
@@ -87,9 +136,31 @@ func (server *MemgoServer) Exec(client resp.ConnectionIntf, cmdLine database.Cmd
 
 	cmdName := strings.ToLower(string(cmdLine[0]))
 	// 特殊命令
-	if cmdName == "rewriteaof" {
+	if cmdName == "rewriteaof" || cmdName == "bgrewriteaof" {
 		return BGRewriteAof(server, cmdLine)
 	}
+	switch cmdName {
+	case "save":
+		return server.execSave()
+	case "bgsave":
+		return server.execBGSave()
+	case "lastsave":
+		return server.execLastSave()
+	case "replicaof", "slaveof":
+		return server.execReplicaOf(cmdLine[1:])
+	case "role":
+		return server.execRole()
+	case "replconf":
+		return server.execReplConf(client, cmdLine[1:])
+	case "psync", "sync":
+		return server.execPSync(client, cmdLine)
+	case "wait":
+		return server.execWait(cmdLine[1:])
+	}
+
+	if cmdName == "info" {
+		return server.execInfo(cmdLine[1:])
+	}
 
 	// 正常命令
 	if cmdName == "select" {
@@ -98,17 +169,78 @@ func (server *MemgoServer) Exec(client resp.ConnectionIntf, cmdLine database.Cmd
 		}
 		return server.ExecSelect(client, cmdLine[1:])
 	}
+	return server.execNormal(client, cmdLine, nil)
+}
+
+// ExecWithCheck 与 Exec 相同, 但在持有命令的 key 锁之后先执行 check, 集群模式迁移槽时据此判断 key 是否已经迁走
+// NODE 只用于 GetRelatedKeys 不为空的普通命令
+func (server *MemgoServer) ExecWithCheck(client resp.ConnectionIntf, cmdLine database.CmdLine, check KeysCheck) (result resp.ReplyIntf) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Warn(fmt.Sprintf("error occurs: %v\n%s", err, string(debug.Stack())))
+			result = protocol.MakeUnknownErrReply()
+		}
+	}()
+	return server.execNormal(client, cmdLine, check)
+}
+
+func (server *MemgoServer) execNormal(client resp.ConnectionIntf, cmdLine database.CmdLine, check KeysCheck) resp.ReplyIntf {
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	write := isWriteCommand(cmdName)
+	if write {
+		if server.isReadOnlyFor(client) {
+			return protocol.MakeErrReply("READONLY You can't write against a read only replica.")
+		}
+		if server.notEnoughReplicas() {
+			return protocol.MakeErrReply("NOREPLICAS Not enough good replicas to write.")
+		}
+		if reply := server.aofWriteErrReply(); reply != nil {
+			return reply
+		}
+	}
+	server.snapshotLock.RLock()
+	defer server.snapshotLock.RUnlock()
 	selectedDB := client.GetDBIndex()
-	return server.dbSet[selectedDB].Exec(client, cmdLine)
+	var reply resp.ReplyIntf
+	if check != nil {
+		reply = server.dbSet[selectedDB].execNormalCommand(cmdLine, check)
+	} else {
+		reply = server.dbSet[selectedDB].Exec(client, cmdLine)
+	}
+	// NODE 执行期间写入 aof 失败时, 命令可能没有持久化, 不能回复成功
+	if write {
+		if errReply := server.aofWriteErrReply(); errReply != nil {
+			return errReply
+		}
+	}
+	return reply
+}
+
+// aofWriteErrReply 写入 aof 失败后拒绝写命令, 与 redis 相同
+func (server *MemgoServer) aofWriteErrReply() resp.ReplyIntf {
+	if server.persister == nil {
+		return nil
+	}
+	if err := server.persister.WriteError(); err != nil {
+		return protocol.MakeErrReply("MISCONF Errors writing to the AOF file: " + err.Error())
+	}
+	return nil
 }
 
 func (server *MemgoServer) Close() {
+	if server.closing != nil {
+		close(server.closing)
+	}
+	server.detachMaster()
+	server.disconnectReplicas()
+	server.snapshot.wg.Wait()
 	if server.persister != nil {
 		server.persister.Close()
 	}
 }
 
 func (server *MemgoServer) AfterClientClose(conn resp.ConnectionIntf) {
+	server.removeReplica(conn)
 }
 
 func (server *MemgoServer) ForEach(idx int, entity2reply func(key string, entity *database.DataEntity, expireAt *time.Time) bool) {
@@ -118,6 +250,22 @@ func (server *MemgoServer) ForEach(idx int, entity2reply func(key string, entity
 	server.dbSet[idx].ForEach(entity2reply)
 }
 
+func (server *MemgoServer) LoadEntity(idx int, key string, entity *database.DataEntity, expireAt *time.Time) error {
+	if idx >= len(server.dbSet) || idx < 0 {
+		return errors.New("db index out of range: " + strconv.Itoa(idx))
+	}
+	// 已过期的 key 不再加载
+	if expireAt != nil && expireAt.Before(time.Now()) {
+		return nil
+	}
+	dbObj := server.dbSet[idx]
+	dbObj.PutEntity(key, entity)
+	if expireAt != nil {
+		dbObj.Expire(key, *expireAt)
+	}
+	return nil
+}
+
 func (server *MemgoServer) ExecSelect(client resp.ConnectionIntf, cmdLine CmdLine) resp.ReplyIntf {
 	dbIndex, err := strconv.Atoi(string(cmdLine[0]))
 	if err != nil {
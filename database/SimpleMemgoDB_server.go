@@ -1,6 +1,7 @@
 package database
 
 import (
+	"errors"
 	"memgo/aof"
 	"memgo/config"
 	"memgo/interface/database"
@@ -25,6 +26,15 @@ func (server *SimpleMemgoDBServer) ForEach(idx int, entity2reply func(key string
 
 }
 
+// LoadEntity 不带过期时间的简单实现, 忽略 expireAt
+func (server *SimpleMemgoDBServer) LoadEntity(idx int, key string, entity *database.DataEntity, expireAt *time.Time) error {
+	if idx >= len(server.dbSet) || idx < 0 {
+		return errors.New("db index out of range: " + strconv.Itoa(idx))
+	}
+	server.dbSet[idx].PutEntity(key, entity)
+	return nil
+}
+
 func NewSimpleMemgoServer() (DbEngine *SimpleMemgoDBServer) {
 	DbEngine = &SimpleMemgoDBServer{}
 	if config.Properties.Databases == 0 {
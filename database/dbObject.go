@@ -16,10 +16,9 @@ import (
 	"memgo/interface/database"
 	lockerIntf "memgo/interface/locker"
 	"memgo/interface/resp"
-	"memgo/logger"
 	"memgo/redis/RESP/protocol"
-	"memgo/utils/timewheel"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -40,6 +39,10 @@ type DbObject struct {
 	// 将增删改操作追加到aof文件中
 	// NODE 初始化时必须不为nil, 否则loadAof时会error
 	addAof func(CmdLine)
+	// 写命令修改 key 之前调用, 生成快照时据此保存 key 的旧值; keys 为 nil 表示整个 DB
+	beforeWrite func(keys []string)
+	// 累计删除的过期 key 数
+	expiredKeys int64
 }
 
 // MakeDbObject 使用ConcurrentDict
@@ -56,11 +59,12 @@ type DbObject struct {
 // MakeDbObject 使用SyncDict
 func MakeDbObject() *DbObject {
 	return &DbObject{
-		index:  0,
-		data:   dict.MakeSyncDict(),
-		ttlMap: dict.MakeSyncDict(),
-		locker: locker.MakeSegMentedLocker(lockerSize),
-		addAof: func(CmdLine) {},
+		index:       0,
+		data:        dict.MakeSyncDict(),
+		ttlMap:      dict.MakeSampleDict(),
+		locker:      locker.MakeSegMentedLocker(lockerSize),
+		addAof:      func(CmdLine) {},
+		beforeWrite: func([]string) {},
 	}
 }
 
@@ -79,10 +83,14 @@ func (dbObj *DbObject) Exec(conn resp.ConnectionIntf, cmdLine CmdLine) resp.Repl
 	// TODO 事务命令
 
 	// 普通命令, 执行不需要连接Conn
-	return dbObj.execNormalCommand(cmdLine)
+	return dbObj.execNormalCommand(cmdLine, nil)
 }
 
-func (dbObj *DbObject) execNormalCommand(cmdLine CmdLine) resp.ReplyIntf {
+// KeysCheck 在持有命令涉及的 key 的锁之后, 执行命令之前调用; 返回非 nil 时不执行命令, 直接回复
+// exists 判断 key 是否存在, 检查与执行之间 key 不会被其他命令修改
+type KeysCheck func(exists func(key string) bool) resp.ReplyIntf
+
+func (dbObj *DbObject) execNormalCommand(cmdLine CmdLine, check KeysCheck) resp.ReplyIntf {
 	cmdName := strings.ToLower(string(cmdLine[0]))
 	cmd, ok := cmdTable[cmdName]
 	// 合法性检验
@@ -100,37 +108,31 @@ func (dbObj *DbObject) execNormalCommand(cmdLine CmdLine) resp.ReplyIntf {
 	dbObj.Locks(writeKeys, readKeys)
 	defer dbObj.UnLocks(writeKeys, readKeys)
 
+	if check != nil {
+		exists := func(key string) bool {
+			_, ok := dbObj.GetEntity(key)
+			return ok
+		}
+		if reply := check(exists); reply != nil {
+			return reply
+		}
+	}
+	if cmd.flags&flagWrite > 0 {
+		dbObj.beforeWrite(writeKeys)
+	}
 	return fun(dbObj, cmdLine[1:])
 }
 
 // ======= TTL Function ======= //
 
+// Expire 只在 ttlMap 中记录过期时间点; 过期 key 由 惰性删除(IsExpire) 与 定期删除(activeExpireCycle) 共同回收
 func (dbObj *DbObject) Expire(key string, expireTime time.Time) {
 	// 过期时间设置错误 直接过期
 	if time.Now().After(expireTime) {
 		dbObj.Remove(key)
 		return
 	}
-	// 过期时间设置正常, 加入 ttlMap中 记录过期时间点, 加入时间轮中
 	dbObj.ttlMap.Put(key, expireTime)
-	taskKey := genExpireTask(key)
-	timewheel.At(expireTime, taskKey, func() {
-		dbObj.Lock(key)
-		defer dbObj.UnLock(key)
-
-		// check-lock-check, ttl may be updated during waiting lock
-		logger.Info("expire " + key)
-		rawExpireTime, exists := dbObj.ttlMap.Get(key)
-		if !exists {
-			return
-		}
-		ExpireTime, _ := rawExpireTime.(time.Time)
-		IfExpired := time.Now().After(ExpireTime)
-		// 惰性删除
-		if IfExpired {
-			dbObj.Remove(key)
-		}
-	})
 }
 
 func (dbObj *DbObject) IsExpire(key string) bool {
@@ -143,12 +145,29 @@ func (dbObj *DbObject) IsExpire(key string) bool {
 	// 惰性删除
 	if IfExpired {
 		dbObj.Remove(key)
+		atomic.AddInt64(&dbObj.expiredKeys, 1)
 	}
 	return IfExpired
 }
 
-func genExpireTask(key string) string {
-	return "expire: " + key
+// Persist 移除 key 的过期时间, 若 key 原本设置了过期时间则返回 true
+func (dbObj *DbObject) Persist(key string) bool {
+	_, exists := dbObj.ttlMap.Get(key)
+	if !exists {
+		return false
+	}
+	dbObj.ttlMap.Remove(key)
+	return true
+}
+
+// GetExpireTime 返回 key 的过期时间点, 未设置过期时间时 ok 为 false
+func (dbObj *DbObject) GetExpireTime(key string) (expireAt time.Time, ok bool) {
+	raw, exists := dbObj.ttlMap.Get(key)
+	if !exists {
+		return time.Time{}, false
+	}
+	expireAt, _ = raw.(time.Time)
+	return expireAt, true
 }
 
 // ======= locker Function ======= //
@@ -204,8 +223,6 @@ func (dbObj *DbObject) Remove(key string) {
 	// TODO 看是否需要将以下两个操作原子
 	dbObj.data.Remove(key)
 	dbObj.ttlMap.Remove(key)
-	taskKey := genExpireTask(key)
-	timewheel.Cancel(taskKey)
 }
 
 func (dbObj *DbObject) Removes(keys ...string) int {
@@ -222,6 +239,7 @@ func (dbObj *DbObject) Removes(keys ...string) int {
 
 func (dbObj *DbObject) Flush() {
 	dbObj.data.Clear()
+	dbObj.ttlMap.Clear()
 }
 
 // ForEach DbObject层面的 ForEach实际上是根据 key value去ttlMap中 取出过期时间, 然后调用回调函数entity2reply
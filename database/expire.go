@@ -0,0 +1,110 @@
+// NODE 定期删除: 参考 redis 的 activeExpireCycle
+// 不再为每一个设置了 ttl 的 key 在时间轮中注册一个任务 (千万级 key 时 内存与协程开销过大)
+// 而是每个 tick 对每个 DB 的 ttlMap 进行随机采样, 删除采样到的过期 key;
+// 若采样中过期 key 的比例较高, 则继续采样, 直到超出本轮的 cpu 时间预算
+// 未被采样到的过期 key 由 GetEntity 中的惰性删除兜底
+
+package database
+
+import (
+	"memgo/config"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultHz = 10
+	// 每次采样的 key 个数
+	activeExpireCycleKeysPerLoop = 20
+	// 采样中过期 key 的比例超过该值 则继续对该 DB 采样
+	activeExpireCycleAcceptableStale = 10
+	// 每一轮定期删除 最多占用 tick 间隔的百分比
+	activeExpireCycleSlowTimePerc = 25
+)
+
+// expireStats 定期删除的统计信息, 通过 INFO stats 展示
+// 累计删除的过期 key 数记录在每个 DbObject 的 expiredKeys 中
+type expireStats struct {
+	stalePerc      int64 // 估算的 过期但未删除 key 的比例 (万分比)
+	cycleCpuMs     int64 // 定期删除累计耗时
+	timeCapReached int64 // 因超出时间预算而提前结束的轮数
+}
+
+// serverHz 返回生效的 hz 配置
+func serverHz() int {
+	if config.Properties.Hz <= 0 {
+		return defaultHz
+	}
+	return config.Properties.Hz
+}
+
+func (server *MemgoServer) startActiveExpire() {
+	hz := serverHz()
+	interval := time.Second / time.Duration(hz)
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				server.activeExpireCycle(interval * activeExpireCycleSlowTimePerc / 100)
+			case <-server.closing:
+				return
+			}
+		}
+	}()
+}
+
+// activeExpireCycle 在 budget 时间内 依次对每个 DB 进行采样删除
+func (server *MemgoServer) activeExpireCycle(budget time.Duration) {
+	start := time.Now()
+	deadline := start.Add(budget)
+	var sampled, expired int64
+	defer func() {
+		atomic.AddInt64(&server.expireStats.cycleCpuMs, time.Since(start).Milliseconds())
+		if sampled > 0 {
+			// 指数加权平均, 与 redis 的 stat_expired_stale_perc 一致
+			current := expired * 10000 / sampled
+			prev := atomic.LoadInt64(&server.expireStats.stalePerc)
+			atomic.StoreInt64(&server.expireStats.stalePerc, (current*5+prev*95)/100)
+		}
+	}()
+
+	for _, dbObj := range server.dbSet {
+		for {
+			if dbObj.ttlMap.Len() == 0 {
+				break
+			}
+			s, e := dbObj.expireSample(activeExpireCycleKeysPerLoop)
+			sampled += int64(s)
+			expired += int64(e)
+			if time.Now().After(deadline) {
+				atomic.AddInt64(&server.expireStats.timeCapReached, 1)
+				return
+			}
+			if s == 0 || e*100/s <= activeExpireCycleAcceptableStale {
+				break
+			}
+		}
+	}
+}
+
+// expireSample 从 ttlMap 中随机采样 count 个 key, 删除其中已过期的 key
+func (dbObj *DbObject) expireSample(count int) (sampled int, expired int) {
+	keys := dbObj.ttlMap.RandomDistinctKeys(count)
+	now := time.Now()
+	for _, key := range keys {
+		sampled++
+		expireAt, ok := dbObj.GetExpireTime(key)
+		if !ok || now.Before(expireAt) {
+			continue
+		}
+		// check-lock-check, ttl 可能在等待锁的过程中被更新
+		dbObj.Lock(key)
+		if dbObj.IsExpire(key) {
+			expired++
+		}
+		dbObj.UnLock(key)
+	}
+	return
+}
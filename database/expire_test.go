@@ -0,0 +1,37 @@
+package database
+
+import (
+	"memgo/interface/database"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// 过期 key 从不被访问时, 只能由定期删除回收; 采样必须是随机的, 不能总是采到同一批未过期的 key
+func TestActiveExpireReclaimsUntouchedKeys(t *testing.T) {
+	db := MakeDbObject()
+	server := &MemgoServer{dbSet: []*DbObject{db}}
+	const n = 2000
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		long, short := "long:"+strconv.Itoa(i), "short:"+strconv.Itoa(i)
+		db.PutEntity(long, &database.DataEntity{Data: []byte("v")})
+		db.Expire(long, now.Add(time.Hour))
+		db.PutEntity(short, &database.DataEntity{Data: []byte("v")})
+		db.Expire(short, now.Add(10*time.Millisecond))
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	for i := 0; i < 10000 && db.ttlMap.Len() > n; i++ {
+		server.activeExpireCycle(25 * time.Millisecond)
+	}
+	if db.ttlMap.Len() != n || db.data.Len() != n {
+		t.Fatalf("expect %d keys left, got data %d ttl %d", n, db.data.Len(), db.ttlMap.Len())
+	}
+	db.ttlMap.ForEach(func(key string, val interface{}) bool {
+		if key[:5] != "long:" {
+			t.Fatalf("unexpected key left: %s", key)
+		}
+		return true
+	})
+}
@@ -38,16 +38,23 @@ func (db *DbObject) getOrInitDict(key string) (dict.DictIntf, bool, resp.ReplyIn
 	return dictObj, inited, nil
 }
 
+// HSet key field value [field value ...]
 func execHSet(db database.DbObjectIntf, args CmdLine) resp.ReplyIntf {
+	if len(args)%2 != 1 {
+		return protocol.MakeArgNumErrReply("hset")
+	}
 	key := string(args[0])
-	field := string(args[1])
-	value := args[2]
 	dbObj := db.(*DbObject)
 	dictObj, _, errReply := dbObj.getOrInitDict(key)
 	if errReply != nil {
 		return errReply
 	}
-	result := dictObj.Put(field, value)
+	result := 0
+	for i := 1; i < len(args); i += 2 {
+		field := string(args[i])
+		value := args[i+1]
+		result += dictObj.Put(field, value)
+	}
 	dbObj.addAof(utils.ToCmdLine3("HSet", args...))
 	return protocol.MakeIntReply(int64(result))
 }
@@ -166,11 +173,11 @@ func execHStrlen(db database.DbObjectIntf, args CmdLine) resp.ReplyIntf {
 }
 
 func init() {
-	RegisterCommand("HSet", execHSet, writeFirstKey, 4)      // HSet key field value
-	RegisterCommand("HSetNX", execHSetNx, writeFirstKey, 4)  // HSetNx key field value
-	RegisterCommand("HExists", execHExists, readFirstKey, 3) // HExists key field
-	RegisterCommand("HGet", execHGet, readFirstKey, 3)       // HGet key field
-	RegisterCommand("HDel", execHDel, writeFirstKey, -3)     // HDel key field1 ...
-	RegisterCommand("HLen", execHLen, readFirstKey, 2)       // HLen key
-	RegisterCommand("HStrlen", execHStrlen, readFirstKey, 3) // HStrlen key field
+	RegisterCommand("HSet", execHSet, writeFirstKey, -4, flagWrite)    // HSet key field value [field value ...]
+	RegisterCommand("HSetNX", execHSetNx, writeFirstKey, 4, flagWrite) // HSetNx key field value
+	RegisterCommand("HExists", execHExists, readFirstKey, 3, flagRead) // HExists key field
+	RegisterCommand("HGet", execHGet, readFirstKey, 3, flagRead)       // HGet key field
+	RegisterCommand("HDel", execHDel, writeFirstKey, -3, flagWrite)    // HDel key field1 ...
+	RegisterCommand("HLen", execHLen, readFirstKey, 2, flagRead)       // HLen key
+	RegisterCommand("HStrlen", execHStrlen, readFirstKey, 3, flagRead) // HStrlen key field
 }
@@ -0,0 +1,140 @@
+package database
+
+import (
+	"fmt"
+	"memgo/config"
+	"memgo/interface/resp"
+	"memgo/redis/RESP/protocol"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// infoSection INFO 命令的一个分节, 按注册顺序输出
+type infoSection struct {
+	name string
+	gen  func(server *MemgoServer) string
+}
+
+var infoSections = []infoSection{
+	{"server", genServerInfo},
+	{"persistence", genPersistenceInfo},
+	{"stats", genStatsInfo},
+	{"replication", genReplicationInfo},
+	{"cluster", genClusterInfo},
+	{"keyspace", genKeyspaceInfo},
+}
+
+// execInfo INFO [section ...]
+func (server *MemgoServer) execInfo(args CmdLine) resp.ReplyIntf {
+	wanted := make(map[string]bool)
+	for _, arg := range args {
+		wanted[strings.ToLower(string(arg))] = true
+	}
+	all := len(wanted) == 0 || wanted["all"] || wanted["everything"] || wanted["default"]
+
+	var builder strings.Builder
+	for _, section := range infoSections {
+		if !all && !wanted[section.name] {
+			continue
+		}
+		if builder.Len() > 0 {
+			builder.WriteString("\r\n")
+		}
+		builder.WriteString("# " + strings.ToUpper(section.name[:1]) + section.name[1:] + "\r\n")
+		builder.WriteString(section.gen(server))
+	}
+	return protocol.MakeBulkReply([]byte(builder.String()))
+}
+
+func genClusterInfo(server *MemgoServer) string {
+	return fmt.Sprintf("cluster_enabled:%d\r\n", boolToInt(config.Properties.ClusterEnabled == "yes"))
+}
+
+func genServerInfo(server *MemgoServer) string {
+	startUp := config.EachTimeServerInfo.StartUpTime
+	return fmt.Sprintf("run_id:%s\r\ntcp_port:%d\r\nuptime_in_seconds:%d\r\nhz:%d\r\n",
+		config.Properties.RunID,
+		config.Properties.Port,
+		int64(time.Since(startUp)/time.Second),
+		serverHz())
+}
+
+func genPersistenceInfo(server *MemgoServer) string {
+	var builder strings.Builder
+	state := &server.snapshot
+	state.mu.Lock()
+	lastStatus := "ok"
+	if state.lastErr != nil {
+		lastStatus = "err"
+	}
+	builder.WriteString(fmt.Sprintf("rdb_changes_since_last_save:%d\r\nrdb_bgsave_in_progress:%d\r\nrdb_last_save_time:%d\r\n"+
+		"rdb_last_bgsave_status:%s\r\nrdb_last_bgsave_time_sec:%d\r\nrdb_last_compression_ratio:%.2f\r\n",
+		atomic.LoadInt64(&server.dirty),
+		boolToInt(state.inProgress),
+		state.lastSave.Unix(),
+		lastStatus,
+		int64(state.lastElapsed/time.Second),
+		state.compressionRatio))
+	state.mu.Unlock()
+
+	if server.persister == nil {
+		builder.WriteString("aof_enabled:0\r\n")
+		return builder.String()
+	}
+	info := server.persister.GetInfo()
+	builder.WriteString(fmt.Sprintf("aof_enabled:1\r\naof_rewrite_in_progress:%d\r\naof_rewrite_phase:%s\r\naof_rewrite_dumped_keys:%d\r\n"+
+		"aof_last_rewrite_time_sec:%d\r\naof_current_rewrite_time_sec:%d\r\naof_last_bgrewrite_status:%s\r\n"+
+		"aof_last_write_status:%s\r\naof_current_size:%d\r\naof_base_size:%d\r\n"+
+		"aof_fsync:%s\r\naof_fsync_count:%d\r\naof_fsync_latency_avg_us:%d\r\naof_fsync_latency_max_us:%d\r\n"+
+		"aof_fsync_latency_last_us:%d\r\naof_group_commit_avg_batch:%.2f\r\naof_base_compression_ratio:%.2f\r\n",
+		boolToInt(info.RewriteInProgress),
+		info.RewritePhase,
+		info.RewriteDumpedKeys,
+		info.LastRewriteTimeSec,
+		info.CurrentRewriteTimeSec,
+		info.LastBgRewriteStatus,
+		info.LastWriteStatus,
+		info.CurrentSize,
+		info.BaseSize,
+		info.Fsync,
+		info.FsyncCount,
+		info.FsyncLatencyAvg.Microseconds(),
+		info.FsyncLatencyMax.Microseconds(),
+		info.FsyncLatencyLast.Microseconds(),
+		info.GroupCommitAvgBatch,
+		info.BaseCompressionRatio))
+	return builder.String()
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func genStatsInfo(server *MemgoServer) string {
+	var expiredKeys int64
+	for _, dbObj := range server.dbSet {
+		expiredKeys += atomic.LoadInt64(&dbObj.expiredKeys)
+	}
+	stalePerc := atomic.LoadInt64(&server.expireStats.stalePerc)
+	return fmt.Sprintf("expired_keys:%d\r\nexpired_stale_perc:%.2f\r\nexpired_time_cap_reached_count:%d\r\nexpire_cycle_cpu_milliseconds:%d\r\n",
+		expiredKeys,
+		float64(stalePerc)/100,
+		atomic.LoadInt64(&server.expireStats.timeCapReached),
+		atomic.LoadInt64(&server.expireStats.cycleCpuMs))
+}
+
+func genKeyspaceInfo(server *MemgoServer) string {
+	var builder strings.Builder
+	for i, dbObj := range server.dbSet {
+		keys := dbObj.data.Len()
+		if keys == 0 {
+			continue
+		}
+		builder.WriteString(fmt.Sprintf("db%d:keys=%d,expires=%d\r\n", i, keys, dbObj.ttlMap.Len()))
+	}
+	return builder.String()
+}
@@ -1,12 +1,14 @@
 package database
 
 import (
+	"math"
 	"memgo/interface/database"
 	"memgo/interface/resp"
 	"memgo/redis/RESP/protocol"
 	"memgo/utils"
 	"memgo/utils/wildcard"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -111,71 +113,182 @@ func execKeys_DbObj(db database.DbObjectIntf, args CmdLine) resp.ReplyIntf {
 	return protocol.MakeMultiBulkReply(keys)
 }
 
-func execExpire(db database.DbObjectIntf, args CmdLine) resp.ReplyIntf {
+// expire 命令的可选参数 NX | XX | GT | LT
+const (
+	expireNX = 1 << iota // 仅当 key 没有过期时间时设置
+	expireXX             // 仅当 key 已有过期时间时设置
+	expireGT             // 仅当新的过期时间大于当前过期时间时设置
+	expireLT             // 仅当新的过期时间小于当前过期时间时设置
+)
+
+func parseExpireFlags(args CmdLine) (int, protocol.ErrorReply) {
+	flags := 0
+	for _, arg := range args {
+		switch strings.ToUpper(string(arg)) {
+		case "NX":
+			flags |= expireNX
+		case "XX":
+			flags |= expireXX
+		case "GT":
+			flags |= expireGT
+		case "LT":
+			flags |= expireLT
+		default:
+			return 0, protocol.MakeErrReply("ERR Unsupported option " + string(arg))
+		}
+	}
+	if flags&expireNX > 0 && flags&(expireXX|expireGT|expireLT) > 0 {
+		return 0, protocol.MakeErrReply("ERR NX and XX, GT or LT options at the same time are not compatible")
+	}
+	if flags&expireGT > 0 && flags&expireLT > 0 {
+		return 0, protocol.MakeErrReply("ERR GT and LT options at the same time are not compatible")
+	}
+	return flags, nil
+}
+
+// expireGeneric EXPIRE PEXPIRE EXPIREAT PEXPIREAT 的公共逻辑
+// 参数的单位为 unit, relative 为 true 时是相对当前的时间, 否则是 unix 时间戳
+func expireGeneric(db database.DbObjectIntf, name string, args CmdLine, unit time.Duration, relative bool) resp.ReplyIntf {
 	var dbObject = db.(*DbObject)
 	key := string(args[0])
-	ttlArg, err := strconv.ParseInt(string(args[1]), 10, 32)
+	raw, err := strconv.ParseInt(string(args[1]), 10, 64)
 	if err != nil {
-		return protocol.MakeIntReply(0)
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	// NODE 超出范围时拒绝, 而不是溢出得到一个错误的时间; 相对时间还需能用 time.Duration 表示, 与 raft 模式的 proposeExpire 相同
+	factor := int64(unit / time.Millisecond)
+	limit, baseMs := math.MaxInt64/factor, int64(0)
+	if relative {
+		limit, baseMs = math.MaxInt64/int64(unit), time.Now().UnixMilli()
+	}
+	if raw > limit || raw < -limit {
+		return protocol.MakeErrReply("ERR invalid expire time in '" + name + "' command")
+	}
+	flags, errReply := parseExpireFlags(args[2:])
+	if errReply != nil {
+		return errReply
 	}
 	_, exists := dbObject.GetEntity(key)
 	if !exists {
 		return protocol.MakeIntReply(0)
 	}
-	ttl := time.Duration(ttlArg) * time.Second
-	expireAt := time.Now().Add(ttl)
+
+	expireAt := time.UnixMilli(baseMs + raw*factor)
+	// 没有过期时间的 key 视为永不过期 (ttl 无穷大)
+	current, hasTTL := dbObject.GetExpireTime(key)
+	if flags&expireNX > 0 && hasTTL {
+		return protocol.MakeIntReply(0)
+	}
+	if flags&expireXX > 0 && !hasTTL {
+		return protocol.MakeIntReply(0)
+	}
+	if flags&expireGT > 0 && (!hasTTL || !expireAt.After(current)) {
+		return protocol.MakeIntReply(0)
+	}
+	if flags&expireLT > 0 && hasTTL && !expireAt.Before(current) {
+		return protocol.MakeIntReply(0)
+	}
+
 	dbObject.addAof(utils.MakeExpireCmd(key, expireAt).Args)
 	dbObject.Expire(key, expireAt)
 	return protocol.MakeIntReply(1)
 }
 
-// TODO addAof
+// EXPIRE key seconds [NX | XX | GT | LT]
+func execExpire(db database.DbObjectIntf, args CmdLine) resp.ReplyIntf {
+	return expireGeneric(db, "expire", args, time.Second, true)
+}
+
+// PEXPIRE key milliseconds [NX | XX | GT | LT]
+func execPExpire(db database.DbObjectIntf, args CmdLine) resp.ReplyIntf {
+	return expireGeneric(db, "pexpire", args, time.Millisecond, true)
+}
+
+// EXPIREAT key unix-time-seconds [NX | XX | GT | LT]
 func execExpireAt(db database.DbObjectIntf, args CmdLine) resp.ReplyIntf {
+	return expireGeneric(db, "expireat", args, time.Second, false)
+}
+
+// PEXPIREAT key unix-time-milliseconds [NX | XX | GT | LT]
+func execPExpireAt(db database.DbObjectIntf, args CmdLine) resp.ReplyIntf {
+	return expireGeneric(db, "pexpireat", args, time.Millisecond, false)
+}
+
+// ttlGeneric TTL PTTL EXPIRETIME PEXPIRETIME 的公共逻辑
+// key 不存在 返回-2; 没有设置过期时间 返回-1
+func ttlGeneric(db database.DbObjectIntf, args CmdLine, convert func(expireAt time.Time) int64) resp.ReplyIntf {
 	var dbObject = db.(*DbObject)
 	key := string(args[0])
-	rawTTL, err := strconv.ParseInt(string(args[1]), 10, 32)
-	if err != nil {
-		return protocol.MakeIntReply(0)
-	}
 	_, exists := dbObject.GetEntity(key)
 	if !exists {
-		return protocol.MakeIntReply(0)
+		return protocol.MakeIntReply(-2)
 	}
-
-	expireAt := time.Unix(rawTTL, 0)
-	dbObject.addAof(utils.MakeExpireCmd(key, expireAt).Args)
-	dbObject.Expire(key, expireAt)
-	return protocol.MakeIntReply(1)
+	expireAt, hasTTL := dbObject.GetExpireTime(key)
+	if !hasTTL {
+		return protocol.MakeIntReply(-1)
+	}
+	return protocol.MakeIntReply(convert(expireAt))
 }
 
+// TTL key 剩余秒数, 与 redis 一致进行四舍五入
 func execTTL(db database.DbObjectIntf, args CmdLine) resp.ReplyIntf {
+	return ttlGeneric(db, args, func(expireAt time.Time) int64 {
+		ttl := time.Until(expireAt)
+		return int64((ttl + 500*time.Millisecond) / time.Second)
+	})
+}
+
+// PTTL key 剩余毫秒数
+func execPTTL(db database.DbObjectIntf, args CmdLine) resp.ReplyIntf {
+	return ttlGeneric(db, args, func(expireAt time.Time) int64 {
+		return int64(time.Until(expireAt) / time.Millisecond)
+	})
+}
+
+// EXPIRETIME key 过期时间点的 unix 秒级时间戳
+func execExpireTime(db database.DbObjectIntf, args CmdLine) resp.ReplyIntf {
+	return ttlGeneric(db, args, func(expireAt time.Time) int64 {
+		return expireAt.Unix()
+	})
+}
+
+// PEXPIRETIME key 过期时间点的 unix 毫秒级时间戳
+func execPExpireTime(db database.DbObjectIntf, args CmdLine) resp.ReplyIntf {
+	return ttlGeneric(db, args, func(expireAt time.Time) int64 {
+		return expireAt.UnixMilli()
+	})
+}
+
+// PERSIST key 移除过期时间
+func execPersist(db database.DbObjectIntf, args CmdLine) resp.ReplyIntf {
 	var dbObject = db.(*DbObject)
 	key := string(args[0])
 	_, exists := dbObject.GetEntity(key)
-	// key不存在 返回-2
 	if !exists {
-		return protocol.MakeIntReply(-2)
+		return protocol.MakeIntReply(0)
 	}
-
-	raw, isExpire := dbObject.ttlMap.Get(key)
-	// 没有设置过期时间 返回-1
-	if !isExpire {
-		return protocol.MakeIntReply(-1)
+	if !dbObject.Persist(key) {
+		return protocol.MakeIntReply(0)
 	}
-	expireTime := raw.(time.Time)
-	ttl := expireTime.Sub(time.Now())
-	return protocol.MakeIntReply(int64(ttl / time.Second))
+	dbObject.addAof(utils.ToCmdLine3("PERSIST", args...))
+	return protocol.MakeIntReply(1)
 }
 
 func init() {
-	RegisterCommand("TTL", execTTL, readFirstKey, 2)                 // TTL k1
-	RegisterCommand("EXPIREAT", execExpireAt, writeFirstKey, 3)      // EXPIREAT k 1324687
-	RegisterCommand("EXPIRE", execExpire, writeFirstKey, 3)          // EXPIRE k 3
-	RegisterCommand("DEL", execDel_DbObj, writeAllKeys, -2)          // DEL k1 k2 k3 ...
-	RegisterCommand("EXISTS", execExists_DbObj, readAllKeys, -2)     // EXISTS k1 k2 k3 ...
-	RegisterCommand("FLUSHDB", execFlushDB_DbObj, noPrepare, 1)      // FLUSHDB
-	RegisterCommand("TYPE", execType_DbObj, readFirstKey, 2)         // TYPE key
-	RegisterCommand("RENAME", execRename_DbObj, writeAllKeys, 3)     // RENAME src dest
-	RegisterCommand("RENAMENX", execRenameNx_DbObj, writeAllKeys, 3) // RENAMENX src dest
-	RegisterCommand("KEYS", execKeys_DbObj, noPrepare, 2)            // KEYS pattern
+	RegisterCommand("TTL", execTTL, readFirstKey, 2, flagRead)                  // TTL k1
+	RegisterCommand("PTTL", execPTTL, readFirstKey, 2, flagRead)                // PTTL k1
+	RegisterCommand("EXPIRETIME", execExpireTime, readFirstKey, 2, flagRead)    // EXPIRETIME k1
+	RegisterCommand("PEXPIRETIME", execPExpireTime, readFirstKey, 2, flagRead)  // PEXPIRETIME k1
+	RegisterCommand("EXPIREAT", execExpireAt, writeFirstKey, -3, flagWrite)     // EXPIREAT k 1324687 [NX|XX|GT|LT]
+	RegisterCommand("PEXPIREAT", execPExpireAt, writeFirstKey, -3, flagWrite)   // PEXPIREAT k 1324687000 [NX|XX|GT|LT]
+	RegisterCommand("EXPIRE", execExpire, writeFirstKey, -3, flagWrite)         // EXPIRE k 3 [NX|XX|GT|LT]
+	RegisterCommand("PEXPIRE", execPExpire, writeFirstKey, -3, flagWrite)       // PEXPIRE k 3000 [NX|XX|GT|LT]
+	RegisterCommand("PERSIST", execPersist, writeFirstKey, 2, flagWrite)        // PERSIST k
+	RegisterCommand("DEL", execDel_DbObj, writeAllKeys, -2, flagWrite)          // DEL k1 k2 k3 ...
+	RegisterCommand("EXISTS", execExists_DbObj, readAllKeys, -2, flagRead)      // EXISTS k1 k2 k3 ...
+	RegisterCommand("FLUSHDB", execFlushDB_DbObj, noPrepare, 1, flagWrite)      // FLUSHDB
+	RegisterCommand("TYPE", execType_DbObj, readFirstKey, 2, flagRead)          // TYPE key
+	RegisterCommand("RENAME", execRename_DbObj, writeAllKeys, 3, flagWrite)     // RENAME src dest
+	RegisterCommand("RENAMENX", execRenameNx_DbObj, writeAllKeys, 3, flagWrite) // RENAMENX src dest
+	RegisterCommand("KEYS", execKeys_DbObj, noPrepare, 2, flagRead)             // KEYS pattern
 }
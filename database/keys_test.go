@@ -0,0 +1,80 @@
+package database
+
+import (
+	"memgo/utils"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpireCommands(t *testing.T) {
+	db := MakeDbObject()
+	// 固定的过期时间点, 使 EXPIRETIME 的结果确定
+	at := time.Now().Add(time.Hour).Unix()
+	later, earlier := strconv.FormatInt(at+100, 10), strconv.FormatInt(at-100, 10)
+	cases := []struct {
+		cmdLine string
+		want    string
+	}{
+		{"PTTL k", ":-2"},
+		{"EXPIRETIME k", ":-2"},
+		{"PEXPIRE k 1000", ":0"},
+		{"SET k v", "+OK"},
+		{"PTTL k", ":-1"},
+		{"EXPIRETIME k", ":-1"},
+		{"PERSIST k", ":0"},
+		// 没有过期时间: XX 与 GT 不设置, NX 与 LT 设置
+		{"EXPIREAT k " + later + " XX", ":0"},
+		{"EXPIREAT k " + later + " GT", ":0"},
+		{"EXPIREAT k " + strconv.FormatInt(at, 10) + " NX", ":1"},
+		{"EXPIRETIME k", ":" + strconv.FormatInt(at, 10)},
+		{"PEXPIRETIME k", ":" + strconv.FormatInt(at*1000, 10)},
+		{"EXPIREAT k " + later + " NX", ":0"},
+		{"EXPIREAT k " + later + " LT", ":0"},
+		{"EXPIREAT k " + earlier + " GT", ":0"},
+		{"EXPIREAT k " + later + " GT", ":1"},
+		{"EXPIRETIME k", ":" + later},
+		{"EXPIREAT k " + earlier + " LT", ":1"},
+		{"EXPIRETIME k", ":" + earlier},
+		{"EXPIREAT k " + later + " XX", ":1"},
+		{"EXPIRETIME k", ":" + later},
+		{"PERSIST k", ":1"},
+		{"PTTL k", ":-1"},
+		{"EXPIRE k 100 LT", ":1"},
+		{"PERSIST k", ":1"},
+		{"EXPIRE k 100 NX XX", "-ERR NX and XX, GT or LT options at the same time are not compatible"},
+		{"EXPIRE k 100 GT LT", "-ERR GT and LT options at the same time are not compatible"},
+		{"EXPIRE k 100 YY", "-ERR Unsupported option YY"},
+		{"EXPIRE k x", "-ERR value is not an integer or out of range"},
+		// 超出 time.Duration 或毫秒时间戳的范围
+		{"EXPIRE k 10000000000", "-ERR invalid expire time in 'expire' command"},
+		{"PEXPIRE k 9223372036854775807", "-ERR invalid expire time in 'pexpire' command"},
+		{"EXPIREAT k -9223372036854775808", "-ERR invalid expire time in 'expireat' command"},
+		{"PTTL k", ":-1"},
+		// 过期时间在过去时 key 立即过期
+		{"PEXPIRE k -1", ":1"},
+		{"PTTL k", ":-2"},
+	}
+	for _, c := range cases {
+		reply := db.Exec(nil, utils.ToCmdLine(strings.Fields(c.cmdLine)...))
+		if got := string(reply.ToBytes()); got != c.want+"\r\n" {
+			t.Fatalf("%s: expect %q, got %q", c.cmdLine, c.want, strings.TrimSuffix(got, "\r\n"))
+		}
+	}
+
+	db.Exec(nil, utils.ToCmdLine("SET", "k", "v"))
+	db.Exec(nil, utils.ToCmdLine("PEXPIRE", "k", "100000"))
+	reply := db.Exec(nil, utils.ToCmdLine("PTTL", "k"))
+	pttl, err := strconv.ParseInt(strings.TrimSpace(string(reply.ToBytes()[1:])), 10, 64)
+	if err != nil || pttl <= 99000 || pttl > 100000 {
+		t.Fatalf("PTTL after PEXPIRE 100000: %q", reply.ToBytes())
+	}
+	// 接近上限的过期时间仍然可以正确表示
+	if reply := db.Exec(nil, utils.ToCmdLine("EXPIRE", "k", "9000000000")); string(reply.ToBytes()) != ":1\r\n" {
+		t.Fatalf("EXPIRE k 9000000000: %q", reply.ToBytes())
+	}
+	if reply := db.Exec(nil, utils.ToCmdLine("TTL", "k")); string(reply.ToBytes()) != ":9000000000\r\n" {
+		t.Fatalf("TTL after EXPIRE 9000000000: %q", reply.ToBytes())
+	}
+}
@@ -0,0 +1,218 @@
+package database
+
+import (
+	"memgo/config"
+	"memgo/interface/database"
+	"memgo/interface/resp"
+	"memgo/rdb"
+	"memgo/redis/RESP/protocol"
+	"memgo/redis/client"
+	"memgo/utils"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultMigrateTimeout = time.Second
+
+// DUMP key
+func execDump(db database.DbObjectIntf, args CmdLine) resp.ReplyIntf {
+	entity, ok := db.GetEntity(string(args[0]))
+	if !ok {
+		return protocol.MakeNullBulkReply()
+	}
+	payload, err := rdb.DumpValue(entity)
+	if err != nil {
+		return protocol.MakeErrReply("ERR " + err.Error())
+	}
+	return protocol.MakeBulkReply(payload)
+}
+
+// RESTORE key ttl serialized-value [REPLACE] [ABSTTL]
+// ttl 为 0 表示不过期, ABSTTL 时 ttl 为 unix 毫秒时间戳
+func execRestore(db database.DbObjectIntf, args CmdLine) resp.ReplyIntf {
+	var dbObject = db.(*DbObject)
+	key := string(args[0])
+	ttl, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if ttl < 0 {
+		return protocol.MakeErrReply("ERR Invalid TTL value, must be >= 0")
+	}
+	replace, absTTL := false, false
+	for _, arg := range args[3:] {
+		switch strings.ToUpper(string(arg)) {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			absTTL = true
+		default:
+			return protocol.MakeSyntaxErrReply()
+		}
+	}
+	entity, err := rdb.RestoreValue(args[2])
+	if err != nil {
+		return protocol.MakeErrReply("ERR " + err.Error())
+	}
+	if _, exists := dbObject.GetEntity(key); exists && !replace {
+		return protocol.MakeErrReply("BUSYKEY Target key name already exists.")
+	}
+	var expireAt time.Time
+	if ttl > 0 {
+		if absTTL {
+			expireAt = time.UnixMilli(ttl)
+		} else {
+			expireAt = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+		}
+		// 已经过期的 key 不再写入
+		if expireAt.Before(time.Now()) {
+			if dbObject.Removes(key) > 0 {
+				dbObject.addAof(utils.ToCmdLine("DEL", key))
+			}
+			return protocol.MakeOkReply()
+		}
+	}
+	dbObject.PutEntity(key, entity)
+	dbObject.Persist(key)
+	// NODE aof 中记录为不过期的 RESTORE 加上 PEXPIREAT, 重放时不受相对时间影响
+	dbObject.addAof(utils.ToCmdLine3("RESTORE", args[0], []byte("0"), args[2], []byte("REPLACE")))
+	if ttl > 0 {
+		dbObject.Expire(key, expireAt)
+		dbObject.addAof(utils.MakeExpireCmd(key, expireAt).Args)
+	}
+	return protocol.MakeOkReply()
+}
+
+// migrateKeys MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE] [AUTH password] [KEYS key ...]
+func migrateKeys(args CmdLine) (keys []string, copyKeys bool, replace bool, password string, ok bool) {
+	if len(args[2]) > 0 {
+		keys = append(keys, string(args[2]))
+	}
+	for i := 5; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "COPY":
+			copyKeys = true
+		case "REPLACE":
+			replace = true
+		case "AUTH":
+			if i+1 >= len(args) {
+				return nil, false, false, "", false
+			}
+			password = string(args[i+1])
+			i++
+		case "KEYS":
+			if len(keys) > 0 {
+				return nil, false, false, "", false
+			}
+			for _, key := range args[i+1:] {
+				keys = append(keys, string(key))
+			}
+			i = len(args)
+		default:
+			return nil, false, false, "", false
+		}
+	}
+	return keys, copyKeys, replace, password, true
+}
+
+func prepareMigrate(args CmdLine) ([]string, []string) {
+	keys, _, _, _, _ := migrateKeys(args)
+	return keys, nil
+}
+
+// execMigrate 将 key 序列化后通过 RESTORE 写入目标实例, 成功后删除本地的 key
+// NODE 传输期间持有这些 key 的写锁, 对 key 的其他命令等待迁移完成, 因此每个 key 的迁移是原子的
+func execMigrate(db database.DbObjectIntf, args CmdLine) resp.ReplyIntf {
+	var dbObject = db.(*DbObject)
+	keys, copyKeys, replace, password, ok := migrateKeys(args)
+	if !ok {
+		return protocol.MakeSyntaxErrReply()
+	}
+	destDB, err1 := strconv.Atoi(string(args[3]))
+	timeoutMs, err2 := strconv.Atoi(string(args[4]))
+	if err1 != nil || err2 != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	timeout := time.Duration(timeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultMigrateTimeout
+	}
+
+	type migration struct {
+		key     string
+		payload []byte
+		ttl     int64
+	}
+	var migrations []migration
+	for _, key := range keys {
+		entity, ok := dbObject.GetEntity(key)
+		if !ok {
+			continue
+		}
+		payload, err := rdb.DumpValue(entity)
+		if err != nil {
+			return protocol.MakeErrReply("ERR " + err.Error())
+		}
+		var ttl int64
+		if expireAt, ok := dbObject.GetExpireTime(key); ok {
+			if ttl = time.Until(expireAt).Milliseconds(); ttl <= 0 {
+				ttl = 1
+			}
+		}
+		migrations = append(migrations, migration{key, payload, ttl})
+	}
+	if len(migrations) == 0 {
+		return protocol.MakeStatusReply("NOKEY")
+	}
+
+	addr := net.JoinHostPort(string(args[0]), string(args[1]))
+	c, err := client.Dial(addr, timeout)
+	if err != nil {
+		return protocol.MakeErrReply("IOERR error or timeout connecting to the client")
+	}
+	defer c.Close()
+	// 集群模式下目标节点正在导入该槽, RESTORE-ASKING 不会被重定向
+	restoreCmd := "RESTORE"
+	if config.Properties.ClusterEnabled == "yes" {
+		restoreCmd = "RESTORE-ASKING"
+	}
+	cmds := [][]string{{"SELECT", strconv.Itoa(destDB)}}
+	if password != "" {
+		cmds = append([][]string{{"AUTH", password}}, cmds...)
+	}
+	for _, m := range migrations {
+		cmd := []string{restoreCmd, m.key, strconv.FormatInt(m.ttl, 10), string(m.payload)}
+		if replace {
+			cmd = append(cmd, "REPLACE")
+		}
+		cmds = append(cmds, cmd)
+	}
+	for _, cmd := range cmds {
+		reply, err := c.Do(cmd...)
+		if err != nil {
+			return protocol.MakeErrReply("IOERR error or timeout reading to target instance")
+		}
+		if errReply, ok := reply.(*protocol.StandardErrorReply); ok {
+			return protocol.MakeErrReply("ERR Target instance replied with error: " + errReply.Status)
+		}
+	}
+
+	if !copyKeys {
+		migrated := make([]string, len(migrations))
+		for i, m := range migrations {
+			migrated[i] = m.key
+		}
+		dbObject.Removes(migrated...)
+		dbObject.addAof(utils.ToCmdLine2("DEL", migrated...))
+	}
+	return protocol.MakeOkReply()
+}
+
+func init() {
+	RegisterCommand("DUMP", execDump, readFirstKey, 2, flagRead)                 // DUMP key
+	RegisterCommand("RESTORE", execRestore, writeFirstKey, -4, flagWrite)        // RESTORE key ttl value [REPLACE] [ABSTTL]
+	RegisterCommand("RESTORE-ASKING", execRestore, writeFirstKey, -4, flagWrite) // 集群迁移槽时 MIGRATE 使用
+	RegisterCommand("MIGRATE", execMigrate, prepareMigrate, -6, flagWrite)       // MIGRATE host port key|"" db timeout [COPY] [REPLACE] [AUTH pw] [KEYS k ...]
+}
@@ -11,5 +11,5 @@ func Ping(db database.DbObjectIntf, args CmdLine) resp.ReplyIntf {
 }
 
 func init() {
-	RegisterCommand("ping", Ping, noPrepare, 1)
+	RegisterCommand("ping", Ping, noPrepare, 1, flagSpec)
 }
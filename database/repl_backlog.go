@@ -0,0 +1,60 @@
+package database
+
+import "memgo/config"
+
+const defaultReplBacklogSize = 1 << 20
+
+// replBacklog 复制积压缓冲, 保存复制流最近的 size 个字节
+// 从节点断线重连后, 若它的偏移量之后的数据仍在积压缓冲中, 只需补发这部分数据(部分同步), 不需要重新全量同步
+type replBacklog struct {
+	buf     []byte
+	idx     int   // 下一个字节写入的位置
+	histLen int   // 缓冲中的有效字节数
+	offset  int64 // 最后一个字节在复制流中的偏移量, 与 master_repl_offset 相同
+}
+
+func newReplBacklog(offset int64) *replBacklog {
+	size := config.Properties.ReplBacklogSize
+	if size <= 0 {
+		size = defaultReplBacklogSize
+	}
+	return &replBacklog{
+		buf:    make([]byte, size),
+		offset: offset,
+	}
+}
+
+func (backlog *replBacklog) write(data []byte) {
+	backlog.offset += int64(len(data))
+	size := len(backlog.buf)
+	// 超过缓冲大小时 只有最后 size 个字节有效
+	if len(data) > size {
+		data = data[len(data)-size:]
+	}
+	n := copy(backlog.buf[backlog.idx:], data)
+	copy(backlog.buf, data[n:])
+	backlog.idx = (backlog.idx + len(data)) % size
+	backlog.histLen += len(data)
+	if backlog.histLen > size {
+		backlog.histLen = size
+	}
+}
+
+// firstByteOffset 缓冲中第一个字节的偏移量, 偏移量从 1 开始计数
+func (backlog *replBacklog) firstByteOffset() int64 {
+	return backlog.offset - int64(backlog.histLen) + 1
+}
+
+// readFrom 返回从 psyncOffset(含) 开始直到最新的数据, 数据已不在缓冲中时返回 false
+func (backlog *replBacklog) readFrom(psyncOffset int64) ([]byte, bool) {
+	if psyncOffset < backlog.firstByteOffset() || psyncOffset > backlog.offset+1 {
+		return nil, false
+	}
+	n := int(backlog.offset + 1 - psyncOffset)
+	size := len(backlog.buf)
+	start := (backlog.idx - n + size) % size
+	data := make([]byte, n)
+	copied := copy(data, backlog.buf[start:])
+	copy(data[copied:], backlog.buf)
+	return data, true
+}
@@ -0,0 +1,42 @@
+package database
+
+import (
+	"bytes"
+	"memgo/config"
+	"testing"
+)
+
+func TestReplBacklog(t *testing.T) {
+	config.Properties = &config.ServerProperties{ReplBacklogSize: 8}
+	backlog := newReplBacklog(100)
+	if data, ok := backlog.readFrom(101); !ok || len(data) != 0 {
+		t.Fatalf("empty backlog should accept the next offset")
+	}
+	backlog.write([]byte("abcde"))
+	backlog.write([]byte("fghij"))
+	// 缓冲只保留最后 8 个字节 "cdefghij", 偏移量 103 ~ 110
+	if backlog.firstByteOffset() != 103 || backlog.offset != 110 {
+		t.Fatalf("unexpected range %d ~ %d", backlog.firstByteOffset(), backlog.offset)
+	}
+	cases := []struct {
+		offset int64
+		data   string
+		ok     bool
+	}{
+		{102, "", false},
+		{103, "cdefghij", true},
+		{108, "hij", true},
+		{111, "", true},
+		{112, "", false},
+	}
+	for _, c := range cases {
+		data, ok := backlog.readFrom(c.offset)
+		if ok != c.ok || !bytes.Equal(data, []byte(c.data)) {
+			t.Errorf("readFrom(%d) = %q, %v; want %q, %v", c.offset, data, ok, c.data, c.ok)
+		}
+	}
+	backlog.write([]byte("0123456789xy"))
+	if data, _ := backlog.readFrom(backlog.firstByteOffset()); string(data) != "456789xy" {
+		t.Errorf("oversized write kept %q", data)
+	}
+}
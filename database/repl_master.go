@@ -0,0 +1,469 @@
+package database
+
+import (
+	"bufio"
+	"errors"
+	"memgo/interface/resp"
+	"memgo/logger"
+	"memgo/rdb"
+	"memgo/redis/RESP/connection"
+	"memgo/redis/RESP/protocol"
+	"memgo/utils"
+	randstring "memgo/utils/rand_string"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errReplicaClosed = errors.New("connection with replica closed")
+
+// 从节点的发送缓冲超过该大小时断开连接, 防止从节点过慢时主节点内存无限增长
+const replicaOutputBufferLimit = 256 << 20
+
+// WAIT 检查从节点 ACK 的间隔
+const waitPollInterval = 10 * time.Millisecond
+
+const (
+	// 全量同步时发送缓冲中的快照超过该大小, 后台协程暂停编码, 等待从节点读取
+	replSnapshotChunk = 4 << 20
+	// 流式发送快照时 快照长度未知, 以 $EOF:<mark> 开始, 以 mark 结束, 与 redis 的无盘复制相同
+	replEOFMarkLen = 40
+)
+
+// replicaClient 主节点上的一个从节点连接
+// 复制流先追加到 pending, 由独立的 goroutine 发送, 写命令不会因为从节点的网络而阻塞
+// 全量同步时快照边生成边追加到 pending, 期间的复制流暂存在 deferred, 快照结束后再发送
+type replicaClient struct {
+	conn          resp.ConnectionIntf
+	ip            string
+	listeningPort int
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	pending  []byte
+	deferred []byte
+	online   bool // 已发送 PSYNC, 开始接收复制流
+	syncing  bool // 正在发送全量同步的快照
+	closed   bool
+
+	ackOffset int64 // 原子操作, 从节点上报的已处理的偏移量
+	ackTime   int64 // 原子操作, 最近一次 ACK 的时间 unix 纳秒
+}
+
+func newReplicaClient(conn resp.ConnectionIntf) *replicaClient {
+	replica := &replicaClient{conn: conn}
+	replica.cond = sync.NewCond(&replica.mu)
+	if c, ok := conn.(interface{ RemoteAddr() net.Addr }); ok {
+		if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+			replica.ip = addr.IP.String()
+		}
+	}
+	return replica
+}
+
+func (replica *replicaClient) addr() string {
+	return replica.ip + ":" + strconv.Itoa(replica.listeningPort)
+}
+
+func (replica *replicaClient) isOnline() bool {
+	replica.mu.Lock()
+	defer replica.mu.Unlock()
+	return replica.online && !replica.closed
+}
+
+func (replica *replicaClient) isSyncing() bool {
+	replica.mu.Lock()
+	defer replica.mu.Unlock()
+	return replica.syncing
+}
+
+func (replica *replicaClient) ackedOffset() int64 {
+	return atomic.LoadInt64(&replica.ackOffset)
+}
+
+func (replica *replicaClient) lag() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&replica.ackTime)))
+}
+
+func (replica *replicaClient) ack(offset int64) {
+	atomic.StoreInt64(&replica.ackOffset, offset)
+	atomic.StoreInt64(&replica.ackTime, time.Now().UnixNano())
+}
+
+// send 追加到发送缓冲, 超过上限时断开连接
+func (replica *replicaClient) send(data []byte) {
+	replica.mu.Lock()
+	if replica.closed {
+		replica.mu.Unlock()
+		return
+	}
+	if !replica.reserve(len(data)) {
+		return
+	}
+	if replica.syncing {
+		replica.deferred = append(replica.deferred, data...)
+	} else {
+		replica.pending = append(replica.pending, data...)
+	}
+	replica.mu.Unlock()
+	replica.cond.Broadcast()
+}
+
+// reserve 检查发送缓冲能否再容纳 size 个字节, 调用方需持有 mu; 超过上限时释放 mu 并断开连接
+func (replica *replicaClient) reserve(size int) bool {
+	if len(replica.pending)+len(replica.deferred)+size <= replicaOutputBufferLimit {
+		return true
+	}
+	replica.mu.Unlock()
+	logger.Warn("replica " + replica.addr() + " output buffer overcome the limit, disconnecting")
+	go replica.close()
+	return false
+}
+
+// Write 追加全量同步的快照, 实现 io.Writer 供快照编码器使用
+func (replica *replicaClient) Write(p []byte) (int, error) {
+	replica.mu.Lock()
+	if replica.closed {
+		replica.mu.Unlock()
+		return 0, errReplicaClosed
+	}
+	if !replica.reserve(len(p)) {
+		return 0, errReplicaClosed
+	}
+	replica.pending = append(replica.pending, p...)
+	replica.mu.Unlock()
+	replica.cond.Broadcast()
+	return len(p), nil
+}
+
+// waitDrained 发送缓冲中的快照较多时等待从节点读取, 防止从节点过慢时快照全部堆积在内存中
+func (replica *replicaClient) waitDrained() {
+	replica.mu.Lock()
+	defer replica.mu.Unlock()
+	for len(replica.pending) > replSnapshotChunk && !replica.closed {
+		replica.cond.Wait()
+	}
+}
+
+// start 开始接收复制流, 首先发送的是 data(部分同步的回复与积压的数据)
+func (replica *replicaClient) start(data []byte) {
+	replica.mu.Lock()
+	replica.online = true
+	replica.pending = append(replica.pending, data...)
+	replica.mu.Unlock()
+	replica.ack(0)
+	go replica.sendLoop()
+}
+
+// startSync 开始全量同步, 首先发送 header, 随后是通过 Write 追加的快照
+func (replica *replicaClient) startSync(header []byte) {
+	replica.mu.Lock()
+	replica.syncing = true
+	replica.mu.Unlock()
+	replica.start(header)
+}
+
+// finishSync 快照发送完毕, trailer 之后开始发送暂存的复制流
+func (replica *replicaClient) finishSync(trailer []byte) {
+	replica.mu.Lock()
+	replica.pending = append(replica.pending, trailer...)
+	replica.pending = append(replica.pending, replica.deferred...)
+	replica.deferred = nil
+	replica.syncing = false
+	replica.mu.Unlock()
+	replica.cond.Broadcast()
+}
+
+func (replica *replicaClient) sendLoop() {
+	for {
+		replica.mu.Lock()
+		for len(replica.pending) == 0 && !replica.closed {
+			replica.cond.Wait()
+		}
+		if replica.closed {
+			replica.mu.Unlock()
+			return
+		}
+		data := replica.pending
+		replica.pending = nil
+		syncing := replica.syncing
+		replica.mu.Unlock()
+		// 唤醒等待缓冲变小的快照协程
+		replica.cond.Broadcast()
+		if _, err := replica.conn.Write(data); err != nil {
+			logger.Warn("write to replica " + replica.addr() + " failed: " + err.Error())
+			replica.close()
+			return
+		}
+		// NODE 从节点加载完快照之前不会 ACK, 发送快照期间以发送的进度作为存活的依据
+		if syncing {
+			atomic.StoreInt64(&replica.ackTime, time.Now().UnixNano())
+		}
+	}
+}
+
+// close 断开与从节点的连接, 连接关闭后 handler 会调用 AfterClientClose 将其移除
+func (replica *replicaClient) close() {
+	replica.mu.Lock()
+	if replica.closed {
+		replica.mu.Unlock()
+		return
+	}
+	replica.closed = true
+	replica.pending = nil
+	replica.mu.Unlock()
+	replica.cond.Broadcast()
+	// NODE Connection.Close 会等待正在进行的写入完成, 直接关闭底层连接使阻塞的写入立即返回
+	if c, ok := replica.conn.(*connection.Connection); ok && c.Conn != nil {
+		_ = c.Conn.Close()
+		return
+	}
+	_ = replica.conn.Close()
+}
+
+// replicaOf 返回连接对应的从节点, 不存在时创建
+func (server *MemgoServer) replicaOf(client resp.ConnectionIntf) *replicaClient {
+	repl := &server.repl
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	replica, ok := repl.replicas[client]
+	if !ok {
+		replica = newReplicaClient(client)
+		repl.replicas[client] = replica
+	}
+	return replica
+}
+
+func (server *MemgoServer) removeReplica(client resp.ConnectionIntf) {
+	repl := &server.repl
+	repl.mu.Lock()
+	replica, ok := repl.replicas[client]
+	delete(repl.replicas, client)
+	repl.mu.Unlock()
+	if ok {
+		replica.close()
+		if replica.listeningPort > 0 {
+			logger.Info("connection with replica " + replica.addr() + " lost")
+		}
+	}
+}
+
+// REPLCONF option value [option value ...]
+func (server *MemgoServer) execReplConf(client resp.ConnectionIntf, args CmdLine) resp.ReplyIntf {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return protocol.MakeSyntaxErrReply()
+	}
+	replica := server.replicaOf(client)
+	for i := 0; i < len(args); i += 2 {
+		option, value := strings.ToLower(string(args[i])), string(args[i+1])
+		switch option {
+		case "listening-port":
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				return protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			replica.listeningPort = port
+		case "ip-address":
+			replica.ip = value
+		case "capa":
+		case "ack":
+			// NODE ACK 不回复
+			offset, err := strconv.ParseInt(value, 10, 64)
+			if err == nil {
+				replica.ack(offset)
+			}
+			return &protocol.NoReply{}
+		default:
+			return protocol.MakeErrReply("ERR Unrecognized REPLCONF option: " + option)
+		}
+	}
+	return protocol.MakeOkReply()
+}
+
+// PSYNC replid offset / SYNC
+// 复制 ID 相同且 offset 之后的数据仍在积压缓冲中时部分同步, 回复 +CONTINUE replid 后补发缺少的数据
+// 否则全量同步: 快照由 snapshotWriter 写时复制生成并边生成边发送, 不暂停命令, 也不在内存中缓存整个快照
+// 快照之后的写命令暂存在该从节点的发送缓冲中, 快照发送完毕后再发送
+func (server *MemgoServer) execPSync(client resp.ConnectionIntf, cmdLine CmdLine) resp.ReplyIntf {
+	isPSync := strings.ToLower(string(cmdLine[0])) == "psync"
+	if isPSync && len(cmdLine) != 3 {
+		return protocol.MakeArgNumErrReply("psync")
+	}
+	replica := server.replicaOf(client)
+	if replica.isOnline() {
+		return protocol.MakeErrReply("ERR replica already in sync")
+	}
+	// NODE 从节点自己还没有完成同步时没有可用的数据
+	link := server.currentMasterLink()
+	if link != nil {
+		if link.getState() != replStateConnected {
+			return protocol.MakeErrReply("NOMASTERLINK Can't SYNC while not connected with my master")
+		}
+		// 防止快照与转发的复制流之间有命令被遗漏或重复, 见 streamFromMaster
+		link.applyMu.Lock()
+		defer link.applyMu.Unlock()
+	}
+
+	if isPSync {
+		if reply, ok := server.tryPartialSync(replica, string(cmdLine[1]), string(cmdLine[2])); ok {
+			return reply
+		}
+	}
+
+	// 持有写锁时开始快照, 快照对应的正是此刻的复制偏移量
+	server.snapshotLock.Lock()
+	repl := &server.repl
+	repl.mu.Lock()
+	if repl.backlog == nil {
+		repl.backlog = newReplBacklog(repl.offset)
+	}
+	var header string
+	if isPSync {
+		header = "+FULLRESYNC " + repl.replID + " " + strconv.FormatInt(repl.offset, 10)
+		// NODE 从节点转发的是主节点的复制流, 无法插入 SELECT, 需要告知下级快照之后复制流所在的 db
+		if repl.master != nil {
+			header += " " + strconv.Itoa(repl.streamDB)
+		}
+		header += protocol.CRLF
+	}
+	if repl.master == nil {
+		// 新的从节点从快照开始, 下一条命令前需要 SELECT
+		repl.streamDB = -1
+	}
+	mark := randstring.RandString(replEOFMarkLen)
+	replica.startSync([]byte(header + "$EOF:" + mark + protocol.CRLF))
+	repl.syncFull++
+	repl.mu.Unlock()
+
+	buf := bufio.NewWriterSize(replica, replSnapshotChunk)
+	enc := rdb.NewEncoder(buf)
+	_ = enc.WriteHeader()
+	writer := newSnapshotWriter(enc, len(server.dbSet))
+	writer.pace = replica.waitDrained
+	server.addSnapshotWriter(writer)
+	server.snapshotLock.Unlock()
+
+	logger.Info("full resync requested by replica " + replica.addr() + ", streaming snapshot")
+	go func() {
+		err := writer.run(server.dbSet)
+		server.removeSnapshotWriter(writer)
+		if err == nil {
+			err = buf.Flush()
+		}
+		if err != nil {
+			logger.Warn("send snapshot to replica " + replica.addr() + " failed: " + err.Error())
+			replica.close()
+			return
+		}
+		replica.finishSync([]byte(mark))
+		logger.Info("snapshot sent to replica " + replica.addr())
+	}()
+	return &protocol.NoReply{}
+}
+
+// tryPartialSync 尝试部分同步, 失败时返回 false, 需要全量同步
+func (server *MemgoServer) tryPartialSync(replica *replicaClient, replID string, rawOffset string) (resp.ReplyIntf, bool) {
+	repl := &server.repl
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	if replID == "?" {
+		return nil, false
+	}
+	psyncOffset, err := strconv.ParseInt(rawOffset, 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	if replID != repl.replID && (replID != repl.replID2 || psyncOffset > repl.secondOffset) {
+		repl.syncPartialErr++
+		logger.Info("partial resync from replica " + replica.addr() + " rejected: replication ID mismatch")
+		return nil, false
+	}
+	if repl.backlog == nil {
+		repl.syncPartialErr++
+		return nil, false
+	}
+	data, ok := repl.backlog.readFrom(psyncOffset)
+	if !ok {
+		repl.syncPartialErr++
+		logger.Info("partial resync from replica " + replica.addr() + " rejected: offset " + rawOffset + " out of backlog")
+		return nil, false
+	}
+	replica.start(append([]byte("+CONTINUE "+repl.replID+protocol.CRLF), data...))
+	repl.syncPartialOK++
+	logger.Info("partial resync accepted from replica " + replica.addr() + ", sending " + strconv.Itoa(len(data)) + " bytes of backlog")
+	return &protocol.NoReply{}, true
+}
+
+// WAIT numreplicas timeout
+// 阻塞当前客户端, 直到至少 numreplicas 个从节点确认收到了此前的所有写命令, 或超时(毫秒, 0 表示一直等待)
+// 返回确认的从节点数量
+func (server *MemgoServer) execWait(args CmdLine) resp.ReplyIntf {
+	if len(args) != 2 {
+		return protocol.MakeArgNumErrReply("wait")
+	}
+	numReplicas, err := strconv.Atoi(string(args[0]))
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	timeoutMs, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil || timeoutMs < 0 {
+		return protocol.MakeErrReply("ERR timeout is not an integer or out of range")
+	}
+	repl := &server.repl
+	repl.mu.Lock()
+	if repl.master != nil {
+		repl.mu.Unlock()
+		return protocol.MakeErrReply("ERR WAIT cannot be used with replica instances.")
+	}
+	// NODE 以当前的复制偏移量为目标, 包含了此前所有客户端的写命令
+	target := repl.offset
+	acked := repl.countAcked(target)
+	if acked < numReplicas && repl.backlog != nil {
+		// 要求从节点立即上报, 不必等待每秒一次的 ACK
+		repl.appendStream(protocol.MakeMultiBulkReply(utils.ToCmdLine("REPLCONF", "GETACK", "*")).ToBytes())
+	}
+	repl.mu.Unlock()
+	if acked >= numReplicas {
+		return protocol.MakeIntReply(int64(acked))
+	}
+
+	var deadline <-chan time.Time
+	if timeoutMs > 0 {
+		timer := time.NewTimer(time.Duration(timeoutMs) * time.Millisecond)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	ticker := time.NewTicker(waitPollInterval)
+	defer ticker.Stop()
+	for acked < numReplicas {
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return protocol.MakeIntReply(int64(server.ackedReplicas(target)))
+		case <-server.closing:
+			return protocol.MakeIntReply(int64(acked))
+		}
+		acked = server.ackedReplicas(target)
+	}
+	return protocol.MakeIntReply(int64(acked))
+}
+
+func (server *MemgoServer) ackedReplicas(offset int64) int {
+	server.repl.mu.Lock()
+	defer server.repl.mu.Unlock()
+	return server.repl.countAcked(offset)
+}
+
+// countAcked 已确认收到 offset 之前所有数据的从节点数量, 调用方需持有 mu
+func (repl *replicationState) countAcked(offset int64) int {
+	count := 0
+	for _, replica := range repl.replicas {
+		if replica.isOnline() && replica.ackedOffset() >= offset {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,496 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"memgo/config"
+	"memgo/logger"
+	"memgo/rdb"
+	"memgo/redis/RESP/connection"
+	"memgo/redis/RESP/parser"
+	"memgo/redis/RESP/protocol"
+	"memgo/utils"
+	randstring "memgo/utils/rand_string"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 从节点与主节点连接的状态, 与 redis ROLE 命令的输出一致
+const (
+	replStateConnect    = "connect"    // 等待重连
+	replStateConnecting = "connecting" // 握手中
+	replStateSync       = "sync"       // 接收快照中
+	replStateConnected  = "connected"  // 接收复制流中
+)
+
+var errReplicationStopped = errors.New("replication stopped")
+
+// masterClient 执行复制流中的命令时使用的连接, 不会向主节点回复
+// 从节点通过它识别来自主节点的命令, 不受只读限制
+type masterClient struct {
+	connection.Connection
+}
+
+func (c *masterClient) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// masterLink 从节点与主节点之间的连接, 断开后每秒重连一次, 直到 REPLICAOF NO ONE
+type masterLink struct {
+	host string
+	port int
+
+	mu      sync.Mutex
+	state   string
+	conn    net.Conn
+	stopped bool
+
+	// 执行复制流使用的连接, 重连后继续使用, 部分同步时保持之前选中的 db
+	client  *masterClient
+	lastIO  int64 // 原子操作, 最近一次收到主节点数据的时间 unix 秒
+	writeMu sync.Mutex
+	// 执行并转发一条命令期间持有, 为下级生成快照时持有, 保证快照与转发的复制流首尾衔接
+	applyMu sync.Mutex
+	stopCh  chan struct{}
+	done    chan struct{}
+}
+
+func (link *masterLink) addr() string {
+	return net.JoinHostPort(link.host, strconv.Itoa(link.port))
+}
+
+func (link *masterLink) getState() string {
+	link.mu.Lock()
+	defer link.mu.Unlock()
+	return link.state
+}
+
+func (link *masterLink) setState(state string) {
+	link.mu.Lock()
+	link.state = state
+	link.mu.Unlock()
+}
+
+func (link *masterLink) lastIOSecondsAgo() int64 {
+	last := atomic.LoadInt64(&link.lastIO)
+	if last == 0 {
+		return -1
+	}
+	return time.Now().Unix() - last
+}
+
+// setConn 记录当前连接以便 stop 时关闭, 已停止时返回 false
+func (link *masterLink) setConn(conn net.Conn) bool {
+	link.mu.Lock()
+	defer link.mu.Unlock()
+	if link.stopped {
+		return false
+	}
+	link.conn = conn
+	return true
+}
+
+// stop 关闭连接并等待复制 goroutine 退出
+func (link *masterLink) stop() {
+	link.mu.Lock()
+	link.stopped = true
+	if link.conn != nil {
+		_ = link.conn.Close()
+	}
+	link.mu.Unlock()
+	close(link.stopCh)
+	<-link.done
+}
+
+// write 复制流的处理与定时 ACK 在不同的 goroutine 中向主节点写入
+func (link *masterLink) write(conn net.Conn, args ...string) error {
+	link.writeMu.Lock()
+	defer link.writeMu.Unlock()
+	_ = conn.SetWriteDeadline(time.Now().Add(replTimeout()))
+	_, err := conn.Write(protocol.MakeMultiBulkReply(utils.ToCmdLine(args...)).ToBytes())
+	return err
+}
+
+func (server *MemgoServer) currentMasterLink() *masterLink {
+	server.repl.mu.Lock()
+	defer server.repl.mu.Unlock()
+	return server.repl.master
+}
+
+func (server *MemgoServer) startReplication(host string, port int) {
+	link := &masterLink{
+		host:   host,
+		port:   port,
+		state:  replStateConnect,
+		client: &masterClient{},
+		stopCh: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	server.repl.mu.Lock()
+	if server.repl.streamDB > 0 {
+		link.client.SelectDB(server.repl.streamDB)
+	}
+	server.repl.master = link
+	atomic.StoreInt32(&server.repl.isReplica, 1)
+	server.repl.mu.Unlock()
+	// NODE 成为从节点后数据可能被主节点的数据替换, 断开自己的从节点让它们重新同步
+	server.disconnectReplicas()
+	logger.Info("connecting to MASTER " + link.addr())
+	go server.runReplication(link)
+}
+
+// detachMaster 断开与主节点的连接, 不是从节点时返回 nil
+func (server *MemgoServer) detachMaster() *masterLink {
+	server.repl.mu.Lock()
+	link := server.repl.master
+	server.repl.master = nil
+	atomic.StoreInt32(&server.repl.isReplica, 0)
+	server.repl.mu.Unlock()
+	if link != nil {
+		link.stop()
+	}
+	return link
+}
+
+// stopReplication 断开与主节点的连接并晋升为主节点, 原本就是主节点时返回 false
+// NODE 已同步的数据保留; 生成新的复制 ID, 旧的 ID 保留为 replid2, 原来同一主节点的从节点可以部分同步到本节点
+func (server *MemgoServer) stopReplication() bool {
+	if server.detachMaster() == nil {
+		return false
+	}
+	repl := &server.repl
+	repl.mu.Lock()
+	repl.replID2 = repl.replID
+	repl.secondOffset = repl.offset + 1
+	repl.replID = randstring.RandString(40)
+	if repl.backlog == nil {
+		repl.backlog = newReplBacklog(repl.offset)
+	}
+	repl.mu.Unlock()
+	// 下级重连后通过 replid2 部分同步, 并得知新的复制 ID
+	server.disconnectReplicas()
+	return true
+}
+
+func (server *MemgoServer) runReplication(link *masterLink) {
+	defer close(link.done)
+	for {
+		err := server.syncWithMaster(link)
+		select {
+		case <-link.stopCh:
+			return
+		default:
+		}
+		logger.Warn("replication with MASTER " + link.addr() + " broken: " + err.Error())
+		link.setState(replStateConnect)
+		select {
+		case <-link.stopCh:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// syncWithMaster 握手, 部分或全量同步, 然后执行复制流直到连接断开
+func (server *MemgoServer) syncWithMaster(link *masterLink) error {
+	link.setState(replStateConnecting)
+	conn, err := net.DialTimeout("tcp", link.addr(), replTimeout())
+	if err != nil {
+		return err
+	}
+	if !link.setConn(conn) {
+		_ = conn.Close()
+		return errReplicationStopped
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	_ = conn.SetReadDeadline(time.Now().Add(replTimeout()))
+	if err := link.handshake(conn, reader); err != nil {
+		return err
+	}
+	// NODE 总是用自己的复制 ID 与偏移量尝试部分同步, 主节点不认识该 ID 时回复 FULLRESYNC
+	server.repl.mu.Lock()
+	replID, psyncOffset := server.repl.replID, server.repl.offset+1
+	server.repl.mu.Unlock()
+	reply, err := link.command(conn, reader, "PSYNC", replID, strconv.FormatInt(psyncOffset, 10))
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(reply)
+	switch {
+	case len(fields) >= 1 && fields[0] == "+CONTINUE":
+		newReplID := replID
+		if len(fields) > 1 {
+			newReplID = fields[1]
+		}
+		server.continueWithMaster(newReplID)
+		logger.Info("MASTER <-> REPLICA partial resync accepted, continue from offset " + strconv.FormatInt(psyncOffset, 10))
+	case len(fields) >= 3 && fields[0] == "+FULLRESYNC":
+		masterOffset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return errors.New("unexpected reply to PSYNC: " + reply)
+		}
+		streamDB := 0
+		if len(fields) > 3 {
+			if streamDB, err = strconv.Atoi(fields[3]); err != nil {
+				return errors.New("unexpected reply to PSYNC: " + reply)
+			}
+		}
+		link.setState(replStateSync)
+		data, err := readSnapshotPayload(conn, reader)
+		if err != nil {
+			return err
+		}
+		if err := server.loadFromMaster(link, data, fields[1], masterOffset, streamDB); err != nil {
+			return err
+		}
+		logger.Info("MASTER <-> REPLICA sync finished, " + strconv.Itoa(len(data)) + " bytes loaded")
+	default:
+		return errors.New("unexpected reply to PSYNC: " + reply)
+	}
+	link.setState(replStateConnected)
+	return server.streamFromMaster(link, conn, reader)
+}
+
+// continueWithMaster 部分同步成功, 主节点晋升后复制 ID 会改变
+func (server *MemgoServer) continueWithMaster(newReplID string) {
+	repl := &server.repl
+	repl.mu.Lock()
+	changed := newReplID != repl.replID
+	if changed {
+		repl.replID2 = repl.replID
+		repl.secondOffset = repl.offset + 1
+		repl.replID = newReplID
+	}
+	if repl.backlog == nil {
+		repl.backlog = newReplBacklog(repl.offset)
+	}
+	repl.mu.Unlock()
+	// 下级使用旧的 ID 重连后仍可以部分同步
+	if changed {
+		server.disconnectReplicas()
+	}
+}
+
+// command 发送一条命令并读取单行回复
+func (link *masterLink) command(conn net.Conn, reader *bufio.Reader, args ...string) (string, error) {
+	if err := link.write(conn, args...); err != nil {
+		return "", err
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (link *masterLink) handshake(conn net.Conn, reader *bufio.Reader) error {
+	reply, err := link.command(conn, reader, "PING")
+	if err != nil {
+		return err
+	}
+	// 主节点设置了密码时 PING 返回 NOAUTH
+	if !strings.HasPrefix(reply, "+") && !strings.HasPrefix(reply, "-NOAUTH") {
+		return errors.New("error reply to PING from master: " + reply)
+	}
+	if config.Properties.MasterAuth != "" {
+		reply, err = link.command(conn, reader, "AUTH", config.Properties.MasterAuth)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(reply, "+") {
+			return errors.New("unable to AUTH to MASTER: " + reply)
+		}
+	}
+	port := config.Properties.Port
+	if config.Properties.SlaveAnnouncePort > 0 {
+		port = config.Properties.SlaveAnnouncePort
+	}
+	replconf := [][]string{{"REPLCONF", "listening-port", strconv.Itoa(port)}}
+	if config.Properties.SlaveAnnounceIP != "" {
+		replconf = append(replconf, []string{"REPLCONF", "ip-address", config.Properties.SlaveAnnounceIP})
+	}
+	replconf = append(replconf, []string{"REPLCONF", "capa", "psync2"})
+	for _, args := range replconf {
+		reply, err = link.command(conn, reader, args...)
+		if err != nil {
+			return err
+		}
+		// 与 redis 相同, REPLCONF 失败不影响同步
+		if strings.HasPrefix(reply, "-") {
+			logger.Warn("master does not understand " + strings.Join(args[:2], " ") + ": " + reply)
+		}
+	}
+	return nil
+}
+
+// readSnapshotPayload 读取 $len\r\n<data>, 主节点生成快照期间可能发送空行保活
+func readSnapshotPayload(conn net.Conn, reader *bufio.Reader) ([]byte, error) {
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(replTimeout()))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			continue
+		}
+		if line[0] != '$' {
+			return nil, errors.New("bad protocol from MASTER, the first byte is not '$': " + line)
+		}
+		if strings.HasPrefix(line, "$EOF:") {
+			return readEOFPayload(conn, reader, []byte(line[len("$EOF:"):]))
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, errors.New("bad snapshot length from MASTER: " + line)
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+}
+
+// readEOFPayload 读取长度未知的快照, 快照之后紧跟 mark
+// NODE 只消费到 mark 为止, mark 之后的复制流留在 reader 中
+func readEOFPayload(conn net.Conn, reader *bufio.Reader, mark []byte) ([]byte, error) {
+	if len(mark) == 0 {
+		return nil, errors.New("bad snapshot EOF mark from MASTER")
+	}
+	var data []byte
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(replTimeout()))
+		if _, err := reader.Peek(1); err != nil {
+			return nil, err
+		}
+		chunk, _ := reader.Peek(reader.Buffered())
+		prev := len(data)
+		data = append(data, chunk...)
+		// mark 可能跨越两次读取
+		from := prev - len(mark) + 1
+		if from < 0 {
+			from = 0
+		}
+		if idx := bytes.Index(data[from:], mark); idx >= 0 {
+			end := from + idx
+			_, _ = reader.Discard(end + len(mark) - prev)
+			return data[:end], nil
+		}
+		_, _ = reader.Discard(len(chunk))
+	}
+}
+
+// loadFromMaster 清空所有数据并加载主节点的快照, 期间暂停所有命令
+func (server *MemgoServer) loadFromMaster(link *masterLink, data []byte, replID string, offset int64, streamDB int) error {
+	server.snapshotLock.Lock()
+	defer server.snapshotLock.Unlock()
+	server.saveBeforeFlush()
+	for _, db := range server.dbSet {
+		db.Flush()
+	}
+	var loaded int64
+	err := rdb.DecodeAny(bufio.NewReader(bytes.NewReader(data)), func(entry *rdb.Entry) error {
+		loaded++
+		return server.LoadEntity(entry.DbIndex, entry.Key, entry.Entity, entry.ExpireAt)
+	})
+	if err != nil {
+		return errors.New("load snapshot from MASTER failed: " + err.Error())
+	}
+	// 加载不经过 propagate, 计入修改次数使 save 规则生效
+	atomic.AddInt64(&server.dirty, loaded+1)
+	// NODE 原有的 aof 已与数据不一致, 以当前数据为基础重新开始
+	if server.persister != nil {
+		if err := server.persister.Rebase(); err != nil {
+			logger.Error("rebase aof after sync failed: " + err.Error())
+		}
+	}
+
+	link.client = &masterClient{}
+	link.client.SelectDB(streamDB)
+	repl := &server.repl
+	repl.mu.Lock()
+	repl.replID = replID
+	repl.replID2 = ""
+	repl.secondOffset = -1
+	repl.offset = offset
+	repl.backlog = newReplBacklog(offset)
+	repl.streamDB = streamDB
+	repl.mu.Unlock()
+	// 数据已被替换, 下级需要重新全量同步
+	server.disconnectReplicas()
+	return nil
+}
+
+// streamFromMaster 逐条执行复制流中的命令并原样转发给下级, 每秒上报已处理的偏移量
+func (server *MemgoServer) streamFromMaster(link *masterLink, conn net.Conn, reader *bufio.Reader) error {
+	repl := &server.repl
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				repl.mu.Lock()
+				offset := repl.offset
+				repl.mu.Unlock()
+				if err := link.write(conn, "REPLCONF", "ACK", strconv.FormatInt(offset, 10)); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	_ = conn.SetReadDeadline(time.Now().Add(replTimeout()))
+	ch := parser.ParseStream(reader)
+	// 提前返回时 parser 仍在阻塞发送, 需要取走剩余的载荷
+	defer func() {
+		go func() {
+			for range ch {
+			}
+		}()
+	}()
+	for payload := range ch {
+		if payload.Err != nil {
+			return payload.Err
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(replTimeout()))
+		atomic.StoreInt64(&link.lastIO, time.Now().Unix())
+		cmd, ok := payload.Data.(*protocol.MultiBulkReply)
+		if !ok || len(cmd.Args) == 0 {
+			return errors.New("unexpected data in replication stream")
+		}
+		// REPLCONF GETACK 由主节点的 WAIT 发出, 要求立即上报偏移量
+		getAck := strings.ToLower(string(cmd.Args[0])) == "replconf"
+		link.applyMu.Lock()
+		if !getAck {
+			server.Exec(link.client, cmd.Args)
+		}
+		// NODE 主节点的复制流只包含 MultiBulk, 重新编码与收到的字节完全相同, 偏移量与主节点保持一致
+		repl.mu.Lock()
+		repl.streamDB = link.client.GetDBIndex()
+		repl.appendStream(cmd.ToBytes())
+		offset := repl.offset
+		repl.mu.Unlock()
+		link.applyMu.Unlock()
+		if getAck {
+			if err := link.write(conn, "REPLCONF", "ACK", strconv.FormatInt(offset, 10)); err != nil {
+				return err
+			}
+		}
+	}
+	return io.EOF
+}
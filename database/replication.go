@@ -0,0 +1,319 @@
+// NODE 主从复制, 参考 redis
+// 主节点: 所有写命令经过 propagate 写入 aof 的同时, 编码为 RESP 追加到每个从节点的发送缓冲与积压缓冲, 称为复制流
+//        从节点发送 PSYNC 后, 主节点暂停所有命令生成快照(与 SAVE 相同), 同时将该从节点加入复制流, 保证快照与之后的命令首尾衔接
+// 从节点: REPLICAOF host port 后连接主节点, 收到快照后清空数据并加载, 随后逐条执行复制流中的命令
+//        执行后原样转发给自己的从节点(级联复制), 因此整条链上的复制 ID 与偏移量都相同
+// 复制 ID(replid) 与偏移量(offset) 标识复制流的历史: offset 为复制流的字节数, 从节点每秒通过 REPLCONF ACK 上报
+// 部分同步: 从节点重连时发送 PSYNC replid offset+1, 复制 ID 相同且之后的数据仍在积压缓冲中时, 主节点只补发缺少的部分
+// 从节点晋升为主节点时生成新的复制 ID, 旧的 ID 保存为 replid2, 原来的兄弟节点可以用旧的 ID 继续部分同步
+// NODE 过期的 key 由主从各自删除(过期时间在复制流中是绝对时间), 主节点不会为过期的 key 生成 DEL 命令
+
+package database
+
+import (
+	"bytes"
+	"memgo/config"
+	"memgo/interface/resp"
+	"memgo/logger"
+	"memgo/redis/RESP/protocol"
+	"memgo/utils"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultReplTimeout       = 60 * time.Second
+	defaultReplPingPeriod    = 10 * time.Second
+	defaultMinReplicasMaxLag = 10 * time.Second
+)
+
+type replicationState struct {
+	mu     sync.Mutex
+	replID string
+	offset int64 // 复制流的总字节数 master_repl_offset
+	// 晋升之前的复制 ID, 偏移量不超过 secondOffset 时仍可以用它部分同步
+	replID2      string
+	secondOffset int64
+	// 第一个从节点连接后创建, 之后复制流总是写入积压缓冲, 为 nil 时不记录复制流
+	backlog  *replBacklog
+	streamDB int // 复制流当前选中的 db, -1 表示下一条命令之前需要 SELECT
+	// 连接到本节点的从节点, 包括还在握手的
+	replicas map[resp.ConnectionIntf]*replicaClient
+	lastPing time.Time
+
+	syncFull       int64
+	syncPartialOK  int64
+	syncPartialErr int64
+	// ACK 延迟不超过 min-replicas-max-lag 的从节点数量, 每秒更新, 原子操作
+	goodReplicas int32
+
+	// 作为从节点时 与主节点的连接, 为 nil 时是主节点
+	master    *masterLink
+	isReplica int32 // master 不为 nil, 原子操作, 用于在每个写命令中快速判断
+}
+
+func replTimeout() time.Duration {
+	if config.Properties.ReplTimeout <= 0 {
+		return defaultReplTimeout
+	}
+	return time.Duration(config.Properties.ReplTimeout) * time.Second
+}
+
+func replPingPeriod() time.Duration {
+	if config.Properties.ReplPingPeriod <= 0 {
+		return defaultReplPingPeriod
+	}
+	return time.Duration(config.Properties.ReplPingPeriod) * time.Second
+}
+
+func minReplicasMaxLag() time.Duration {
+	if config.Properties.MinReplicasMaxLag <= 0 {
+		return defaultMinReplicasMaxLag
+	}
+	return time.Duration(config.Properties.MinReplicasMaxLag) * time.Second
+}
+
+// replicaReadOnly 默认 yes
+func replicaReadOnly() bool {
+	return strings.ToLower(config.Properties.ReplicaReadOnly) != "no"
+}
+
+func (server *MemgoServer) initReplication() {
+	server.repl.replID = config.Properties.RunID
+	server.repl.secondOffset = -1
+	server.repl.streamDB = -1
+	server.repl.replicas = make(map[resp.ConnectionIntf]*replicaClient)
+	if raw := strings.Fields(config.Properties.ReplicaOf); len(raw) == 2 {
+		port, err := strconv.Atoi(raw[1])
+		if err != nil {
+			logger.Error("invalid replicaof config: " + config.Properties.ReplicaOf)
+		} else {
+			server.startReplication(raw[0], port)
+		}
+	}
+	go server.replicationCron()
+}
+
+// feedReplicas 将写命令追加到复制流, 由 propagate 调用
+// NODE 从节点的复制流来自主节点, 由 streamFromMaster 原样转发, 从节点自己的写命令(replica-read-only no)不会传给下级
+func (server *MemgoServer) feedReplicas(dbIdx int, cmdLine CmdLine) {
+	repl := &server.repl
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	if repl.backlog == nil || repl.master != nil {
+		return
+	}
+	var buf bytes.Buffer
+	if dbIdx != repl.streamDB {
+		buf.Write(protocol.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(dbIdx))).ToBytes())
+		repl.streamDB = dbIdx
+	}
+	buf.Write(protocol.MakeMultiBulkReply(cmdLine).ToBytes())
+	repl.appendStream(buf.Bytes())
+}
+
+// appendStream 调用方需持有 mu
+func (repl *replicationState) appendStream(data []byte) {
+	repl.offset += int64(len(data))
+	repl.backlog.write(data)
+	for _, replica := range repl.replicas {
+		if replica.isOnline() {
+			replica.send(data)
+		}
+	}
+}
+
+func (repl *replicationState) hasOnlineReplicas() bool {
+	for _, replica := range repl.replicas {
+		if replica.isOnline() {
+			return true
+		}
+	}
+	return false
+}
+
+// replicationCron 每秒执行: 定期向从节点发送 PING, 断开超时未 ACK 的从节点
+func (server *MemgoServer) replicationCron() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-server.closing:
+			return
+		}
+		repl := &server.repl
+		repl.mu.Lock()
+		// NODE PING 同样计入复制偏移量, 从节点据此判断与主节点的连接是否超时
+		if repl.master == nil && repl.hasOnlineReplicas() && time.Since(repl.lastPing) >= replPingPeriod() {
+			repl.appendStream(protocol.MakeMultiBulkReply(utils.ToCmdLine("PING")).ToBytes())
+			repl.lastPing = time.Now()
+		}
+		var timeout []*replicaClient
+		var good int32
+		for _, replica := range repl.replicas {
+			if !replica.isOnline() {
+				continue
+			}
+			if replica.lag() > replTimeout() {
+				timeout = append(timeout, replica)
+			} else if replica.lag() <= minReplicasMaxLag() && !replica.isSyncing() {
+				// NODE 正在接收快照的从节点还不能提供数据
+				good++
+			}
+		}
+		atomic.StoreInt32(&repl.goodReplicas, good)
+		repl.mu.Unlock()
+		for _, replica := range timeout {
+			logger.Warn("disconnecting timedout replica " + replica.addr())
+			replica.close()
+		}
+	}
+}
+
+// disconnectReplicas 断开所有从节点, 它们会重连并全量同步; 用于本节点的数据被整体替换之后
+func (server *MemgoServer) disconnectReplicas() {
+	server.repl.mu.Lock()
+	replicas := make([]*replicaClient, 0, len(server.repl.replicas))
+	for _, replica := range server.repl.replicas {
+		replicas = append(replicas, replica)
+	}
+	server.repl.mu.Unlock()
+	for _, replica := range replicas {
+		replica.close()
+	}
+}
+
+// REPLICAOF host port / REPLICAOF NO ONE
+func (server *MemgoServer) execReplicaOf(args CmdLine) resp.ReplyIntf {
+	if len(args) != 2 {
+		return protocol.MakeArgNumErrReply("replicaof")
+	}
+	if strings.ToLower(string(args[0])) == "no" && strings.ToLower(string(args[1])) == "one" {
+		if server.stopReplication() {
+			logger.Info("MASTER MODE enabled")
+		}
+		return protocol.MakeOkReply()
+	}
+	host := string(args[0])
+	port, err := strconv.Atoi(string(args[1]))
+	if err != nil || port <= 0 || port > 65535 {
+		return protocol.MakeErrReply("ERR Invalid master port")
+	}
+	server.repl.mu.Lock()
+	link := server.repl.master
+	server.repl.mu.Unlock()
+	if link != nil && link.host == host && link.port == port {
+		return protocol.MakeStatusReply("OK Already connected to specified master")
+	}
+	server.detachMaster()
+	server.startReplication(host, port)
+	return protocol.MakeOkReply()
+}
+
+// ROLE
+func (server *MemgoServer) execRole() resp.ReplyIntf {
+	repl := &server.repl
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	if link := repl.master; link != nil {
+		return protocol.MakeMultiRawReply([]resp.ReplyIntf{
+			protocol.MakeBulkReply([]byte("slave")),
+			protocol.MakeBulkReply([]byte(link.host)),
+			protocol.MakeIntReply(int64(link.port)),
+			protocol.MakeBulkReply([]byte(link.getState())),
+			protocol.MakeIntReply(repl.offset),
+		})
+	}
+	replicas := make([]resp.ReplyIntf, 0, len(repl.replicas))
+	for _, replica := range repl.replicas {
+		if !replica.isOnline() {
+			continue
+		}
+		replicas = append(replicas, protocol.MakeMultiBulkReply(utils.ToCmdLine(
+			replica.ip, strconv.Itoa(replica.listeningPort), strconv.FormatInt(replica.ackedOffset(), 10))))
+	}
+	return protocol.MakeMultiRawReply([]resp.ReplyIntf{
+		protocol.MakeBulkReply([]byte("master")),
+		protocol.MakeIntReply(repl.offset),
+		protocol.MakeMultiRawReply(replicas),
+	})
+}
+
+func genReplicationInfo(server *MemgoServer) string {
+	repl := &server.repl
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	var builder strings.Builder
+	if link := repl.master; link != nil {
+		state := link.getState()
+		linkStatus := "down"
+		if state == replStateConnected {
+			linkStatus = "up"
+		}
+		builder.WriteString("role:slave\r\n")
+		builder.WriteString("master_host:" + link.host + "\r\n")
+		builder.WriteString("master_port:" + strconv.Itoa(link.port) + "\r\n")
+		builder.WriteString("master_link_status:" + linkStatus + "\r\n")
+		builder.WriteString("master_last_io_seconds_ago:" + strconv.FormatInt(link.lastIOSecondsAgo(), 10) + "\r\n")
+		builder.WriteString("master_sync_in_progress:" + strconv.Itoa(boolToInt(state == replStateSync)) + "\r\n")
+		builder.WriteString("slave_repl_offset:" + strconv.FormatInt(repl.offset, 10) + "\r\n")
+		builder.WriteString("slave_read_only:" + strconv.Itoa(boolToInt(replicaReadOnly())) + "\r\n")
+	} else {
+		builder.WriteString("role:master\r\n")
+	}
+	var lines []string
+	for _, replica := range repl.replicas {
+		if !replica.isOnline() {
+			continue
+		}
+		lines = append(lines, "slave"+strconv.Itoa(len(lines))+":ip="+replica.ip+",port="+strconv.Itoa(replica.listeningPort)+
+			",state=online,offset="+strconv.FormatInt(replica.ackedOffset(), 10)+
+			",lag="+strconv.FormatInt(int64(replica.lag()/time.Second), 10)+"\r\n")
+	}
+	builder.WriteString("connected_slaves:" + strconv.Itoa(len(lines)) + "\r\n")
+	if config.Properties.MinReplicasToWrite > 0 {
+		builder.WriteString("min_slaves_good_slaves:" + strconv.Itoa(int(atomic.LoadInt32(&repl.goodReplicas))) + "\r\n")
+	}
+	for _, line := range lines {
+		builder.WriteString(line)
+	}
+	builder.WriteString("master_replid:" + repl.replID + "\r\n")
+	builder.WriteString("master_replid2:" + repl.replID2 + "\r\n")
+	builder.WriteString("master_repl_offset:" + strconv.FormatInt(repl.offset, 10) + "\r\n")
+	builder.WriteString("second_repl_offset:" + strconv.FormatInt(repl.secondOffset, 10) + "\r\n")
+	if backlog := repl.backlog; backlog != nil {
+		builder.WriteString("repl_backlog_active:1\r\n")
+		builder.WriteString("repl_backlog_size:" + strconv.Itoa(len(backlog.buf)) + "\r\n")
+		builder.WriteString("repl_backlog_first_byte_offset:" + strconv.FormatInt(backlog.firstByteOffset(), 10) + "\r\n")
+		builder.WriteString("repl_backlog_histlen:" + strconv.Itoa(backlog.histLen) + "\r\n")
+	} else {
+		builder.WriteString("repl_backlog_active:0\r\n")
+	}
+	builder.WriteString("sync_full:" + strconv.FormatInt(repl.syncFull, 10) + "\r\n")
+	builder.WriteString("sync_partial_ok:" + strconv.FormatInt(repl.syncPartialOK, 10) + "\r\n")
+	builder.WriteString("sync_partial_err:" + strconv.FormatInt(repl.syncPartialErr, 10) + "\r\n")
+	return builder.String()
+}
+
+// isReadOnlyFor 从节点拒绝普通客户端的写命令, 复制流中的命令除外
+func (server *MemgoServer) isReadOnlyFor(client resp.ConnectionIntf) bool {
+	if atomic.LoadInt32(&server.repl.isReplica) == 0 || !replicaReadOnly() {
+		return false
+	}
+	_, fromMaster := client.(*masterClient)
+	return !fromMaster
+}
+
+// notEnoughReplicas min-replicas-to-write 开启时, 健康的从节点不足则主节点拒绝写命令
+// NODE 健康的从节点数量每秒更新一次, 从节点断开后最多 1 秒才开始拒绝
+func (server *MemgoServer) notEnoughReplicas() bool {
+	minReplicas := config.Properties.MinReplicasToWrite
+	if minReplicas <= 0 || atomic.LoadInt32(&server.repl.isReplica) == 1 {
+		return false
+	}
+	return int(atomic.LoadInt32(&server.repl.goodReplicas)) < minReplicas
+}
@@ -0,0 +1,297 @@
+package database_test
+
+import (
+	"io"
+	"memgo/config"
+	"memgo/database"
+	"memgo/redis/RESP/handler"
+	"memgo/redis/client"
+	"memgo/tcp"
+	randstring "memgo/utils/rand_string"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testServer struct {
+	addr    string
+	closing chan struct{}
+	done    chan struct{}
+}
+
+func startServer(t *testing.T) *testServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{
+		addr:    listener.Addr().String(),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	// NODE 复制 ID 取自 RunID, 同一进程中的节点需要各自不同的 ID
+	config.Properties.RunID = randstring.RandString(40)
+	server := database.NewMemgoServerInMemory()
+	go func() {
+		tcp.ListenAndServe(listener, handler.MakeHandlerWith(server), s.closing)
+		close(s.done)
+	}()
+	return s
+}
+
+func (s *testServer) stop() {
+	if s.closing != nil {
+		close(s.closing)
+		<-s.done
+		s.closing = nil
+	}
+}
+
+// do 执行一条命令, 返回回复的 RESP 文本
+func do(t *testing.T, addr string, args ...string) string {
+	t.Helper()
+	c, err := client.Dial(addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	reply, err := c.Do(args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(reply.ToBytes())
+}
+
+func replicaOf(t *testing.T, replica string, master string) {
+	t.Helper()
+	host, port, _ := net.SplitHostPort(master)
+	if reply := do(t, replica, "REPLICAOF", host, port); reply != "+OK\r\n" {
+		t.Fatalf("REPLICAOF: %q", reply)
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for " + what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func waitValue(t *testing.T, addr string, key string, value string) {
+	t.Helper()
+	want := "$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+	waitFor(t, key+" on "+addr, func() bool {
+		return do(t, addr, "GET", key) == want
+	})
+}
+
+// replInfo 返回 INFO replication 中的一项
+func replInfo(t *testing.T, addr string, field string) string {
+	t.Helper()
+	for _, line := range strings.Split(do(t, addr, "INFO", "replication"), "\r\n") {
+		if strings.HasPrefix(line, field+":") {
+			return strings.TrimPrefix(line, field+":")
+		}
+	}
+	return ""
+}
+
+// tcpProxy 转发到 target, 用于模拟从节点与主节点之间的网络中断
+type tcpProxy struct {
+	listener net.Listener
+	target   string
+
+	mu     sync.Mutex
+	conns  []net.Conn
+	refuse bool
+}
+
+func startProxy(t *testing.T, target string) *tcpProxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &tcpProxy{listener: listener, target: target}
+	go p.serve()
+	return p
+}
+
+func (p *tcpProxy) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		if p.refuse {
+			p.mu.Unlock()
+			_ = conn.Close()
+			continue
+		}
+		upstream, err := net.Dial("tcp", p.target)
+		if err != nil {
+			p.mu.Unlock()
+			_ = conn.Close()
+			continue
+		}
+		p.conns = append(p.conns, conn, upstream)
+		p.mu.Unlock()
+		go func() {
+			_, _ = io.Copy(upstream, conn)
+			_ = upstream.Close()
+		}()
+		go func() {
+			_, _ = io.Copy(conn, upstream)
+			_ = conn.Close()
+		}()
+	}
+}
+
+// cut 断开所有已建立的连接, refuse 为 true 时之后的连接立即关闭
+func (p *tcpProxy) cut(refuse bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refuse = refuse
+	for _, conn := range p.conns {
+		_ = conn.Close()
+	}
+	p.conns = nil
+}
+
+func (p *tcpProxy) close() {
+	_ = p.listener.Close()
+	p.cut(true)
+}
+
+func TestReplicationFullSync(t *testing.T) {
+	master, replica := startServer(t), startServer(t)
+	defer master.stop()
+	defer replica.stop()
+	for i := 0; i < 100; i++ {
+		do(t, master.addr, "SET", "k"+strconv.Itoa(i), "v"+strconv.Itoa(i))
+	}
+	replicaOf(t, replica.addr, master.addr)
+	waitValue(t, replica.addr, "k99", "v99")
+	for i := 0; i < 100; i++ {
+		value := "v" + strconv.Itoa(i)
+		if reply := do(t, replica.addr, "GET", "k"+strconv.Itoa(i)); reply != "$"+strconv.Itoa(len(value))+"\r\n"+value+"\r\n" {
+			t.Fatalf("k%d on replica: %q", i, reply)
+		}
+	}
+	// 同步之后的写命令通过复制流到达从节点
+	do(t, master.addr, "SET", "after", "sync")
+	waitValue(t, replica.addr, "after", "sync")
+	if reply := do(t, replica.addr, "SET", "k0", "x"); !strings.HasPrefix(reply, "-READONLY") {
+		t.Fatalf("replica accepted a write: %q", reply)
+	}
+	if got := replInfo(t, master.addr, "sync_full"); got != "1" {
+		t.Fatalf("sync_full: %s", got)
+	}
+}
+
+func TestReplicationPartialResync(t *testing.T) {
+	config.Properties.ReplBacklogSize = 4096
+	defer func() { config.Properties.ReplBacklogSize = 0 }()
+	master, replica := startServer(t), startServer(t)
+	defer master.stop()
+	defer replica.stop()
+	proxy := startProxy(t, master.addr)
+	defer proxy.close()
+
+	do(t, master.addr, "SET", "k", "v0")
+	replicaOf(t, replica.addr, proxy.listener.Addr().String())
+	waitValue(t, replica.addr, "k", "v0")
+
+	// 短暂断开, 缺少的数据仍在积压缓冲中: 部分同步
+	proxy.cut(false)
+	do(t, master.addr, "SET", "k", "v1")
+	waitValue(t, replica.addr, "k", "v1")
+	if got := replInfo(t, master.addr, "sync_partial_ok"); got != "1" {
+		t.Fatalf("sync_partial_ok: %s", got)
+	}
+	if got := replInfo(t, master.addr, "sync_full"); got != "1" {
+		t.Fatalf("sync_full: %s", got)
+	}
+
+	// 断开期间的写入超过积压缓冲: 全量同步
+	proxy.cut(true)
+	value := strings.Repeat("x", 1024)
+	for i := 0; i < 10; i++ {
+		do(t, master.addr, "SET", "big"+strconv.Itoa(i), value)
+	}
+	do(t, master.addr, "SET", "k", "v2")
+	proxy.cut(false)
+	waitValue(t, replica.addr, "k", "v2")
+	waitValue(t, replica.addr, "big0", value)
+	if got := replInfo(t, master.addr, "sync_full"); got != "2" {
+		t.Fatalf("sync_full: %s", got)
+	}
+	// NODE 首次同步时从节点的复制 ID 同样不被主节点认识, 也计入 sync_partial_err
+	if got := replInfo(t, master.addr, "sync_partial_err"); got != "2" {
+		t.Fatalf("sync_partial_err: %s", got)
+	}
+}
+
+func TestWait(t *testing.T) {
+	master := startServer(t)
+	defer master.stop()
+	replicas := []*testServer{startServer(t), startServer(t)}
+	for _, replica := range replicas {
+		defer replica.stop()
+		replicaOf(t, replica.addr, master.addr)
+	}
+	do(t, master.addr, "SET", "k", "v")
+	for _, replica := range replicas {
+		waitValue(t, replica.addr, "k", "v")
+	}
+
+	do(t, master.addr, "SET", "k", "v1")
+	if reply := do(t, master.addr, "WAIT", "2", "5000"); reply != ":2\r\n" {
+		t.Fatalf("WAIT 2: %q", reply)
+	}
+	// 从节点不足时等待到超时, 返回已确认的数量
+	start := time.Now()
+	if reply := do(t, master.addr, "WAIT", "3", "200"); reply != ":2\r\n" {
+		t.Fatalf("WAIT 3: %q", reply)
+	}
+	if time.Since(start) < 200*time.Millisecond {
+		t.Fatal("WAIT returned before the timeout")
+	}
+	if reply := do(t, replicas[0].addr, "WAIT", "1", "100"); !strings.HasPrefix(reply, "-ERR WAIT cannot be used") {
+		t.Fatalf("WAIT on replica: %q", reply)
+	}
+}
+
+func TestMinReplicasToWrite(t *testing.T) {
+	config.Properties.MinReplicasToWrite = 1
+	defer func() { config.Properties.MinReplicasToWrite = 0 }()
+	master, replica := startServer(t), startServer(t)
+	defer master.stop()
+	defer replica.stop()
+
+	noReplicas := "-NOREPLICAS Not enough good replicas to write.\r\n"
+	if reply := do(t, master.addr, "SET", "k", "v"); reply != noReplicas {
+		t.Fatalf("SET without replicas: %q", reply)
+	}
+	if reply := do(t, master.addr, "GET", "k"); reply != "$-1\r\n" {
+		t.Fatalf("GET: %q", reply)
+	}
+	// 健康的从节点数量每秒更新一次
+	replicaOf(t, replica.addr, master.addr)
+	waitFor(t, "a good replica", func() bool {
+		return do(t, master.addr, "SET", "k", "v") == "+OK\r\n"
+	})
+	waitValue(t, replica.addr, "k", "v")
+
+	replica.stop()
+	waitFor(t, "NOREPLICAS", func() bool {
+		return do(t, master.addr, "SET", "k", "v") == noReplicas
+	})
+}
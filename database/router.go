@@ -3,6 +3,7 @@ package database
 import (
 	"memgo/interface/database"
 	"memgo/interface/resp"
+	"sort"
 	"strings"
 )
 
@@ -18,7 +19,7 @@ type command struct {
 	executor ExecFunc
 	prepare  PreFunc
 	arity    int
-	// flags    int
+	flags    int
 }
 
 const (
@@ -27,15 +28,129 @@ const (
 	flagWrite  = 2
 	flagSingle = 4
 	flagMulti  = 8
+	flagAdmin  = 16 // 管理命令, 例如持久化与复制
 )
 
-func RegisterCommand(name string, executor ExecFunc, prepare PreFunc, arity int) {
+// ACL 中命令的类别, 由命令的 flags 得到
+const (
+	CategoryRead  = "read"
+	CategoryWrite = "write"
+	CategoryAdmin = "admin"
+)
+
+// extraCommandFlags 不在 cmdTable 中的命令(MemgoServer.Exec 以及其他模式直接处理的命令)的 flags, 只用于 ACL
+var extraCommandFlags = map[string]int{
+	"save":         flagAdmin,
+	"bgsave":       flagAdmin,
+	"lastsave":     flagAdmin,
+	"rewriteaof":   flagAdmin,
+	"bgrewriteaof": flagAdmin,
+	"replicaof":    flagAdmin,
+	"slaveof":      flagAdmin,
+	"role":         flagAdmin,
+	"replconf":     flagAdmin,
+	"psync":        flagAdmin,
+	"sync":         flagAdmin,
+	"wait":         flagSpec,
+	"info":         flagSpec,
+	"select":       flagSpec,
+	"acl":          flagAdmin,
+	"cluster":      flagAdmin,
+	"asking":       flagSpec,
+	"raft":         flagAdmin,
+	"crdt":         flagAdmin,
+	"sentinel":     flagAdmin,
+}
+
+// RegisterCommand flags 标识命令是否会修改数据, 从节点据此拒绝客户端的写命令
+func RegisterCommand(name string, executor ExecFunc, prepare PreFunc, arity int, flags int) {
 	name = strings.ToLower(name)
 	cmdTable[name] = &command{
 		executor: executor,
 		prepare:  prepare,
 		arity:    arity,
+		flags:    flags,
+	}
+}
+
+// RegisterCommandFlags 其他模式自己实现的命令登记读写属性, ACL 据此确定类别; 已在 cmdTable 中的命令不受影响
+func RegisterCommandFlags(name string, write bool) {
+	flags := flagRead
+	if write {
+		flags = flagWrite
+	}
+	extraCommandFlags[strings.ToLower(name)] = flags
+}
+
+func commandFlags(name string) (int, bool) {
+	if cmd, ok := cmdTable[name]; ok {
+		return cmd.flags, true
+	}
+	flags, ok := extraCommandFlags[name]
+	return flags, ok
+}
+
+// CommandCategories 返回命令所属的类别, 命令不存在时 ok 为 false
+func CommandCategories(name string) (categories []string, ok bool) {
+	flags, ok := commandFlags(strings.ToLower(name))
+	if !ok {
+		return nil, false
+	}
+	if flags&flagRead > 0 {
+		categories = append(categories, CategoryRead)
+	}
+	if flags&flagWrite > 0 {
+		categories = append(categories, CategoryWrite)
+	}
+	if flags&flagAdmin > 0 {
+		categories = append(categories, CategoryAdmin)
+	}
+	return categories, true
+}
+
+// CommandsInCategory 返回属于 category 的所有命令, 按名称排序
+func CommandsInCategory(category string) []string {
+	var names []string
+	add := func(name string) {
+		categories, _ := CommandCategories(name)
+		for _, c := range categories {
+			if c == category {
+				names = append(names, name)
+				return
+			}
+		}
+	}
+	for name := range cmdTable {
+		add(name)
+	}
+	for name := range extraCommandFlags {
+		if _, ok := cmdTable[name]; !ok {
+			add(name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isWriteCommand 未知的命令返回 false, 由执行时报错
+func isWriteCommand(name string) bool {
+	cmd, ok := cmdTable[strings.ToLower(name)]
+	return ok && cmd.flags&flagWrite > 0
+}
+
+// IsWriteCommand raft 模式据此决定命令是否需要写入日志
+func IsWriteCommand(name string) bool {
+	return isWriteCommand(name)
+}
+
+// GetRelatedKeys 返回命令涉及的所有 key, 集群模式据此计算槽; 未知的命令或参数数量错误时返回 nil, 由执行时报错
+func GetRelatedKeys(cmdLine CmdLine) []string {
+	cmd, ok := cmdTable[strings.ToLower(string(cmdLine[0]))]
+	if !ok || !validateArity(cmd.arity, cmdLine) {
+		return nil
 	}
+	writeKeys, readKeys := cmd.prepare(cmdLine[1:])
+	return append(writeKeys, readKeys...)
 }
 
 // SET K V =》 arity = 3
@@ -5,6 +5,7 @@ import (
 	"memgo/interface/database"
 	"memgo/interface/resp"
 	"memgo/redis/RESP/protocol"
+	"memgo/utils"
 	"strconv"
 )
 
@@ -36,13 +37,18 @@ func (db *DbObject) getOrInitSet(key string) (*set.Set, bool, resp.ReplyIntf) {
 
 func execSAdd(db database.DbObjectIntf, args CmdLine) resp.ReplyIntf {
 	key := string(args[0])
-	member := string(args[1])
+	members := args[1:]
 	dbObj, _ := db.(*DbObject)
 	setObj, _, err := dbObj.getOrInitSet(key)
 	if err != nil {
 		return err
 	}
-	return protocol.MakeIntReply(int64(setObj.Add(member)))
+	counter := 0
+	for _, member := range members {
+		counter += setObj.Add(string(member))
+	}
+	dbObj.addAof(utils.ToCmdLine3("SAdd", args...))
+	return protocol.MakeIntReply(int64(counter))
 }
 
 func execSIsMember(db database.DbObjectIntf, args CmdLine) resp.ReplyIntf {
@@ -71,6 +77,11 @@ func execSPop(db database.DbObjectIntf, args CmdLine) resp.ReplyIntf {
 	}
 	res := setObj.RandomMembers(1)
 	setObj.Remove(res[0])
+	if setObj.Len() == 0 {
+		DbObj.Remove(key)
+	}
+	// 随机弹出的成员需要以 SRem 的形式写入 aof, 保证重放结果一致
+	DbObj.addAof(utils.ToCmdLine2("SRem", key, res[0]))
 	return protocol.MakeBulkReply([]byte(res[0]))
 }
 
@@ -95,7 +106,7 @@ func execSRandMember(db database.DbObjectIntf, args CmdLine) resp.ReplyIntf {
 	if err != nil {
 		return protocol.MakeErrReply(err.Error())
 	}
-	
+
 	if count > 0 {
 		res := make([][]byte, int(count))
 		for i, mem := range setObj.RandomDistinctMembers(int(count)) {
@@ -134,6 +145,9 @@ func execSRem(db database.DbObjectIntf, args CmdLine) resp.ReplyIntf {
 	if setObj.Len() == 0 {
 		DbObj.Remove(key)
 	}
+	if counter > 0 {
+		DbObj.addAof(utils.ToCmdLine3("SRem", args...))
+	}
 	return protocol.MakeIntReply(int64(counter))
 }
 
@@ -244,12 +258,12 @@ func execSDiff(db database.DbObjectIntf, args CmdLine) resp.ReplyIntf {
 }
 
 func init() {
-	RegisterCommand("SAdd", execSAdd, writeFirstKey, 3)               // SAdd s1 k1
-	RegisterCommand("SIsMember", execSIsMember, readFirstKey, 3)      // SIsMember s1 k1
-	RegisterCommand("SPop", execSPop, writeFirstKey, 2)               // SPop s1
-	RegisterCommand("SRandMember", execSRandMember, readFirstKey, -2) // SRandMember s1 [count]
-	RegisterCommand("SRem", execSRem, writeFirstKey, -3)              // SRem s1 mem1 mem2 mem3
-	RegisterCommand("SInter", execSInter, readAllKeys, -3)            // SInter s1 s2 s3...
-	RegisterCommand("SUnion", execSUnion, readAllKeys, -3)
-	RegisterCommand("SDiff", execSDiff, readAllKeys, -3)
+	RegisterCommand("SAdd", execSAdd, writeFirstKey, -3, flagWrite)             // SAdd s1 k1 k2 ...
+	RegisterCommand("SIsMember", execSIsMember, readFirstKey, 3, flagRead)      // SIsMember s1 k1
+	RegisterCommand("SPop", execSPop, writeFirstKey, 2, flagWrite)              // SPop s1
+	RegisterCommand("SRandMember", execSRandMember, readFirstKey, -2, flagRead) // SRandMember s1 [count]
+	RegisterCommand("SRem", execSRem, writeFirstKey, -3, flagWrite)             // SRem s1 mem1 mem2 mem3
+	RegisterCommand("SInter", execSInter, readAllKeys, -3, flagRead)            // SInter s1 s2 s3...
+	RegisterCommand("SUnion", execSUnion, readAllKeys, -3, flagRead)
+	RegisterCommand("SDiff", execSDiff, readAllKeys, -3, flagRead)
 }
@@ -0,0 +1,357 @@
+// NODE 快照持久化 SAVE / BGSAVE / LASTSAVE
+// memgo 没有 fork, 由 snapshotWriter 在命令层面模拟写时复制, 得到时间点一致的数据
+// 开始时短暂持有 snapshotLock 的写锁, 之后命令照常执行; 后台协程逐个 key 编码并直接写入临时文件, 不在内存中缓存整个快照
+
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"memgo/compress"
+	"memgo/config"
+	"memgo/encrypt"
+	"memgo/interface/resp"
+	"memgo/logger"
+	"memgo/rdb"
+	"memgo/redis/RESP/protocol"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultRDBFilename = "dump.rdb"
+	// BGSAVE 失败后 save 规则至少间隔该时间才会再次触发
+	bgSaveRetryDelay = 5 * time.Second
+	// 写入快照文件的缓冲区大小, 避免每个 key 都产生一次加密 frame
+	snapshotBufferSize = 64 * 1024
+)
+
+type saveParam struct {
+	seconds int64
+	changes int64
+}
+
+// snapshotState 记录快照的进度与结果
+type snapshotState struct {
+	mu          sync.Mutex
+	inProgress  bool
+	lastSave    time.Time // 上次成功保存的时间
+	lastTry     time.Time
+	lastErr     error
+	lastElapsed time.Duration
+	wg          sync.WaitGroup
+	// 最近一次保存的快照压缩前后的大小之比, 未压缩时为 0
+	compressionRatio float64
+}
+
+func rdbFilename() string {
+	if config.Properties.RDBFilename == "" {
+		return defaultRDBFilename
+	}
+	return config.Properties.RDBFilename
+}
+
+// parseSaveParams 解析 save 配置 eg: "900 1 300 10"
+func parseSaveParams(raw string) []saveParam {
+	fields := strings.Fields(strings.Trim(raw, "\""))
+	params := make([]saveParam, 0, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		seconds, err1 := strconv.ParseInt(fields[i], 10, 64)
+		changes, err2 := strconv.ParseInt(fields[i+1], 10, 64)
+		if err1 != nil || err2 != nil || seconds <= 0 || changes <= 0 {
+			logger.Warn("invalid save param: " + fields[i] + " " + fields[i+1])
+			continue
+		}
+		params = append(params, saveParam{seconds: seconds, changes: changes})
+	}
+	return params
+}
+
+// DumpSnapshot 暂停所有命令, 将数据编码为 memgo 格式的快照, raft 模式据此生成日志快照
+func (server *MemgoServer) DumpSnapshot() ([]byte, error) {
+	server.snapshotLock.Lock()
+	defer server.snapshotLock.Unlock()
+	return server.encodeSnapshot(false)
+}
+
+// RestoreSnapshot 清空所有数据库后从快照恢复, 快照内容不写入 aof
+func (server *MemgoServer) RestoreSnapshot(data []byte) error {
+	server.snapshotLock.Lock()
+	defer server.snapshotLock.Unlock()
+	server.saveBeforeFlush()
+	for _, dbObj := range server.dbSet {
+		dbObj.Flush()
+	}
+	return rdb.DecodeAny(bufio.NewReader(bytes.NewReader(data)), func(entry *rdb.Entry) error {
+		return server.LoadEntity(entry.DbIndex, entry.Key, entry.Entity, entry.ExpireAt)
+	})
+}
+
+// encodeSnapshot 将数据编码为快照, 调用方需持有 snapshotLock 的写锁
+func (server *MemgoServer) encodeSnapshot(redisFormat bool) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	var enc rdb.SnapshotEncoder = rdb.NewEncoder(buf)
+	if redisFormat {
+		enc = rdb.NewRedisEncoder(buf)
+	}
+	if err := rdb.Dump(enc, server, len(server.dbSet)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// saveBeforeFlush 清空所有数据库(加载快照)之前调用
+func (server *MemgoServer) saveBeforeFlush() {
+	for _, dbObj := range server.dbSet {
+		server.saveBeforeWrite(dbObj, nil)
+	}
+}
+
+// snapshotFile 快照的写入链路: 编码器 -> 缓冲 -> 压缩 -> 加密 -> 同目录下的临时文件
+// 开启 rdb-file-compression 时压缩(redis 格式除外), 配置了 encryption-key-file 时 使用密钥文件中最新的密钥加密
+type snapshotFile struct {
+	tmp *os.File
+	buf *bufio.Writer
+	gz  *compress.Writer
+}
+
+func createSnapshotFile(filename string, redisFormat bool) (*snapshotFile, error) {
+	keyring, err := encrypt.LoadKeyFile(config.Properties.EncryptionKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(filename), "temp-*.rdb")
+	if err != nil {
+		return nil, err
+	}
+	f := &snapshotFile{tmp: tmpFile}
+	var w io.Writer = tmpFile
+	if keyring != nil {
+		if w, err = encrypt.NewWriter(tmpFile, keyring); err != nil {
+			f.abort()
+			return nil, err
+		}
+	}
+	if config.Properties.RDBFileCompression && !redisFormat {
+		f.gz = compress.NewWriter(w)
+		w = f.gz
+	}
+	f.buf = bufio.NewWriterSize(w, snapshotBufferSize)
+	return f, nil
+}
+
+// commit 刷盘后原子地替换快照文件, 返回压缩比, 未压缩时为 0
+func (f *snapshotFile) commit(filename string) (float64, error) {
+	var ratio float64
+	err := f.buf.Flush()
+	if err == nil && f.gz != nil {
+		if err = f.gz.Close(); err == nil {
+			ratio = f.gz.Ratio()
+		}
+	}
+	if err == nil {
+		err = f.tmp.Sync()
+	}
+	if closeErr := f.tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.tmp.Name(), filename)
+	}
+	if err != nil {
+		_ = os.Remove(f.tmp.Name())
+	}
+	return ratio, err
+}
+
+func (f *snapshotFile) abort() {
+	_ = f.tmp.Close()
+	_ = os.Remove(f.tmp.Name())
+}
+
+// saveSnapshot 生成快照并写入磁盘, background 为 true 时在后台协程中进行
+// 快照期间命令照常执行, 数据边编码边写入临时文件
+func (server *MemgoServer) saveSnapshot(background bool) error {
+	state := &server.snapshot
+	state.mu.Lock()
+	if state.inProgress {
+		state.mu.Unlock()
+		return errors.New("ERR Background save already in progress")
+	}
+	state.inProgress = true
+	state.lastTry = time.Now()
+	state.mu.Unlock()
+
+	start := time.Now()
+	redisFormat := config.Properties.RDBRedisFormat
+	file, err := createSnapshotFile(rdbFilename(), redisFormat)
+	if err != nil {
+		server.finishSnapshot(start, 0, 0, err)
+		return err
+	}
+	var enc rdb.SnapshotEncoder = rdb.NewEncoder(file.buf)
+	if redisFormat {
+		enc = rdb.NewRedisEncoder(file.buf)
+	}
+	if err := enc.WriteHeader(); err != nil {
+		file.abort()
+		server.finishSnapshot(start, 0, 0, err)
+		return err
+	}
+	// 持有写锁时开始快照, 保证开始时没有执行到一半的写命令
+	server.snapshotLock.Lock()
+	writer := newSnapshotWriter(enc, len(server.dbSet))
+	server.addSnapshotWriter(writer)
+	dirty := atomic.LoadInt64(&server.dirty)
+	server.snapshotLock.Unlock()
+
+	save := func() error {
+		err := writer.run(server.dbSet)
+		server.removeSnapshotWriter(writer)
+		if err != nil {
+			file.abort()
+			server.finishSnapshot(start, 0, 0, err)
+			return err
+		}
+		ratio, err := file.commit(rdbFilename())
+		server.finishSnapshot(start, dirty, ratio, err)
+		return err
+	}
+	if !background {
+		return save()
+	}
+	state.wg.Add(1)
+	go func() {
+		defer state.wg.Done()
+		_ = save()
+	}()
+	return nil
+}
+
+func (server *MemgoServer) finishSnapshot(start time.Time, dirty int64, ratio float64, err error) {
+	state := &server.snapshot
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.inProgress = false
+	state.lastErr = err
+	state.lastElapsed = time.Since(start)
+	if err != nil {
+		logger.Error("save snapshot failed: " + err.Error())
+		return
+	}
+	state.lastSave = time.Now()
+	state.compressionRatio = ratio
+	atomic.AddInt64(&server.dirty, -dirty)
+	logger.Info("snapshot saved to " + rdbFilename())
+}
+
+// SAVE
+func (server *MemgoServer) execSave() resp.ReplyIntf {
+	if err := server.saveSnapshot(false); err != nil {
+		return protocol.MakeErrReply(err.Error())
+	}
+	return protocol.MakeOkReply()
+}
+
+// BGSAVE
+func (server *MemgoServer) execBGSave() resp.ReplyIntf {
+	if err := server.saveSnapshot(true); err != nil {
+		return protocol.MakeErrReply(err.Error())
+	}
+	return protocol.MakeStatusReply("Background saving started")
+}
+
+// LASTSAVE 返回上次成功保存快照的 unix 时间戳
+func (server *MemgoServer) execLastSave() resp.ReplyIntf {
+	server.snapshot.mu.Lock()
+	defer server.snapshot.mu.Unlock()
+	return protocol.MakeIntReply(server.snapshot.lastSave.Unix())
+}
+
+// startSnapshotCron 每秒检查一次 save 规则
+func (server *MemgoServer) startSnapshotCron() {
+	// 启动时视为刚保存过快照, 与 redis 一致
+	server.snapshot.lastSave = time.Now()
+	params := parseSaveParams(config.Properties.Save)
+	if len(params) == 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Second)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if server.shouldSave(params) {
+					_ = server.saveSnapshot(true)
+				}
+			case <-server.closing:
+				return
+			}
+		}
+	}()
+}
+
+func (server *MemgoServer) shouldSave(params []saveParam) bool {
+	state := &server.snapshot
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.inProgress {
+		return false
+	}
+	if state.lastErr != nil && time.Since(state.lastTry) < bgSaveRetryDelay {
+		return false
+	}
+	dirty := atomic.LoadInt64(&server.dirty)
+	for _, param := range params {
+		if dirty >= param.changes && time.Since(state.lastSave) >= time.Duration(param.seconds)*time.Second {
+			return true
+		}
+	}
+	return false
+}
+
+// loadSnapshot 启动时从快照文件中恢复数据
+func (server *MemgoServer) loadSnapshot() {
+	file, err := os.Open(rdbFilename())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Error("open snapshot failed: " + err.Error())
+		}
+		return
+	}
+	defer file.Close()
+	start := time.Now()
+	keyring, err := encrypt.LoadKeyFile(config.Properties.EncryptionKeyFile)
+	if err != nil {
+		panic("load encryption key file failed: " + err.Error())
+	}
+	reader, err := encrypt.MaybeDecrypt(bufio.NewReader(file), keyring)
+	if err == nil {
+		reader, err = compress.MaybeDecompress(reader)
+	}
+	if err != nil {
+		panic("load snapshot failed: " + err.Error())
+	}
+	var loaded int
+	// 同时支持 memgo 快照与 redis 生成的 rdb 文件
+	err = rdb.DecodeAny(reader, func(entry *rdb.Entry) error {
+		loaded++
+		return server.LoadEntity(entry.DbIndex, entry.Key, entry.Entity, entry.ExpireAt)
+	})
+	if errors.Is(err, rdb.ErrUnsupportedType) {
+		panic("load snapshot failed: " + err.Error() + ", drop such keys with memgo-rdb -skip-unsupported if acceptable")
+	}
+	if err != nil {
+		// NODE 快照损坏时拒绝启动, 防止用不完整的数据覆盖快照
+		panic("load snapshot failed: " + err.Error())
+	}
+	logger.Info("loaded " + strconv.Itoa(loaded) + " keys from snapshot in " + time.Since(start).String())
+}
@@ -0,0 +1,79 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"memgo/rdb"
+	"memgo/utils"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// 快照期间并发执行的写命令不影响快照内容, 快照中是开始时的数据
+func TestSnapshotWriterPointInTime(t *testing.T) {
+	server := &MemgoServer{dbSet: []*DbObject{MakeDbObject(), MakeDbObject()}}
+	for i := range server.dbSet {
+		dbObj := server.dbSet[i]
+		dbObj.index = i
+		dbObj.beforeWrite = func(keys []string) {
+			server.saveBeforeWrite(dbObj, keys)
+		}
+	}
+	const n = 5000
+	for i := 0; i < n; i++ {
+		key := "k" + strconv.Itoa(i)
+		server.dbSet[0].execNormalCommand(utils.ToCmdLine("SET", key, "old"), nil)
+		server.dbSet[1].execNormalCommand(utils.ToCmdLine("SET", key, "old"), nil)
+	}
+
+	buf := &bytes.Buffer{}
+	enc := rdb.NewEncoder(buf)
+	if err := enc.WriteHeader(); err != nil {
+		t.Fatal(err)
+	}
+	writer := newSnapshotWriter(enc, len(server.dbSet))
+	server.addSnapshotWriter(writer)
+	update := func(from, to int) {
+		db := server.dbSet[0]
+		for i := from; i < to; i++ {
+			key := "k" + strconv.Itoa(i)
+			db.execNormalCommand(utils.ToCmdLine("SET", key, "new"), nil)
+			db.execNormalCommand(utils.ToCmdLine("SET", "new"+key, "new"), nil)
+			if i%2 == 0 {
+				db.execNormalCommand(utils.ToCmdLine("DEL", key), nil)
+			}
+		}
+	}
+	// 一半的修改发生在后台写入之前, 另一半与后台写入并发
+	update(0, n/2)
+	server.dbSet[1].execNormalCommand(utils.ToCmdLine("FLUSHDB"), nil)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		update(n/2, n)
+	}()
+	if err := writer.run(server.dbSet); err != nil {
+		t.Fatal(err)
+	}
+	server.removeSnapshotWriter(writer)
+	wg.Wait()
+
+	counts := make([]int, len(server.dbSet))
+	err := rdb.DecodeAny(bufio.NewReader(buf), func(entry *rdb.Entry) error {
+		counts[entry.DbIndex]++
+		if val := string(entry.Entity.Data.([]byte)); val != "old" {
+			t.Errorf("db %d key %s: expect old, got %s", entry.DbIndex, entry.Key, val)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, count := range counts {
+		if count != n {
+			t.Errorf("db %d: expect %d keys, got %d", i, n, count)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package database
+
+import (
+	"memgo/interface/database"
+	"memgo/rdb"
+	"sync"
+	"time"
+)
+
+// snapshotWriter 在不暂停命令的前提下 生成时间点一致的快照
+// 后台协程逐个 key 编码写入文件; 快照期间写命令修改 key 之前, 先把 key 的旧值写入快照(类似写时复制)
+// 每个 key 只写入一次: saved 记录已写入 或 快照开始时还不存在的 key
+// NODE 未写入的 key 只能被写命令修改, 而写命令必须先经过 beforeWrite, 因此持有 mu 时读到的一定是快照开始时的值
+type snapshotWriter struct {
+	mu    sync.Mutex
+	enc   rdb.SnapshotEncoder
+	curDB int // 最近一次写入的 DB header, -1 表示还未写入
+	saved []map[string]struct{}
+	// done 的 DB 已全部写入, 之后的修改都与快照无关
+	done []bool
+	err  error
+	// pace 不为 nil 时 后台协程每写入一个 key 调用一次(不持有 mu), 用于在输出过慢时等待
+	pace func()
+}
+
+func newSnapshotWriter(enc rdb.SnapshotEncoder, dbNum int) *snapshotWriter {
+	w := &snapshotWriter{
+		enc:   enc,
+		curDB: -1,
+		saved: make([]map[string]struct{}, dbNum),
+		done:  make([]bool, dbNum),
+	}
+	for i := range w.saved {
+		w.saved[i] = make(map[string]struct{})
+	}
+	return w
+}
+
+// saveKeys 写入 keys 在快照开始时的值, keys 为 nil 时写入整个 DB(FLUSHDB 等不声明 key 的写命令)
+func (w *snapshotWriter) saveKeys(dbObj *DbObject, keys []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.done[dbObj.index] {
+		return
+	}
+	if keys == nil {
+		w.saveDB(dbObj)
+		return
+	}
+	for _, key := range keys {
+		w.saveKey(dbObj, key)
+	}
+}
+
+// saveDB 写入 DB 中剩余的 key 并标记完成, 调用方需持有 mu
+func (w *snapshotWriter) saveDB(dbObj *DbObject) {
+	dbObj.data.ForEach(func(key string, _ interface{}) bool {
+		w.saveKey(dbObj, key)
+		return true
+	})
+	w.done[dbObj.index] = true
+	w.saved[dbObj.index] = nil
+}
+
+// saveKey 调用方需持有 mu
+func (w *snapshotWriter) saveKey(dbObj *DbObject, key string) {
+	saved := w.saved[dbObj.index]
+	if _, ok := saved[key]; ok {
+		return
+	}
+	saved[key] = struct{}{}
+	raw, ok := dbObj.data.Get(key)
+	if !ok || w.err != nil {
+		return
+	}
+	if w.curDB != dbObj.index {
+		if w.err = w.enc.WriteDBHeader(dbObj.index); w.err != nil {
+			return
+		}
+		w.curDB = dbObj.index
+	}
+	var expireAt *time.Time
+	if expireTime, ok := dbObj.GetExpireTime(key); ok {
+		expireAt = &expireTime
+	}
+	w.err = w.enc.WriteEntry(key, raw.(*database.DataEntity), expireAt)
+}
+
+// run 在后台逐个写入所有 DB 中还未写入的 key
+func (w *snapshotWriter) run(dbSet []*DbObject) error {
+	for _, dbObj := range dbSet {
+		dbObj.data.ForEach(func(key string, _ interface{}) bool {
+			w.mu.Lock()
+			if !w.done[dbObj.index] {
+				w.saveKey(dbObj, key)
+			}
+			err := w.err
+			w.mu.Unlock()
+			if err == nil && w.pace != nil {
+				w.pace()
+			}
+			return err == nil
+		})
+		w.mu.Lock()
+		w.done[dbObj.index] = true
+		w.saved[dbObj.index] = nil
+		err := w.err
+		w.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return w.enc.WriteEnd()
+}
+
+// addSnapshotWriter 开始一个快照, 调用方需持有 snapshotLock 的写锁, 保证开始时没有执行到一半的写命令
+// NODE BGSAVE 与每个全量同步的从节点各自有一个快照, 写命令执行前依次通知所有的快照
+func (server *MemgoServer) addSnapshotWriter(w *snapshotWriter) {
+	server.writersMu.Lock()
+	defer server.writersMu.Unlock()
+	var writers []*snapshotWriter
+	if old := server.snapshotWriters.Load(); old != nil {
+		writers = append(writers, *old...)
+	}
+	writers = append(writers, w)
+	server.snapshotWriters.Store(&writers)
+}
+
+func (server *MemgoServer) removeSnapshotWriter(w *snapshotWriter) {
+	server.writersMu.Lock()
+	defer server.writersMu.Unlock()
+	old := server.snapshotWriters.Load()
+	if old == nil {
+		return
+	}
+	writers := make([]*snapshotWriter, 0, len(*old))
+	for _, writer := range *old {
+		if writer != w {
+			writers = append(writers, writer)
+		}
+	}
+	if len(writers) == 0 {
+		server.snapshotWriters.Store(nil)
+		return
+	}
+	server.snapshotWriters.Store(&writers)
+}
+
+// saveBeforeWrite 正在生成快照时, 写命令修改 keys 之前先将其旧值写入快照
+func (server *MemgoServer) saveBeforeWrite(dbObj *DbObject, keys []string) {
+	writers := server.snapshotWriters.Load()
+	if writers == nil {
+		return
+	}
+	for _, w := range *writers {
+		w.saveKeys(dbObj, keys)
+	}
+}
@@ -99,10 +99,10 @@ func execStrlen_DbObj(db database.DbObjectIntf, args CmdLine) resp.ReplyIntf {
 }
 
 func init() {
-	RegisterCommand("GET", execGet_DbObj, readFirstKey, 2) // GET K
+	RegisterCommand("GET", execGet_DbObj, readFirstKey, 2, flagRead) // GET K
 	// TODO 目前实现的SET方法为 only SET K V ; 需要迭代更新
-	RegisterCommand("SET", execSet_DbObj, writeFirstKey, 3)       // SET K V
-	RegisterCommand("SETNX", execSetNx_DbObj, writeFirstKey, 3)   // SETNX K V
-	RegisterCommand("GETSET", execGetSet_DbObj, writeFirstKey, 3) // GETSET K V
-	RegisterCommand("STRLEN", execStrlen_DbObj, readFirstKey, 2)  // STRLEN K
+	RegisterCommand("SET", execSet_DbObj, writeFirstKey, 3, flagWrite)       // SET K V
+	RegisterCommand("SETNX", execSetNx_DbObj, writeFirstKey, 3, flagWrite)   // SETNX K V
+	RegisterCommand("GETSET", execGetSet_DbObj, writeFirstKey, 3, flagWrite) // GETSET K V
+	RegisterCommand("STRLEN", execStrlen_DbObj, readFirstKey, 2, flagRead)   // STRLEN K
 }
@@ -0,0 +1,172 @@
+package dict
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+// SampleDict 支持均匀随机采样的 dict, 用于定期删除对 ttlMap 的采样
+// 读操作无锁; 增加或删除 key 时持有 mu 并同时维护 keys, 用于 O(1) 的随机采样
+// NODE 写操作在 mu 上串行, 只用于 ttlMap, 数据本身使用无锁的 SyncDict
+// NODE Go 1.24 之后 sync.Map 的 Range 顺序是固定的, 不能用 Range 的前几个 key 作为随机 key
+type SampleDict struct {
+	m     sync.Map
+	count int32
+
+	// 所有写操作持有 mu, 保证 keys 与 m 中的 key 一致
+	mu    sync.Mutex
+	keys  []string
+	index map[string]int // key 在 keys 中的下标
+}
+
+func MakeSampleDict() *SampleDict {
+	return &SampleDict{
+		m:     sync.Map{},
+		count: 0,
+		index: make(map[string]int),
+	}
+}
+
+// addKey 调用者需要持有 mu
+func (d *SampleDict) addKey(key string) {
+	d.index[key] = len(d.keys)
+	d.keys = append(d.keys, key)
+	atomic.AddInt32(&d.count, 1)
+}
+
+// removeKey 用最后一个 key 填补被删除的位置, 调用者需要持有 mu
+func (d *SampleDict) removeKey(key string) {
+	i := d.index[key]
+	last := len(d.keys) - 1
+	d.keys[i] = d.keys[last]
+	d.index[d.keys[i]] = i
+	d.keys[last] = ""
+	d.keys = d.keys[:last]
+	delete(d.index, key)
+	atomic.AddInt32(&d.count, -1)
+}
+
+func (d *SampleDict) Get(key string) (val interface{}, exists bool) {
+	val, exists = d.m.Load(key)
+	return
+}
+
+func (d *SampleDict) Len() int {
+	return int(atomic.LoadInt32(&d.count))
+}
+
+func (d *SampleDict) Put(key string, val interface{}) (result int) {
+	// kv 已经存在 插入 return 0
+	// kv 不存在 插入 return 1
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.m.Load(key)
+	d.m.Store(key, val)
+	if ok {
+		return 0
+	}
+	d.addKey(key)
+	return 1
+}
+
+func (d *SampleDict) PutIfAbsent(key string, val interface{}) (result int) {
+	// kv 已经存在 不插入 return 0
+	// kv 不存在 插入 return 1
+	if _, ok := d.m.Load(key); ok {
+		return 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.m.Load(key); ok {
+		return 0
+	}
+	d.m.Store(key, val)
+	d.addKey(key)
+	return 1
+}
+
+func (d *SampleDict) PutIfExists(key string, val interface{}) (result int) {
+	// kv 已经存在 插入 return 1
+	// kv 不存在 不插入 return 0
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.m.Load(key); !ok {
+		return 0
+	}
+	d.m.Store(key, val)
+	return 1
+}
+
+func (d *SampleDict) Remove(key string) (result int) {
+	if _, ok := d.m.Load(key); !ok {
+		return 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.m.LoadAndDelete(key); !ok {
+		return 0
+	}
+	d.removeKey(key)
+	return 1
+}
+
+func (d *SampleDict) ForEach(consumer Consumer) {
+	d.m.Range(func(key, value interface{}) bool {
+		return consumer(key.(string), value)
+	})
+}
+
+func (d *SampleDict) Keys() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	keys := make([]string, len(d.keys))
+	copy(keys, d.keys)
+	return keys
+}
+
+// RandomKeys 返回的 key 可能重复
+func (d *SampleDict) RandomKeys(limit int) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.keys) == 0 {
+		return nil
+	}
+	keys := make([]string, limit)
+	for i := range keys {
+		keys[i] = d.keys[rand.Intn(len(d.keys))]
+	}
+	return keys
+}
+
+// RandomDistinctKeys 对 keys 的前 limit 个位置做部分 Fisher-Yates 洗牌, 同时更新 index
+func (d *SampleDict) RandomDistinctKeys(limit int) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := len(d.keys)
+	if limit >= n {
+		keys := make([]string, n)
+		copy(keys, d.keys)
+		return keys
+	}
+	keys := make([]string, limit)
+	for i := 0; i < limit; i++ {
+		j := i + rand.Intn(n-i)
+		d.keys[i], d.keys[j] = d.keys[j], d.keys[i]
+		d.index[d.keys[i]], d.index[d.keys[j]] = i, j
+		keys[i] = d.keys[i]
+	}
+	return keys
+}
+
+func (d *SampleDict) Clear() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.m.Range(func(key, value interface{}) bool {
+		d.m.Delete(key)
+		return true
+	})
+	d.keys = nil
+	d.index = make(map[string]int)
+	atomic.StoreInt32(&d.count, 0)
+}
@@ -93,16 +93,16 @@ func (d *SyncDict) ForEach(consumer Consumer) {
 }
 
 func (d *SyncDict) Keys() []string {
-	keys := make([]string, d.Len())
-	i := 0
+	// NODE 遍历过程中可能有并发写入, 不能按 Len() 预先定长
+	keys := make([]string, 0, d.Len())
 	d.m.Range(func(key, value interface{}) bool {
-		keys[i] = key.(string)
-		i++
+		keys = append(keys, key.(string))
 		return true
 	})
 	return keys
 }
 
+// RandomKeys 取 Range 的第一个 key, 并不随机; 需要随机采样时使用 SampleDict
 func (d *SyncDict) RandomKeys(limit int) []string {
 	keys := make([]string, limit)
 	for i := 0; i < limit; i++ {
@@ -132,5 +132,9 @@ func (d *SyncDict) RandomDistinctKeys(limit int) []string {
 }
 
 func (d *SyncDict) Clear() {
-	*d = *MakeSyncDict()
+	d.m.Range(func(key, value interface{}) bool {
+		d.m.Delete(key)
+		return true
+	})
+	atomic.StoreInt32(&d.count, 0)
 }
@@ -0,0 +1,420 @@
+package encrypt
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// NODE 落盘文件(aof/快照)的加密, 使用 AES-256-GCM
+// 文件格式:
+//   header: "MGENC" + 1字节版本号 + 1字节 keyID 长度 + keyID + 16字节随机 fileID
+//   frame:  4字节大端长度(密文长度, 含 16字节 tag) + 12字节随机 nonce + 密文
+// 每次 Write 生成一个 frame, 因此加密的 aof 依然可以直接追加; 读取时逐个 frame 解密, 可以流式地交给 ParseStream
+// 附加数据(AAD) 为 header + frame 在文件中的偏移, 防止 frame 被调换顺序或拼接到其他文件中
+// NODE 文件末尾不完整的 frame(宕机时只写了一半) 读取时返回 io.ErrUnexpectedEOF, 与明文 aof 结尾不完整时的处理一致
+//
+// 密钥文件每行一个密钥 "<keyID> <64位十六进制>", 以 # 开头的行为注释, 最后一个密钥用于加密新文件
+// 文件 header 中记录了加密时使用的 keyID, 因此密钥文件需要保留仍被引用的旧密钥
+
+const (
+	Magic   = "MGENC"
+	version = 1
+
+	keySize     = 32
+	fileIDSize  = 16
+	nonceSize   = 12
+	tagSize     = 16
+	lengthSize  = 4
+	maxKeyIDLen = 255
+	// 单个 frame 的明文上限, 更大的写入会被拆分为多个 frame
+	maxFramePlain = 1 << 20
+)
+
+var (
+	ErrNoKey     = errors.New("encryption key is not available")
+	ErrCorrupted = errors.New("encrypted file is corrupted")
+)
+
+// Keyring 密钥文件中的所有密钥
+type Keyring struct {
+	keys   map[string]cipher.AEAD
+	active string
+}
+
+// LoadKeyFile 读取密钥文件, filename 为空时返回 nil, 表示不加密
+func LoadKeyFile(filename string) (*Keyring, error) {
+	if filename == "" {
+		return nil, nil
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	kr := &Keyring{keys: make(map[string]cipher.AEAD)}
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || len(fields[0]) > maxKeyIDLen {
+			return nil, fmt.Errorf("invalid key file line %d", lineNum)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil || len(key) != keySize {
+			return nil, fmt.Errorf("invalid key at key file line %d: require %d hex encoded bytes", lineNum, keySize)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		kr.keys[fields[0]] = aead
+		kr.active = fields[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if kr.active == "" {
+		return nil, errors.New("no key found in key file " + filename)
+	}
+	return kr, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ActiveKeyID 加密新文件使用的密钥
+func (kr *Keyring) ActiveKeyID() string {
+	return kr.active
+}
+
+func (kr *Keyring) aead(keyID string) (cipher.AEAD, error) {
+	if kr == nil {
+		return nil, fmt.Errorf("%w: file is encrypted but no key file is configured", ErrNoKey)
+	}
+	aead, ok := kr.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: key %s not found in key file", ErrNoKey, keyID)
+	}
+	return aead, nil
+}
+
+// IsEncrypted 判断 reader 的内容是否为加密文件, 不消耗数据
+func IsEncrypted(reader *bufio.Reader) bool {
+	magic, err := reader.Peek(len(Magic))
+	return err == nil && string(magic) == Magic
+}
+
+// IsEncryptedFile 判断文件是否为加密文件, 空文件返回 false
+func IsEncryptedFile(filename string) (bool, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	return IsEncrypted(bufio.NewReader(file)), nil
+}
+
+// readHeader 读取文件 header, 返回 header 原文以及其中的 keyID
+func readHeader(r io.Reader) ([]byte, string, error) {
+	fixed := make([]byte, len(Magic)+2)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, "", err
+	}
+	if string(fixed[:len(Magic)]) != Magic {
+		return nil, "", errors.New("not an encrypted file")
+	}
+	if fixed[len(Magic)] != version {
+		return nil, "", fmt.Errorf("unsupported encryption version %d", fixed[len(Magic)])
+	}
+	rest := make([]byte, int(fixed[len(Magic)+1])+fileIDSize)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, "", err
+	}
+	keyID := string(rest[:len(rest)-fileIDSize])
+	return append(fixed, rest...), keyID, nil
+}
+
+func makeHeader(keyID string) ([]byte, error) {
+	header := make([]byte, 0, len(Magic)+2+len(keyID)+fileIDSize)
+	header = append(header, Magic...)
+	header = append(header, version, byte(len(keyID)))
+	header = append(header, keyID...)
+	fileID := make([]byte, fileIDSize)
+	if _, err := rand.Read(fileID); err != nil {
+		return nil, err
+	}
+	return append(header, fileID...), nil
+}
+
+func additionalData(header []byte, offset int64) []byte {
+	ad := make([]byte, len(header)+8)
+	copy(ad, header)
+	binary.BigEndian.PutUint64(ad[len(header):], uint64(offset))
+	return ad
+}
+
+// sealFrame 加密一个 frame, offset 为该 frame 在文件中的位置
+func sealFrame(aead cipher.AEAD, header []byte, offset int64, plain []byte) ([]byte, error) {
+	frame := make([]byte, lengthSize+nonceSize, lengthSize+nonceSize+len(plain)+tagSize)
+	binary.BigEndian.PutUint32(frame, uint32(len(plain)+tagSize))
+	if _, err := rand.Read(frame[lengthSize:]); err != nil {
+		return nil, err
+	}
+	nonce := frame[lengthSize:]
+	return aead.Seal(frame, nonce, plain, additionalData(header, offset)), nil
+}
+
+// Writer 加密写入, 每次 Write 写入一个或多个完整的 frame
+type Writer struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	offset int64 // 下一个 frame 在文件中的位置
+}
+
+// NewWriter 使用当前密钥创建新的加密文件, 立即写入 header
+func NewWriter(w io.Writer, kr *Keyring) (*Writer, error) {
+	if kr == nil {
+		return nil, ErrNoKey
+	}
+	aead, err := kr.aead(kr.ActiveKeyID())
+	if err != nil {
+		return nil, err
+	}
+	header, err := makeHeader(kr.ActiveKeyID())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, aead: aead, header: header, offset: int64(len(header))}, nil
+}
+
+// OpenAppender 追加写入已有的加密文件, 沿用文件 header 中的密钥; 空文件视为新文件
+// file 需要以 O_APPEND 打开
+func OpenAppender(file *os.File, kr *Keyring) (*Writer, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		return NewWriter(file, kr)
+	}
+	header, keyID, err := readHeader(io.NewSectionReader(file, 0, info.Size()))
+	if err != nil {
+		return nil, fmt.Errorf("read encryption header of %s: %w", file.Name(), err)
+	}
+	aead, err := kr.aead(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{w: file, aead: aead, header: header, offset: info.Size()}, nil
+}
+
+// Write 加密 p 并写入, 返回写入的明文长度
+func (w *Writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxFramePlain {
+			chunk = chunk[:maxFramePlain]
+		}
+		frame, err := sealFrame(w.aead, w.header, w.offset, chunk)
+		if err != nil {
+			return written, err
+		}
+		n, err := w.w.Write(frame)
+		w.offset += int64(n)
+		if err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// Reader 逐个 frame 解密
+type Reader struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	header []byte
+	offset int64
+	plain  []byte // 当前 frame 中还未被读取的明文
+	err    error
+}
+
+// NewReader 读取 header 并创建解密 reader
+func NewReader(r io.Reader, kr *Keyring) (*Reader, error) {
+	header, keyID, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := kr.aead(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{r: r, aead: aead, header: header, offset: int64(len(header))}, nil
+}
+
+// MaybeDecrypt 内容为加密文件时返回解密后的 reader, 否则原样返回
+func MaybeDecrypt(r *bufio.Reader, kr *Keyring) (*bufio.Reader, error) {
+	if !IsEncrypted(r) {
+		return r, nil
+	}
+	dec, err := NewReader(r, kr)
+	if err != nil {
+		return nil, err
+	}
+	return bufio.NewReader(dec), nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.plain, r.err = r.nextFrame()
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+func (r *Reader) nextFrame() ([]byte, error) {
+	sealedLen, sealed, err := readFrame(r.r)
+	if err != nil {
+		return nil, err
+	}
+	nonce, ciphertext := sealed[:nonceSize], sealed[nonceSize:]
+	plain, err := r.aead.Open(ciphertext[:0], nonce, ciphertext, additionalData(r.header, r.offset))
+	if err != nil {
+		return nil, fmt.Errorf("%w: authentication failed at offset %d", ErrCorrupted, r.offset)
+	}
+	r.offset += int64(lengthSize + nonceSize + sealedLen)
+	return plain, nil
+}
+
+// readFrame 读取一个 frame, 返回密文长度 与 nonce+密文
+// 文件恰好结束时返回 io.EOF, frame 不完整时返回 io.ErrUnexpectedEOF
+func readFrame(r io.Reader) (int, []byte, error) {
+	var length [lengthSize]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return 0, nil, err
+	}
+	sealedLen := int(binary.BigEndian.Uint32(length[:]))
+	if sealedLen < tagSize || sealedLen > maxFramePlain+tagSize {
+		return 0, nil, fmt.Errorf("%w: invalid frame length %d", ErrCorrupted, sealedLen)
+	}
+	sealed := make([]byte, nonceSize+sealedLen)
+	if _, err := io.ReadFull(r, sealed); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return sealedLen, sealed, nil
+}
+
+// PlainSize 返回加密文件中明文的长度, 不需要密钥; 结尾不完整的 frame 不计入
+func PlainSize(filename string) (int64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	header, _, err := readHeader(io.NewSectionReader(file, 0, info.Size()))
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	var length [lengthSize]byte
+	for pos := int64(len(header)); ; {
+		if _, err := file.ReadAt(length[:], pos); err != nil {
+			if err == io.EOF {
+				return size, nil
+			}
+			return 0, err
+		}
+		sealedLen := int64(binary.BigEndian.Uint32(length[:]))
+		pos += lengthSize + nonceSize + sealedLen
+		if sealedLen < tagSize || pos > info.Size() {
+			return size, nil
+		}
+		size += sealedLen - tagSize
+	}
+}
+
+// Truncate 将加密文件截断到明文中的 offset 处
+// offset 位于 frame 中间时, 截断该 frame 并将其剩余的明文重新加密
+func Truncate(file *os.File, kr *Keyring, offset int64) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(io.NewSectionReader(file, 0, info.Size()))
+	header, keyID, err := readHeader(reader)
+	if err != nil {
+		return err
+	}
+	var plainPos int64
+	cipherPos := int64(len(header))
+	for plainPos < offset {
+		sealedLen, sealed, err := readFrame(reader)
+		if err != nil {
+			return fmt.Errorf("truncate offset %d is beyond the valid data: %w", offset, err)
+		}
+		frameSize := int64(lengthSize + nonceSize + sealedLen)
+		plainLen := int64(sealedLen - tagSize)
+		if plainPos+plainLen > offset {
+			aead, err := kr.aead(keyID)
+			if err != nil {
+				return err
+			}
+			nonce, ciphertext := sealed[:nonceSize], sealed[nonceSize:]
+			plain, err := aead.Open(nil, nonce, ciphertext, additionalData(header, cipherPos))
+			if err != nil {
+				return fmt.Errorf("%w: authentication failed at offset %d", ErrCorrupted, cipherPos)
+			}
+			frame, err := sealFrame(aead, header, cipherPos, plain[:offset-plainPos])
+			if err != nil {
+				return err
+			}
+			if err := file.Truncate(cipherPos); err != nil {
+				return err
+			}
+			_, err = file.WriteAt(frame, cipherPos)
+			return err
+		}
+		plainPos += plainLen
+		cipherPos += frameSize
+	}
+	return file.Truncate(cipherPos)
+}
@@ -0,0 +1,109 @@
+package encrypt
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeKeyFile(t *testing.T, dir string, lines ...string) *Keyring {
+	filename := filepath.Join(dir, "keys")
+	if err := os.WriteFile(filename, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	kr, err := LoadKeyFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kr
+}
+
+func readAll(t *testing.T, filename string, kr *Keyring) ([]byte, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := MaybeDecrypt(bufio.NewReader(file), kr)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(reader)
+}
+
+func TestAppendAndRotate(t *testing.T) {
+	dir := t.TempDir()
+	key1 := "k1 " + strings.Repeat("01", keySize)
+	key2 := "k2 " + strings.Repeat("02", keySize)
+	kr := writeKeyFile(t, dir, key1)
+	filename := filepath.Join(dir, "data")
+
+	file, _ := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	w, err := OpenAppender(file, kr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write([]byte("hello "))
+	_ = file.Close()
+
+	// 轮换密钥后 已有的文件继续使用原来的密钥追加
+	kr = writeKeyFile(t, dir, key1, key2)
+	file, _ = os.OpenFile(filename, os.O_APPEND|os.O_RDWR, 0600)
+	if w, err = OpenAppender(file, kr); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write([]byte("world"))
+	_ = file.Close()
+
+	data, err := readAll(t, filename, kr)
+	if err != nil || string(data) != "hello world" {
+		t.Fatalf("unexpected content %q %v", data, err)
+	}
+	if size, _ := PlainSize(filename); size != int64(len("hello world")) {
+		t.Errorf("wrong plain size %d", size)
+	}
+	if _, err := readAll(t, filename, writeKeyFile(t, dir, key2)); err == nil {
+		t.Error("expect error without the original key")
+	}
+}
+
+func TestCorruptedAndTruncated(t *testing.T) {
+	dir := t.TempDir()
+	kr := writeKeyFile(t, dir, "k1 "+strings.Repeat("ab", keySize))
+	buf := &bytes.Buffer{}
+	w, _ := NewWriter(buf, kr)
+	_, _ = w.Write([]byte("first"))
+	_, _ = w.Write([]byte("second"))
+	raw := buf.Bytes()
+	filename := filepath.Join(dir, "data")
+
+	// 结尾不完整的 frame
+	_ = os.WriteFile(filename, raw[:len(raw)-3], 0600)
+	data, err := readAll(t, filename, kr)
+	if err != io.ErrUnexpectedEOF || string(data) != "first" {
+		t.Errorf("expect truncated error, actual %q %v", data, err)
+	}
+
+	// 篡改密文
+	tampered := append([]byte(nil), raw...)
+	tampered[len(tampered)-1] ^= 1
+	_ = os.WriteFile(filename, tampered, 0600)
+	if _, err = readAll(t, filename, kr); err == nil || !strings.Contains(err.Error(), ErrCorrupted.Error()) {
+		t.Errorf("expect corrupted error, actual %v", err)
+	}
+
+	// 截断到 frame 中间时重新加密剩余部分
+	_ = os.WriteFile(filename, raw, 0600)
+	file, _ := os.OpenFile(filename, os.O_RDWR, 0600)
+	if err := Truncate(file, kr, int64(len("first")+3)); err != nil {
+		t.Fatal(err)
+	}
+	_ = file.Close()
+	if data, err = readAll(t, filename, kr); err != nil || string(data) != "firstsec" {
+		t.Errorf("unexpected content after truncate %q %v", data, err)
+	}
+}
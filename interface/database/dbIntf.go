@@ -25,6 +25,8 @@ type DBServerIntf interface {
 type DBEngine interface {
 	DBServerIntf
 	ForEach(idx int, entity2reply func(key string, entity *DataEntity, expireAt *time.Time) bool)
+	// LoadEntity 从快照加载数据时直接写入 key, 不经过命令执行, 也不会写入 aof
+	LoadEntity(idx int, key string, entity *DataEntity, expireAt *time.Time) error
 }
 
 type DbObjectIntf interface {
@@ -5,6 +5,7 @@ import (
 	"memgo/config"
 	"memgo/logger"
 	"memgo/redis/RESP/handler"
+	"memgo/sentinel"
 	"memgo/tcp"
 	utils "memgo/utils/rand_string"
 	"os"
@@ -26,6 +27,11 @@ var defaultProperties = &config.ServerProperties{
 	AppendFilename: "0517test.aof",
 	MaxClients:     5000,
 	RunID:          utils.RandString(40),
+
+	AutoAofRewritePercentage: 100,
+	AutoAofRewriteMinSize:    64 << 20,
+	AofUseRdbPreamble:        true,
+	AofLoadTruncated:         true,
 }
 
 func fileExists(filename string) bool {
@@ -41,6 +47,11 @@ func main() {
 		Ext:        "log",
 		TimeFormat: "2006-01-02",
 	})
+	// memgo --sentinel sentinel.conf 以哨兵模式启动
+	if len(os.Args) == 3 && os.Args[1] == "--sentinel" {
+		runSentinel(os.Args[2])
+		return
+	}
 	configFilename := os.Getenv("CONFIG")
 	if configFilename == "" {
 		if fileExists("redis.conf") {
@@ -59,3 +70,19 @@ func main() {
 		logger.Error(err)
 	}
 }
+
+func runSentinel(configFilename string) {
+	cfg, err := sentinel.LoadConfig(configFilename)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	s := sentinel.New(cfg)
+	s.Start()
+	err = tcp.ListenAndServeWithSignal(&tcp.Config{
+		Address: fmt.Sprintf("%s:%d", cfg.Bind, cfg.Port),
+	}, handler.MakeHandlerWith(s))
+	if err != nil {
+		logger.Error(err)
+	}
+}
@@ -0,0 +1,102 @@
+package raft
+
+import (
+	"math"
+	"memgo/interface/resp"
+	"memgo/redis/RESP/protocol"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 每个节点独立执行日志中的命令, 重启时也会重放日志, 因此提交的命令必须是确定的:
+// 依赖当前时间的相对过期时间在 leader 上换算为绝对时间, SPOP 由 leader 选出成员后以 SREM 提交
+// NODE 与 aof 中记录的形式相同(PEXPIREAT, SREM)
+
+const maxSpopRetries = 5
+
+// proposeDeterministic 将命令改写为确定的形式之后提交
+func (s *Server) proposeDeterministic(client resp.ConnectionIntf, cmdLine [][]byte) resp.ReplyIntf {
+	now := time.Now()
+	switch strings.ToLower(string(cmdLine[0])) {
+	case "expire":
+		return s.proposeExpire(client, cmdLine, now, time.Second)
+	case "pexpire":
+		return s.proposeExpire(client, cmdLine, now, time.Millisecond)
+	case "restore", "restore-asking":
+		cmdLine = absRestore(cmdLine, now)
+	case "spop":
+		return s.proposeSpop(client, cmdLine)
+	}
+	return s.node.Propose(client.GetDBIndex(), cmdLine)
+}
+
+// proposeExpire EXPIRE key seconds [NX|XX|GT|LT] -> PEXPIREAT key unix-time-milliseconds [NX|XX|GT|LT]
+func (s *Server) proposeExpire(client resp.ConnectionIntf, cmdLine [][]byte, now time.Time, unit time.Duration) resp.ReplyIntf {
+	if len(cmdLine) < 3 {
+		return s.node.Propose(client.GetDBIndex(), cmdLine)
+	}
+	raw, err := strconv.ParseInt(string(cmdLine[2]), 10, 64)
+	if err != nil {
+		// 参数错误在各节点上得到相同的错误回复
+		return s.node.Propose(client.GetDBIndex(), cmdLine)
+	}
+	// NODE 与单机模式相同, 相对时间需能用 time.Duration 表示, 此时换算为毫秒时间戳也不会溢出
+	if limit := math.MaxInt64 / int64(unit); raw > limit || raw < -limit {
+		return protocol.MakeErrReply("ERR invalid expire time in '" + strings.ToLower(string(cmdLine[0])) + "' command")
+	}
+	factor := int64(unit / time.Millisecond)
+	nowMs := now.UnixMilli()
+	rewritten := make([][]byte, 0, len(cmdLine))
+	rewritten = append(rewritten, []byte("PEXPIREAT"), cmdLine[1], []byte(strconv.FormatInt(nowMs+raw*factor, 10)))
+	rewritten = append(rewritten, cmdLine[3:]...)
+	return s.node.Propose(client.GetDBIndex(), rewritten)
+}
+
+// absRestore RESTORE key ttl value [REPLACE] 的 ttl 换算为绝对时间并加上 ABSTTL
+func absRestore(cmdLine [][]byte, now time.Time) [][]byte {
+	if len(cmdLine) < 4 {
+		return cmdLine
+	}
+	for _, arg := range cmdLine[4:] {
+		if strings.ToUpper(string(arg)) == "ABSTTL" {
+			return cmdLine
+		}
+	}
+	ttl, err := strconv.ParseInt(string(cmdLine[2]), 10, 64)
+	if err != nil || ttl <= 0 || ttl > math.MaxInt64-now.UnixMilli() {
+		return cmdLine
+	}
+	rewritten := make([][]byte, 0, len(cmdLine)+1)
+	rewritten = append(rewritten, cmdLine[0], cmdLine[1], []byte(strconv.FormatInt(now.UnixMilli()+ttl, 10)))
+	rewritten = append(rewritten, cmdLine[3:]...)
+	return append(rewritten, []byte("ABSTTL"))
+}
+
+// proposeSpop leader 在已应用的状态中随机选出成员, 以 SREM 提交; 成员被并发的命令删除时重新选择
+func (s *Server) proposeSpop(client resp.ConnectionIntf, cmdLine [][]byte) resp.ReplyIntf {
+	if len(cmdLine) != 2 {
+		return s.node.Propose(client.GetDBIndex(), cmdLine)
+	}
+	key := cmdLine[1]
+	for i := 0; i < maxSpopRetries; i++ {
+		if reply := s.node.ReadBarrier(); reply != nil {
+			return reply
+		}
+		random := s.db.Exec(client, [][]byte{[]byte("SRANDMEMBER"), key})
+		member, ok := random.(*protocol.BulkReply)
+		if !ok {
+			// key 不存在或者类型错误
+			return random
+		}
+		reply := s.node.Propose(client.GetDBIndex(), [][]byte{[]byte("SREM"), key, member.Arg})
+		removed, ok := reply.(*protocol.IntReply)
+		if !ok {
+			return reply
+		}
+		if removed.Code == 1 {
+			return protocol.MakeBulkReply(member.Arg)
+		}
+	}
+	return protocol.MakeErrReply("TRYAGAIN SPOP conflicted with concurrent writes")
+}
@@ -0,0 +1,48 @@
+package raft
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 投票与选举都必须先持久化 term 与 votedFor, 无法持久化时拒绝投票, 放弃选举
+func TestPersistStateFailure(t *testing.T) {
+	dir := t.TempDir()
+	self, other := "127.0.0.1:1", "127.0.0.1:2"
+	n, err := NewNode(Config{Self: self, Peers: []string{self, other}, Dir: dir}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.storage.close()
+	// 状态文件的位置是一个非空目录, 写入时 rename 失败
+	statePath := filepath.Join(dir, stateFile)
+	if err := os.MkdirAll(filepath.Join(statePath, "blocked"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, granted := n.handleRequestVote(1, other, 0, 0); granted {
+		t.Fatal("granted a vote that was not persisted")
+	}
+	n.mu.Lock()
+	if n.votedFor != "" {
+		t.Fatalf("votedFor %q after failed persist", n.votedFor)
+	}
+	term := n.currentTerm
+	n.startElection()
+	if n.role != follower || n.currentTerm != term || n.votedFor != "" {
+		t.Fatalf("election started without persisting: role %d term %d votedFor %q", n.role, n.currentTerm, n.votedFor)
+	}
+	n.mu.Unlock()
+
+	if err := os.RemoveAll(statePath); err != nil {
+		t.Fatal(err)
+	}
+	if _, granted := n.handleRequestVote(2, other, 0, 0); !granted {
+		t.Fatal("vote refused after storage recovered")
+	}
+	savedTerm, votedFor, err := n.storage.loadState()
+	if err != nil || savedTerm != 2 || votedFor != other {
+		t.Fatalf("persisted state %d %q %v", savedTerm, votedFor, err)
+	}
+}
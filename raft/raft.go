@@ -0,0 +1,647 @@
+// Package raft raft 模式: self 与 peers 组成一个 raft 组, 写命令写入日志, 多数节点持久化之后才应用到数据库
+// 只有 leader 处理客户端的读写命令, 其他节点回复 -NOTLEADER <leader 地址>
+// 读命令通过 read index 或者 leader 租约确认本节点仍是 leader 之后执行, 保证线性一致
+
+package raft
+
+import (
+	"errors"
+	"math/rand"
+	"memgo/interface/resp"
+	"memgo/logger"
+	"memgo/redis/RESP/protocol"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultElectionTimeout   = time.Second
+	defaultSnapshotThreshold = 10000
+	// 每次 AppendEntries 最多携带的日志数
+	maxBatch = 128
+
+	ReadIndex = "readindex"
+	ReadLease = "lease"
+)
+
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+func (r role) String() string {
+	switch r {
+	case leader:
+		return "leader"
+	case candidate:
+		return "candidate"
+	}
+	return "follower"
+}
+
+// StateMachine 提交的日志按顺序应用到状态机, 快照用于压缩日志以及同步落后太多的节点
+type StateMachine interface {
+	Apply(entry *Entry) resp.ReplyIntf
+	Snapshot() ([]byte, error)
+	Restore(data []byte) error
+}
+
+type Config struct {
+	Self              string // 本节点地址, 同时作为节点 id
+	Peers             []string
+	Dir               string
+	ElectionTimeout   time.Duration
+	ReadMode          string
+	SnapshotThreshold int
+}
+
+// waiter 等待日志应用的客户端, 日志被其他 leader 的日志覆盖时 term 不同
+type waiter struct {
+	term  int64
+	reply chan resp.ReplyIntf
+}
+
+type Node struct {
+	cfg       Config
+	heartbeat time.Duration
+	fsm       StateMachine
+	storage   *storage
+
+	mu          sync.Mutex
+	changed     *sync.Cond // commitIndex, lastApplied, 角色或确认 leader 身份的回复发生变化
+	role        role
+	currentTerm int64
+	votedFor    string
+	leader      string
+	// log[0] 只有 Index 与 Term, 表示快照中的最后一条日志(没有快照时为 0 0)
+	log         []*Entry
+	commitIndex int64
+	lastApplied int64
+	peers       map[string]*peer
+	waiters     map[int64]*waiter
+
+	electionDeadline time.Time
+	lastHeard        time.Time // 最近一次收到 leader 消息的时间
+	leaderSince      time.Time
+	noopIndex        int64 // 当选时追加的空日志, 提交之后才能确定 commitIndex 包含之前所有已提交的日志
+
+	// 应用日志与安装快照互斥, 先于 mu 加锁
+	applyMu sync.Mutex
+
+	closed  bool
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewNode 从 cfg.Dir 恢复状态, 快照先应用到状态机, 之后的日志在提交后重新应用
+func NewNode(cfg Config, fsm StateMachine) (*Node, error) {
+	if cfg.ElectionTimeout <= 0 {
+		cfg.ElectionTimeout = defaultElectionTimeout
+	}
+	if cfg.SnapshotThreshold <= 0 {
+		cfg.SnapshotThreshold = defaultSnapshotThreshold
+	}
+	if cfg.ReadMode == "" {
+		cfg.ReadMode = ReadIndex
+	}
+	if cfg.ReadMode != ReadIndex && cfg.ReadMode != ReadLease {
+		return nil, errors.New("unknown raft read mode " + cfg.ReadMode)
+	}
+	st, err := openStorage(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		cfg:       cfg,
+		heartbeat: cfg.ElectionTimeout / 10,
+		fsm:       fsm,
+		storage:   st,
+		peers:     make(map[string]*peer),
+		waiters:   make(map[int64]*waiter),
+		closing:   make(chan struct{}),
+	}
+	n.changed = sync.NewCond(&n.mu)
+	if n.currentTerm, n.votedFor, err = st.loadState(); err != nil {
+		st.close()
+		return nil, err
+	}
+	snapIndex, snapTerm, data, err := st.loadSnapshot()
+	if err == nil && data != nil {
+		err = fsm.Restore(data)
+	}
+	if err != nil {
+		st.close()
+		return nil, err
+	}
+	n.log = []*Entry{{Index: snapIndex, Term: snapTerm}}
+	n.commitIndex, n.lastApplied = snapIndex, snapIndex
+	entries, err := st.loadLog()
+	if err != nil {
+		st.close()
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Index == n.lastIndex()+1 {
+			n.log = append(n.log, e)
+		}
+	}
+	for _, addr := range cfg.Peers {
+		if addr != "" && addr != cfg.Self {
+			n.peers[addr] = newPeer(addr)
+		}
+	}
+	n.resetElectionTimer()
+	logger.Info("raft: " + cfg.Self + " term " + strconv.FormatInt(n.currentTerm, 10) + ", snapshot at " +
+		strconv.FormatInt(snapIndex, 10) + ", last log index " + strconv.FormatInt(n.lastIndex(), 10))
+	return n, nil
+}
+
+func (n *Node) Start() {
+	n.wg.Add(2 + len(n.peers))
+	go n.ticker()
+	go n.applier()
+	for _, p := range n.peers {
+		go n.replicator(p)
+	}
+}
+
+func (n *Node) Close() {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return
+	}
+	n.closed = true
+	close(n.closing)
+	n.changed.Broadcast()
+	n.mu.Unlock()
+	n.wg.Wait()
+	for _, p := range n.peers {
+		p.close()
+	}
+	n.storage.close()
+}
+
+func (n *Node) quorum() int {
+	return (len(n.peers)+1)/2 + 1
+}
+
+func (n *Node) lastIndex() int64 {
+	return n.log[len(n.log)-1].Index
+}
+
+func (n *Node) snapshotIndex() int64 {
+	return n.log[0].Index
+}
+
+// entry 调用方需保证 index 在 [snapshotIndex, lastIndex] 之间
+func (n *Node) entry(index int64) *Entry {
+	return n.log[index-n.snapshotIndex()]
+}
+
+func (n *Node) resetElectionTimer() {
+	n.electionDeadline = time.Now().Add(n.cfg.ElectionTimeout + time.Duration(rand.Int63n(int64(n.cfg.ElectionTimeout))))
+}
+
+// persistState currentTerm 与 votedFor 必须在回复之前刷盘, 否则重启后可能在同一 term 投票两次
+// 失败时调用方不能投票或发起选举
+func (n *Node) persistState() error {
+	if err := n.storage.saveState(n.currentTerm, n.votedFor); err != nil {
+		logger.Error("raft: save state failed: " + err.Error())
+		return err
+	}
+	return nil
+}
+
+// stepDown 收到更大的 term 或者失去多数节点时成为 follower, 调用方需持有 mu
+func (n *Node) stepDown(term int64) {
+	if term > n.currentTerm {
+		n.currentTerm = term
+		n.votedFor = ""
+		// NODE 失败时只是 term 没有持久化, 重启后回到旧的 term 与当时的投票, 仍然安全; 投票前会再次持久化
+		_ = n.persistState()
+	}
+	if n.role == leader {
+		logger.Info("raft: step down at term " + strconv.FormatInt(n.currentTerm, 10))
+		n.leader = ""
+	}
+	n.role = follower
+	n.changed.Broadcast()
+}
+
+func (n *Node) ticker() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.closing:
+			return
+		}
+		now := time.Now()
+		n.mu.Lock()
+		if n.role != leader && now.After(n.electionDeadline) {
+			n.startElection()
+		} else if n.role == leader && now.Sub(n.leaderSince) > n.cfg.ElectionTimeout &&
+			n.acked(now.Add(-n.cfg.ElectionTimeout)) < n.quorum() {
+			// 一个选举超时内没有联系上多数节点, 其他节点可能已经选出新的 leader
+			logger.Warn("raft: lost contact with the majority")
+			n.stepDown(n.currentTerm)
+		}
+		n.mu.Unlock()
+	}
+}
+
+// acked 包括本节点在内, 在 since 之后发送的 AppendEntries 得到成功回复的节点数, 调用方需持有 mu
+func (n *Node) acked(since time.Time) int {
+	count := 1
+	for _, p := range n.peers {
+		if !p.ackSent.Before(since) {
+			count++
+		}
+	}
+	return count
+}
+
+// startElection 调用方需持有 mu
+func (n *Node) startElection() {
+	prevTerm, prevVote := n.currentTerm, n.votedFor
+	n.currentTerm++
+	n.votedFor = n.cfg.Self
+	n.resetElectionTimer()
+	if err := n.persistState(); err != nil {
+		// 无法持久化给自己的投票, 放弃本次选举, 下一个选举超时后重试
+		n.currentTerm, n.votedFor = prevTerm, prevVote
+		return
+	}
+	n.role = candidate
+	n.leader = ""
+	term, lastIndex, lastTerm := n.currentTerm, n.lastIndex(), n.log[len(n.log)-1].Term
+	logger.Info("raft: start election at term " + strconv.FormatInt(term, 10))
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	n.wg.Add(len(n.peers))
+	for _, p := range n.peers {
+		go func(p *peer) {
+			defer n.wg.Done()
+			replyTerm, granted, err := p.requestVote(n.cfg.ElectionTimeout, term, n.cfg.Self, lastIndex, lastTerm)
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if replyTerm > n.currentTerm {
+				n.stepDown(replyTerm)
+				return
+			}
+			if n.role != candidate || n.currentTerm != term || !granted {
+				return
+			}
+			votes++
+			if votes >= n.quorum() {
+				n.becomeLeader()
+			}
+		}(p)
+	}
+}
+
+// becomeLeader 追加一条空日志, 提交之后之前 term 的日志也随之提交, 调用方需持有 mu
+func (n *Node) becomeLeader() {
+	logger.Info("raft: become leader at term " + strconv.FormatInt(n.currentTerm, 10))
+	n.role = leader
+	n.leader = n.cfg.Self
+	n.leaderSince = time.Now()
+	for _, p := range n.peers {
+		p.nextIndex = n.lastIndex() + 1
+		p.matchIndex = 0
+		p.ackSent = time.Time{}
+	}
+	noop := &Entry{Index: n.lastIndex() + 1, Term: n.currentTerm}
+	if err := n.storage.append([]*Entry{noop}); err != nil {
+		logger.Error("raft: append log failed: " + err.Error())
+		n.stepDown(n.currentTerm)
+		return
+	}
+	n.log = append(n.log, noop)
+	n.noopIndex = noop.Index
+	n.broadcastAppend()
+	n.advanceCommit()
+	n.changed.Broadcast()
+}
+
+// broadcastAppend 立即向所有节点发送 AppendEntries, 不等待下一次心跳
+func (n *Node) broadcastAppend() {
+	for _, p := range n.peers {
+		p.notify()
+	}
+}
+
+// advanceCommit 多数节点持有的当前 term 的日志提交, 调用方需持有 mu
+// NODE 之前 term 的日志即使已经复制到多数节点也不能直接提交(raft 论文 5.4.2)
+func (n *Node) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex; index-- {
+		if n.entry(index).Term != n.currentTerm {
+			return
+		}
+		count := 1
+		for _, p := range n.peers {
+			if p.matchIndex >= index {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commitIndex = index
+			n.changed.Broadcast()
+			return
+		}
+	}
+}
+
+// replicator leader 向一个节点复制日志, 有新的日志时立即发送, 否则每个心跳间隔发送一次
+func (n *Node) replicator(p *peer) {
+	defer n.wg.Done()
+	timer := time.NewTimer(n.heartbeat)
+	defer timer.Stop()
+	for {
+		select {
+		case <-p.trigger:
+		case <-timer.C:
+		case <-n.closing:
+			return
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(n.heartbeat)
+		n.replicateTo(p)
+	}
+}
+
+func (n *Node) replicateTo(p *peer) {
+	n.mu.Lock()
+	if n.role != leader {
+		n.mu.Unlock()
+		return
+	}
+	term := n.currentTerm
+	if p.nextIndex <= n.snapshotIndex() {
+		n.mu.Unlock()
+		n.sendSnapshot(p, term)
+		return
+	}
+	prevIndex := p.nextIndex - 1
+	prevTerm := n.entry(prevIndex).Term
+	end := n.lastIndex()
+	if end-prevIndex > maxBatch {
+		end = prevIndex + maxBatch
+	}
+	entries := append([]*Entry(nil), n.log[prevIndex+1-n.snapshotIndex():end+1-n.snapshotIndex()]...)
+	commitIndex := n.commitIndex
+	n.mu.Unlock()
+
+	sent := time.Now()
+	replyTerm, success, matchIndex, err := p.appendEntries(n.cfg.ElectionTimeout, term, n.cfg.Self, prevIndex, prevTerm, commitIndex, entries)
+	if err != nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.checkReply(p, term, replyTerm, sent) {
+		return
+	}
+	if success {
+		if matchIndex > p.matchIndex {
+			p.matchIndex = matchIndex
+		}
+		p.nextIndex = p.matchIndex + 1
+		n.advanceCommit()
+	} else {
+		// 回复中是对方的最后一条日志或者冲突的位置
+		p.nextIndex--
+		if matchIndex+1 < p.nextIndex {
+			p.nextIndex = matchIndex + 1
+		}
+		if p.nextIndex < 1 {
+			p.nextIndex = 1
+		}
+	}
+	if p.nextIndex <= n.lastIndex() {
+		p.notify()
+	}
+}
+
+// checkReply 处理回复中的 term, 返回 leader 身份是否仍然有效, 调用方需持有 mu
+func (n *Node) checkReply(p *peer, term, replyTerm int64, sent time.Time) bool {
+	if replyTerm > n.currentTerm {
+		n.stepDown(replyTerm)
+		return false
+	}
+	if n.role != leader || n.currentTerm != term {
+		return false
+	}
+	if sent.After(p.ackSent) {
+		p.ackSent = sent
+		n.changed.Broadcast()
+	}
+	return true
+}
+
+func (n *Node) sendSnapshot(p *peer, term int64) {
+	index, lastTerm, data, err := n.storage.loadSnapshot()
+	if err != nil {
+		logger.Error("raft: load snapshot failed: " + err.Error())
+		return
+	}
+	sent := time.Now()
+	replyTerm, err := p.installSnapshot(n.cfg.ElectionTimeout, term, n.cfg.Self, index, lastTerm, data)
+	if err != nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.checkReply(p, term, replyTerm, sent) {
+		return
+	}
+	if index > p.matchIndex {
+		p.matchIndex = index
+	}
+	p.nextIndex = p.matchIndex + 1
+	n.advanceCommit()
+	p.notify()
+}
+
+// applier 按顺序应用已提交的日志, 并回复等待的客户端
+func (n *Node) applier() {
+	defer n.wg.Done()
+	for {
+		n.mu.Lock()
+		for !n.closed && n.lastApplied >= n.commitIndex {
+			n.changed.Wait()
+		}
+		closed := n.closed
+		n.mu.Unlock()
+		if closed {
+			return
+		}
+		n.applyCommitted()
+	}
+}
+
+func (n *Node) applyCommitted() {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	// 等待期间可能安装了快照, 重新计算
+	start, end := n.lastApplied+1, n.commitIndex
+	entries := append([]*Entry(nil), n.log[start-n.snapshotIndex():end+1-n.snapshotIndex()]...)
+	n.mu.Unlock()
+
+	for _, e := range entries {
+		var reply resp.ReplyIntf
+		if len(e.Cmd) > 0 {
+			reply = n.fsm.Apply(e)
+		}
+		n.mu.Lock()
+		n.lastApplied = e.Index
+		if w := n.waiters[e.Index]; w != nil {
+			delete(n.waiters, e.Index)
+			if w.term != e.Term {
+				reply = n.notLeaderReply()
+			}
+			w.reply <- reply
+		}
+		n.changed.Broadcast()
+		n.mu.Unlock()
+	}
+
+	n.mu.Lock()
+	shouldSnapshot := n.lastApplied-n.snapshotIndex() >= int64(n.cfg.SnapshotThreshold)
+	n.mu.Unlock()
+	if shouldSnapshot {
+		n.takeSnapshot()
+	}
+}
+
+// takeSnapshot 状态机停在 lastApplied, 保存快照后删除快照包含的日志, 调用方需持有 applyMu
+func (n *Node) takeSnapshot() {
+	start := time.Now()
+	data, err := n.fsm.Snapshot()
+	if err != nil {
+		logger.Error("raft: snapshot failed: " + err.Error())
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	index := n.lastApplied
+	term := n.entry(index).Term
+	if err := n.storage.saveSnapshot(index, term, data); err != nil {
+		logger.Error("raft: save snapshot failed: " + err.Error())
+		return
+	}
+	log := append([]*Entry{{Index: index, Term: term}}, n.log[index+1-n.snapshotIndex():]...)
+	if err := n.storage.rewriteLog(log[1:]); err != nil {
+		logger.Error("raft: compact log failed: " + err.Error())
+		return
+	}
+	n.log = log
+	logger.Info("raft: snapshot at " + strconv.FormatInt(index, 10) + " in " + time.Since(start).String())
+}
+
+func (n *Node) notLeaderReply() resp.ReplyIntf {
+	if n.leader != "" && n.leader != n.cfg.Self {
+		return protocol.MakeErrReply("NOTLEADER " + n.leader)
+	}
+	return protocol.MakeErrReply("TRYAGAIN No raft leader elected")
+}
+
+// waitUntil 等待 cond 成立, 超时或者节点关闭时返回 false, 调用方需持有 mu
+func (n *Node) waitUntil(deadline time.Time, cond func() bool) bool {
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		n.mu.Lock()
+		n.changed.Broadcast()
+		n.mu.Unlock()
+	})
+	defer timer.Stop()
+	for !cond() {
+		if n.closed || !time.Now().Before(deadline) {
+			return false
+		}
+		n.changed.Wait()
+	}
+	return true
+}
+
+// Propose leader 将命令写入日志, 等待提交并应用后返回执行结果
+func (n *Node) Propose(db int, cmdLine [][]byte) resp.ReplyIntf {
+	n.mu.Lock()
+	if n.role != leader {
+		defer n.mu.Unlock()
+		return n.notLeaderReply()
+	}
+	e := &Entry{Index: n.lastIndex() + 1, Term: n.currentTerm, DB: db, Cmd: cmdLine}
+	if err := n.storage.append([]*Entry{e}); err != nil {
+		n.mu.Unlock()
+		logger.Error("raft: append log failed: " + err.Error())
+		return protocol.MakeErrReply("ERR raft log write failed: " + err.Error())
+	}
+	n.log = append(n.log, e)
+	w := &waiter{term: e.Term, reply: make(chan resp.ReplyIntf, 1)}
+	n.waiters[e.Index] = w
+	n.broadcastAppend()
+	n.advanceCommit()
+	n.mu.Unlock()
+
+	timer := time.NewTimer(2 * n.cfg.ElectionTimeout)
+	defer timer.Stop()
+	select {
+	case reply := <-w.reply:
+		return reply
+	case <-timer.C:
+	case <-n.closing:
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.waiters, e.Index)
+	// NODE 超时的日志仍可能在之后提交, 客户端无法确定命令是否执行
+	return protocol.MakeErrReply("TIMEOUT raft log entry not committed in time")
+}
+
+// ReadBarrier 确认本节点是 leader 且状态机已经应用了当前的 commitIndex, 返回 nil 表示可以执行读命令
+// readindex: 向多数节点发送心跳确认 leader 身份; lease: 多数节点在一个选举超时(留出时钟误差)内确认过时直接读取
+func (n *Node) ReadBarrier() resp.ReplyIntf {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.role != leader {
+		return n.notLeaderReply()
+	}
+	deadline := time.Now().Add(n.cfg.ElectionTimeout)
+	term := n.currentTerm
+	stillLeader := func() bool { return n.role == leader && n.currentTerm == term }
+	// 当选后的空日志提交前, commitIndex 可能落后于之前的 leader
+	if !n.waitUntil(deadline, func() bool { return !stillLeader() || n.commitIndex >= n.noopIndex }) || !stillLeader() {
+		return n.notLeaderReply()
+	}
+	readIndex := n.commitIndex
+	now := time.Now()
+	if n.cfg.ReadMode != ReadLease || n.acked(now.Add(-n.cfg.ElectionTimeout*9/10)) < n.quorum() {
+		n.broadcastAppend()
+		if !n.waitUntil(deadline, func() bool { return !stillLeader() || n.acked(now) >= n.quorum() }) || !stillLeader() {
+			return n.notLeaderReply()
+		}
+	}
+	if !n.waitUntil(deadline, func() bool { return n.lastApplied >= readIndex }) {
+		return protocol.MakeErrReply("TIMEOUT raft state machine is behind")
+	}
+	return nil
+}
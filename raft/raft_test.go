@@ -0,0 +1,198 @@
+package raft_test
+
+import (
+	"memgo/raft"
+	"memgo/redis/RESP/handler"
+	"memgo/redis/RESP/protocol"
+	"memgo/redis/client"
+	"memgo/tcp"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testNode struct {
+	addr    string
+	dir     string
+	closing chan struct{}
+	done    chan struct{}
+}
+
+func startNode(t *testing.T, n *testNode, addrs []string, readMode string) {
+	listener, err := net.Listen("tcp", n.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := raft.NewServer(raft.Config{
+		Self:              n.addr,
+		Peers:             addrs,
+		Dir:               n.dir,
+		ElectionTimeout:   300 * time.Millisecond,
+		ReadMode:          readMode,
+		SnapshotThreshold: 20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.closing, n.done = make(chan struct{}), make(chan struct{})
+	go func() {
+		tcp.ListenAndServe(listener, handler.MakeHandlerWith(server), n.closing)
+		close(n.done)
+	}()
+}
+
+func (n *testNode) stop() {
+	if n.closing != nil {
+		close(n.closing)
+		<-n.done
+		n.closing = nil
+	}
+}
+
+// do 跟随 NOTLEADER 重定向, 直到得到不是重定向的回复; 无法连接时尝试其他节点
+func do(t *testing.T, addrs []string, addr string, args ...string) (string, string) {
+	deadline := time.Now().Add(10 * time.Second)
+	for i := 0; time.Now().Before(deadline); i++ {
+		c, err := client.Dial(addr, time.Second)
+		if err != nil {
+			addr = addrs[i%len(addrs)]
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+		reply, err := c.Do(args...)
+		_ = c.Close()
+		if err != nil {
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+		if errReply, ok := reply.(*protocol.StandardErrorReply); ok {
+			if strings.HasPrefix(errReply.Status, "NOTLEADER ") {
+				addr = strings.TrimPrefix(errReply.Status, "NOTLEADER ")
+				continue
+			}
+			if strings.HasPrefix(errReply.Status, "TRYAGAIN") || strings.HasPrefix(errReply.Status, "TIMEOUT") {
+				time.Sleep(50 * time.Millisecond)
+				continue
+			}
+			t.Fatalf("%v: %s", args, errReply.Status)
+		}
+		value, _ := client.String(reply)
+		return addr, value
+	}
+	t.Fatalf("%v: no leader", args)
+	return "", ""
+}
+
+func TestRaftGroup(t *testing.T) {
+	nodes := make([]*testNode, 3)
+	var addrs []string
+	for i := range nodes {
+		// 先占用端口得到地址, 再由节点监听
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[i] = &testNode{addr: l.Addr().String(), dir: t.TempDir()}
+		addrs = append(addrs, nodes[i].addr)
+		_ = l.Close()
+	}
+	for i, n := range nodes {
+		mode := raft.ReadIndex
+		if i == 0 {
+			mode = raft.ReadLease
+		}
+		startNode(t, n, addrs, mode)
+	}
+	defer func() {
+		for _, n := range nodes {
+			n.stop()
+		}
+	}()
+
+	leaderAddr, _ := do(t, addrs, addrs[0], "SET", "k0", "v0")
+	for i := 1; i < 50; i++ {
+		leaderAddr, _ = do(t, addrs, leaderAddr, "SET", "k"+strconv.Itoa(i), "v"+strconv.Itoa(i))
+	}
+	// 其他节点重定向到 leader
+	for _, addr := range addrs {
+		if addr == leaderAddr {
+			continue
+		}
+		c, err := client.Dial(addr, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, _ := c.Do("GET", "k0")
+		_ = c.Close()
+		if errReply, ok := reply.(*protocol.StandardErrorReply); !ok || errReply.Status != "NOTLEADER "+leaderAddr {
+			t.Fatalf("expect redirect to %s, got %s", leaderAddr, string(reply.ToBytes()))
+		}
+	}
+
+	// leader 下线后选出新的 leader, 已提交的数据不丢失
+	var old *testNode
+	for _, n := range nodes {
+		if n.addr == leaderAddr {
+			old = n
+		}
+	}
+	old.stop()
+	other := addrs[0]
+	if other == leaderAddr {
+		other = addrs[1]
+	}
+	newLeader, value := do(t, addrs, other, "GET", "k49")
+	if value != "v49" || newLeader == leaderAddr {
+		t.Fatalf("expect v49 from new leader, got %q from %s", value, newLeader)
+	}
+	for i := 50; i < 100; i++ {
+		newLeader, _ = do(t, addrs, newLeader, "SET", "k"+strconv.Itoa(i), "v"+strconv.Itoa(i))
+	}
+
+	// 旧 leader 从日志与快照恢复并追上进度, 之后成为多数节点的一员
+	startNode(t, old, addrs, raft.ReadIndex)
+	time.Sleep(time.Second)
+	for _, n := range nodes {
+		if n.addr == newLeader {
+			n.stop()
+		}
+	}
+	for i := 0; i < 100; i += 7 {
+		key := "k" + strconv.Itoa(i)
+		if _, value := do(t, addrs, old.addr, "GET", key); value != "v"+strconv.Itoa(i) {
+			t.Fatalf("%s: expect v%d, got %q", key, i, value)
+		}
+	}
+}
+
+// 重启后从日志重放, 相对过期时间与 SPOP 的结果与重启之前相同
+func TestRaftDeterministicReplay(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &testNode{addr: l.Addr().String(), dir: t.TempDir()}
+	_ = l.Close()
+	addrs := []string{n.addr}
+	startNode(t, n, addrs, raft.ReadIndex)
+	defer n.stop()
+
+	do(t, addrs, n.addr, "SET", "k", "v")
+	do(t, addrs, n.addr, "EXPIRE", "k", "100")
+	_, expireAt := do(t, addrs, n.addr, "PEXPIRETIME", "k")
+	do(t, addrs, n.addr, "SADD", "s", "a", "b", "c")
+	_, popped := do(t, addrs, n.addr, "SPOP", "s")
+
+	time.Sleep(50 * time.Millisecond)
+	n.stop()
+	time.Sleep(time.Second)
+	startNode(t, n, addrs, raft.ReadIndex)
+	if _, value := do(t, addrs, n.addr, "PEXPIRETIME", "k"); value != expireAt {
+		t.Fatalf("expect expire time %s after replay, got %s", expireAt, value)
+	}
+	if _, value := do(t, addrs, n.addr, "SISMEMBER", "s", popped); value != "0" {
+		t.Fatalf("popped member %s is back after replay", popped)
+	}
+}
@@ -0,0 +1,356 @@
+package raft
+
+import (
+	"errors"
+	"memgo/config"
+	"memgo/interface/resp"
+	"memgo/logger"
+	"memgo/redis/RESP/protocol"
+	"memgo/redis/client"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 节点之间通过 RESP 通信:
+//   RAFT REQUESTVOTE term candidate last-log-index last-log-term                  -> [term granted]
+//   RAFT APPENDENTRIES term leader prev-index prev-term leader-commit entries...  -> [term success match-index]
+//   RAFT INSTALLSNAPSHOT term leader last-index last-term data                    -> [term]
+// APPENDENTRIES 失败时 match-index 为对方的最后一条日志或者冲突的位置, leader 据此回退 nextIndex
+
+var errInvalidReply = errors.New("invalid raft reply")
+
+type peer struct {
+	addr string
+	// 复制与投票分别使用各自的连接, 投票不会被正在传输的快照阻塞
+	client     *client.Client
+	voteClient *client.Client
+	voteMu     sync.Mutex // 上一轮选举的请求可能尚未结束
+	trigger    chan struct{}
+
+	// 以下字段由 Node.mu 保护
+	nextIndex  int64
+	matchIndex int64
+	ackSent    time.Time // 最近一次得到成功回复的 AppendEntries 的发送时间
+}
+
+func newPeer(addr string) *peer {
+	return &peer{addr: addr, trigger: make(chan struct{}, 1), nextIndex: 1}
+}
+
+func (p *peer) notify() {
+	select {
+	case p.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// call 发送请求并返回整数数组回复, 出错时关闭连接, 下次调用重新连接
+func (p *peer) call(c **client.Client, timeout time.Duration, args [][]byte) ([]int64, error) {
+	if *c == nil {
+		conn, err := client.DialAuth(p.addr, timeout, config.Properties.RequirePass)
+		if err != nil {
+			return nil, err
+		}
+		*c = conn
+	}
+	reply, err := (*c).DoBytes(args)
+	if err == nil {
+		var fields []string
+		if fields, err = client.Strings(reply); err == nil {
+			result := make([]int64, len(fields))
+			for i, field := range fields {
+				if result[i], err = strconv.ParseInt(field, 10, 64); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				return result, nil
+			}
+		}
+	}
+	_ = (*c).Close()
+	*c = nil
+	return nil, err
+}
+
+func (p *peer) requestVote(timeout time.Duration, term int64, candidate string, lastIndex, lastTerm int64) (int64, bool, error) {
+	args := toArgs("RAFT", "REQUESTVOTE", strconv.FormatInt(term, 10), candidate,
+		strconv.FormatInt(lastIndex, 10), strconv.FormatInt(lastTerm, 10))
+	p.voteMu.Lock()
+	result, err := p.call(&p.voteClient, timeout, args)
+	p.voteMu.Unlock()
+	if err != nil {
+		return 0, false, err
+	}
+	if len(result) != 2 {
+		return 0, false, errInvalidReply
+	}
+	return result[0], result[1] == 1, nil
+}
+
+func (p *peer) appendEntries(timeout time.Duration, term int64, leader string, prevIndex, prevTerm, commit int64,
+	entries []*Entry) (int64, bool, int64, error) {
+	args := toArgs("RAFT", "APPENDENTRIES", strconv.FormatInt(term, 10), leader, strconv.FormatInt(prevIndex, 10),
+		strconv.FormatInt(prevTerm, 10), strconv.FormatInt(commit, 10))
+	for _, e := range entries {
+		args = append(args, e.encode()...)
+	}
+	result, err := p.call(&p.client, timeout, args)
+	if err != nil {
+		return 0, false, 0, err
+	}
+	if len(result) != 3 {
+		return 0, false, 0, errInvalidReply
+	}
+	return result[0], result[1] == 1, result[2], nil
+}
+
+func (p *peer) installSnapshot(timeout time.Duration, term int64, leader string, index, lastTerm int64, data []byte) (int64, error) {
+	args := toArgs("RAFT", "INSTALLSNAPSHOT", strconv.FormatInt(term, 10), leader,
+		strconv.FormatInt(index, 10), strconv.FormatInt(lastTerm, 10))
+	result, err := p.call(&p.client, timeout, append(args, data))
+	if err != nil {
+		return 0, err
+	}
+	if len(result) != 1 {
+		return 0, errInvalidReply
+	}
+	return result[0], nil
+}
+
+func (p *peer) close() {
+	p.voteMu.Lock()
+	defer p.voteMu.Unlock()
+	for _, c := range []*client.Client{p.client, p.voteClient} {
+		if c != nil {
+			_ = c.Close()
+		}
+	}
+}
+
+func toArgs(args ...string) [][]byte {
+	result := make([][]byte, len(args))
+	for i, arg := range args {
+		result[i] = []byte(arg)
+	}
+	return result
+}
+
+func intsReply(values ...int64) resp.ReplyIntf {
+	replies := make([]resp.ReplyIntf, len(values))
+	for i, v := range values {
+		replies[i] = protocol.MakeIntReply(v)
+	}
+	return protocol.MakeMultiRawReply(replies)
+}
+
+func boolToInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func parseInts(args [][]byte) ([]int64, bool) {
+	result := make([]int64, len(args))
+	for i, arg := range args {
+		v, err := strconv.ParseInt(string(arg), 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		result[i] = v
+	}
+	return result, true
+}
+
+// ExecRaft RAFT 命令, 包括节点之间的 RPC 以及查看状态的 RAFT STATUS
+func (n *Node) ExecRaft(args [][]byte) resp.ReplyIntf {
+	if len(args) == 0 {
+		return protocol.MakeArgNumErrReply("raft")
+	}
+	switch strings.ToLower(string(args[0])) {
+	case "requestvote":
+		if len(args) != 5 {
+			return protocol.MakeArgNumErrReply("raft requestvote")
+		}
+		values, ok := parseInts([][]byte{args[1], args[3], args[4]})
+		if !ok {
+			return protocol.MakeErrReply("ERR invalid raft message")
+		}
+		term, granted := n.handleRequestVote(values[0], string(args[2]), values[1], values[2])
+		return intsReply(term, boolToInt(granted))
+	case "appendentries":
+		if len(args) < 6 {
+			return protocol.MakeArgNumErrReply("raft appendentries")
+		}
+		values, ok := parseInts([][]byte{args[1], args[3], args[4], args[5]})
+		entries, err := decodeEntries(args[6:])
+		if !ok || err != nil {
+			return protocol.MakeErrReply("ERR invalid raft message")
+		}
+		term, success, matchIndex := n.handleAppendEntries(values[0], string(args[2]), values[1], values[2], values[3], entries)
+		return intsReply(term, boolToInt(success), matchIndex)
+	case "installsnapshot":
+		if len(args) != 6 {
+			return protocol.MakeArgNumErrReply("raft installsnapshot")
+		}
+		values, ok := parseInts([][]byte{args[1], args[3], args[4]})
+		if !ok {
+			return protocol.MakeErrReply("ERR invalid raft message")
+		}
+		return intsReply(n.handleInstallSnapshot(values[0], string(args[2]), values[1], values[2], args[5]))
+	case "status":
+		return protocol.MakeBulkReply([]byte(n.status()))
+	}
+	return protocol.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try RAFT STATUS.")
+}
+
+func (n *Node) status() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return "role:" + n.role.String() + "\r\n" +
+		"term:" + strconv.FormatInt(n.currentTerm, 10) + "\r\n" +
+		"leader:" + n.leader + "\r\n" +
+		"read_mode:" + n.cfg.ReadMode + "\r\n" +
+		"commit_index:" + strconv.FormatInt(n.commitIndex, 10) + "\r\n" +
+		"last_applied:" + strconv.FormatInt(n.lastApplied, 10) + "\r\n" +
+		"last_log_index:" + strconv.FormatInt(n.lastIndex(), 10) + "\r\n" +
+		"snapshot_index:" + strconv.FormatInt(n.snapshotIndex(), 10) + "\r\n" +
+		"peers:" + strconv.Itoa(len(n.peers)) + "\r\n"
+}
+
+// handleRequestVote 最近一个选举超时内收到过 leader 消息时拒绝投票(不更新 term),
+// 避免网络恢复后的节点打断正常的 leader, 同时保证 leader 租约期间不会选出新的 leader
+func (n *Node) handleRequestVote(term int64, candidate string, lastIndex, lastTerm int64) (int64, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if term < n.currentTerm {
+		return n.currentTerm, false
+	}
+	if n.role == leader || (n.leader != "" && time.Since(n.lastHeard) < n.cfg.ElectionTimeout) {
+		return n.currentTerm, false
+	}
+	if term > n.currentTerm {
+		n.stepDown(term)
+	}
+	myLastTerm := n.log[len(n.log)-1].Term
+	upToDate := lastTerm > myLastTerm || (lastTerm == myLastTerm && lastIndex >= n.lastIndex())
+	if (n.votedFor == "" || n.votedFor == candidate) && upToDate {
+		prevVote := n.votedFor
+		n.votedFor = candidate
+		if err := n.persistState(); err != nil {
+			// 投票没有持久化, 重启后可能在同一 term 再次投票, 拒绝
+			n.votedFor = prevVote
+			return n.currentTerm, false
+		}
+		n.resetElectionTimer()
+		return n.currentTerm, true
+	}
+	return n.currentTerm, false
+}
+
+// acceptLeader 收到当前 term 的 leader 的消息, 调用方需持有 mu
+func (n *Node) acceptLeader(term int64, leaderAddr string) {
+	if term > n.currentTerm || n.role != follower {
+		n.stepDown(term)
+	}
+	n.leader = leaderAddr
+	n.lastHeard = time.Now()
+	n.resetElectionTimer()
+}
+
+func (n *Node) handleAppendEntries(term int64, leaderAddr string, prevIndex, prevTerm, commit int64, entries []*Entry) (int64, bool, int64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if term < n.currentTerm {
+		return n.currentTerm, false, 0
+	}
+	n.acceptLeader(term, leaderAddr)
+	if prevIndex > n.lastIndex() {
+		return n.currentTerm, false, n.lastIndex()
+	}
+	// 快照包含的日志都已提交, 与 leader 一致
+	if prevIndex < n.snapshotIndex() {
+		for len(entries) > 0 && entries[0].Index <= n.snapshotIndex() {
+			entries = entries[1:]
+		}
+		prevIndex, prevTerm = n.snapshotIndex(), n.log[0].Term
+	}
+	if n.entry(prevIndex).Term != prevTerm {
+		// 跳过冲突的整个 term, 减少往返次数
+		conflictTerm := n.entry(prevIndex).Term
+		index := prevIndex - 1
+		for index > n.snapshotIndex() && n.entry(index).Term == conflictTerm {
+			index--
+		}
+		return n.currentTerm, false, index
+	}
+	for i, e := range entries {
+		if e.Index <= n.lastIndex() {
+			if n.entry(e.Index).Term == e.Term {
+				continue
+			}
+			// 删除冲突的日志及之后的所有日志, 它们一定没有提交
+			n.log = n.log[:e.Index-n.snapshotIndex()]
+			if err := n.storage.rewriteLog(n.log[1:]); err != nil {
+				logger.Error("raft: truncate log failed: " + err.Error())
+				return n.currentTerm, false, n.lastIndex()
+			}
+		}
+		if err := n.storage.append(entries[i:]); err != nil {
+			logger.Error("raft: append log failed: " + err.Error())
+			return n.currentTerm, false, n.lastIndex()
+		}
+		n.log = append(n.log, entries[i:]...)
+		break
+	}
+	matchIndex := prevIndex + int64(len(entries))
+	if commit > n.commitIndex {
+		n.commitIndex = commit
+		if n.commitIndex > matchIndex {
+			n.commitIndex = matchIndex
+		}
+		n.changed.Broadcast()
+	}
+	return n.currentTerm, true, matchIndex
+}
+
+// handleInstallSnapshot 用 leader 的快照替换状态机, 与应用日志互斥
+func (n *Node) handleInstallSnapshot(term int64, leaderAddr string, index, lastTerm int64, data []byte) int64 {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if term < n.currentTerm {
+		return n.currentTerm
+	}
+	n.acceptLeader(term, leaderAddr)
+	if index <= n.lastApplied {
+		return n.currentTerm
+	}
+	if err := n.fsm.Restore(data); err != nil {
+		logger.Error("raft: restore snapshot failed: " + err.Error())
+		return n.currentTerm
+	}
+	if err := n.storage.saveSnapshot(index, lastTerm, data); err != nil {
+		logger.Error("raft: save snapshot failed: " + err.Error())
+	}
+	// 快照之后的日志与 leader 一致时保留
+	log := []*Entry{{Index: index, Term: lastTerm}}
+	if index <= n.lastIndex() && index >= n.snapshotIndex() && n.entry(index).Term == lastTerm {
+		log = append(log, n.log[index+1-n.snapshotIndex():]...)
+	}
+	n.log = log
+	if err := n.storage.rewriteLog(n.log[1:]); err != nil {
+		logger.Error("raft: rewrite log failed: " + err.Error())
+	}
+	n.lastApplied = index
+	if n.commitIndex < index {
+		n.commitIndex = index
+	}
+	n.changed.Broadcast()
+	logger.Info("raft: installed snapshot at " + strconv.FormatInt(index, 10) + " from " + leaderAddr)
+	return n.currentTerm
+}
@@ -0,0 +1,114 @@
+package raft
+
+import (
+	"memgo/config"
+	"memgo/database"
+	databaseIntf "memgo/interface/database"
+	"memgo/interface/resp"
+	"memgo/redis/RESP/connection"
+	"memgo/redis/RESP/protocol"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultDir = "raft"
+
+// Server raft 模式的 database 层, 写命令提交后才在 MemgoServer 中执行, 数据只通过 raft 的日志与快照持久化
+// 写命令先改写为确定的形式再提交, 见 deterministic.go
+type Server struct {
+	db   *database.MemgoServer
+	node *Node
+}
+
+// MakeServer 成员为配置中的 self 与 peers
+func MakeServer() *Server {
+	selfAddr := config.Properties.Self
+	if selfAddr == "" {
+		host := config.Properties.Bind
+		if host == "" || host == "0.0.0.0" {
+			host = "127.0.0.1"
+		}
+		selfAddr = net.JoinHostPort(host, strconv.Itoa(config.Properties.Port))
+	}
+	var peers []string
+	for _, peer := range config.Properties.Peers {
+		peers = append(peers, strings.TrimSpace(peer))
+	}
+	dir := config.Properties.RaftDir
+	if dir == "" {
+		dir = defaultDir
+	}
+	server, err := NewServer(Config{
+		Self:              selfAddr,
+		Peers:             peers,
+		Dir:               dir,
+		ElectionTimeout:   time.Duration(config.Properties.RaftElectionTimeout) * time.Millisecond,
+		ReadMode:          strings.ToLower(config.Properties.RaftReadMode),
+		SnapshotThreshold: config.Properties.RaftSnapshotThreshold,
+	})
+	if err != nil {
+		panic("start raft failed: " + err.Error())
+	}
+	return server
+}
+
+func NewServer(cfg Config) (*Server, error) {
+	db := database.NewMemgoServerInMemory()
+	node, err := NewNode(cfg, &stateMachine{db: db})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	node.Start()
+	return &Server{db: db, node: node}, nil
+}
+
+func (s *Server) Exec(client resp.ConnectionIntf, cmdLine databaseIntf.CmdLine) resp.ReplyIntf {
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	switch cmdName {
+	case "raft":
+		return s.node.ExecRaft(cmdLine[1:])
+	case "select", "ping", "info":
+		// 只涉及连接或本节点的命令
+		return s.db.Exec(client, cmdLine)
+	case "save", "bgsave", "bgrewriteaof", "rewriteaof", "replicaof", "slaveof", "psync", "sync", "wait", "migrate":
+		// MIGRATE 会在每个节点上重复执行, 并且依赖外部实例
+		return protocol.MakeErrReply("ERR " + cmdName + " is not supported in raft mode")
+	}
+	if database.IsWriteCommand(cmdName) {
+		return s.proposeDeterministic(client, cmdLine)
+	}
+	if reply := s.node.ReadBarrier(); reply != nil {
+		return reply
+	}
+	return s.db.Exec(client, cmdLine)
+}
+
+func (s *Server) Close() {
+	s.node.Close()
+	s.db.Close()
+}
+
+func (s *Server) AfterClientClose(c resp.ConnectionIntf) {
+	s.db.AfterClientClose(c)
+}
+
+type stateMachine struct {
+	db *database.MemgoServer
+}
+
+func (sm *stateMachine) Apply(entry *Entry) resp.ReplyIntf {
+	conn := &connection.Connection{}
+	conn.SelectDB(entry.DB)
+	return sm.db.Exec(conn, entry.Cmd)
+}
+
+func (sm *stateMachine) Snapshot() ([]byte, error) {
+	return sm.db.DumpSnapshot()
+}
+
+func (sm *stateMachine) Restore(data []byte) error {
+	return sm.db.RestoreSnapshot(data)
+}
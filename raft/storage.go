@@ -0,0 +1,234 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"memgo/logger"
+	"memgo/redis/RESP/protocol"
+	"memgo/redis/client"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	stateFile    = "state"    // currentTerm votedFor
+	logFile      = "log"      // 日志条目, 每条编码为一个 RESP 数组, 与 aof 类似
+	snapshotFile = "snapshot" // 第一行为快照包含的最后一条日志的 index term, 之后是 memgo 快照
+)
+
+var errInvalidEntry = errors.New("invalid raft log entry")
+
+// Entry 日志条目, Cmd 为空表示 leader 当选时追加的空日志
+type Entry struct {
+	Index int64
+	Term  int64
+	DB    int
+	Cmd   [][]byte
+}
+
+// encode 编码为 index term db argc args..., 在 AppendEntries 中多条日志依次排列
+func (e *Entry) encode() [][]byte {
+	args := make([][]byte, 0, 4+len(e.Cmd))
+	args = append(args, []byte(strconv.FormatInt(e.Index, 10)), []byte(strconv.FormatInt(e.Term, 10)),
+		[]byte(strconv.Itoa(e.DB)), []byte(strconv.Itoa(len(e.Cmd))))
+	return append(args, e.Cmd...)
+}
+
+// decodeEntries 解析 encode 的输出, 可以包含多条日志
+func decodeEntries(args [][]byte) ([]*Entry, error) {
+	var entries []*Entry
+	for len(args) > 0 {
+		if len(args) < 4 {
+			return nil, errInvalidEntry
+		}
+		index, err1 := strconv.ParseInt(string(args[0]), 10, 64)
+		term, err2 := strconv.ParseInt(string(args[1]), 10, 64)
+		db, err3 := strconv.Atoi(string(args[2]))
+		argc, err4 := strconv.Atoi(string(args[3]))
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil || argc < 0 || len(args) < 4+argc {
+			return nil, errInvalidEntry
+		}
+		entries = append(entries, &Entry{Index: index, Term: term, DB: db, Cmd: args[4 : 4+argc]})
+		args = args[4+argc:]
+	}
+	return entries, nil
+}
+
+// storage raft 需要持久化的状态, 每次修改后刷盘再回复
+type storage struct {
+	dir string
+	log *os.File
+}
+
+func openStorage(dir string) (*storage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &storage{dir: dir}, nil
+}
+
+func (s *storage) path(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+// writeFile 先写入临时文件, 刷盘后原子地替换
+func (s *storage) writeFile(name string, data []byte) error {
+	tmpFile, err := os.CreateTemp(s.dir, "temp-"+name+"-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.Write(data)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), s.path(name))
+	}
+	if err != nil {
+		_ = os.Remove(tmpFile.Name())
+	}
+	return err
+}
+
+// loadState 文件不存在时返回初始状态
+func (s *storage) loadState() (term int64, votedFor string, err error) {
+	data, err := os.ReadFile(s.path(stateFile))
+	if os.IsNotExist(err) {
+		return 0, "", nil
+	} else if err != nil {
+		return 0, "", err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return 0, "", errors.New("invalid raft state file")
+	}
+	if term, err = strconv.ParseInt(fields[0], 10, 64); err != nil {
+		return 0, "", errors.New("invalid raft state file")
+	}
+	if fields[1] != "-" {
+		votedFor = fields[1]
+	}
+	return term, votedFor, nil
+}
+
+func (s *storage) saveState(term int64, votedFor string) error {
+	if votedFor == "" {
+		votedFor = "-"
+	}
+	return s.writeFile(stateFile, []byte(strconv.FormatInt(term, 10)+" "+votedFor+"\n"))
+}
+
+// loadSnapshot 没有快照时 data 为 nil
+func (s *storage) loadSnapshot() (index int64, term int64, data []byte, err error) {
+	raw, err := os.ReadFile(s.path(snapshotFile))
+	if os.IsNotExist(err) {
+		return 0, 0, nil, nil
+	} else if err != nil {
+		return 0, 0, nil, err
+	}
+	header, data, ok := bytes.Cut(raw, []byte("\n"))
+	fields := strings.Fields(string(header))
+	if !ok || len(fields) != 2 {
+		return 0, 0, nil, errors.New("invalid raft snapshot file")
+	}
+	index, err1 := strconv.ParseInt(fields[0], 10, 64)
+	term, err2 := strconv.ParseInt(fields[1], 10, 64)
+	if err1 != nil || err2 != nil {
+		return 0, 0, nil, errors.New("invalid raft snapshot file")
+	}
+	return index, term, data, nil
+}
+
+func (s *storage) saveSnapshot(index, term int64, data []byte) error {
+	header := strconv.FormatInt(index, 10) + " " + strconv.FormatInt(term, 10) + "\n"
+	return s.writeFile(snapshotFile, append([]byte(header), data...))
+}
+
+// loadLog 读取所有日志并打开日志文件用于追加
+// NODE 写入最后一条日志时宕机会留下不完整的条目, 该条目尚未回复过任何节点, 截断即可
+func (s *storage) loadLog() ([]*Entry, error) {
+	data, err := os.ReadFile(s.path(logFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	src := bytes.NewReader(data)
+	reader := bufio.NewReader(src)
+	var entries []*Entry
+	var valid int64
+	for {
+		reply, err := client.ReadReply(reader)
+		if err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			logger.Warn("raft: truncate incomplete entry at the end of log")
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		args, err := client.Strings(reply)
+		if err != nil {
+			return nil, err
+		}
+		cmdLine := make([][]byte, len(args))
+		for i, arg := range args {
+			cmdLine[i] = []byte(arg)
+		}
+		entry, err := decodeEntries(cmdLine)
+		if err != nil || len(entry) != 1 {
+			return nil, errInvalidEntry
+		}
+		entries = append(entries, entry[0])
+		valid = int64(len(data)) - int64(src.Len()) - int64(reader.Buffered())
+	}
+	s.log, err = os.OpenFile(s.path(logFile), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.log.Truncate(valid); err == nil {
+		_, err = s.log.Seek(valid, io.SeekStart)
+	}
+	return entries, err
+}
+
+// append 追加日志并刷盘
+func (s *storage) append(entries []*Entry) error {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		buf.Write(protocol.MakeMultiBulkReply(e.encode()).ToBytes())
+	}
+	if _, err := s.log.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return s.log.Sync()
+}
+
+// rewriteLog 日志冲突截断或者快照之后压缩时, 用 entries 替换整个日志文件
+func (s *storage) rewriteLog(entries []*Entry) error {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		buf.Write(protocol.MakeMultiBulkReply(e.encode()).ToBytes())
+	}
+	if err := s.writeFile(logFile, buf.Bytes()); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.path(logFile), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_ = s.log.Close()
+	s.log = file
+	return nil
+}
+
+func (s *storage) close() {
+	if s.log != nil {
+		_ = s.log.Close()
+	}
+}
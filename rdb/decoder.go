@@ -0,0 +1,234 @@
+package rdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"memgo/datastruct/dict"
+	"memgo/datastruct/set"
+	"memgo/interface/database"
+	"time"
+)
+
+var ErrChecksum = errors.New("snapshot checksum mismatch")
+
+// Entry 快照中的一个 key
+type Entry struct {
+	DbIndex  int
+	Key      string
+	Entity   *database.DataEntity
+	ExpireAt *time.Time
+}
+
+// errLengthExceeded 长度或元素个数超过了剩余的数据, 说明数据损坏或是恶意构造的
+var errLengthExceeded = errors.New("length exceeds the remaining data")
+
+// 数据总长度未知时, 超过该长度的值边读边分配, 防止损坏的长度导致一次分配过多内存
+const maxPreallocSize = 1 << 20
+
+// crcReader 读取的同时计算校验和
+// NODE 不能在 bufio.Reader 之下计算, 否则会把预读的(不属于快照的)字节也算进去
+type crcReader struct {
+	r   *bufio.Reader
+	crc hash.Hash64
+	// remain 剩余的字节数, 小于 0 表示未知(读取文件时)
+	remain int64
+}
+
+func (cr *crcReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.crc.Write(p[:n])
+	if cr.remain >= 0 {
+		cr.remain -= int64(n)
+	}
+	return n, err
+}
+
+func (cr *crcReader) ReadByte() (byte, error) {
+	b, err := cr.r.ReadByte()
+	if err == nil {
+		cr.crc.Write([]byte{b})
+		if cr.remain >= 0 {
+			cr.remain--
+		}
+	}
+	return b, err
+}
+
+// readCount 读取元素个数, 每个元素至少占 minSize 个字节
+func (cr *crcReader) readCount(minSize uint64) (uint64, error) {
+	count, err := cr.readUvarint()
+	if err != nil {
+		return 0, err
+	}
+	if cr.remain >= 0 && count > uint64(cr.remain)/minSize {
+		return 0, errLengthExceeded
+	}
+	return count, nil
+}
+
+func (cr *crcReader) readUvarint() (uint64, error) {
+	return binary.ReadUvarint(cr)
+}
+
+func (cr *crcReader) readBytes() ([]byte, error) {
+	size, err := cr.readCount(1)
+	if err != nil {
+		return nil, err
+	}
+	if cr.remain < 0 && size > maxPreallocSize {
+		var buf bytes.Buffer
+		n, err := io.CopyN(&buf, cr, int64(size))
+		if err == io.EOF && uint64(n) < size {
+			err = io.ErrUnexpectedEOF
+		}
+		return buf.Bytes(), err
+	}
+	buf := make([]byte, size)
+	_, err = io.ReadFull(cr, buf)
+	return buf, err
+}
+
+func (cr *crcReader) readString() (string, error) {
+	b, err := cr.readBytes()
+	return string(b), err
+}
+
+// IsSnapshot 判断 reader 的开头是否为 memgo 快照, 不消耗数据
+func IsSnapshot(r *bufio.Reader) bool {
+	head, err := r.Peek(len(Magic))
+	return err == nil && string(head) == Magic
+}
+
+// Decode 解析 memgo 快照, 每解析出一个 key 调用一次 handle
+// 返回时 r 恰好停在快照结尾之后, 调用方可以继续读取后续数据 (eg: aof 的增量部分)
+func Decode(r *bufio.Reader, handle func(entry *Entry) error) error {
+	cr := &crcReader{r: r, crc: crc64.New(crcTable), remain: -1}
+	header := make([]byte, len(Magic)+len(Version))
+	if _, err := io.ReadFull(cr, header); err != nil {
+		return err
+	}
+	if string(header[:len(Magic)]) != Magic {
+		return errors.New("not a memgo snapshot")
+	}
+	if string(header[len(Magic):]) > Version {
+		return fmt.Errorf("unsupported snapshot version %s", header[len(Magic):])
+	}
+
+	dbIndex := 0
+	var expireAt *time.Time
+	for {
+		op, err := cr.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case opEOF:
+			expected := cr.crc.Sum64()
+			var b [8]byte
+			if _, err := io.ReadFull(r, b[:]); err != nil {
+				return err
+			}
+			if binary.LittleEndian.Uint64(b[:]) != expected {
+				return ErrChecksum
+			}
+			return nil
+		case opAux:
+			if _, err := cr.readString(); err != nil {
+				return err
+			}
+			if _, err := cr.readString(); err != nil {
+				return err
+			}
+		case opSelectDB:
+			idx, err := cr.readUvarint()
+			if err != nil {
+				return err
+			}
+			dbIndex = int(idx)
+		case opExpireMs:
+			var b [8]byte
+			if _, err := io.ReadFull(cr, b[:]); err != nil {
+				return err
+			}
+			t := time.UnixMilli(int64(binary.LittleEndian.Uint64(b[:])))
+			expireAt = &t
+		default:
+			key, entity, err := cr.readEntry(op)
+			if err != nil {
+				return err
+			}
+			err = handle(&Entry{
+				DbIndex:  dbIndex,
+				Key:      key,
+				Entity:   entity,
+				ExpireAt: expireAt,
+			})
+			if err != nil {
+				return err
+			}
+			expireAt = nil
+		}
+	}
+}
+
+func (cr *crcReader) readEntry(typ byte) (string, *database.DataEntity, error) {
+	key, err := cr.readString()
+	if err != nil {
+		return "", nil, err
+	}
+	entity, err := cr.readValue(typ, key)
+	return key, entity, err
+}
+
+// readValue 读取值, 不包括类型与 key
+func (cr *crcReader) readValue(typ byte, key string) (*database.DataEntity, error) {
+	switch typ {
+	case typeString:
+		val, err := cr.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		return &database.DataEntity{Data: val}, nil
+	case typeSet:
+		size, err := cr.readCount(1)
+		if err != nil {
+			return nil, err
+		}
+		setObj := set.MakeSet()
+		for i := uint64(0); i < size; i++ {
+			member, err := cr.readString()
+			if err != nil {
+				return nil, err
+			}
+			setObj.Add(member)
+		}
+		return &database.DataEntity{Data: setObj}, nil
+	case typeHash:
+		// field 与 value 各自至少占 1 个字节(长度)
+		size, err := cr.readCount(2)
+		if err != nil {
+			return nil, err
+		}
+		hash := dict.MakeSimpleDict()
+		for i := uint64(0); i < size; i++ {
+			field, err := cr.readString()
+			if err != nil {
+				return nil, err
+			}
+			value, err := cr.readBytes()
+			if err != nil {
+				return nil, err
+			}
+			hash.Put(field, value)
+		}
+		return &database.DataEntity{Data: hash}, nil
+	default:
+		return nil, fmt.Errorf("unknown value type %d of key %s", typ, key)
+	}
+}
@@ -0,0 +1,66 @@
+package rdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc64"
+	"memgo/interface/database"
+)
+
+// ErrDumpPayload DUMP 的数据损坏或版本不支持
+var ErrDumpPayload = errors.New("DUMP payload version or checksum are wrong")
+
+// DumpValue DUMP 与 MIGRATE 使用的序列化格式, 结构与 redis 的 DUMP 相同:
+//
+//	类型 值 快照版本号 8字节 CRC64(小端)
+//
+// 值的编码与快照中的 key 相同, 因此只能由 memgo 读取
+func DumpValue(entity *database.DataEntity) ([]byte, error) {
+	typ, err := entityType("", entity)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	if err := enc.writeByte(typ); err != nil {
+		return nil, err
+	}
+	if err := enc.writeValue("", entity); err != nil {
+		return nil, err
+	}
+	if err := enc.write([]byte(Version)); err != nil {
+		return nil, err
+	}
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], enc.crc.Sum64())
+	buf.Write(b[:])
+	return buf.Bytes(), nil
+}
+
+// RestoreValue 解析 DumpValue 的输出
+func RestoreValue(data []byte) (*database.DataEntity, error) {
+	if len(data) < 1+len(Version)+8 {
+		return nil, ErrDumpPayload
+	}
+	body := data[:len(data)-8]
+	if crc64.Checksum(body, crcTable) != binary.LittleEndian.Uint64(data[len(data)-8:]) {
+		return nil, ErrDumpPayload
+	}
+	if string(body[len(body)-len(Version):]) > Version {
+		return nil, ErrDumpPayload
+	}
+	value := body[1 : len(body)-len(Version)]
+	// NODE 负载的长度已知, 其中的长度与元素个数都不能超过剩余的字节数, 防止构造的负载导致巨大的内存分配
+	cr := &crcReader{r: bufio.NewReader(bytes.NewReader(value)), crc: crc64.New(crcTable), remain: int64(len(value))}
+	entity, err := cr.readValue(body[0], "")
+	if err != nil {
+		return nil, ErrDumpPayload
+	}
+	// 值之后不应该有多余的数据
+	if _, err := cr.ReadByte(); err == nil {
+		return nil, ErrDumpPayload
+	}
+	return entity, nil
+}
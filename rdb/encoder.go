@@ -0,0 +1,225 @@
+// NODE memgo 的快照(snapshot)格式, 参考 redis 的 rdb 文件
+// 文件结构:
+//   "MEMGO" + 4位版本号
+//   [opAux key val]...            元信息, eg: 生成时间
+//   opSelectDB dbIdx              之后的 key 都属于该 DB
+//     [opExpireMs unixMs] type key value
+//     ...
+//   opEOF
+//   8字节 CRC64(ECMA, 小端) 校验和, 覆盖之前的所有字节
+// 长度与整数均使用 uvarint 编码
+
+package rdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"memgo/datastruct/dict"
+	"memgo/datastruct/set"
+	"memgo/interface/database"
+	"time"
+)
+
+const (
+	Magic   = "MEMGO"
+	Version = "0001"
+
+	opAux      = 0xFA
+	opSelectDB = 0xFE
+	opExpireMs = 0xFC
+	opEOF      = 0xFF
+
+	typeString = 0
+	typeSet    = 1
+	typeHash   = 2
+)
+
+var crcTable = crc64.MakeTable(crc64.ECMA)
+
+// Encoder 将数据按 memgo 快照格式写入 writer
+type Encoder struct {
+	w   io.Writer
+	crc hash.Hash64
+	buf [binary.MaxVarintLen64]byte
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	crc := crc64.New(crcTable)
+	return &Encoder{
+		w:   io.MultiWriter(w, crc),
+		crc: crc,
+	}
+}
+
+func (enc *Encoder) write(p []byte) error {
+	_, err := enc.w.Write(p)
+	return err
+}
+
+func (enc *Encoder) writeByte(b byte) error {
+	return enc.write([]byte{b})
+}
+
+func (enc *Encoder) writeUvarint(v uint64) error {
+	n := binary.PutUvarint(enc.buf[:], v)
+	return enc.write(enc.buf[:n])
+}
+
+func (enc *Encoder) writeBytes(b []byte) error {
+	if err := enc.writeUvarint(uint64(len(b))); err != nil {
+		return err
+	}
+	return enc.write(b)
+}
+
+func (enc *Encoder) writeString(s string) error {
+	return enc.writeBytes([]byte(s))
+}
+
+// WriteHeader 写入文件头与生成时间
+func (enc *Encoder) WriteHeader() error {
+	if err := enc.write([]byte(Magic + Version)); err != nil {
+		return err
+	}
+	return enc.WriteAux("ctime", fmt.Sprint(time.Now().Unix()))
+}
+
+// WriteAux 写入一条元信息
+func (enc *Encoder) WriteAux(key, val string) error {
+	if err := enc.writeByte(opAux); err != nil {
+		return err
+	}
+	if err := enc.writeString(key); err != nil {
+		return err
+	}
+	return enc.writeString(val)
+}
+
+// WriteDBHeader 之后写入的 key 都属于 dbIdx
+func (enc *Encoder) WriteDBHeader(dbIdx int) error {
+	if err := enc.writeByte(opSelectDB); err != nil {
+		return err
+	}
+	return enc.writeUvarint(uint64(dbIdx))
+}
+
+// WriteEntry 写入一个 key, expireAt 为 nil 表示没有过期时间
+func (enc *Encoder) WriteEntry(key string, entity *database.DataEntity, expireAt *time.Time) error {
+	if expireAt != nil {
+		if err := enc.writeByte(opExpireMs); err != nil {
+			return err
+		}
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], uint64(expireAt.UnixMilli()))
+		if err := enc.write(b[:]); err != nil {
+			return err
+		}
+	}
+	typ, err := entityType(key, entity)
+	if err != nil {
+		return err
+	}
+	if err := enc.writeByte(typ); err != nil {
+		return err
+	}
+	if err := enc.writeString(key); err != nil {
+		return err
+	}
+	return enc.writeValue(key, entity)
+}
+
+func entityType(key string, entity *database.DataEntity) (byte, error) {
+	switch entity.Data.(type) {
+	case []byte:
+		return typeString, nil
+	case *set.Set:
+		return typeSet, nil
+	case dict.DictIntf:
+		return typeHash, nil
+	}
+	return 0, fmt.Errorf("unknown entity type %T of key %s", entity.Data, key)
+}
+
+// writeValue 写入值, 不包括类型与 key
+func (enc *Encoder) writeValue(key string, entity *database.DataEntity) error {
+	switch val := entity.Data.(type) {
+	case []byte:
+		return enc.writeBytes(val)
+	case *set.Set:
+		members := val.ToSlice()
+		if err := enc.writeUvarint(uint64(len(members))); err != nil {
+			return err
+		}
+		for _, member := range members {
+			if err := enc.writeString(member); err != nil {
+				return err
+			}
+		}
+		return nil
+	case dict.DictIntf:
+		fields := val.Keys()
+		if err := enc.writeUvarint(uint64(len(fields))); err != nil {
+			return err
+		}
+		for _, field := range fields {
+			raw, _ := val.Get(field)
+			value, ok := raw.([]byte)
+			if !ok {
+				return fmt.Errorf("unknown hash value type %T of key %s", raw, key)
+			}
+			if err := enc.writeString(field); err != nil {
+				return err
+			}
+			if err := enc.writeBytes(value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown entity type %T of key %s", entity.Data, key)
+}
+
+// WriteEnd 写入结束标记与校验和
+func (enc *Encoder) WriteEnd() error {
+	if err := enc.writeByte(opEOF); err != nil {
+		return err
+	}
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], enc.crc.Sum64())
+	_, err := enc.w.Write(b[:])
+	return err
+}
+
+// SnapshotEncoder 快照的写出格式, 目前有 memgo 格式(Encoder) 与 redis rdb 格式(RedisEncoder)
+type SnapshotEncoder interface {
+	WriteHeader() error
+	WriteAux(key, val string) error
+	WriteDBHeader(dbIdx int) error
+	WriteEntry(key string, entity *database.DataEntity, expireAt *time.Time) error
+	WriteEnd() error
+}
+
+// Dump 将 engine 中前 dbNum 个 DB 的数据写入 enc
+// NODE 调用方需要保证 dump 期间数据不被修改, 才能得到时间点一致的快照
+func Dump(enc SnapshotEncoder, engine database.DBEngine, dbNum int) error {
+	if err := enc.WriteHeader(); err != nil {
+		return err
+	}
+	for i := 0; i < dbNum; i++ {
+		if err := enc.WriteDBHeader(i); err != nil {
+			return err
+		}
+		var dumpErr error
+		engine.ForEach(i, func(key string, entity *database.DataEntity, expireAt *time.Time) bool {
+			dumpErr = enc.WriteEntry(key, entity, expireAt)
+			return dumpErr == nil
+		})
+		if dumpErr != nil {
+			return dumpErr
+		}
+	}
+	return enc.WriteEnd()
+}
@@ -0,0 +1,142 @@
+package rdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc64"
+	"memgo/datastruct/dict"
+	"memgo/datastruct/set"
+	"memgo/interface/database"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	hash := dict.MakeSimpleDict()
+	hash.Put("f1", []byte("v1"))
+	hash.Put("f2", []byte("v2"))
+	expireAt := time.UnixMilli(time.Now().Add(time.Hour).UnixMilli())
+	entries := []*Entry{
+		{DbIndex: 0, Key: "str", Entity: &database.DataEntity{Data: []byte("a\r\nb")}},
+		{DbIndex: 0, Key: "set", Entity: &database.DataEntity{Data: set.MakeSet("m1", "m2", "m3")}, ExpireAt: &expireAt},
+		{DbIndex: 3, Key: "hash", Entity: &database.DataEntity{Data: hash}},
+	}
+
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf)
+	if err := enc.WriteHeader(); err != nil {
+		t.Fatal(err)
+	}
+	currentDB := -1
+	for _, entry := range entries {
+		if entry.DbIndex != currentDB {
+			if err := enc.WriteDBHeader(entry.DbIndex); err != nil {
+				t.Fatal(err)
+			}
+			currentDB = entry.DbIndex
+		}
+		if err := enc.WriteEntry(entry.Key, entry.Entity, entry.ExpireAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.WriteEnd(); err != nil {
+		t.Fatal(err)
+	}
+	// 快照之后的数据不应被消耗
+	buf.WriteString("tail")
+
+	reader := bufio.NewReader(bytes.NewReader(buf.Bytes()))
+	if !IsSnapshot(reader) {
+		t.Fatal("expect snapshot header")
+	}
+	var decoded []*Entry
+	err := Decode(reader, func(entry *Entry) error {
+		decoded = append(decoded, entry)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(entries) {
+		t.Fatalf("expect %d entries, actual %d", len(entries), len(decoded))
+	}
+	if decoded[0].DbIndex != 0 || string(decoded[0].Entity.Data.([]byte)) != "a\r\nb" {
+		t.Error("wrong string entry")
+	}
+	if decoded[1].ExpireAt == nil || !decoded[1].ExpireAt.Equal(expireAt) || decoded[1].Entity.Data.(*set.Set).Len() != 3 {
+		t.Error("wrong set entry")
+	}
+	if decoded[2].DbIndex != 3 {
+		t.Error("wrong db index")
+	}
+	if v, _ := decoded[2].Entity.Data.(dict.DictIntf).Get("f2"); string(v.([]byte)) != "v2" {
+		t.Error("wrong hash entry")
+	}
+	rest := make([]byte, 4)
+	if _, err := reader.Read(rest); err != nil || string(rest) != "tail" {
+		t.Error("decoder consumed data after snapshot")
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf)
+	_ = enc.WriteHeader()
+	_ = enc.WriteDBHeader(0)
+	_ = enc.WriteEntry("k", &database.DataEntity{Data: []byte("value")}, nil)
+	_ = enc.WriteEnd()
+
+	data := buf.Bytes()
+	data[len(data)-12] ^= 0xFF // 破坏 value 的内容
+	err := Decode(bufio.NewReader(bytes.NewReader(data)), func(entry *Entry) error {
+		return nil
+	})
+	if err != ErrChecksum {
+		t.Errorf("expect checksum error, actual %v", err)
+	}
+}
+
+func TestDumpRestore(t *testing.T) {
+	payload, err := DumpValue(&database.DataEntity{Data: set.MakeSet("a", "b")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entity, err := RestoreValue(payload)
+	if err != nil || entity.Data.(*set.Set).Len() != 2 {
+		t.Fatalf("restore failed: %v", err)
+	}
+	payload[1] ^= 0xFF
+	if _, err := RestoreValue(payload); err != ErrDumpPayload {
+		t.Fatal("expect checksum error")
+	}
+}
+
+// 负载中声明的长度或元素个数超过负载本身时, 在分配内存之前拒绝
+func TestRestoreOversizedLength(t *testing.T) {
+	makePayload := func(typ byte, counts ...uint64) []byte {
+		body := []byte{typ}
+		for _, count := range counts {
+			body = binary.AppendUvarint(body, count)
+		}
+		body = append(body, Version...)
+		return binary.LittleEndian.AppendUint64(body, crc64.Checksum(body, crcTable))
+	}
+	for name, payload := range map[string][]byte{
+		"string": makePayload(typeString, 1<<40),
+		"set":    makePayload(typeSet, 1<<40),
+		"hash":   makePayload(typeHash, 1<<40),
+		"member": makePayload(typeSet, 1, 1<<40),
+	} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		if _, err := RestoreValue(payload); err != ErrDumpPayload {
+			t.Fatalf("%s: expect ErrDumpPayload, got %v", name, err)
+		}
+		runtime.ReadMemStats(&after)
+		if after.TotalAlloc-before.TotalAlloc > 1<<20 {
+			t.Fatalf("%s: allocated %d bytes for a %d bytes payload", name, after.TotalAlloc-before.TotalAlloc, len(payload))
+		}
+	}
+}
@@ -0,0 +1,619 @@
+// NODE 解析 redis 6/7 生成的 rdb 文件 (版本 <= 12)
+// string、set、hash 映射为 memgo 的对应类型;
+// memgo 暂不支持 list、zset、stream, 默认遇到这些 key 时加载失败, 以免启动时静默丢失数据;
+// 设置 DecodeOptions.SkipUnsupported 时(memgo-rdb -skip-unsupported)完整解析后跳过, 并在结束时汇总报告
+
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"memgo/datastruct/dict"
+	"memgo/datastruct/set"
+	"memgo/interface/database"
+	"memgo/logger"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	RedisMagic = "REDIS"
+	// 能够解析的最高版本 (redis 7.2)
+	redisMaxVersion = 12
+
+	redisOpFunction2    = 0xF5
+	redisOpFunctionPre  = 0xF6
+	redisOpModuleAux    = 0xF7
+	redisOpIdle         = 0xF8
+	redisOpFreq         = 0xF9
+	redisOpAux          = 0xFA
+	redisOpResizeDB     = 0xFB
+	redisOpExpireTimeMs = 0xFC
+	redisOpExpireTime   = 0xFD
+	redisOpSelectDB     = 0xFE
+	redisOpEOF          = 0xFF
+
+	redisTypeString          = 0
+	redisTypeList            = 1
+	redisTypeSet             = 2
+	redisTypeZSet            = 3
+	redisTypeHash            = 4
+	redisTypeZSet2           = 5
+	redisTypeModule2         = 7
+	redisTypeHashZipmap      = 9
+	redisTypeListZiplist     = 10
+	redisTypeSetIntset       = 11
+	redisTypeZSetZiplist     = 12
+	redisTypeHashZiplist     = 13
+	redisTypeListQuicklist   = 14
+	redisTypeStreamListpacks = 15
+	redisTypeHashListpack    = 16
+	redisTypeZSetListpack    = 17
+	redisTypeListQuicklist2  = 18
+	redisTypeStreamListpack2 = 19
+	redisTypeSetListpack     = 20
+	redisTypeStreamListpack3 = 21
+
+	redisEncInt8  = 0
+	redisEncInt16 = 1
+	redisEncInt32 = 2
+	redisEncLZF   = 3
+
+	quicklistNodePlain = 1
+)
+
+// IsRedisRDB 判断 reader 的开头是否为 redis rdb 文件, 不消耗数据
+func IsRedisRDB(r *bufio.Reader) bool {
+	head, err := r.Peek(len(RedisMagic))
+	return err == nil && string(head) == RedisMagic
+}
+
+// ErrUnsupportedType redis rdb 文件中有 memgo 不支持的类型(list, zset, stream)
+var ErrUnsupportedType = errors.New("unsupported redis value type")
+
+type DecodeOptions struct {
+	// SkipUnsupported 跳过 memgo 不支持类型的 key, 而不是返回 ErrUnsupportedType
+	SkipUnsupported bool
+}
+
+// DecodeAny 根据文件头自动识别 memgo 快照或 redis rdb 文件并解析, 遇到不支持的类型时返回 ErrUnsupportedType
+func DecodeAny(r *bufio.Reader, handle func(entry *Entry) error) error {
+	return DecodeAnyWith(r, DecodeOptions{}, handle)
+}
+
+func DecodeAnyWith(r *bufio.Reader, opts DecodeOptions, handle func(entry *Entry) error) error {
+	if IsRedisRDB(r) {
+		return DecodeRedisWith(r, opts, handle)
+	}
+	return Decode(r, handle)
+}
+
+type redisDecoder struct {
+	r       *bufio.Reader
+	crc     uint64
+	version int
+	opts    DecodeOptions
+	skipped map[string]int // 因类型不支持而跳过的 key 数
+}
+
+func (dec *redisDecoder) Read(p []byte) (int, error) {
+	n, err := dec.r.Read(p)
+	dec.crc = crc64Jones(dec.crc, p[:n])
+	return n, err
+}
+
+func (dec *redisDecoder) ReadByte() (byte, error) {
+	b, err := dec.r.ReadByte()
+	if err == nil {
+		dec.crc = crc64Jones(dec.crc, []byte{b})
+	}
+	return b, err
+}
+
+func (dec *redisDecoder) readFull(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	_, err := io.ReadFull(dec, buf)
+	return buf, err
+}
+
+// readLength 读取长度编码; encoded 为 true 时 length 表示特殊编码的类型
+func (dec *redisDecoder) readLength() (length uint64, encoded bool, err error) {
+	b, err := dec.ReadByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3F), false, nil
+	case 1:
+		next, err := dec.ReadByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b&0x3F)<<8 | uint64(next), false, nil
+	case 2:
+		switch b {
+		case 0x80:
+			buf, err := dec.readFull(4)
+			if err != nil {
+				return 0, false, err
+			}
+			return uint64(binary.BigEndian.Uint32(buf)), false, nil
+		case 0x81:
+			buf, err := dec.readFull(8)
+			if err != nil {
+				return 0, false, err
+			}
+			return binary.BigEndian.Uint64(buf), false, nil
+		default:
+			return 0, false, fmt.Errorf("unknown length encoding 0x%x", b)
+		}
+	default:
+		return uint64(b & 0x3F), true, nil
+	}
+}
+
+func (dec *redisDecoder) readLen() (int, error) {
+	length, encoded, err := dec.readLength()
+	if err != nil {
+		return 0, err
+	}
+	if encoded {
+		return 0, errors.New("unexpected encoded length")
+	}
+	return int(length), nil
+}
+
+func (dec *redisDecoder) readString() ([]byte, error) {
+	length, encoded, err := dec.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if !encoded {
+		return dec.readFull(int(length))
+	}
+	switch length {
+	case redisEncInt8:
+		b, err := dec.readFull(1)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.FormatInt(int64(int8(b[0])), 10)), nil
+	case redisEncInt16:
+		b, err := dec.readFull(2)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.FormatInt(int64(int16(binary.LittleEndian.Uint16(b))), 10)), nil
+	case redisEncInt32:
+		b, err := dec.readFull(4)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.FormatInt(int64(int32(binary.LittleEndian.Uint32(b))), 10)), nil
+	case redisEncLZF:
+		compressedLen, err := dec.readLen()
+		if err != nil {
+			return nil, err
+		}
+		rawLen, err := dec.readLen()
+		if err != nil {
+			return nil, err
+		}
+		compressed, err := dec.readFull(compressedLen)
+		if err != nil {
+			return nil, err
+		}
+		return lzfDecompress(compressed, rawLen)
+	default:
+		return nil, fmt.Errorf("unknown string encoding %d", length)
+	}
+}
+
+// skipDouble 跳过 zset(type 3) 中以字符串形式保存的分数
+func (dec *redisDecoder) skipDouble() error {
+	l, err := dec.ReadByte()
+	if err != nil {
+		return err
+	}
+	// 253 nan 254 +inf 255 -inf
+	if l >= 253 {
+		return nil
+	}
+	_, err = dec.readFull(int(l))
+	return err
+}
+
+// DecodeRedis 解析 redis rdb 文件, 每解析出一个 key 调用一次 handle, 遇到不支持的类型时返回 ErrUnsupportedType
+func DecodeRedis(r *bufio.Reader, handle func(entry *Entry) error) error {
+	return DecodeRedisWith(r, DecodeOptions{}, handle)
+}
+
+func DecodeRedisWith(r *bufio.Reader, opts DecodeOptions, handle func(entry *Entry) error) error {
+	dec := &redisDecoder{r: r, opts: opts, skipped: make(map[string]int)}
+	header, err := dec.readFull(len(RedisMagic) + 4)
+	if err != nil {
+		return err
+	}
+	if string(header[:len(RedisMagic)]) != RedisMagic {
+		return errors.New("not a redis rdb file")
+	}
+	dec.version, err = strconv.Atoi(string(header[len(RedisMagic):]))
+	if err != nil || dec.version < 1 || dec.version > redisMaxVersion {
+		return fmt.Errorf("unsupported rdb version %s", header[len(RedisMagic):])
+	}
+	defer dec.reportSkipped()
+
+	dbIndex := 0
+	var expireAt *time.Time
+	for {
+		op, err := dec.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case redisOpEOF:
+			return dec.verifyChecksum()
+		case redisOpSelectDB:
+			if dbIndex, err = dec.readLen(); err != nil {
+				return err
+			}
+		case redisOpResizeDB:
+			if _, err = dec.readLen(); err != nil {
+				return err
+			}
+			if _, err = dec.readLen(); err != nil {
+				return err
+			}
+		case redisOpAux:
+			if _, err = dec.readString(); err != nil {
+				return err
+			}
+			if _, err = dec.readString(); err != nil {
+				return err
+			}
+		case redisOpExpireTime:
+			b, err := dec.readFull(4)
+			if err != nil {
+				return err
+			}
+			t := time.Unix(int64(binary.LittleEndian.Uint32(b)), 0)
+			expireAt = &t
+		case redisOpExpireTimeMs:
+			b, err := dec.readFull(8)
+			if err != nil {
+				return err
+			}
+			t := time.UnixMilli(int64(binary.LittleEndian.Uint64(b)))
+			expireAt = &t
+		case redisOpIdle:
+			if _, err = dec.readLen(); err != nil {
+				return err
+			}
+		case redisOpFreq:
+			if _, err = dec.ReadByte(); err != nil {
+				return err
+			}
+		case redisOpFunction2:
+			if _, err = dec.readString(); err != nil {
+				return err
+			}
+		case redisOpFunctionPre, redisOpModuleAux:
+			return fmt.Errorf("unsupported rdb opcode 0x%x", op)
+		default:
+			key, err := dec.readString()
+			if err != nil {
+				return err
+			}
+			entity, err := dec.readValue(op)
+			if err != nil {
+				return fmt.Errorf("read value of key %s failed: %w", key, err)
+			}
+			if entity != nil {
+				err = handle(&Entry{
+					DbIndex:  dbIndex,
+					Key:      string(key),
+					Entity:   entity,
+					ExpireAt: expireAt,
+				})
+				if err != nil {
+					return err
+				}
+			}
+			expireAt = nil
+		}
+	}
+}
+
+func (dec *redisDecoder) verifyChecksum() error {
+	// 版本 5 之前没有校验和
+	if dec.version < 5 {
+		return nil
+	}
+	expected := dec.crc
+	var b [8]byte
+	if _, err := io.ReadFull(dec.r, b[:]); err != nil {
+		return err
+	}
+	actual := binary.LittleEndian.Uint64(b[:])
+	// 校验和为 0 表示生成时关闭了校验 (rdbchecksum no)
+	if actual != 0 && actual != expected {
+		return ErrChecksum
+	}
+	return nil
+}
+
+func (dec *redisDecoder) reportSkipped() {
+	if len(dec.skipped) == 0 {
+		return
+	}
+	types := make([]string, 0, len(dec.skipped))
+	for typ, count := range dec.skipped {
+		types = append(types, typ+"="+strconv.Itoa(count))
+	}
+	sort.Strings(types)
+	logger.Warn("skipped keys of types memgo does not support: " + strings.Join(types, ","))
+}
+
+// readValue 读取 key 对应的值; memgo 不支持的类型在 SkipUnsupported 时返回 nil
+func (dec *redisDecoder) readValue(typ byte) (*database.DataEntity, error) {
+	switch typ {
+	case redisTypeString:
+		val, err := dec.readString()
+		if err != nil {
+			return nil, err
+		}
+		return &database.DataEntity{Data: val}, nil
+	case redisTypeSet:
+		members, err := dec.readStringList(1)
+		if err != nil {
+			return nil, err
+		}
+		return makeSetEntity(members), nil
+	case redisTypeSetIntset:
+		members, err := dec.readEncodedList(intsetEntries)
+		if err != nil {
+			return nil, err
+		}
+		return makeSetEntity(members), nil
+	case redisTypeSetListpack:
+		members, err := dec.readEncodedList(listpackEntries)
+		if err != nil {
+			return nil, err
+		}
+		return makeSetEntity(members), nil
+	case redisTypeHash:
+		pairs, err := dec.readStringList(2)
+		if err != nil {
+			return nil, err
+		}
+		return makeHashEntity(pairs)
+	case redisTypeHashZipmap:
+		pairs, err := dec.readEncodedList(zipmapEntries)
+		if err != nil {
+			return nil, err
+		}
+		return makeHashEntity(pairs)
+	case redisTypeHashZiplist:
+		pairs, err := dec.readEncodedList(ziplistEntries)
+		if err != nil {
+			return nil, err
+		}
+		return makeHashEntity(pairs)
+	case redisTypeHashListpack:
+		pairs, err := dec.readEncodedList(listpackEntries)
+		if err != nil {
+			return nil, err
+		}
+		return makeHashEntity(pairs)
+	case redisTypeList:
+		_, err := dec.readStringList(1)
+		return nil, dec.skip("list", err)
+	case redisTypeListZiplist:
+		_, err := dec.readString()
+		return nil, dec.skip("list", err)
+	case redisTypeListQuicklist:
+		err := dec.skipStrings(1)
+		return nil, dec.skip("list", err)
+	case redisTypeListQuicklist2:
+		err := dec.skipQuicklist2()
+		return nil, dec.skip("list", err)
+	case redisTypeZSet, redisTypeZSet2:
+		err := dec.skipZSet(typ)
+		return nil, dec.skip("zset", err)
+	case redisTypeZSetZiplist, redisTypeZSetListpack:
+		_, err := dec.readString()
+		return nil, dec.skip("zset", err)
+	case redisTypeStreamListpacks, redisTypeStreamListpack2, redisTypeStreamListpack3:
+		err := dec.skipStream(typ)
+		return nil, dec.skip("stream", err)
+	default:
+		return nil, fmt.Errorf("unsupported rdb value type %d", typ)
+	}
+}
+
+// skip 不支持的类型解析完成之后调用, 没有设置 SkipUnsupported 时返回 ErrUnsupportedType
+func (dec *redisDecoder) skip(typeName string, err error) error {
+	if err != nil {
+		return err
+	}
+	if !dec.opts.SkipUnsupported {
+		return fmt.Errorf("%w %s", ErrUnsupportedType, typeName)
+	}
+	dec.skipped[typeName]++
+	return nil
+}
+
+// readStringList 读取 长度 + 长度*factor 个字符串
+func (dec *redisDecoder) readStringList(factor int) ([][]byte, error) {
+	length, err := dec.readLen()
+	if err != nil {
+		return nil, err
+	}
+	items := make([][]byte, 0, length*factor)
+	for i := 0; i < length*factor; i++ {
+		item, err := dec.readString()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// readEncodedList 读取一个字符串, 并按紧凑编码解析
+func (dec *redisDecoder) readEncodedList(parse func([]byte) ([][]byte, error)) ([][]byte, error) {
+	buf, err := dec.readString()
+	if err != nil {
+		return nil, err
+	}
+	return parse(buf)
+}
+
+func (dec *redisDecoder) skipStrings(factor int) error {
+	_, err := dec.readStringList(factor)
+	return err
+}
+
+func (dec *redisDecoder) skipQuicklist2() error {
+	length, err := dec.readLen()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < length; i++ {
+		// container 类型: PLAIN 或 PACKED, 两者都以字符串保存
+		if _, err = dec.readLen(); err != nil {
+			return err
+		}
+		if _, err = dec.readString(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dec *redisDecoder) skipZSet(typ byte) error {
+	length, err := dec.readLen()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < length; i++ {
+		if _, err = dec.readString(); err != nil {
+			return err
+		}
+		if typ == redisTypeZSet2 {
+			_, err = dec.readFull(8)
+		} else {
+			err = dec.skipDouble()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skipStream 跳过 stream 类型的值, 结构参考 redis rdb.c rdbLoadObject
+func (dec *redisDecoder) skipStream(typ byte) error {
+	skipLens := func(n int) error {
+		for i := 0; i < n; i++ {
+			if _, err := dec.readLen(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// listpacks: (master id, listpack) 对
+	if err := dec.skipStrings(2); err != nil {
+		return err
+	}
+	// length, last id(ms, seq)
+	if err := skipLens(3); err != nil {
+		return err
+	}
+	if typ >= redisTypeStreamListpack2 {
+		// first id, max deleted id, entries added
+		if err := skipLens(5); err != nil {
+			return err
+		}
+	}
+	groups, err := dec.readLen()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < groups; i++ {
+		if _, err = dec.readString(); err != nil {
+			return err
+		}
+		if err = skipLens(2); err != nil {
+			return err
+		}
+		if typ >= redisTypeStreamListpack2 {
+			if err = skipLens(1); err != nil {
+				return err
+			}
+		}
+		// 消费组 PEL: 16字节 id + 8字节投递时间 + 投递次数
+		pel, err := dec.readLen()
+		if err != nil {
+			return err
+		}
+		for j := 0; j < pel; j++ {
+			if _, err = dec.readFull(24); err != nil {
+				return err
+			}
+			if err = skipLens(1); err != nil {
+				return err
+			}
+		}
+		consumers, err := dec.readLen()
+		if err != nil {
+			return err
+		}
+		for j := 0; j < consumers; j++ {
+			if _, err = dec.readString(); err != nil {
+				return err
+			}
+			// seen time, 版本 3 增加了 active time
+			timeFields := 8
+			if typ >= redisTypeStreamListpack3 {
+				timeFields = 16
+			}
+			if _, err = dec.readFull(timeFields); err != nil {
+				return err
+			}
+			consumerPel, err := dec.readLen()
+			if err != nil {
+				return err
+			}
+			if _, err = dec.readFull(16 * consumerPel); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func makeSetEntity(members [][]byte) *database.DataEntity {
+	setObj := set.MakeSet()
+	for _, member := range members {
+		setObj.Add(string(member))
+	}
+	return &database.DataEntity{Data: setObj}
+}
+
+func makeHashEntity(pairs [][]byte) (*database.DataEntity, error) {
+	if len(pairs)%2 != 0 {
+		return nil, errMalformed
+	}
+	hash := dict.MakeSimpleDict()
+	for i := 0; i < len(pairs); i += 2 {
+		hash.Put(string(pairs[i]), pairs[i+1])
+	}
+	return &database.DataEntity{Data: hash}, nil
+}
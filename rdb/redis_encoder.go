@@ -0,0 +1,199 @@
+// NODE 按 redis rdb 格式(版本 9, redis 5.0 及以上均可加载)写出数据
+// 只使用普通编码: 不压缩字符串, set/hash 不使用 intset、listpack 等紧凑编码
+// redis 加载时会根据元素数量自行转换编码
+
+package rdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"memgo/datastruct/dict"
+	"memgo/datastruct/set"
+	"memgo/interface/database"
+	"time"
+)
+
+const redisWriteVersion = "0009"
+
+// redis 使用的 CRC64 (Jones 多项式, 反射, 初值 0, 结果不取反), 与标准库 crc64 的实现不同
+var crcJonesTable = func() [256]uint64 {
+	const poly = 0x95ac9329ac4bc9b5
+	var table [256]uint64
+	for i := range table {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 == 1 {
+				crc = crc>>1 ^ poly
+			} else {
+				crc >>= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+func crc64Jones(crc uint64, p []byte) uint64 {
+	for _, b := range p {
+		crc = crcJonesTable[byte(crc)^b] ^ crc>>8
+	}
+	return crc
+}
+
+// RedisEncoder 将数据按 redis rdb 格式写入 writer
+type RedisEncoder struct {
+	w   io.Writer
+	crc uint64
+}
+
+func NewRedisEncoder(w io.Writer) *RedisEncoder {
+	return &RedisEncoder{w: w}
+}
+
+func (enc *RedisEncoder) write(p []byte) error {
+	enc.crc = crc64Jones(enc.crc, p)
+	_, err := enc.w.Write(p)
+	return err
+}
+
+func (enc *RedisEncoder) writeByte(b byte) error {
+	return enc.write([]byte{b})
+}
+
+// writeLength 使用 redis 的长度编码
+func (enc *RedisEncoder) writeLength(length uint64) error {
+	switch {
+	case length < 1<<6:
+		return enc.writeByte(byte(length))
+	case length < 1<<14:
+		return enc.write([]byte{byte(length>>8) | 0x40, byte(length)})
+	case length <= 0xFFFFFFFF:
+		b := make([]byte, 5)
+		b[0] = 0x80
+		binary.BigEndian.PutUint32(b[1:], uint32(length))
+		return enc.write(b)
+	default:
+		b := make([]byte, 9)
+		b[0] = 0x81
+		binary.BigEndian.PutUint64(b[1:], length)
+		return enc.write(b)
+	}
+}
+
+func (enc *RedisEncoder) writeBytes(b []byte) error {
+	if err := enc.writeLength(uint64(len(b))); err != nil {
+		return err
+	}
+	return enc.write(b)
+}
+
+func (enc *RedisEncoder) writeString(s string) error {
+	return enc.writeBytes([]byte(s))
+}
+
+// WriteHeader 写入文件头与 redis 加载时会读取的元信息
+func (enc *RedisEncoder) WriteHeader() error {
+	if err := enc.write([]byte(RedisMagic + redisWriteVersion)); err != nil {
+		return err
+	}
+	if err := enc.WriteAux("redis-bits", "64"); err != nil {
+		return err
+	}
+	return enc.WriteAux("ctime", fmt.Sprint(time.Now().Unix()))
+}
+
+func (enc *RedisEncoder) WriteAux(key, val string) error {
+	if err := enc.writeByte(redisOpAux); err != nil {
+		return err
+	}
+	if err := enc.writeString(key); err != nil {
+		return err
+	}
+	return enc.writeString(val)
+}
+
+func (enc *RedisEncoder) WriteDBHeader(dbIdx int) error {
+	if err := enc.writeByte(redisOpSelectDB); err != nil {
+		return err
+	}
+	return enc.writeLength(uint64(dbIdx))
+}
+
+func (enc *RedisEncoder) WriteEntry(key string, entity *database.DataEntity, expireAt *time.Time) error {
+	if expireAt != nil {
+		if err := enc.writeByte(redisOpExpireTimeMs); err != nil {
+			return err
+		}
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], uint64(expireAt.UnixMilli()))
+		if err := enc.write(b[:]); err != nil {
+			return err
+		}
+	}
+	switch val := entity.Data.(type) {
+	case []byte:
+		if err := enc.writeByte(redisTypeString); err != nil {
+			return err
+		}
+		if err := enc.writeString(key); err != nil {
+			return err
+		}
+		return enc.writeBytes(val)
+	case *set.Set:
+		if err := enc.writeByte(redisTypeSet); err != nil {
+			return err
+		}
+		if err := enc.writeString(key); err != nil {
+			return err
+		}
+		members := val.ToSlice()
+		if err := enc.writeLength(uint64(len(members))); err != nil {
+			return err
+		}
+		for _, member := range members {
+			if err := enc.writeString(member); err != nil {
+				return err
+			}
+		}
+		return nil
+	case dict.DictIntf:
+		if err := enc.writeByte(redisTypeHash); err != nil {
+			return err
+		}
+		if err := enc.writeString(key); err != nil {
+			return err
+		}
+		fields := val.Keys()
+		if err := enc.writeLength(uint64(len(fields))); err != nil {
+			return err
+		}
+		for _, field := range fields {
+			raw, _ := val.Get(field)
+			value, ok := raw.([]byte)
+			if !ok {
+				return fmt.Errorf("unknown hash value type %T of key %s", raw, key)
+			}
+			if err := enc.writeString(field); err != nil {
+				return err
+			}
+			if err := enc.writeBytes(value); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown entity type %T of key %s", entity.Data, key)
+	}
+}
+
+// WriteEnd 写入结束标记与校验和
+func (enc *RedisEncoder) WriteEnd() error {
+	if err := enc.writeByte(redisOpEOF); err != nil {
+		return err
+	}
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], enc.crc)
+	_, err := enc.w.Write(b[:])
+	return err
+}
@@ -0,0 +1,347 @@
+// redis rdb 文件中的紧凑编码: lzf 压缩、ziplist、listpack、intset、zipmap
+// 只实现解码, memgo 写出的 rdb 文件只使用普通编码
+
+package rdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+var errMalformed = errors.New("malformed redis rdb encoding")
+
+// lzfDecompress 解压 lzf 压缩的字符串, outLen 为解压后的长度
+func lzfDecompress(in []byte, outLen int) ([]byte, error) {
+	out := make([]byte, 0, outLen)
+	i := 0
+	for i < len(in) {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 1<<5 {
+			// 字面量: 之后的 ctrl+1 个字节原样拷贝
+			length := ctrl + 1
+			if i+length > len(in) {
+				return nil, errMalformed
+			}
+			out = append(out, in[i:i+length]...)
+			i += length
+			continue
+		}
+		// 回溯引用: 从已解压数据中拷贝
+		length := ctrl >> 5
+		if length == 7 {
+			if i >= len(in) {
+				return nil, errMalformed
+			}
+			length += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errMalformed
+		}
+		ref := len(out) - ((ctrl&0x1f)<<8 | int(in[i])) - 1
+		i++
+		if ref < 0 {
+			return nil, errMalformed
+		}
+		// 引用区域可能与输出重叠, 只能逐字节拷贝
+		for j := 0; j < length+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != outLen {
+		return nil, fmt.Errorf("lzf decompressed length %d, expect %d", len(out), outLen)
+	}
+	return out, nil
+}
+
+// ziplistEntries 解析 ziplist, 返回其中的所有元素 (整数转换为十进制字符串)
+func ziplistEntries(buf []byte) ([][]byte, error) {
+	if len(buf) < 11 {
+		return nil, errMalformed
+	}
+	pos := 10 // zlbytes(4) zltail(4) zllen(2)
+	var entries [][]byte
+	for {
+		if pos >= len(buf) {
+			return nil, errMalformed
+		}
+		if buf[pos] == 0xFF {
+			return entries, nil
+		}
+		// prevlen
+		if buf[pos] == 0xFE {
+			pos += 5
+		} else {
+			pos++
+		}
+		if pos >= len(buf) {
+			return nil, errMalformed
+		}
+		header := buf[pos]
+		var entry []byte
+		switch header >> 6 {
+		case 0:
+			length := int(header & 0x3F)
+			pos++
+			if pos+length > len(buf) {
+				return nil, errMalformed
+			}
+			entry = buf[pos : pos+length]
+			pos += length
+		case 1:
+			if pos+2 > len(buf) {
+				return nil, errMalformed
+			}
+			length := int(header&0x3F)<<8 | int(buf[pos+1])
+			pos += 2
+			if pos+length > len(buf) {
+				return nil, errMalformed
+			}
+			entry = buf[pos : pos+length]
+			pos += length
+		case 2:
+			if pos+5 > len(buf) {
+				return nil, errMalformed
+			}
+			length := int(binary.BigEndian.Uint32(buf[pos+1 : pos+5]))
+			pos += 5
+			if pos+length > len(buf) {
+				return nil, errMalformed
+			}
+			entry = buf[pos : pos+length]
+			pos += length
+		default:
+			pos++
+			var val int64
+			switch header {
+			case 0xC0:
+				if pos+2 > len(buf) {
+					return nil, errMalformed
+				}
+				val = int64(int16(binary.LittleEndian.Uint16(buf[pos:])))
+				pos += 2
+			case 0xD0:
+				if pos+4 > len(buf) {
+					return nil, errMalformed
+				}
+				val = int64(int32(binary.LittleEndian.Uint32(buf[pos:])))
+				pos += 4
+			case 0xE0:
+				if pos+8 > len(buf) {
+					return nil, errMalformed
+				}
+				val = int64(binary.LittleEndian.Uint64(buf[pos:]))
+				pos += 8
+			case 0xF0:
+				if pos+3 > len(buf) {
+					return nil, errMalformed
+				}
+				val = int64(int32(uint32(buf[pos])<<8|uint32(buf[pos+1])<<16|uint32(buf[pos+2])<<24) >> 8)
+				pos += 3
+			case 0xFE:
+				if pos+1 > len(buf) {
+					return nil, errMalformed
+				}
+				val = int64(int8(buf[pos]))
+				pos++
+			default:
+				// 1111xxxx 立即数, 取值 0~12
+				imm := int64(header & 0x0F)
+				if imm < 1 || imm > 13 {
+					return nil, errMalformed
+				}
+				val = imm - 1
+			}
+			entry = []byte(strconv.FormatInt(val, 10))
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// listpackEntries 解析 listpack, 返回其中的所有元素 (整数转换为十进制字符串)
+func listpackEntries(buf []byte) ([][]byte, error) {
+	if len(buf) < 7 {
+		return nil, errMalformed
+	}
+	pos := 6 // total bytes(4) num elements(2)
+	var entries [][]byte
+	for {
+		if pos >= len(buf) {
+			return nil, errMalformed
+		}
+		b := buf[pos]
+		if b == 0xFF {
+			return entries, nil
+		}
+		start := pos
+		var entry []byte
+		var val int64
+		isInt := true
+		need := func(n int) bool { return pos+n <= len(buf) }
+		switch {
+		case b&0x80 == 0: // 7 位无符号整数
+			val = int64(b & 0x7F)
+			pos++
+		case b&0xC0 == 0x80: // 6 位长度的字符串
+			length := int(b & 0x3F)
+			pos++
+			if !need(length) {
+				return nil, errMalformed
+			}
+			entry = buf[pos : pos+length]
+			pos += length
+			isInt = false
+		case b&0xE0 == 0xC0: // 13 位有符号整数
+			if !need(2) {
+				return nil, errMalformed
+			}
+			uval := uint64(b&0x1F)<<8 | uint64(buf[pos+1])
+			val = signExtend(uval, 13)
+			pos += 2
+		case b&0xF0 == 0xE0: // 12 位长度的字符串
+			if !need(2) {
+				return nil, errMalformed
+			}
+			length := int(b&0x0F)<<8 | int(buf[pos+1])
+			pos += 2
+			if !need(length) {
+				return nil, errMalformed
+			}
+			entry = buf[pos : pos+length]
+			pos += length
+			isInt = false
+		case b == 0xF0: // 32 位长度的字符串
+			if !need(5) {
+				return nil, errMalformed
+			}
+			length := int(binary.LittleEndian.Uint32(buf[pos+1:]))
+			pos += 5
+			if !need(length) {
+				return nil, errMalformed
+			}
+			entry = buf[pos : pos+length]
+			pos += length
+			isInt = false
+		case b >= 0xF1 && b <= 0xF4:
+			size := map[byte]int{0xF1: 2, 0xF2: 3, 0xF3: 4, 0xF4: 8}[b]
+			if !need(1 + size) {
+				return nil, errMalformed
+			}
+			var uval uint64
+			for i := 0; i < size; i++ {
+				uval |= uint64(buf[pos+1+i]) << (8 * i)
+			}
+			val = signExtend(uval, size*8)
+			pos += 1 + size
+		default:
+			return nil, errMalformed
+		}
+		if isInt {
+			entry = []byte(strconv.FormatInt(val, 10))
+		}
+		entries = append(entries, entry)
+		// 跳过 backlen
+		pos += listpackBacklenSize(pos - start)
+	}
+}
+
+func signExtend(v uint64, bits int) int64 {
+	if bits >= 64 {
+		return int64(v)
+	}
+	shift := 64 - bits
+	return int64(v<<shift) >> shift
+}
+
+func listpackBacklenSize(l int) int {
+	switch {
+	case l <= 127:
+		return 1
+	case l < 16383:
+		return 2
+	case l < 2097151:
+		return 3
+	case l < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
+
+// intsetEntries 解析 intset
+func intsetEntries(buf []byte) ([][]byte, error) {
+	if len(buf) < 8 {
+		return nil, errMalformed
+	}
+	encoding := int(binary.LittleEndian.Uint32(buf[0:4]))
+	length := int(binary.LittleEndian.Uint32(buf[4:8]))
+	if encoding != 2 && encoding != 4 && encoding != 8 || len(buf) < 8+encoding*length {
+		return nil, errMalformed
+	}
+	entries := make([][]byte, 0, length)
+	for i := 0; i < length; i++ {
+		p := buf[8+i*encoding:]
+		var val int64
+		switch encoding {
+		case 2:
+			val = int64(int16(binary.LittleEndian.Uint16(p)))
+		case 4:
+			val = int64(int32(binary.LittleEndian.Uint32(p)))
+		case 8:
+			val = int64(binary.LittleEndian.Uint64(p))
+		}
+		entries = append(entries, []byte(strconv.FormatInt(val, 10)))
+	}
+	return entries, nil
+}
+
+// zipmapEntries 解析 zipmap (redis 2.6 之前的 hash 编码), 返回 field value 交替的切片
+func zipmapEntries(buf []byte) ([][]byte, error) {
+	if len(buf) < 2 {
+		return nil, errMalformed
+	}
+	pos := 1 // zmlen
+	readLen := func() (int, bool) {
+		if pos >= len(buf) {
+			return 0, false
+		}
+		b := buf[pos]
+		if b < 254 {
+			pos++
+			return int(b), true
+		}
+		if b == 254 && pos+5 <= len(buf) {
+			l := int(binary.LittleEndian.Uint32(buf[pos+1:]))
+			pos += 5
+			return l, true
+		}
+		return 0, false
+	}
+	var entries [][]byte
+	for {
+		if pos >= len(buf) {
+			return nil, errMalformed
+		}
+		if buf[pos] == 0xFF {
+			return entries, nil
+		}
+		keyLen, ok := readLen()
+		if !ok || pos+keyLen > len(buf) {
+			return nil, errMalformed
+		}
+		key := buf[pos : pos+keyLen]
+		pos += keyLen
+		valLen, ok := readLen()
+		if !ok || pos+1+valLen > len(buf) {
+			return nil, errMalformed
+		}
+		free := int(buf[pos])
+		pos++
+		val := buf[pos : pos+valLen]
+		pos += valLen + free
+		entries = append(entries, key, val)
+	}
+}
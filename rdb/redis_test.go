@@ -0,0 +1,163 @@
+package rdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"memgo/datastruct/dict"
+	"memgo/datastruct/set"
+	"memgo/interface/database"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCRC64Jones(t *testing.T) {
+	// redis crc64.c 中的测试向量
+	if crc := crc64Jones(0, []byte("123456789")); crc != 0xe9c6d914c4b8d9ca {
+		t.Errorf("wrong crc %x", crc)
+	}
+}
+
+func TestRedisEncodeDecode(t *testing.T) {
+	hash := dict.MakeSimpleDict()
+	hash.Put("f1", []byte("v1"))
+	expireAt := time.UnixMilli(time.Now().Add(time.Hour).UnixMilli())
+	long := strings.Repeat("x", 20000) // 超过 14 位长度, 使用 32 位长度编码
+
+	buf := &bytes.Buffer{}
+	enc := NewRedisEncoder(buf)
+	_ = enc.WriteHeader()
+	_ = enc.WriteDBHeader(0)
+	_ = enc.WriteEntry("str", &database.DataEntity{Data: []byte(long)}, &expireAt)
+	_ = enc.WriteDBHeader(100)
+	_ = enc.WriteEntry("set", &database.DataEntity{Data: set.MakeSet("a", "b")}, nil)
+	_ = enc.WriteEntry("hash", &database.DataEntity{Data: hash}, nil)
+	if err := enc.WriteEnd(); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded []*Entry
+	err := DecodeAny(bufio.NewReader(bytes.NewReader(buf.Bytes())), func(entry *Entry) error {
+		decoded = append(decoded, entry)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 3 {
+		t.Fatalf("expect 3 entries, actual %d", len(decoded))
+	}
+	if string(decoded[0].Entity.Data.([]byte)) != long || !decoded[0].ExpireAt.Equal(expireAt) {
+		t.Error("wrong string entry")
+	}
+	if decoded[1].DbIndex != 100 || decoded[1].Entity.Data.(*set.Set).Len() != 2 {
+		t.Error("wrong set entry")
+	}
+	if v, _ := decoded[2].Entity.Data.(dict.DictIntf).Get("f1"); string(v.([]byte)) != "v1" {
+		t.Error("wrong hash entry")
+	}
+
+	data := buf.Bytes()
+	data[len(data)-10] ^= 0xFF // 破坏最后一个 value 的内容
+	err = DecodeRedis(bufio.NewReader(bytes.NewReader(data)), func(entry *Entry) error { return nil })
+	if err != ErrChecksum {
+		t.Errorf("expect checksum error, actual %v", err)
+	}
+}
+
+// 手工构造 redis 7 使用紧凑编码写出的 rdb 文件
+func TestRedisCompactEncodings(t *testing.T) {
+	str := func(s string) []byte { return append([]byte{byte(len(s))}, s...) }
+	blob := func(b []byte) []byte { return append([]byte{byte(len(b))}, b...) }
+
+	// listpack: "f1" -> 5
+	listpack := []byte{0, 0, 0, 0, 2, 0, 0x82, 'f', '1', 3, 0x05, 1, 0xFF}
+	binary.LittleEndian.PutUint32(listpack, uint32(len(listpack)))
+	// intset: 2 字节编码, 元素 -2 1
+	intset := []byte{2, 0, 0, 0, 2, 0, 0, 0, 0xFE, 0xFF, 1, 0}
+	// ziplist: "ab" -> -3
+	ziplist := []byte{0, 0, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0x02, 'a', 'b', 4, 0xFE, 0xFD, 0xFF}
+	binary.LittleEndian.PutUint32(ziplist, uint32(len(ziplist)))
+	// lzf 压缩的 10 个 'a'
+	lzf := []byte{0xC3, 5, 10, 0x00, 'a', 0xE0, 0x00, 0x00}
+
+	file := []byte("REDIS0011")
+	file = append(file, redisOpAux)
+	file = append(file, str("redis-ver")...)
+	file = append(file, str("7.2.0")...)
+	file = append(file, redisOpSelectDB, 0, redisOpResizeDB, 6, 0)
+	file = append(file, redisTypeHashListpack)
+	file = append(file, str("lp")...)
+	file = append(file, blob(listpack)...)
+	file = append(file, redisTypeSetIntset)
+	file = append(file, str("is")...)
+	file = append(file, blob(intset)...)
+	file = append(file, redisTypeHashZiplist)
+	file = append(file, str("zl")...)
+	file = append(file, blob(ziplist)...)
+	file = append(file, redisTypeString)
+	file = append(file, str("lzf")...)
+	file = append(file, lzf...)
+	file = append(file, redisTypeString)
+	file = append(file, str("int")...)
+	file = append(file, 0xC1, 0x39, 0x30) // int16 12345
+	file = append(file, redisTypeZSetListpack)
+	file = append(file, str("zs")...)
+	file = append(file, blob(listpack)...)
+	file = append(file, redisOpEOF)
+	file = append(file, make([]byte, 8)...) // 校验和为 0 表示未开启校验
+
+	entries := make(map[string]*Entry)
+	err := DecodeAnyWith(bufio.NewReader(bytes.NewReader(file)), DecodeOptions{SkipUnsupported: true}, func(entry *Entry) error {
+		entries[entry.Key] = entry
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := entries["zs"]; ok || len(entries) != 5 {
+		t.Fatalf("expect 5 entries without zset, actual %d", len(entries))
+	}
+	if v, _ := entries["lp"].Entity.Data.(dict.DictIntf).Get("f1"); string(v.([]byte)) != "5" {
+		t.Error("wrong listpack hash")
+	}
+	if s := entries["is"].Entity.Data.(*set.Set); !s.IsMember("-2") || !s.IsMember("1") {
+		t.Error("wrong intset")
+	}
+	if v, _ := entries["zl"].Entity.Data.(dict.DictIntf).Get("ab"); string(v.([]byte)) != "-3" {
+		t.Error("wrong ziplist hash")
+	}
+	if string(entries["lzf"].Entity.Data.([]byte)) != "aaaaaaaaaa" {
+		t.Error("wrong lzf string")
+	}
+	if string(entries["int"].Entity.Data.([]byte)) != "12345" {
+		t.Error("wrong int string")
+	}
+}
+
+// 默认遇到不支持的类型时加载失败, 而不是丢弃这些 key
+func TestRedisUnsupportedType(t *testing.T) {
+	file := []byte("REDIS0011")
+	file = append(file, redisOpSelectDB, 0)
+	file = append(file, redisTypeString, 1, 's', 1, 'v')
+	file = append(file, redisTypeList, 1, 'l', 2, 1, 'a', 1, 'b')
+	file = append(file, redisOpEOF)
+	file = append(file, make([]byte, 8)...)
+
+	var keys []string
+	handle := func(entry *Entry) error {
+		keys = append(keys, entry.Key)
+		return nil
+	}
+	err := DecodeAny(bufio.NewReader(bytes.NewReader(file)), handle)
+	if !errors.Is(err, ErrUnsupportedType) {
+		t.Fatalf("expect unsupported type error, actual %v", err)
+	}
+	keys = nil
+	err = DecodeAnyWith(bufio.NewReader(bytes.NewReader(file)), DecodeOptions{SkipUnsupported: true}, handle)
+	if err != nil || len(keys) != 1 || keys[0] != "s" {
+		t.Fatalf("expect only key s, actual %v %v", keys, err)
+	}
+}
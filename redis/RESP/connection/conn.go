@@ -16,6 +16,8 @@ type Connection struct {
 	waitingReply wait.Wait  // 等待直到发送完数据，用于优雅地关闭连接
 	mu           sync.Mutex // 保留
 	selectedDB   int
+	// 通过 AUTH 认证的 ACL 用户, 为空时使用 default 用户; default 用户需要密码时只能执行 AUTH, HELLO 与 QUIT
+	user string
 }
 
 func NewConn(conn net.Conn) *Connection {
@@ -63,3 +65,11 @@ func (c *Connection) GetDBIndex() int {
 func (c *Connection) SelectDB(i int) {
 	c.selectedDB = i
 }
+
+func (c *Connection) User() string {
+	return c.user
+}
+
+func (c *Connection) SetUser(user string) {
+	c.user = user
+}
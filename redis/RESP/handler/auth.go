@@ -0,0 +1,179 @@
+package handler
+
+import (
+	"memgo/acl"
+	"memgo/config"
+	"memgo/interface/resp"
+	"memgo/logger"
+	"memgo/redis/RESP/connection"
+	"memgo/redis/RESP/protocol"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 认证与 ACL 检查属于连接的状态, 在协议层处理, 与使用哪种 database 层(单机, 集群, raft 等)无关
+// requirepass 是 default 用户的密码, 其他用户通过 ACL SETUSER 或 aclfile 创建
+
+const (
+	defaultAuthMaxFailures = 5
+	defaultAuthFailDelay   = time.Second
+	maxAuthFailDelay       = 10 * time.Second
+	authFailureExpire      = 10 * time.Minute // 超过该时间没有再失败时忘记失败次数
+	defaultUser            = "default"
+)
+
+var (
+	noAuthReply    = protocol.MakeErrReply("NOAUTH Authentication required.")
+	wrongPassReply = protocol.MakeErrReply("WRONGPASS invalid username-password pair or user is disabled.")
+	noPassReply    = protocol.MakeErrReply("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+)
+
+type authFailure struct {
+	count int
+	last  time.Time
+}
+
+// authLimiter 记录每个 IP 连续认证失败的次数, 重新连接不会清除, 认证成功时清除
+type authLimiter struct {
+	mu       sync.Mutex
+	failures map[string]*authFailure
+}
+
+func newAuthLimiter() *authLimiter {
+	return &authLimiter{failures: make(map[string]*authFailure)}
+}
+
+// fail 记录一次失败, 返回回复之前需要等待的时间
+func (l *authLimiter) fail(ip string) time.Duration {
+	maxFailures := config.Properties.AuthMaxFailures
+	if maxFailures <= 0 {
+		maxFailures = defaultAuthMaxFailures
+	}
+	unit := time.Duration(config.Properties.AuthFailDelay) * time.Millisecond
+	if unit <= 0 {
+		unit = defaultAuthFailDelay
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for key, f := range l.failures {
+		if now.Sub(f.last) > authFailureExpire {
+			delete(l.failures, key)
+		}
+	}
+	f := l.failures[ip]
+	if f == nil {
+		f = &authFailure{}
+		l.failures[ip] = f
+	}
+	f.count++
+	f.last = now
+	if f.count <= maxFailures {
+		return 0
+	}
+	if f.count == maxFailures+1 {
+		logger.Warn("auth: too many failed attempts from " + ip)
+	}
+	delay := unit * time.Duration(f.count-maxFailures)
+	if delay > maxAuthFailDelay {
+		delay = maxAuthFailDelay
+	}
+	return delay
+}
+
+func (l *authLimiter) succeed(ip string) {
+	l.mu.Lock()
+	delete(l.failures, ip)
+	l.mu.Unlock()
+}
+
+func remoteIP(client *connection.Connection) string {
+	if client.Conn == nil {
+		return ""
+	}
+	addr := client.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func clientInfo(client *connection.Connection) string {
+	if client.Conn == nil {
+		return ""
+	}
+	return "addr=" + client.RemoteAddr().String()
+}
+
+// currentUser 连接当前的 ACL 用户, 未认证(或者认证的用户已被删除)时返回 nil
+func (r *RespHandler) currentUser(client *connection.Connection) *acl.User {
+	if name := client.User(); name != "" {
+		return r.acl.User(name)
+	}
+	return r.acl.DefaultUser()
+}
+
+// checkPassword 失败时连接回到未认证的状态
+func (r *RespHandler) checkPassword(client *connection.Connection, user, password string) resp.ReplyIntf {
+	ip := remoteIP(client)
+	u := r.acl.Authenticate(user, password, clientInfo(client))
+	if u == nil {
+		client.SetUser("")
+		if delay := r.authLimiter.fail(ip); delay > 0 {
+			time.Sleep(delay)
+		}
+		return wrongPassReply
+	}
+	r.authLimiter.succeed(ip)
+	client.SetUser(u.Name())
+	return nil
+}
+
+// execAuth AUTH password | AUTH username password
+func (r *RespHandler) execAuth(client *connection.Connection, args [][]byte) resp.ReplyIntf {
+	var user, password string
+	switch len(args) {
+	case 1:
+		// default 用户不需要密码时 AUTH password 没有意义, 多半是配置错误
+		if !r.acl.DefaultRequiresPassword() {
+			return noPassReply
+		}
+		user, password = defaultUser, string(args[0])
+	case 2:
+		user, password = string(args[0]), string(args[1])
+	default:
+		return protocol.MakeArgNumErrReply("auth")
+	}
+	if errReply := r.checkPassword(client, user, password); errReply != nil {
+		return errReply
+	}
+	return protocol.MakeOkReply()
+}
+
+// execHello HELLO [protover [AUTH username password]], 只支持 RESP2
+func (r *RespHandler) execHello(client *connection.Connection, args [][]byte) resp.ReplyIntf {
+	if len(args) > 0 {
+		if string(args[0]) != "2" {
+			return protocol.MakeErrReply("NOPROTO sorry, this protocol version is not supported.")
+		}
+		args = args[1:]
+	}
+	if len(args) > 0 {
+		if len(args) != 3 || strings.ToLower(string(args[0])) != "auth" {
+			return protocol.MakeSyntaxErrReply()
+		}
+		if errReply := r.checkPassword(client, string(args[1]), string(args[2])); errReply != nil {
+			return errReply
+		}
+	}
+	if r.currentUser(client) == nil {
+		return noAuthReply
+	}
+	return protocol.MakeMultiRawReply([]resp.ReplyIntf{
+		protocol.MakeBulkReply([]byte("server")), protocol.MakeBulkReply([]byte("memgo")),
+		protocol.MakeBulkReply([]byte("proto")), protocol.MakeIntReply(2),
+	})
+}
@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"memgo/config"
+	"memgo/database"
+	"memgo/redis/client"
+	"memgo/tcp"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAuth(t *testing.T) {
+	config.Properties.RequirePass = "secret"
+	config.Properties.AuthMaxFailures = 2
+	config.Properties.AuthFailDelay = 200
+	defer func() {
+		config.Properties.RequirePass = ""
+		config.Properties.AuthMaxFailures = 0
+		config.Properties.AuthFailDelay = 0
+	}()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closing := make(chan struct{})
+	defer close(closing)
+	go tcp.ListenAndServe(l, MakeHandlerWith(database.NewMemgoServerInMemory()), closing)
+
+	c, err := client.Dial(l.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	expect := func(want string, args ...string) {
+		t.Helper()
+		reply, err := c.Do(args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(reply.ToBytes()); got != want {
+			t.Fatalf("%v: expect %q, got %q", args, want, got)
+		}
+	}
+
+	expect("-NOAUTH Authentication required.\r\n", "SET", "k", "v")
+	expect("-NOAUTH Authentication required.\r\n", "HELLO")
+	wrongPass := "-WRONGPASS invalid username-password pair or user is disabled.\r\n"
+	expect(wrongPass, "AUTH", "wrong")
+	expect(wrongPass, "AUTH", "admin", "secret")
+	// 超过失败次数之后延迟回复
+	start := time.Now()
+	expect(wrongPass, "AUTH", "wrong")
+	if time.Since(start) < 200*time.Millisecond {
+		t.Fatal("expect delayed reply after too many failures")
+	}
+	expect("+OK\r\n", "AUTH", "default", "secret")
+	expect("+OK\r\n", "SET", "k", "v")
+	expect("*4\r\n$6\r\nserver\r\n$5\r\nmemgo\r\n$5\r\nproto\r\n:2\r\n", "HELLO", "2")
+	// 认证成功后清除失败次数
+	expect(wrongPass, "AUTH", "wrong")
+	expect("-NOAUTH Authentication required.\r\n", "GET", "k")
+	expect("*4\r\n$6\r\nserver\r\n$5\r\nmemgo\r\n$5\r\nproto\r\n:2\r\n", "HELLO", "2", "AUTH", "default", "secret")
+	expect("+OK\r\n", "QUIT")
+	if _, err := c.Do("PING"); err == nil {
+		t.Fatal("expect connection closed after QUIT")
+	}
+}
+
+func TestACL(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closing := make(chan struct{})
+	defer close(closing)
+	go tcp.ListenAndServe(l, MakeHandlerWith(database.NewMemgoServerInMemory()), closing)
+
+	c, err := client.Dial(l.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	expect := func(want string, args ...string) {
+		t.Helper()
+		reply, err := c.Do(args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(reply.ToBytes()); got != want {
+			t.Fatalf("%v: expect %q, got %q", args, want, got)
+		}
+	}
+
+	// 没有 requirepass 时连接自动以 default 用户认证
+	expect("$7\r\ndefault\r\n", "ACL", "WHOAMI")
+	expect("+OK\r\n", "ACL", "SETUSER", "reader", "on", ">pw", "~app:*", "+@read")
+	expect("+OK\r\n", "SET", "app:1", "v")
+	expect("+OK\r\n", "AUTH", "reader", "pw")
+	expect("$6\r\nreader\r\n", "ACL", "WHOAMI")
+	expect("$1\r\nv\r\n", "GET", "app:1")
+	expect("-NOPERM User reader has no permissions to run the 'set' command\r\n", "SET", "app:1", "x")
+	expect("-NOPERM No permissions to access a key\r\n", "GET", "other")
+	expect("-NOPERM User reader has no permissions to run the 'acl' command\r\n", "ACL", "LIST")
+	// 删除之后无法再以该用户认证
+	expect("+OK\r\n", "AUTH", "default", "")
+	expect(":1\r\n", "ACL", "DELUSER", "reader")
+	expect("-WRONGPASS invalid username-password pair or user is disabled.\r\n", "AUTH", "reader", "pw")
+}
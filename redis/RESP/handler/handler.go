@@ -3,9 +3,15 @@ package handler
 import (
 	"context"
 	"io"
+	"memgo/acl"
+	"memgo/cluster"
+	"memgo/config"
+	"memgo/crdt"
 	"memgo/database"
 	databaseIntf "memgo/interface/database"
+	"memgo/interface/resp"
 	"memgo/logger"
+	"memgo/raft"
 	"memgo/redis/RESP/connection"
 	"memgo/redis/RESP/parser"
 	"memgo/redis/RESP/protocol"
@@ -18,9 +24,11 @@ import (
 var unKnownErrReplyBytes = []byte("-ERR unknown\r\n")
 
 type RespHandler struct {
-	activeConn sync.Map                  // 存储的就是 ConnectionIntf
-	dbIntf     databaseIntf.DBServerIntf // database层的抽象
-	closing    atomic.Boolean
+	activeConn  sync.Map                  // 存储的就是 ConnectionIntf
+	dbIntf      databaseIntf.DBServerIntf // database层的抽象
+	closing     atomic.Boolean
+	authLimiter *authLimiter
+	acl         *acl.Manager
 }
 
 // 从activeConn中关闭其中一个连接 Conn
@@ -30,14 +38,29 @@ func (r *RespHandler) closeClient(client *connection.Connection) {
 	r.activeConn.Delete(client)
 }
 
-// MakeHandler NODE 目前使用 SimpleMemgoDBServer 作为存储引擎
+// MakeHandler NODE 目前使用 SimpleMemgoDBServer 作为存储引擎, cluster-enabled 时使用集群, raft-enabled 时使用 raft 组,
+// crdt-enabled 时各站点通过 CRDT 合并写入
 func MakeHandler() *RespHandler {
-	var dbIntf databaseIntf.DBServerIntf
-	dbIntf = database.NewMemgoServer()
+	if config.Properties.ClusterEnabled == "yes" {
+		return MakeHandlerWith(cluster.MakeCluster())
+	}
+	if config.Properties.RaftEnabled == "yes" {
+		return MakeHandlerWith(raft.MakeServer())
+	}
+	if config.Properties.CrdtEnabled == "yes" {
+		return MakeHandlerWith(crdt.MakeServer())
+	}
+	return MakeHandlerWith(database.NewMemgoServer())
+}
+
+// MakeHandlerWith 使用指定的 database 层, 例如哨兵模式
+func MakeHandlerWith(dbIntf databaseIntf.DBServerIntf) *RespHandler {
 	return &RespHandler{
-		activeConn: sync.Map{},
-		dbIntf:     dbIntf,
-		closing:    0,
+		activeConn:  sync.Map{},
+		dbIntf:      dbIntf,
+		closing:     0,
+		authLimiter: newAuthLimiter(),
+		acl:         acl.MakeManager(),
 	}
 }
 
@@ -91,7 +114,23 @@ func (r *RespHandler) Handle(ctx context.Context, conn net.Conn) {
 			logger.Error("require multi bulk protocol: " + string(payload.Data.ToBytes()))
 			continue
 		}
-		execResultReply := r.dbIntf.Exec(client, mbReply.Args)
+		if len(mbReply.Args) == 0 {
+			continue
+		}
+		var execResultReply resp.ReplyIntf
+		switch strings.ToLower(string(mbReply.Args[0])) {
+		case "auth":
+			execResultReply = r.execAuth(client, mbReply.Args[1:])
+		case "hello":
+			execResultReply = r.execHello(client, mbReply.Args[1:])
+		case "quit":
+			_, _ = client.Write(protocol.MakeOkReply().ToBytes())
+			r.closeClient(client)
+			logger.Info("connection closed: " + client.RemoteAddr().String())
+			return
+		default:
+			execResultReply = r.exec(client, mbReply.Args)
+		}
 		// 执行结果Reply 为 nil =》 未知错误
 		if execResultReply == nil {
 			// TODO 使用 error报文
@@ -107,6 +146,21 @@ func (r *RespHandler) Handle(ctx context.Context, conn net.Conn) {
 	}
 }
 
+// exec 检查连接的用户是否可以执行该命令, ACL 命令在协议层执行, 其他命令交给 database 层
+func (r *RespHandler) exec(client *connection.Connection, cmdLine [][]byte) resp.ReplyIntf {
+	user := r.currentUser(client)
+	if user == nil {
+		return noAuthReply
+	}
+	if errReply := r.acl.Check(user, cmdLine, clientInfo(client)); errReply != nil {
+		return errReply
+	}
+	if strings.ToLower(string(cmdLine[0])) == "acl" {
+		return r.acl.Exec(user, clientInfo(client), cmdLine[1:])
+	}
+	return r.dbIntf.Exec(client, cmdLine)
+}
+
 func (r *RespHandler) Close() error {
 	logger.Info("handler shutting down...")
 	r.closing.Set(true)
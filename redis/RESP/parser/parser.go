@@ -14,6 +14,20 @@ import (
 type PayLoad struct {
 	Data resp.ReplyIntf
 	Err  error
+	// Offset 解析完该载荷后 已消耗的字节数, 用于定位 aof 文件中损坏的位置
+	Offset int64
+}
+
+// countingReader 记录从底层 reader 读取的字节数
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
 }
 
 // ParseStream 将解析命令和执行命令划分开，进行异步处理
@@ -26,17 +40,25 @@ func ParseStream(reader io.Reader) <-chan *PayLoad {
 // TODO 健壮性感觉有问题，需要确认一下
 func parse0(rawReader io.Reader, ch chan<- *PayLoad) {
 
-	reader := bufio.NewReader(rawReader)
+	counter := &countingReader{r: rawReader}
+	reader := bufio.NewReader(counter)
+	offset := func() int64 {
+		return counter.n - int64(reader.Buffered())
+	}
 	for {
 		line, err := readLineOrHeader(reader)
 		if err != nil {
 			ch <- &PayLoad{
-				Err: err,
+				Err:    err,
+				Offset: offset(),
 			}
 			close(ch)
 			return
 		}
 		line = bytes.TrimSuffix(line, []byte("\r\n"))
+		if len(line) == 0 {
+			continue
+		}
 		// 解析了SingleLineReply 或 多行Reply 接下来看是哪种类型
 		var result resp.ReplyIntf // 接收解析后的reply报文
 		var parseErr error        // 返回解析错误
@@ -57,8 +79,9 @@ func parse0(rawReader io.Reader, ch chan<- *PayLoad) {
 		}
 		// 通过 channel 发送数据有效载荷
 		ch <- &PayLoad{
-			Data: result,
-			Err:  parseErr,
+			Data:   result,
+			Err:    parseErr,
+			Offset: offset(),
 		}
 		// 若解析时发生IO错误，停止解析剩余命令
 		if flag {
@@ -79,7 +102,7 @@ func readLineOrHeader(bufReader *bufio.Reader) ([]byte, error) {
 		return nil, err
 	}
 	// msg[len(msg)-1] = '\n' 因为这是以 '\n' 进行分割的，所以无需判断 \n
-	if len(msg) == 0 || msg[len(msg)-2] != '\r' {
+	if len(msg) < 2 || msg[len(msg)-2] != '\r' {
 		return nil, errors.New("protocol error: " + string(msg))
 	}
 
@@ -53,6 +53,26 @@ func MakeMultiBulkReply(args [][]byte) *MultiBulkReply {
 	}
 }
 
+// MultiRawReply 元素为任意 reply 的数组, 用于嵌套的回复 eg: ROLE
+type MultiRawReply struct {
+	Replies []resp.ReplyIntf
+}
+
+func (r *MultiRawReply) ToBytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("*" + strconv.Itoa(len(r.Replies)) + CRLF)
+	for _, reply := range r.Replies {
+		buf.Write(reply.ToBytes())
+	}
+	return buf.Bytes()
+}
+
+func MakeMultiRawReply(replies []resp.ReplyIntf) *MultiRawReply {
+	return &MultiRawReply{
+		Replies: replies,
+	}
+}
+
 type StatusReply struct {
 	Status string
 }
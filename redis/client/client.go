@@ -0,0 +1,181 @@
+// Package client 同步的 RESP 客户端, 发送一条命令后等待回复
+// 用于节点之间的通信(哨兵, 集群) 以及命令行工具, 不追求吞吐量
+
+package client
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"memgo/interface/resp"
+	"memgo/redis/RESP/protocol"
+	"memgo/utils"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type Client struct {
+	mu      sync.Mutex
+	conn    net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration // 每条命令的读写超时
+}
+
+func Dial(addr string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		timeout: timeout,
+	}, nil
+}
+
+// DialAuth 连接后使用 password 认证, password 为空时与 Dial 相同
+// 节点之间的连接(集群, raft, crdt)使用各节点共同的 requirepass
+func DialAuth(addr string, timeout time.Duration, password string) (*Client, error) {
+	c, err := Dial(addr, timeout)
+	if err != nil || password == "" {
+		return c, err
+	}
+	reply, err := c.Do("AUTH", password)
+	if err == nil {
+		_, err = String(reply)
+	}
+	if err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Do 发送命令并读取回复, 错误回复以 *protocol.StandardErrorReply 返回, error 只表示网络或协议错误
+// NODE 返回 error 后连接状态未知, 调用方应关闭连接
+func (c *Client) Do(args ...string) (resp.ReplyIntf, error) {
+	return c.DoBytes(utils.ToCmdLine(args...))
+}
+
+func (c *Client) DoBytes(cmdLine [][]byte) (resp.ReplyIntf, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timeout > 0 {
+		_ = c.conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	if _, err := c.conn.Write(protocol.MakeMultiBulkReply(cmdLine).ToBytes()); err != nil {
+		return nil, err
+	}
+	return ReadReply(c.reader)
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// ReadReply 读取一个完整的回复, 数组的元素可以是任意类型(包括嵌套的数组), 统一返回 *protocol.MultiRawReply
+func ReadReply(reader *bufio.Reader) (resp.ReplyIntf, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("protocol error: " + line)
+	}
+	body := line[1 : len(line)-2]
+	switch line[0] {
+	case '+':
+		return protocol.MakeStatusReply(body), nil
+	case '-':
+		return protocol.MakeErrReply(body), nil
+	case ':':
+		n, err := strconv.ParseInt(body, 10, 64)
+		if err != nil {
+			return nil, errors.New("protocol error: " + line)
+		}
+		return protocol.MakeIntReply(n), nil
+	case '$':
+		size, err := strconv.Atoi(body)
+		if err != nil || size < -1 {
+			return nil, errors.New("protocol error: " + line)
+		}
+		if size == -1 {
+			return protocol.MakeNullBulkReply(), nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return protocol.MakeBulkReply(data[:size]), nil
+	case '*':
+		size, err := strconv.Atoi(body)
+		if err != nil || size < -1 {
+			return nil, errors.New("protocol error: " + line)
+		}
+		replies := make([]resp.ReplyIntf, 0, size)
+		for i := 0; i < size; i++ {
+			reply, err := ReadReply(reader)
+			if err != nil {
+				return nil, err
+			}
+			replies = append(replies, reply)
+		}
+		return protocol.MakeMultiRawReply(replies), nil
+	}
+	return nil, errors.New("protocol error: " + line)
+}
+
+// String 将状态, 字符串, 整数回复转换为字符串, 错误回复转换为 error
+func String(reply resp.ReplyIntf) (string, error) {
+	switch r := reply.(type) {
+	case *protocol.StatusReply:
+		return r.Status, nil
+	case *protocol.BulkReply:
+		return string(r.Arg), nil
+	case *protocol.IntReply:
+		return strconv.FormatInt(r.Code, 10), nil
+	case *protocol.StandardErrorReply:
+		return "", r
+	}
+	return "", errors.New("unexpected reply: " + string(reply.ToBytes()))
+}
+
+// Int 将整数回复(或内容为整数的字符串回复)转换为整数
+func Int(reply resp.ReplyIntf) (int64, error) {
+	if r, ok := reply.(*protocol.IntReply); ok {
+		return r.Code, nil
+	}
+	s, err := String(reply)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// Array 返回数组回复的元素
+func Array(reply resp.ReplyIntf) ([]resp.ReplyIntf, error) {
+	switch r := reply.(type) {
+	case *protocol.MultiRawReply:
+		return r.Replies, nil
+	case *protocol.StandardErrorReply:
+		return nil, r
+	}
+	return nil, errors.New("unexpected reply: " + string(reply.ToBytes()))
+}
+
+// Strings 返回元素均为字符串的数组回复
+func Strings(reply resp.ReplyIntf) ([]string, error) {
+	replies, err := Array(reply)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, len(replies))
+	for i, r := range replies {
+		if result[i], err = String(r); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
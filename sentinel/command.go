@@ -0,0 +1,303 @@
+package sentinel
+
+import (
+	"memgo/interface/database"
+	"memgo/interface/resp"
+	"memgo/redis/RESP/protocol"
+	"memgo/utils"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exec 哨兵只支持 PING, INFO, ROLE 与 SENTINEL 子命令, 实现 DBServerIntf 以复用 RESP handler
+func (s *Sentinel) Exec(client resp.ConnectionIntf, cmdLine database.CmdLine) resp.ReplyIntf {
+	switch strings.ToLower(string(cmdLine[0])) {
+	case "ping":
+		return protocol.MakePongReply()
+	case "info":
+		return s.execInfo()
+	case "role":
+		return s.execRole()
+	case "sentinel":
+		if len(cmdLine) < 2 {
+			return protocol.MakeArgNumErrReply("sentinel")
+		}
+		return s.execSentinel(strings.ToLower(string(cmdLine[1])), toStrings(cmdLine[2:]))
+	}
+	return protocol.MakeErrReply("ERR unknown command '" + string(cmdLine[0]) + "'")
+}
+
+func (s *Sentinel) AfterClientClose(c resp.ConnectionIntf) {
+}
+
+func toStrings(args [][]byte) []string {
+	result := make([]string, len(args))
+	for i, arg := range args {
+		result[i] = string(arg)
+	}
+	return result
+}
+
+func (s *Sentinel) execSentinel(sub string, args []string) resp.ReplyIntf {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// 投票与 hello 可能改变 epoch 或主节点, 回复之前保存
+	defer s.saveConfig()
+	// 除 myid 与 masters 外, 第一个参数都是主节点的名字
+	var m *master
+	switch sub {
+	case "myid":
+		return protocol.MakeBulkReply([]byte(s.myID))
+	case "masters":
+		replies := make([]resp.ReplyIntf, 0, len(s.masters))
+		for _, m := range s.masters {
+			replies = append(replies, s.masterFields(m))
+		}
+		return protocol.MakeMultiRawReply(replies)
+	case "is-master-down-by-addr":
+		if len(args) != 4 {
+			return protocol.MakeArgNumErrReply("sentinel is-master-down-by-addr")
+		}
+		return s.execIsMasterDown(args)
+	case "hello":
+		if len(args) != 8 {
+			return protocol.MakeArgNumErrReply("sentinel hello")
+		}
+		return s.execHello(args)
+	default:
+		if len(args) == 0 {
+			return protocol.MakeArgNumErrReply("sentinel " + sub)
+		}
+		if m = s.masterByName(args[0]); m == nil {
+			return protocol.MakeErrReply("ERR No such master with that name")
+		}
+	}
+
+	switch sub {
+	case "get-master-addr-by-name":
+		host, port := m.inst.hostPort()
+		return protocol.MakeMultiBulkReply(utils.ToCmdLine(host, port))
+	case "master":
+		return s.masterFields(m)
+	case "replicas", "slaves":
+		replies := make([]resp.ReplyIntf, 0, len(m.replicas))
+		for _, inst := range m.replicas {
+			replies = append(replies, replicaFields(inst))
+		}
+		return protocol.MakeMultiRawReply(replies)
+	case "sentinels":
+		replies := make([]resp.ReplyIntf, 0, len(m.sentinels))
+		for _, p := range m.sentinels {
+			host, port, _ := net.SplitHostPort(p.addr)
+			replies = append(replies, protocol.MakeMultiBulkReply(utils.ToCmdLine(
+				"name", p.addr, "ip", host, "port", port, "runid", p.runID, "flags", "sentinel",
+				"last-hello-message", sinceMillis(p.lastHello))))
+		}
+		return protocol.MakeMultiRawReply(replies)
+	case "ckquorum":
+		usable := 1
+		for _, p := range m.sentinels {
+			if time.Since(p.lastHello) < 5*helloPeriod {
+				usable++
+			}
+		}
+		voters := len(m.sentinels) + 1
+		if usable < m.quorum {
+			return protocol.MakeErrReply("NOQUORUM " + strconv.Itoa(usable) + " usable Sentinels. Not enough available Sentinels to reach the specified quorum for this master")
+		}
+		if usable < voters/2+1 {
+			return protocol.MakeErrReply("NOQUORUM " + strconv.Itoa(usable) + " usable Sentinels. Not enough available Sentinels to reach the majority and authorize a failover")
+		}
+		return protocol.MakeStatusReply("OK " + strconv.Itoa(usable) + " usable Sentinels. Quorum and failover authorization can be reached")
+	case "failover":
+		if m.failoverState != failoverNone {
+			return protocol.MakeErrReply("INPROG Failover already in progress")
+		}
+		if selectReplica(m, time.Now()) == nil {
+			return protocol.MakeErrReply("NOGOODSLAVE No suitable replica to promote")
+		}
+		m.forced = true
+		return protocol.MakeOkReply()
+	}
+	return protocol.MakeErrReply("ERR Unknown sentinel subcommand '" + sub + "'")
+}
+
+func (s *Sentinel) masterByName(name string) *master {
+	for _, m := range s.masters {
+		if m.name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+// SENTINEL is-master-down-by-addr ip port current-epoch runid
+// runid 为 * 时只回复主节点是否主观下线, 否则同时请求投票; 回复 [是否下线, 投票给的哨兵, 投票的 epoch]
+func (s *Sentinel) execIsMasterDown(args []string) resp.ReplyIntf {
+	epoch, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	addr := net.JoinHostPort(args[0], args[1])
+	var m *master
+	for _, candidate := range s.masters {
+		if candidate.inst.addr == addr {
+			m = candidate
+		}
+	}
+	down := m != nil && m.inst.sdown
+	leader, leaderEpoch := "*", int64(0)
+	if m != nil && args[3] != "*" {
+		if epoch > s.currentEpoch {
+			s.currentEpoch = epoch
+			s.event("+new-epoch", m, args[2])
+		}
+		// 每个 epoch 只投一次票, 投给第一个请求的哨兵
+		if m.leaderEpoch < epoch && s.currentEpoch <= epoch {
+			m.leader, m.leaderEpoch = args[3], epoch
+			s.event("+vote-for-leader", m, args[3]+" "+args[2])
+			// 投票给其他哨兵后, 给它留出完成故障转移的时间
+			if args[3] != s.myID {
+				m.nextFailover = time.Now().Add(2 * m.failoverTimeout)
+			}
+		}
+		leader, leaderEpoch = m.leader, m.leaderEpoch
+	}
+	return protocol.MakeMultiRawReply([]resp.ReplyIntf{
+		protocol.MakeIntReply(int64(boolToInt(down))),
+		protocol.MakeBulkReply([]byte(leader)),
+		protocol.MakeIntReply(leaderEpoch),
+	})
+}
+
+// SENTINEL hello master-name master-ip master-port master-config-epoch runid ip port current-epoch
+// 哨兵之间每 2 秒互相发送, 用于发现其他哨兵以及传播故障转移后的新主节点
+func (s *Sentinel) execHello(args []string) resp.ReplyIntf {
+	m := s.masterByName(args[0])
+	configEpoch, err1 := strconv.ParseInt(args[3], 10, 64)
+	currentEpoch, err2 := strconv.ParseInt(args[7], 10, 64)
+	if m == nil || err1 != nil || err2 != nil {
+		return protocol.MakeErrReply("ERR invalid hello message")
+	}
+	runID, addr := args[4], net.JoinHostPort(args[5], args[6])
+	if runID == s.myID {
+		return protocol.MakeOkReply()
+	}
+	p, ok := m.sentinels[addr]
+	if !ok {
+		p = &peer{addr: addr}
+		m.sentinels[addr] = p
+		s.event("+sentinel", m, "sentinel "+runID+" "+addr)
+	}
+	p.runID = runID
+	p.lastHello = time.Now()
+	if currentEpoch > s.currentEpoch {
+		s.currentEpoch = currentEpoch
+		s.event("+new-epoch", m, args[7])
+	}
+	masterAddr := net.JoinHostPort(args[1], args[2])
+	if configEpoch > m.configEpoch {
+		m.configEpoch = configEpoch
+		if masterAddr != m.inst.addr {
+			s.event("+config-update-from", m, "sentinel "+runID+" "+addr)
+			if m.failoverState != failoverNone {
+				s.abortFailover(m, "config-update")
+			}
+			s.switchMaster(m, masterAddr)
+		}
+	}
+	return protocol.MakeOkReply()
+}
+
+func (s *Sentinel) masterFields(m *master) resp.ReplyIntf {
+	host, port := m.inst.hostPort()
+	flags := "master"
+	if m.inst.sdown {
+		flags += ",s_down"
+	}
+	if m.odown {
+		flags += ",o_down"
+	}
+	if m.failoverState != failoverNone {
+		flags += ",failover_in_progress"
+	}
+	return protocol.MakeMultiBulkReply(utils.ToCmdLine(
+		"name", m.name, "ip", host, "port", port, "runid", m.inst.runID, "flags", flags,
+		"last-ok-ping-reply", sinceMillis(m.inst.lastOK),
+		"down-after-milliseconds", strconv.FormatInt(m.downAfter.Milliseconds(), 10),
+		"num-slaves", strconv.Itoa(len(m.replicas)),
+		"num-other-sentinels", strconv.Itoa(len(m.sentinels)),
+		"quorum", strconv.Itoa(m.quorum),
+		"failover-timeout", strconv.FormatInt(m.failoverTimeout.Milliseconds(), 10),
+		"config-epoch", strconv.FormatInt(m.configEpoch, 10)))
+}
+
+func replicaFields(inst *instance) resp.ReplyIntf {
+	host, port := inst.hostPort()
+	flags := "slave"
+	if inst.sdown {
+		flags += ",s_down"
+	}
+	linkStatus := "err"
+	if inst.linkUp {
+		linkStatus = "ok"
+	}
+	masterHost, masterPort, _ := net.SplitHostPort(inst.masterAddr)
+	return protocol.MakeMultiBulkReply(utils.ToCmdLine(
+		"name", inst.addr, "ip", host, "port", port, "runid", inst.runID, "flags", flags,
+		"last-ok-ping-reply", sinceMillis(inst.lastOK),
+		"role-reported", inst.role,
+		"master-link-status", linkStatus,
+		"master-host", masterHost, "master-port", masterPort,
+		"slave-repl-offset", strconv.FormatInt(inst.offset, 10)))
+}
+
+func (s *Sentinel) execInfo() resp.ReplyIntf {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var builder strings.Builder
+	builder.WriteString("# Server\r\nrun_id:" + s.myID + "\r\nredis_mode:sentinel\r\n\r\n# Sentinel\r\n")
+	builder.WriteString("sentinel_masters:" + strconv.Itoa(len(s.masters)) + "\r\n")
+	builder.WriteString("sentinel_current_epoch:" + strconv.FormatInt(s.currentEpoch, 10) + "\r\n")
+	for i, m := range s.masters {
+		status := "ok"
+		if m.odown {
+			status = "odown"
+		} else if m.inst.sdown {
+			status = "sdown"
+		}
+		builder.WriteString("master" + strconv.Itoa(i) + ":name=" + m.name + ",status=" + status +
+			",address=" + m.inst.addr + ",slaves=" + strconv.Itoa(len(m.replicas)) +
+			",sentinels=" + strconv.Itoa(len(m.sentinels)+1) + "\r\n")
+	}
+	return protocol.MakeBulkReply([]byte(builder.String()))
+}
+
+func (s *Sentinel) execRole() resp.ReplyIntf {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, len(s.masters))
+	for i, m := range s.masters {
+		names[i] = m.name
+	}
+	return protocol.MakeMultiRawReply([]resp.ReplyIntf{
+		protocol.MakeBulkReply([]byte("sentinel")),
+		protocol.MakeMultiBulkReply(utils.ToCmdLine(names...)),
+	})
+}
+
+func sinceMillis(t time.Time) string {
+	if t.IsZero() {
+		return "-1"
+	}
+	return strconv.FormatInt(time.Since(t).Milliseconds(), 10)
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
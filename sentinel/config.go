@@ -0,0 +1,300 @@
+package sentinel
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"memgo/logger"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPort            = 26379
+	defaultDownAfter       = 30 * time.Second
+	defaultFailoverTimeout = 3 * time.Minute
+)
+
+// Config 哨兵的配置文件, 格式与 redis sentinel.conf 相同 eg:
+//
+//	port 26379
+//	sentinel monitor mymaster 127.0.0.1 6379 2
+//	sentinel down-after-milliseconds mymaster 5000
+//	sentinel failover-timeout mymaster 60000
+//	sentinel auth-pass mymaster secret
+//	sentinel known-sentinel mymaster 127.0.0.1 26380
+//
+// NODE 与 redis 相同, 哨兵在状态变化(epoch、投票、切换主节点、发现新的实例)时改写配置文件, 重启后从最新的主节点开始
+// 改写后 current-epoch、config-epoch、leader-epoch 记录 epoch 与投票, 每个 epoch 只投一次票在重启后依然成立
+// 改写时按上述格式重新生成整个文件, 原有的注释不会保留
+type Config struct {
+	Bind         string
+	Port         int
+	AnnounceIP   string
+	AnnouncePort int
+	MyID         string
+	CurrentEpoch int64
+	Masters      []*MasterConfig
+	// Filename 状态变化时改写的配置文件, 为空时不保存
+	Filename string
+}
+
+type MasterConfig struct {
+	Name            string
+	Addr            string
+	Quorum          int
+	DownAfter       time.Duration
+	FailoverTimeout time.Duration
+	AuthPass        string
+	KnownSentinels  []string
+	KnownReplicas   []string
+	ConfigEpoch     int64
+	LeaderEpoch     int64 // 最近一次投票的 epoch
+}
+
+func LoadConfig(filename string) (*Config, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	cfg, err := ParseConfig(file)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Filename = filename
+	return cfg, nil
+}
+
+func ParseConfig(src io.Reader) (*Config, error) {
+	cfg := &Config{Bind: "0.0.0.0", Port: defaultPort}
+	masters := make(map[string]*MasterConfig)
+	scanner := bufio.NewScanner(src)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		fail := func(msg string) error {
+			return errors.New("sentinel config line " + strconv.Itoa(lineNo) + ": " + msg)
+		}
+		directive := strings.ToLower(fields[0])
+		if directive != "sentinel" {
+			if len(fields) != 2 {
+				continue
+			}
+			switch directive {
+			case "bind":
+				cfg.Bind = fields[1]
+			case "port":
+				port, err := strconv.Atoi(fields[1])
+				if err != nil {
+					return nil, fail("invalid port")
+				}
+				cfg.Port = port
+			}
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, fail("wrong number of arguments")
+		}
+		option := strings.ToLower(fields[1])
+		switch option {
+		case "myid":
+			cfg.MyID = fields[2]
+			continue
+		case "announce-ip":
+			cfg.AnnounceIP = fields[2]
+			continue
+		case "announce-port":
+			port, err := strconv.Atoi(fields[2])
+			if err != nil {
+				return nil, fail("invalid announce-port")
+			}
+			cfg.AnnouncePort = port
+			continue
+		case "current-epoch":
+			epoch, err := strconv.ParseInt(fields[2], 10, 64)
+			if err != nil || epoch < 0 {
+				return nil, fail("invalid current-epoch")
+			}
+			cfg.CurrentEpoch = epoch
+			continue
+		case "monitor":
+			if len(fields) != 6 {
+				return nil, fail("sentinel monitor <name> <host> <port> <quorum>")
+			}
+			quorum, err := strconv.Atoi(fields[5])
+			if err != nil || quorum <= 0 {
+				return nil, fail("quorum must be 1 or greater")
+			}
+			if _, ok := masters[fields[2]]; ok {
+				return nil, fail("duplicated master name")
+			}
+			master := &MasterConfig{
+				Name:            fields[2],
+				Addr:            net.JoinHostPort(fields[3], fields[4]),
+				Quorum:          quorum,
+				DownAfter:       defaultDownAfter,
+				FailoverTimeout: defaultFailoverTimeout,
+			}
+			masters[master.Name] = master
+			cfg.Masters = append(cfg.Masters, master)
+			continue
+		}
+		// 其余选项的第一个参数都是主节点的名字, 需要在 monitor 之后配置
+		master, ok := masters[fields[2]]
+		if !ok {
+			return nil, fail("no such master with specified name")
+		}
+		args := fields[3:]
+		switch option {
+		case "down-after-milliseconds", "failover-timeout":
+			if len(args) != 1 {
+				return nil, fail("wrong number of arguments")
+			}
+			ms, err := strconv.Atoi(args[0])
+			if err != nil || ms <= 0 {
+				return nil, fail("invalid " + option)
+			}
+			if option == "down-after-milliseconds" {
+				master.DownAfter = time.Duration(ms) * time.Millisecond
+			} else {
+				master.FailoverTimeout = time.Duration(ms) * time.Millisecond
+			}
+		case "config-epoch", "leader-epoch":
+			if len(args) != 1 {
+				return nil, fail("wrong number of arguments")
+			}
+			epoch, err := strconv.ParseInt(args[0], 10, 64)
+			if err != nil || epoch < 0 {
+				return nil, fail("invalid " + option)
+			}
+			if option == "config-epoch" {
+				master.ConfigEpoch = epoch
+			} else {
+				master.LeaderEpoch = epoch
+			}
+		case "auth-pass":
+			if len(args) != 1 {
+				return nil, fail("wrong number of arguments")
+			}
+			master.AuthPass = args[0]
+		case "known-sentinel", "known-replica":
+			if len(args) < 2 {
+				return nil, fail("wrong number of arguments")
+			}
+			addr := net.JoinHostPort(args[0], args[1])
+			if option == "known-sentinel" {
+				master.KnownSentinels = append(master.KnownSentinels, addr)
+			} else {
+				master.KnownReplicas = append(master.KnownReplicas, addr)
+			}
+		default:
+			return nil, fail("unknown option " + option)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(cfg.Masters) == 0 {
+		return nil, errors.New("sentinel config: no master to monitor")
+	}
+	return cfg, nil
+}
+
+// renderConfig 按配置文件的格式输出当前的状态, 调用方需持有 Sentinel.mu
+func (s *Sentinel) renderConfig() string {
+	var builder strings.Builder
+	line := func(fields ...string) {
+		builder.WriteString(strings.Join(fields, " "))
+		builder.WriteString("\n")
+	}
+	builder.WriteString("# 由哨兵在状态变化时自动改写\n")
+	line("bind", s.cfg.Bind)
+	line("port", strconv.Itoa(s.cfg.Port))
+	line("sentinel", "myid", s.myID)
+	if s.cfg.AnnounceIP != "" {
+		line("sentinel", "announce-ip", s.cfg.AnnounceIP)
+	}
+	if s.cfg.AnnouncePort != 0 {
+		line("sentinel", "announce-port", strconv.Itoa(s.cfg.AnnouncePort))
+	}
+	line("sentinel", "current-epoch", strconv.FormatInt(s.currentEpoch, 10))
+	for _, m := range s.masters {
+		host, port := m.inst.hostPort()
+		line("sentinel", "monitor", m.name, host, port, strconv.Itoa(m.quorum))
+		line("sentinel", "down-after-milliseconds", m.name, strconv.FormatInt(m.downAfter.Milliseconds(), 10))
+		line("sentinel", "failover-timeout", m.name, strconv.FormatInt(m.failoverTimeout.Milliseconds(), 10))
+		if m.authPass != "" {
+			line("sentinel", "auth-pass", m.name, m.authPass)
+		}
+		line("sentinel", "config-epoch", m.name, strconv.FormatInt(m.configEpoch, 10))
+		line("sentinel", "leader-epoch", m.name, strconv.FormatInt(m.leaderEpoch, 10))
+		// map 的遍历顺序是随机的, 排序后内容不变时不需要改写
+		var replicas, sentinels []string
+		for addr := range m.replicas {
+			replicas = append(replicas, addr)
+		}
+		for addr := range m.sentinels {
+			sentinels = append(sentinels, addr)
+		}
+		sort.Strings(replicas)
+		sort.Strings(sentinels)
+		for _, addr := range replicas {
+			host, port, _ := net.SplitHostPort(addr)
+			line("sentinel", "known-replica", m.name, host, port)
+		}
+		for _, addr := range sentinels {
+			host, port, _ := net.SplitHostPort(addr)
+			line("sentinel", "known-sentinel", m.name, host, port)
+		}
+	}
+	return builder.String()
+}
+
+// saveConfig 状态有变化时改写配置文件, 调用方需持有 Sentinel.mu
+// NODE 在回复投票之前保存, 防止重启后在同一个 epoch 中再次投票
+func (s *Sentinel) saveConfig() {
+	if s.cfg.Filename == "" {
+		return
+	}
+	content := s.renderConfig()
+	if content == s.savedConfig {
+		return
+	}
+	if err := writeFile(s.cfg.Filename, []byte(content)); err != nil {
+		logger.Warn("sentinel: rewrite config failed: " + err.Error())
+		return
+	}
+	s.savedConfig = content
+}
+
+// writeFile 先写入同目录下的临时文件, 刷盘后再原子地替换
+func writeFile(filename string, data []byte) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.Write(data)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), filename)
+	}
+	if err != nil {
+		_ = os.Remove(tmpFile.Name())
+	}
+	return err
+}
@@ -0,0 +1,198 @@
+package sentinel
+
+import (
+	"memgo/redis/RESP/protocol"
+	"memgo/redis/client"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// instance 被监控的主节点或从节点
+// NODE 除 client 之外的字段由 Sentinel.mu 保护; client 只在一次探测中使用, 同一个实例的探测不会并发
+type instance struct {
+	addr   string
+	client *client.Client
+	runID  string
+
+	lastOK time.Time // 最近一次收到有效的 PING 回复, 创建时视为正常
+	sdown  bool      // 主观下线: 超过 down-after 没有有效的 PING 回复
+
+	// 最近一次 INFO replication 的结果
+	infoTime   time.Time
+	role       string
+	masterAddr string // 从节点复制的主节点
+	linkUp     bool
+	offset     int64
+	// 主节点的 INFO 中的从节点, 用于发现新的从节点
+	replicaAddrs []string
+
+	// 从节点的角色或主节点与当前配置不一致的开始时间, 持续一段时间后重新配置
+	misconfiguredSince time.Time
+}
+
+func newInstance(addr string) *instance {
+	return &instance{addr: addr, lastOK: time.Now()}
+}
+
+func (inst *instance) hostPort() (string, string) {
+	host, port, _ := net.SplitHostPort(inst.addr)
+	return host, port
+}
+
+// probeResult 一次探测的结果, 在不持有锁时探测, 持有锁时应用
+type probeResult struct {
+	pingOK bool
+	info   map[string]string
+}
+
+// do 在实例上执行命令, 需要时建立连接并认证; 出错时关闭连接, 下次重连
+func (inst *instance) do(authPass string, timeout time.Duration, args ...string) (string, error) {
+	if inst.client == nil {
+		c, err := client.Dial(inst.addr, timeout)
+		if err != nil {
+			return "", err
+		}
+		if authPass != "" {
+			reply, err := c.Do("AUTH", authPass)
+			if err == nil {
+				_, err = client.String(reply)
+			}
+			if err != nil {
+				_ = c.Close()
+				return "", err
+			}
+		}
+		inst.client = c
+	}
+	reply, err := inst.client.Do(args...)
+	if err != nil {
+		_ = inst.client.Close()
+		inst.client = nil
+		return "", err
+	}
+	return client.String(reply)
+}
+
+func (inst *instance) probe(authPass string, timeout time.Duration, wantInfo bool) probeResult {
+	var result probeResult
+	pong, err := inst.do(authPass, timeout, "PING")
+	// NODE 与 redis 相同, LOADING 等错误也视为有效回复, 说明实例还在运行
+	result.pingOK = err == nil && pong == "PONG"
+	if errReply, ok := err.(*protocol.StandardErrorReply); ok {
+		result.pingOK = strings.HasPrefix(errReply.Status, "LOADING") ||
+			strings.HasPrefix(errReply.Status, "MASTERDOWN")
+	}
+	if wantInfo && inst.client != nil {
+		if text, err := inst.do(authPass, timeout, "INFO", "server", "replication"); err == nil {
+			result.info = parseInfo(text)
+		}
+	}
+	return result
+}
+
+func (inst *instance) close() {
+	if inst.client != nil {
+		_ = inst.client.Close()
+		inst.client = nil
+	}
+}
+
+// parseInfo 解析 INFO 的输出 key:value
+func parseInfo(text string) map[string]string {
+	info := make(map[string]string)
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if idx := strings.IndexByte(line, ':'); idx > 0 {
+			info[line[:idx]] = line[idx+1:]
+		}
+	}
+	return info
+}
+
+// applyInfo 调用方需持有 Sentinel.mu
+func (inst *instance) applyInfo(info map[string]string, now time.Time) {
+	inst.infoTime = now
+	if runID := info["run_id"]; runID != "" {
+		inst.runID = runID
+	}
+	inst.role = info["role"]
+	inst.masterAddr = ""
+	inst.linkUp = false
+	inst.offset = 0
+	inst.replicaAddrs = inst.replicaAddrs[:0]
+	if inst.role == "slave" {
+		inst.masterAddr = net.JoinHostPort(info["master_host"], info["master_port"])
+		inst.linkUp = info["master_link_status"] == "up"
+		inst.offset, _ = strconv.ParseInt(info["slave_repl_offset"], 10, 64)
+		return
+	}
+	inst.offset, _ = strconv.ParseInt(info["master_repl_offset"], 10, 64)
+	// slave0:ip=127.0.0.1,port=6380,state=online,offset=100,lag=0
+	for key, value := range info {
+		if !strings.HasPrefix(key, "slave") || len(key) == 5 || key[5] < '0' || key[5] > '9' {
+			continue
+		}
+		var ip, port string
+		for _, field := range strings.Split(value, ",") {
+			if kv := strings.SplitN(field, "=", 2); len(kv) == 2 {
+				switch kv[0] {
+				case "ip":
+					ip = kv[1]
+				case "port":
+					port = kv[1]
+				}
+			}
+		}
+		if ip != "" && port != "" {
+			inst.replicaAddrs = append(inst.replicaAddrs, net.JoinHostPort(ip, port))
+		}
+	}
+}
+
+// peer 监控同一个主节点的其他哨兵
+type peer struct {
+	addr      string
+	runID     string
+	client    *client.Client
+	lastHello time.Time // 最近一次收到它的 hello
+
+	// 最近一次 is-master-down-by-addr 的回复
+	replyTime    time.Time
+	masterDown   bool
+	leader       string
+	leaderEpoch  int64
+	lastHelloOut time.Time // 最近一次向它发送 hello
+}
+
+func (p *peer) do(timeout time.Duration, args ...string) ([]string, error) {
+	if p.client == nil {
+		c, err := client.Dial(p.addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+		p.client = c
+	}
+	reply, err := p.client.Do(args...)
+	if err != nil {
+		_ = p.client.Close()
+		p.client = nil
+		return nil, err
+	}
+	if _, ok := reply.(*protocol.MultiRawReply); ok {
+		return client.Strings(reply)
+	}
+	s, err := client.String(reply)
+	return []string{s}, err
+}
+
+func (p *peer) close() {
+	if p.client != nil {
+		_ = p.client.Close()
+		p.client = nil
+	}
+}
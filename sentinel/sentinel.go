@@ -0,0 +1,567 @@
+// Package sentinel 哨兵模式, 参考 redis sentinel
+// 哨兵定期 PING 主从节点, 超过 down-after 没有有效回复时认为主节点主观下线(sdown)
+// 向其他哨兵询问(SENTINEL is-master-down-by-addr), 认为下线的哨兵数量达到 quorum 时认为主节点客观下线(odown)
+// 客观下线后开始故障转移: 增加 epoch 并请求其他哨兵投票, 得到多数票(且不少于 quorum)的哨兵成为领导者
+// 领导者选出复制偏移量最大的从节点, 发送 REPLICAOF NO ONE, 确认晋升后让其他从节点复制新的主节点
+// 其他哨兵通过 hello 消息中更大的 config epoch 得知新的主节点
+// NODE redis 通过主节点的 pub/sub 频道发现其他哨兵, memgo 没有 pub/sub, 哨兵之间直接发送 SENTINEL HELLO
+//      需要在配置中用 known-sentinel 指定其他哨兵, 收到 hello 的哨兵也会记住发送者, 因此只需单向配置
+
+package sentinel
+
+import (
+	"math/rand"
+	"memgo/logger"
+	randstring "memgo/utils/rand_string"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	tickPeriod      = time.Second
+	infoPeriod      = 10 * time.Second
+	helloPeriod     = 2 * time.Second
+	commandTimeout  = time.Second
+	electionTimeout = 10 * time.Second
+	// 其他哨兵的回复超过该时间则不再计入客观下线与投票
+	peerReplyValidity = 5 * time.Second
+	// 从节点的配置持续不一致超过该时间后重新配置, 避免干扰正在进行的故障转移
+	reconfigureDelay  = 5 * time.Second
+	maxFailoverDesync = 2 * time.Second
+)
+
+const (
+	failoverNone = iota
+	failoverWaitElection
+	failoverWaitPromotion
+)
+
+type Sentinel struct {
+	myID         string
+	announceAddr string
+	cfg          *Config
+	// 最近一次写入配置文件的内容
+	savedConfig string
+
+	mu           sync.Mutex
+	currentEpoch int64
+	masters      []*master
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// master 一个被监控的主节点及其从节点, 以及监控它的其他哨兵
+type master struct {
+	name            string
+	quorum          int
+	downAfter       time.Duration
+	failoverTimeout time.Duration
+	authPass        string
+
+	inst        *instance
+	configEpoch int64
+	replicas    map[string]*instance // addr -> 从节点
+	sentinels   map[string]*peer     // addr -> 其他哨兵
+	odown       bool
+
+	// 本哨兵在 leaderEpoch 中投票给了 leader, 每个 epoch 只投一次
+	leader      string
+	leaderEpoch int64
+
+	failoverState int
+	failoverEpoch int64
+	failoverStart time.Time
+	forced        bool // SENTINEL FAILOVER, 不需要客观下线与投票
+	promoted      *instance
+	// 在此之前不会开始新的故障转移, 投票给其他哨兵后同样需要等待
+	nextFailover time.Time
+}
+
+func New(cfg *Config) *Sentinel {
+	myID := cfg.MyID
+	if myID == "" {
+		myID = randstring.RandString(40)
+	}
+	ip := cfg.AnnounceIP
+	if ip == "" {
+		ip = cfg.Bind
+		if ip == "0.0.0.0" || ip == "" {
+			ip = "127.0.0.1"
+		}
+	}
+	port := cfg.AnnouncePort
+	if port == 0 {
+		port = cfg.Port
+	}
+	s := &Sentinel{
+		myID:         myID,
+		announceAddr: net.JoinHostPort(ip, strconv.Itoa(port)),
+		cfg:          cfg,
+		currentEpoch: cfg.CurrentEpoch,
+		closing:      make(chan struct{}),
+	}
+	for _, mc := range cfg.Masters {
+		m := &master{
+			name:            mc.Name,
+			quorum:          mc.Quorum,
+			downAfter:       mc.DownAfter,
+			failoverTimeout: mc.FailoverTimeout,
+			authPass:        mc.AuthPass,
+			inst:            newInstance(mc.Addr),
+			replicas:        make(map[string]*instance),
+			sentinels:       make(map[string]*peer),
+			configEpoch:     mc.ConfigEpoch,
+			leaderEpoch:     mc.LeaderEpoch,
+		}
+		for _, addr := range mc.KnownReplicas {
+			m.replicas[addr] = newInstance(addr)
+		}
+		for _, addr := range mc.KnownSentinels {
+			if addr != s.announceAddr {
+				m.sentinels[addr] = &peer{addr: addr}
+			}
+		}
+		s.masters = append(s.masters, m)
+	}
+	return s
+}
+
+// Start 每个主节点一个监控 goroutine
+func (s *Sentinel) Start() {
+	// 随机生成的 myid 需要立即保存, 重启后其他哨兵才能认出自己
+	s.mu.Lock()
+	s.saveConfig()
+	s.mu.Unlock()
+	for _, m := range s.masters {
+		logger.Info("+monitor master " + m.name + " " + m.inst.addr + " quorum " + strconv.Itoa(m.quorum))
+		s.wg.Add(1)
+		go s.monitor(m)
+	}
+}
+
+func (s *Sentinel) monitor(m *master) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(tickPeriod)
+	defer ticker.Stop()
+	for {
+		// 刚开始故障转移时立即再执行一次, 尽快向其他哨兵请求投票
+		if s.tick(m) {
+			continue
+		}
+		select {
+		case <-ticker.C:
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+// probeTask 一次 tick 中对一个实例或哨兵的探测, 在不持有锁时并发执行
+type probeTask struct {
+	inst     *instance
+	wantInfo bool
+	result   probeResult
+
+	peer      *peer
+	hello     []string
+	ask       []string
+	askReply  []string
+	askFailed bool
+}
+
+// tick 返回本次是否开始了故障转移
+func (s *Sentinel) tick(m *master) bool {
+	now := time.Now()
+	tasks := s.prepareTasks(m, now)
+
+	var wg sync.WaitGroup
+	for _, task := range tasks {
+		wg.Add(1)
+		go func(task *probeTask) {
+			defer wg.Done()
+			if task.inst != nil {
+				task.result = task.inst.probe(m.authPass, commandTimeout, task.wantInfo)
+				return
+			}
+			if task.hello != nil {
+				_, _ = task.peer.do(commandTimeout, task.hello...)
+			}
+			if task.ask != nil {
+				reply, err := task.peer.do(commandTimeout, task.ask...)
+				task.askReply, task.askFailed = reply, err != nil || len(reply) != 3
+			}
+		}(task)
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	state := m.failoverState
+	s.applyProbes(m, tasks, time.Now())
+	actions := s.evaluate(m, time.Now())
+	started := state == failoverNone && m.failoverState == failoverWaitElection
+	s.saveConfig()
+	s.mu.Unlock()
+
+	// NODE 向实例发送命令(REPLICAOF)需要网络往返, 在锁外执行
+	for _, action := range actions {
+		action()
+	}
+	return started
+}
+
+func (s *Sentinel) prepareTasks(m *master, now time.Time) []*probeTask {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// 主节点下线或故障转移期间每秒 INFO, 及时获得从节点的状态
+	fastInfo := m.inst.sdown || m.failoverState != failoverNone
+	var tasks []*probeTask
+	for _, inst := range m.instances() {
+		period := infoPeriod
+		if fastInfo || !inst.misconfiguredSince.IsZero() {
+			period = tickPeriod
+		}
+		tasks = append(tasks, &probeTask{inst: inst, wantInfo: now.Sub(inst.infoTime) >= period})
+	}
+	masterHost, masterPort := m.inst.hostPort()
+	myHost, myPort, _ := net.SplitHostPort(s.announceAddr)
+	for _, p := range m.sentinels {
+		task := &probeTask{peer: p}
+		if now.Sub(p.lastHelloOut) >= helloPeriod {
+			p.lastHelloOut = now
+			task.hello = []string{"SENTINEL", "HELLO", m.name, masterHost, masterPort, strconv.FormatInt(m.configEpoch, 10),
+				s.myID, myHost, myPort, strconv.FormatInt(s.currentEpoch, 10)}
+		}
+		if m.inst.sdown {
+			// 选举期间附带自己的 runid 请求投票, 否则只询问主节点的状态
+			runID, epoch := "*", s.currentEpoch
+			if m.failoverState == failoverWaitElection {
+				runID, epoch = s.myID, m.failoverEpoch
+			}
+			task.ask = []string{"SENTINEL", "IS-MASTER-DOWN-BY-ADDR", masterHost, masterPort,
+				strconv.FormatInt(epoch, 10), runID}
+		}
+		if task.hello != nil || task.ask != nil {
+			tasks = append(tasks, task)
+		}
+	}
+	return tasks
+}
+
+// instances 主节点与所有从节点
+func (m *master) instances() []*instance {
+	result := []*instance{m.inst}
+	for _, inst := range m.replicas {
+		result = append(result, inst)
+	}
+	return result
+}
+
+func (s *Sentinel) applyProbes(m *master, tasks []*probeTask, now time.Time) {
+	for _, task := range tasks {
+		if inst := task.inst; inst != nil {
+			// 探测期间主节点可能已经切换, 已不属于该主节点的实例忽略
+			if inst != m.inst && m.replicas[inst.addr] != inst {
+				continue
+			}
+			if task.result.pingOK {
+				inst.lastOK = now
+			}
+			if task.result.info != nil {
+				inst.applyInfo(task.result.info, now)
+				if inst == m.inst {
+					for _, addr := range inst.replicaAddrs {
+						if _, ok := m.replicas[addr]; !ok && addr != m.inst.addr {
+							m.replicas[addr] = newInstance(addr)
+							s.event("+slave", m, addr)
+						}
+					}
+				}
+			}
+			continue
+		}
+		p := task.peer
+		if task.ask == nil || task.askFailed {
+			continue
+		}
+		p.replyTime = now
+		p.masterDown = task.askReply[0] == "1"
+		if task.askReply[1] != "*" {
+			epoch, _ := strconv.ParseInt(task.askReply[2], 10, 64)
+			p.leader, p.leaderEpoch = task.askReply[1], epoch
+		}
+	}
+}
+
+// evaluate 更新下线状态并推进故障转移, 返回需要在锁外执行的操作
+func (s *Sentinel) evaluate(m *master, now time.Time) []func() {
+	for _, inst := range m.instances() {
+		sdown := now.Sub(inst.lastOK) > m.downAfter
+		if sdown != inst.sdown {
+			inst.sdown = sdown
+			kind := "master"
+			if inst != m.inst {
+				kind = "slave"
+			}
+			if sdown {
+				s.event("+sdown", m, kind+" "+inst.addr)
+			} else {
+				s.event("-sdown", m, kind+" "+inst.addr)
+			}
+		}
+	}
+
+	odown := false
+	if m.inst.sdown {
+		votes := 1
+		for _, p := range m.sentinels {
+			if p.masterDown && now.Sub(p.replyTime) < peerReplyValidity {
+				votes++
+			}
+		}
+		odown = votes >= m.quorum
+	}
+	if odown != m.odown {
+		m.odown = odown
+		if odown {
+			// 随机延迟开始故障转移, 避免多个哨兵同时开始选举而都得不到多数票
+			desync := now.Add(time.Duration(rand.Int63n(int64(maxFailoverDesync))))
+			if m.nextFailover.Before(desync) {
+				m.nextFailover = desync
+			}
+			s.event("+odown", m, "master "+m.inst.addr+" #quorum "+strconv.Itoa(m.quorum))
+		} else {
+			s.event("-odown", m, "master "+m.inst.addr)
+		}
+	}
+
+	switch m.failoverState {
+	case failoverNone:
+		if m.forced || (m.odown && now.After(m.nextFailover)) {
+			s.startFailover(m, now)
+		} else {
+			return s.reconfigureInstances(m, now)
+		}
+	case failoverWaitElection:
+		return s.checkElection(m, now)
+	case failoverWaitPromotion:
+		return s.checkPromotion(m, now)
+	}
+	return nil
+}
+
+func (s *Sentinel) startFailover(m *master, now time.Time) {
+	s.currentEpoch++
+	m.failoverEpoch = s.currentEpoch
+	m.failoverState = failoverWaitElection
+	m.failoverStart = now
+	// 投票给自己
+	m.leader, m.leaderEpoch = s.myID, s.currentEpoch
+	// 选举失败后等待一段时间再重试, 同样加上随机延迟
+	m.nextFailover = now.Add(2*m.failoverTimeout + time.Duration(rand.Int63n(int64(maxFailoverDesync))))
+	s.event("+new-epoch", m, strconv.FormatInt(s.currentEpoch, 10))
+	s.event("+try-failover", m, "master "+m.inst.addr)
+}
+
+func (s *Sentinel) abortFailover(m *master, reason string) {
+	s.event("-failover-abort-"+reason, m, "master "+m.inst.addr)
+	m.failoverState = failoverNone
+	m.forced = false
+	m.promoted = nil
+}
+
+// electedLeader 统计 epoch 中的投票, 得票超过哨兵总数的一半且不少于 quorum 的哨兵当选
+func (s *Sentinel) electedLeader(m *master, epoch int64, now time.Time) string {
+	votes := make(map[string]int)
+	if m.leaderEpoch == epoch {
+		votes[m.leader]++
+	}
+	for _, p := range m.sentinels {
+		if p.leaderEpoch == epoch && now.Sub(p.replyTime) < peerReplyValidity {
+			votes[p.leader]++
+		}
+	}
+	voters := len(m.sentinels) + 1
+	need := voters/2 + 1
+	if m.quorum > need {
+		need = m.quorum
+	}
+	for runID, count := range votes {
+		if count >= need {
+			return runID
+		}
+	}
+	return ""
+}
+
+func (s *Sentinel) checkElection(m *master, now time.Time) []func() {
+	if !m.odown && !m.forced {
+		s.abortFailover(m, "not-odown")
+		return nil
+	}
+	leader := s.myID
+	if !m.forced {
+		leader = s.electedLeader(m, m.failoverEpoch, now)
+	}
+	if leader != s.myID {
+		timeout := electionTimeout
+		if m.failoverTimeout < timeout {
+			timeout = m.failoverTimeout
+		}
+		if now.Sub(m.failoverStart) > timeout {
+			s.abortFailover(m, "not-elected")
+		}
+		return nil
+	}
+	s.event("+elected-leader", m, "master "+m.inst.addr)
+	promoted := selectReplica(m, now)
+	if promoted == nil {
+		s.abortFailover(m, "no-good-slave")
+		return nil
+	}
+	s.event("+selected-slave", m, "slave "+promoted.addr+" offset "+strconv.FormatInt(promoted.offset, 10))
+	m.promoted = promoted
+	m.failoverState = failoverWaitPromotion
+	authPass := m.authPass
+	return []func(){func() {
+		if _, err := promoted.do(authPass, commandTimeout, "REPLICAOF", "NO", "ONE"); err != nil {
+			logger.Warn("sentinel: promote " + promoted.addr + " failed: " + err.Error())
+		}
+	}}
+}
+
+// selectReplica 选出可以晋升的从节点: 在线, INFO 是最近获得的, 复制偏移量最大, 相同时选地址较小的
+func selectReplica(m *master, now time.Time) *instance {
+	// 主节点下线时每秒 INFO, 否则(SENTINEL FAILOVER)每 infoPeriod 一次
+	validity := 3 * infoPeriod
+	if m.inst.sdown {
+		validity = peerReplyValidity
+	}
+	var candidates []*instance
+	for _, inst := range m.replicas {
+		if inst.sdown || inst.role != "slave" || now.Sub(inst.infoTime) > validity {
+			continue
+		}
+		candidates = append(candidates, inst)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].offset != candidates[j].offset {
+			return candidates[i].offset > candidates[j].offset
+		}
+		return candidates[i].addr < candidates[j].addr
+	})
+	return candidates[0]
+}
+
+func (s *Sentinel) checkPromotion(m *master, now time.Time) []func() {
+	if now.Sub(m.failoverStart) > m.failoverTimeout {
+		s.abortFailover(m, "timeout")
+		return nil
+	}
+	if m.promoted.role != "master" || m.promoted.infoTime.Before(m.failoverStart) {
+		return nil
+	}
+	s.event("+promoted-slave", m, "slave "+m.promoted.addr)
+	m.configEpoch = m.failoverEpoch
+	s.switchMaster(m, m.promoted.addr)
+	m.failoverState = failoverNone
+	m.forced = false
+	m.promoted = nil
+	// 立即通知其他哨兵
+	for _, p := range m.sentinels {
+		p.lastHelloOut = time.Time{}
+	}
+	s.event("+failover-end", m, "master "+m.inst.addr)
+	return s.reconfigureReplicas(m)
+}
+
+// switchMaster 主节点切换为 addr, 原来的主节点成为从节点, 恢复后会被重新配置
+func (s *Sentinel) switchMaster(m *master, addr string) {
+	old := m.inst
+	s.event("+switch-master", m, old.addr+" "+addr)
+	if inst, ok := m.replicas[addr]; ok {
+		m.inst = inst
+		delete(m.replicas, addr)
+	} else {
+		m.inst = newInstance(addr)
+	}
+	old.sdown = false
+	old.lastOK = time.Now()
+	old.role = ""
+	old.infoTime = time.Time{}
+	m.replicas[old.addr] = old
+	m.odown = false
+	m.inst.sdown = false
+	m.inst.lastOK = time.Now()
+}
+
+// reconfigureReplicas 让所有从节点复制当前的主节点
+func (s *Sentinel) reconfigureReplicas(m *master) []func() {
+	var actions []func()
+	host, port := m.inst.hostPort()
+	authPass := m.authPass
+	for _, inst := range m.replicas {
+		inst := inst
+		event := "sentinel: +slave-reconf-sent " + m.name + " slave " + inst.addr
+		actions = append(actions, func() {
+			if _, err := inst.do(authPass, commandTimeout, "REPLICAOF", host, port); err == nil {
+				logger.Info(event)
+			}
+		})
+	}
+	return actions
+}
+
+// reconfigureInstances 主节点正常时, 纠正角色或复制对象与配置不一致的从节点, 例如恢复后的旧主节点
+func (s *Sentinel) reconfigureInstances(m *master, now time.Time) []func() {
+	if m.inst.sdown {
+		return nil
+	}
+	var actions []func()
+	host, port := m.inst.hostPort()
+	authPass := m.authPass
+	for _, inst := range m.replicas {
+		if inst.sdown || inst.infoTime.IsZero() || (inst.role == "slave" && inst.masterAddr == m.inst.addr) {
+			inst.misconfiguredSince = time.Time{}
+			continue
+		}
+		if inst.misconfiguredSince.IsZero() {
+			inst.misconfiguredSince = now
+			continue
+		}
+		if now.Sub(inst.misconfiguredSince) < reconfigureDelay {
+			continue
+		}
+		inst.misconfiguredSince = now
+		inst := inst
+		s.event("+convert-to-slave", m, "slave "+inst.addr)
+		actions = append(actions, func() {
+			_, _ = inst.do(authPass, commandTimeout, "REPLICAOF", host, port)
+		})
+	}
+	return actions
+}
+
+func (s *Sentinel) event(kind string, m *master, detail string) {
+	logger.Info("sentinel: " + kind + " " + m.name + " " + detail)
+}
+
+// Close 停止监控, 实现 DBServerIntf
+func (s *Sentinel) Close() {
+	close(s.closing)
+	s.wg.Wait()
+	for _, m := range s.masters {
+		for _, inst := range m.instances() {
+			inst.close()
+		}
+		for _, p := range m.sentinels {
+			p.close()
+		}
+	}
+}
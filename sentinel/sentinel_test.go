@@ -0,0 +1,285 @@
+package sentinel
+
+import (
+	"memgo/interface/database"
+	"memgo/interface/resp"
+	"memgo/redis/RESP/handler"
+	"memgo/redis/RESP/protocol"
+	"memgo/tcp"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := ParseConfig(strings.NewReader(`
+port 26380
+sentinel monitor mymaster 127.0.0.1 6379 2
+sentinel down-after-milliseconds mymaster 2000
+sentinel known-sentinel mymaster 127.0.0.1 26381
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := cfg.Masters[0]
+	if cfg.Port != 26380 || m.Addr != "127.0.0.1:6379" || m.Quorum != 2 || m.DownAfter != 2*time.Second ||
+		m.FailoverTimeout != defaultFailoverTimeout || len(m.KnownSentinels) != 1 {
+		t.Fatalf("unexpected config %+v %+v", cfg, m)
+	}
+	if _, err := ParseConfig(strings.NewReader("sentinel down-after-milliseconds other 1000")); err == nil {
+		t.Fatal("option before monitor should fail")
+	}
+}
+
+func TestSelectReplica(t *testing.T) {
+	now := time.Now()
+	m := &master{inst: newInstance("127.0.0.1:6379"), replicas: make(map[string]*instance)}
+	for addr, info := range map[string]string{
+		"127.0.0.1:6380": "role:slave\r\nmaster_host:127.0.0.1\r\nmaster_port:6379\r\nslave_repl_offset:100\r\n",
+		"127.0.0.1:6381": "role:slave\r\nmaster_host:127.0.0.1\r\nmaster_port:6379\r\nslave_repl_offset:200\r\n",
+		"127.0.0.1:6382": "role:slave\r\nmaster_host:127.0.0.1\r\nmaster_port:6379\r\nslave_repl_offset:300\r\n",
+	} {
+		inst := newInstance(addr)
+		inst.applyInfo(parseInfo(info), now)
+		m.replicas[addr] = inst
+	}
+	m.replicas["127.0.0.1:6382"].sdown = true
+	if inst := selectReplica(m, now); inst == nil || inst.addr != "127.0.0.1:6381" {
+		t.Fatalf("expect replica with the largest offset, got %v", inst)
+	}
+	master := newInstance("127.0.0.1:6379")
+	master.applyInfo(parseInfo("role:master\r\nslave0:ip=127.0.0.1,port=6380,state=online,offset=1,lag=0\r\n"), now)
+	if len(master.replicaAddrs) != 1 || master.replicaAddrs[0] != "127.0.0.1:6380" {
+		t.Fatalf("unexpected replicas %v", master.replicaAddrs)
+	}
+}
+
+func TestVote(t *testing.T) {
+	cfg, _ := ParseConfig(strings.NewReader(`
+sentinel myid aaa
+sentinel monitor mymaster 127.0.0.1 6379 2
+sentinel known-sentinel mymaster 127.0.0.1 26380
+sentinel known-sentinel mymaster 127.0.0.1 26381
+`))
+	s := New(cfg)
+	m := s.masters[0]
+	vote := func(epoch, runID string) []string {
+		reply := s.execSentinel("is-master-down-by-addr", []string{"127.0.0.1", "6379", epoch, runID})
+		return strings.Fields(strings.ReplaceAll(string(reply.ToBytes()), "\r\n", " "))
+	}
+	// 每个 epoch 只投给第一个请求的哨兵
+	if reply := vote("1", "bbb"); reply[3] != "bbb" || s.currentEpoch != 1 {
+		t.Fatalf("unexpected vote %v", reply)
+	}
+	if reply := vote("1", "ccc"); reply[3] != "bbb" {
+		t.Fatalf("vote twice in one epoch: %v", reply)
+	}
+	now := time.Now()
+	for _, p := range m.sentinels {
+		p.leader, p.leaderEpoch, p.replyTime = "bbb", 1, now
+	}
+	if leader := s.electedLeader(m, 1, now); leader != "bbb" {
+		t.Fatalf("expect bbb elected, got %q", leader)
+	}
+	m.sentinels["127.0.0.1:26381"].leader = "ccc"
+	m.leader = "aaa"
+	if leader := s.electedLeader(m, 1, now); leader != "" {
+		t.Fatalf("no majority, got %q", leader)
+	}
+}
+
+// fakeInstance 只实现哨兵用到的 PING, INFO 与 REPLICAOF
+type fakeInstance struct {
+	mu         sync.Mutex
+	runID      string
+	role       string
+	masterAddr string
+	offset     int64
+}
+
+func (f *fakeInstance) Exec(c resp.ConnectionIntf, cmdLine database.CmdLine) resp.ReplyIntf {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	args := toStrings(cmdLine)
+	switch strings.ToLower(args[0]) {
+	case "ping":
+		return protocol.MakePongReply()
+	case "info":
+		info := "run_id:" + f.runID + "\r\nrole:" + f.role + "\r\n"
+		if f.role == "slave" {
+			host, port, _ := net.SplitHostPort(f.masterAddr)
+			info += "master_host:" + host + "\r\nmaster_port:" + port + "\r\nmaster_link_status:up\r\n" +
+				"slave_repl_offset:" + strconv.FormatInt(f.offset, 10) + "\r\n"
+		}
+		return protocol.MakeBulkReply([]byte(info))
+	case "replicaof":
+		if strings.EqualFold(args[1], "no") {
+			f.role, f.masterAddr = "master", ""
+		} else {
+			f.role, f.masterAddr = "slave", net.JoinHostPort(args[1], args[2])
+		}
+		return protocol.MakeOkReply()
+	}
+	return protocol.MakeErrReply("ERR unknown command")
+}
+
+func (f *fakeInstance) Close() {}
+
+func (f *fakeInstance) AfterClientClose(c resp.ConnectionIntf) {}
+
+func (f *fakeInstance) state() (string, string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.role, f.masterAddr
+}
+
+type testServer struct {
+	addr    string
+	closing chan struct{}
+	done    chan struct{}
+}
+
+func serve(t *testing.T, addr string, db database.DBServerIntf) *testServer {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &testServer{addr: listener.Addr().String(), closing: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		tcp.ListenAndServe(listener, handler.MakeHandlerWith(db), srv.closing)
+		close(srv.done)
+	}()
+	return srv
+}
+
+func (srv *testServer) stop() {
+	close(srv.closing)
+	<-srv.done
+}
+
+func freeAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// 三个哨兵监控一主两从, 主节点下线后选出领导者完成故障转移, 新的配置写入配置文件, 重启后依然生效
+func TestFailover(t *testing.T) {
+	masterAddr := freeAddr(t)
+	replicas := map[string]*fakeInstance{}
+	for _, offset := range []int64{100, 200} {
+		addr := freeAddr(t)
+		replicas[addr] = &fakeInstance{runID: addr, role: "slave", masterAddr: masterAddr, offset: offset}
+		defer serve(t, addr, replicas[addr]).stop()
+	}
+	masterSrv := serve(t, masterAddr, &fakeInstance{runID: masterAddr, role: "master"})
+
+	dir := t.TempDir()
+	sentinelAddrs := []string{freeAddr(t), freeAddr(t), freeAddr(t)}
+	load := func(i int) *Sentinel {
+		cfg, err := LoadConfig(filepath.Join(dir, "sentinel"+strconv.Itoa(i)+".conf"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return New(cfg)
+	}
+	sentinels := make([]*Sentinel, len(sentinelAddrs))
+	servers := make([]*testServer, len(sentinelAddrs))
+	for i, addr := range sentinelAddrs {
+		host, port, _ := net.SplitHostPort(addr)
+		masterHost, masterPort, _ := net.SplitHostPort(masterAddr)
+		text := "bind " + host + "\nport " + port + "\n" +
+			"sentinel monitor mymaster " + masterHost + " " + masterPort + " 2\n" +
+			"sentinel down-after-milliseconds mymaster 1000\n" +
+			"sentinel failover-timeout mymaster 3000\n"
+		for replica := range replicas {
+			replicaHost, replicaPort, _ := net.SplitHostPort(replica)
+			text += "sentinel known-replica mymaster " + replicaHost + " " + replicaPort + "\n"
+		}
+		for _, other := range sentinelAddrs {
+			otherHost, otherPort, _ := net.SplitHostPort(other)
+			text += "sentinel known-sentinel mymaster " + otherHost + " " + otherPort + "\n"
+		}
+		if err := os.WriteFile(filepath.Join(dir, "sentinel"+strconv.Itoa(i)+".conf"), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+		sentinels[i] = load(i)
+		sentinels[i].Start()
+		servers[i] = serve(t, addr, sentinels[i])
+	}
+	defer func() {
+		for _, srv := range servers {
+			srv.stop()
+		}
+	}()
+
+	masterOf := func(s *Sentinel) string {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.masters[0].inst.addr
+	}
+	// 偏移量最大的从节点晋升
+	var promoted string
+	for addr, inst := range replicas {
+		if inst.offset == 200 {
+			promoted = addr
+		}
+	}
+	time.Sleep(2 * time.Second)
+	masterSrv.stop()
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		done := true
+		for _, s := range sentinels {
+			if masterOf(s) != promoted {
+				done = false
+			}
+		}
+		for addr, inst := range replicas {
+			role, master := inst.state()
+			if addr == promoted && role != "master" || addr != promoted && master != promoted {
+				done = false
+			}
+		}
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("failover not finished")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// 重启后从配置文件中恢复 epoch、投票与新的主节点
+	servers[0].stop()
+	restarted := load(0)
+	servers[0] = serve(t, sentinelAddrs[0], restarted)
+	sentinels[0].mu.Lock()
+	epoch, leaderEpoch := sentinels[0].currentEpoch, sentinels[0].masters[0].leaderEpoch
+	sentinels[0].mu.Unlock()
+	m := restarted.masters[0]
+	if epoch == 0 || leaderEpoch == 0 || restarted.currentEpoch != epoch || m.leaderEpoch != leaderEpoch || m.configEpoch == 0 {
+		t.Fatalf("epoch not restored: current %d/%d leader %d/%d config %d",
+			restarted.currentEpoch, epoch, m.leaderEpoch, leaderEpoch, m.configEpoch)
+	}
+	if m.inst.addr != promoted || restarted.myID != sentinels[0].myID {
+		t.Fatalf("unexpected master %s after restart", m.inst.addr)
+	}
+	if _, ok := m.replicas[masterAddr]; !ok {
+		t.Fatal("old master should be remembered as a replica")
+	}
+	// 已经投过票的 epoch 不再投给其他哨兵
+	host, port := m.inst.hostPort()
+	reply := restarted.execSentinel("is-master-down-by-addr", []string{host, port, strconv.FormatInt(leaderEpoch, 10), "other"})
+	if fields := strings.Fields(strings.ReplaceAll(string(reply.ToBytes()), "\r\n", " ")); fields[3] == "other" {
+		t.Fatalf("vote twice in epoch %d after restart", leaderEpoch)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -20,7 +21,8 @@ type Config struct {
 	Timeout time.Duration `yaml:"timeout"`     // 暂未使用
 }
 
-var ClientCounter int
+// ClientCounter 当前的连接数, 同一进程中可能有多个 server(测试), 通过 atomic 访问
+var ClientCounter int64
 
 // ListenAndServeWithSignal 实现优雅的退出 监听内核推送的信号
 func ListenAndServeWithSignal(cfg *Config, handler tcp.HandlerIntf) error {
@@ -76,11 +78,11 @@ func ListenAndServe(listener net.Listener, handler tcp.HandlerIntf, closeChan <-
 		logger.Info("accept link")
 		ctx := context.Background()
 		wg.Add(1)
-		ClientCounter++
+		atomic.AddInt64(&ClientCounter, 1)
 		go func() {
 			defer func() {
 				wg.Done()
-				ClientCounter--
+				atomic.AddInt64(&ClientCounter, -1)
 			}()
 			handler.Handle(ctx, conn)
 		}()
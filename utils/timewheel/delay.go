@@ -1,24 +1,41 @@
 package timewheel
 
-import "time"
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
-var tw = New(time.Second, 3600)
+// 全局时间轮, 精度为 1ms, 到期任务由固定数量的 worker 执行
+// NODE 第一次 Delay/At 时才创建并启动, 不使用时不占用 goroutine 与 ticker
+var (
+	tw     atomic.Pointer[TimeWheel]
+	twOnce sync.Once
+)
 
-func init() {
-	tw.Start()
+func globalWheel() *TimeWheel {
+	twOnce.Do(func() {
+		wheel := New(time.Millisecond, WithWorkerPool(64))
+		wheel.Start()
+		tw.Store(wheel)
+	})
+	return tw.Load()
 }
 
 // Delay executes job after waiting the given duration
 func Delay(duration time.Duration, key string, job func()) {
-	tw.AddJob(duration, key, job)
+	globalWheel().AddJob(duration, key, job)
 }
 
 // At executes job at given time
 func At(at time.Time, key string, job func()) {
-	tw.AddJob(at.Sub(time.Now()), key, job)
+	globalWheel().AddJob(time.Until(at), key, job)
 }
 
 // Cancel stops a pending job
 func Cancel(key string) {
-	tw.RemoveJob(key)
+	// 时间轮还未启动时 没有等待中的任务
+	if wheel := tw.Load(); wheel != nil {
+		wheel.RemoveJob(key)
+	}
 }
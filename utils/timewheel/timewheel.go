@@ -1,199 +1,297 @@
+// NODE 多层时间轮 (hierarchical timing wheel), 参考 linux 内核的 timer wheel
+// 第 0 层有 256 个槽, 每个槽代表一个 tick; 第 1~4 层各有 64 个槽, 每个槽代表下一层转一圈的时间
+// tick = 1ms 时, 五层时间轮可以覆盖约 49 天, 更长的延迟会在到期前被重新放入时间轮
+// 任务到期前会逐层向下迁移(cascade), 到达第 0 层后在对应的 tick 执行
+//
+// 添加/取消任务都是 O(1): 每个任务记录自身所在的槽位链表及链表节点
+// 调用方不会阻塞在 channel 上: 添加/取消操作先追加到 pending 队列, 由时间轮协程在每个 tick 批量处理
+
 package timewheel
 
 import (
 	"container/list"
 	"memgo/logger"
+	"sync"
 	"time"
 )
 
-// 定义一个结构体，表示任务在时间轮中的位置
-type location struct {
-	slot  int           // 任务所在的槽位
-	etask *list.Element // 任务在槽位中的位置
+const (
+	level0Bits = 8
+	levelNBits = 6
+	level0Size = 1 << level0Bits
+	levelNSize = 1 << levelNBits
+	level0Mask = level0Size - 1
+	levelNMask = levelNSize - 1
+	levelNum   = 5
+
+	// 时间轮能表示的最大延迟(tick 数), 超出的任务先放在最高层, 到期时再重新计算位置
+	maxDelayTicks = int64(1)<<(level0Bits+(levelNum-1)*levelNBits) - 1
+)
+
+// 定义任务结构体
+type task struct {
+	expires int64  // 任务到期的 tick
+	key     string // 任务的键
+	job     func() // 任务的函数
+
+	slot *list.List    // 任务所在的槽位
+	elem *list.Element // 任务在槽位中的位置
 }
 
-// 定义时间轮结构体
-type TimeWheel struct {
-	interval time.Duration // 时间轮转动的时间间隔
-	ticker   *time.Ticker  // 时间轮的定时器
-	slots    []*list.List  // 时间轮的槽位
+// op 调用方提交给时间轮协程的操作, task 为 nil 时表示取消 key 对应的任务
+type op struct {
+	task *task
+	key  string
+}
+
+// Option 时间轮的可选配置
+type Option func(tw *TimeWheel)
 
-	timer             map[string]*location // 存储任务的map
-	currentPos        int                  // 当前时间轮的位置
-	slotNum           int                  // 时间轮的槽数
-	addTaskChannel    chan task            // 添加任务的通道
-	removeTaskChannel chan string          // 移除任务的通道
-	stopChannel       chan bool            // 停止时间轮的通道
+// WithWorkerPool 使用固定数量的 worker 执行到期任务, 而不是为每个任务启一个协程
+func WithWorkerPool(workers int) Option {
+	return func(tw *TimeWheel) {
+		if workers > 0 {
+			tw.workers = workers
+		}
+	}
 }
 
-// 定义任务结构体
-type task struct {
-	delay  time.Duration // 任务延迟时间
-	circle int           // 任务需要转动的圈数
-	key    string        // 任务的键
-	job    func()        // 任务的函数
+// TimeWheel 定义时间轮结构体
+type TimeWheel struct {
+	interval time.Duration // 每个 tick 的时间间隔
+	ticker   *time.Ticker
+	start    time.Time // 时间轮启动的时间点, 用于计算当前应处于的 tick
+	current  int64     // 当前 tick
+
+	levels [levelNum][]*list.List
+	timer  map[string]*task // 存储有键任务的map
+
+	mu      sync.Mutex
+	pending []op // 待处理的添加/取消操作
+
+	workers  int
+	jobQueue chan func()
+
+	stopOnce    sync.Once
+	stopChannel chan struct{}
 }
 
-// New函数用于创建一个新的时间轮
-func New(interval time.Duration, slotNum int) *TimeWheel {
-	if interval <= 0 || slotNum <= 0 {
+// New 创建一个新的时间轮, interval 为一个 tick 的时间
+func New(interval time.Duration, opts ...Option) *TimeWheel {
+	if interval <= 0 {
 		return nil
 	}
 	tw := &TimeWheel{
-		interval:          interval,
-		slots:             make([]*list.List, slotNum),
-		timer:             make(map[string]*location),
-		currentPos:        0,
-		slotNum:           slotNum,
-		addTaskChannel:    make(chan task),
-		removeTaskChannel: make(chan string),
-		stopChannel:       make(chan bool),
+		interval:    interval,
+		start:       time.Now(),
+		timer:       make(map[string]*task),
+		stopChannel: make(chan struct{}),
 	}
-	tw.initSlots()
-
-	return tw
-}
-
-// 初始化时间轮的槽位
-func (tw *TimeWheel) initSlots() {
-	for i := 0; i < tw.slotNum; i++ {
-		tw.slots[i] = list.New()
+	for lvl := 0; lvl < levelNum; lvl++ {
+		size := levelNSize
+		if lvl == 0 {
+			size = level0Size
+		}
+		tw.levels[lvl] = make([]*list.List, size)
+		for i := range tw.levels[lvl] {
+			tw.levels[lvl][i] = list.New()
+		}
+	}
+	for _, opt := range opts {
+		opt(tw)
 	}
+	return tw
 }
 
-// 启动时间轮的定时器
+// Start 启动时间轮
 func (tw *TimeWheel) Start() {
 	tw.ticker = time.NewTicker(tw.interval)
-	go tw.start()
+	if tw.workers > 0 {
+		tw.jobQueue = make(chan func(), tw.workers*64)
+		for i := 0; i < tw.workers; i++ {
+			go tw.worker()
+		}
+	}
+	go tw.run()
 }
 
-// 停止时间轮
+// Stop 停止时间轮, 未执行的任务将被丢弃
 func (tw *TimeWheel) Stop() {
-	tw.stopChannel <- true
+	tw.stopOnce.Do(func() {
+		close(tw.stopChannel)
+	})
 }
 
-// 添加任务到时间轮的任务队列
+// AddJob 添加一个延迟任务, 同一个 key 的旧任务会被替换
 func (tw *TimeWheel) AddJob(delay time.Duration, key string, job func()) {
 	if delay < 0 {
-		return
+		delay = 0
 	}
-	tw.addTaskChannel <- task{delay: delay, key: key, job: job}
+	// 向上取整, 保证任务不会早于 delay 执行
+	expires := int64((time.Since(tw.start) + delay + tw.interval - 1) / tw.interval)
+	tw.submit(op{task: &task{expires: expires, key: key, job: job}, key: key})
 }
 
-// 从时间轮的任务队列中移除任务
+// RemoveJob 从时间轮中移除任务
 // 如果任务已完成或未找到，则不执行任何操作
 func (tw *TimeWheel) RemoveJob(key string) {
 	if key == "" {
 		return
 	}
-	tw.removeTaskChannel <- key
+	tw.submit(op{key: key})
+}
+
+func (tw *TimeWheel) submit(o op) {
+	tw.mu.Lock()
+	tw.pending = append(tw.pending, o)
+	tw.mu.Unlock()
 }
 
-// 启动时间轮
-func (tw *TimeWheel) start() {
+func (tw *TimeWheel) run() {
 	for {
 		select {
-		case <-tw.ticker.C: // 等待时间轮的定时器
-			tw.tickHandler() // 处理时间轮的tick
-		case task := <-tw.addTaskChannel: // 等待添加任务的通道
-			tw.addTask(&task) // 添加任务到时间轮的任务队列
-		case key := <-tw.removeTaskChannel: // 等待移除任务的通道
-			tw.removeTask(key) // 从时间轮的任务队列中移除任务
-		case <-tw.stopChannel: // 等待停止时间轮的通道
-			tw.ticker.Stop() // 停止时间轮的定时器
+		case <-tw.ticker.C:
+			tw.applyPending()
+			// 根据真实流逝的时间追赶 tick, 防止协程调度延迟导致时间轮变慢
+			target := int64(time.Since(tw.start) / tw.interval)
+			for tw.current <= target {
+				tw.tick()
+			}
+		case <-tw.stopChannel:
+			tw.ticker.Stop()
+			if tw.jobQueue != nil {
+				close(tw.jobQueue)
+			}
 			return
 		}
 	}
 }
 
-// 时间轮的tick处理函数
-func (tw *TimeWheel) tickHandler() {
-	// 获取当前位置的槽位
-	l := tw.slots[tw.currentPos]
-	// 如果当前位置是最后一个槽位，则将当前位置重置为0，否则将当前位置加1
-	if tw.currentPos == tw.slotNum-1 {
-		tw.currentPos = 0
-	} else {
-		tw.currentPos++
+// applyPending 批量处理调用方提交的添加/取消操作
+func (tw *TimeWheel) applyPending() {
+	tw.mu.Lock()
+	ops := tw.pending
+	tw.pending = nil
+	tw.mu.Unlock()
+
+	for _, o := range ops {
+		if o.task == nil {
+			tw.removeTask(o.key)
+			continue
+		}
+		if o.key != "" {
+			tw.removeTask(o.key)
+			tw.timer[o.key] = o.task
+		}
+		tw.addTask(o.task)
 	}
-	// 扫描并运行当前槽位中的任务
-	go tw.scanAndRunTask(l)
 }
 
-func (tw *TimeWheel) scanAndRunTask(l *list.List) {
-	// 遍历当前槽位中的任务
-	for e := l.Front(); e != nil; {
-		task := e.Value.(*task)
-		// 如果任务需要转动的圈数大于0，则将圈数减1，继续遍历下一个任务
-		if task.circle > 0 {
-			task.circle--
-			e = e.Next()
-			continue
+// tick 处理当前 tick: 必要时将高层的任务向下迁移, 然后执行第 0 层当前槽位中的任务
+func (tw *TimeWheel) tick() {
+	idx := int(tw.current & level0Mask)
+	if idx == 0 {
+		for lvl := 1; lvl < levelNum; lvl++ {
+			i := int((tw.current >> (level0Bits + (lvl-1)*levelNBits)) & levelNMask)
+			tw.cascade(lvl, i)
+			if i != 0 {
+				break
+			}
 		}
+	}
 
-		// 如果任务需要转动的圈数等于0，则执行任务
-		go func() {
-			defer func() {
-				if err := recover(); err != nil {
-					logger.Error(err)
-				}
-			}()
-			job := task.job
-			job()
-		}()
-		// 从槽位中移除任务
+	l := tw.levels[0][idx]
+	for e := l.Front(); e != nil; {
 		next := e.Next()
+		t := e.Value.(*task)
 		l.Remove(e)
-		// 如果任务有键，则从时间轮的任务map中移除任务
-		if task.key != "" {
-			delete(tw.timer, task.key)
+		t.slot, t.elem = nil, nil
+		// 超出时间轮范围的任务 还没有真正到期
+		if t.expires > tw.current {
+			tw.addTask(t)
+		} else {
+			if t.key != "" {
+				delete(tw.timer, t.key)
+			}
+			tw.runJob(t.job)
 		}
 		e = next
 	}
+	tw.current++
 }
 
-func (tw *TimeWheel) addTask(task *task) {
-	// 获取任务在时间轮中的位置和需要转动的圈数
-	pos, circle := tw.getPositionAndCircle(task.delay)
-	task.circle = circle
-
-	// 将任务添加到对应的槽位中
-	e := tw.slots[pos].PushBack(task)
-	loc := &location{
-		slot:  pos,
-		etask: e,
-	}
-	// 如果任务有键，则将任务添加到时间轮的任务map中
-	if task.key != "" {
-		_, ok := tw.timer[task.key]
-		if ok {
-			tw.removeTask(task.key)
-		}
+// cascade 将第 lvl 层第 idx 个槽位中的任务重新放入时间轮
+func (tw *TimeWheel) cascade(lvl int, idx int) {
+	l := tw.levels[lvl][idx]
+	for e := l.Front(); e != nil; {
+		next := e.Next()
+		t := e.Value.(*task)
+		l.Remove(e)
+		tw.addTask(t)
+		e = next
 	}
-	tw.timer[task.key] = loc
 }
 
-// getPositionAndCircle函数用于获取任务在时间轮中的位置和需要转动的圈数
-func (tw *TimeWheel) getPositionAndCircle(d time.Duration) (pos int, circle int) {
-	// 将任务延迟时间转换为秒数
-	delaySeconds := int(d.Seconds())
-	// 将时间轮转动的时间间隔转换为秒数
-	intervalSeconds := int(tw.interval.Seconds())
-	// 计算任务需要转动的圈数
-	circle = int(delaySeconds / intervalSeconds / tw.slotNum)
-	// 计算任务在时间轮中的位置
-	pos = int(tw.currentPos+delaySeconds/intervalSeconds) % tw.slotNum
-
-	return
+// addTask 根据任务的到期 tick 计算其所在的层和槽位
+func (tw *TimeWheel) addTask(t *task) {
+	expires := t.expires
+	delta := expires - tw.current
+	var l *list.List
+	switch {
+	case delta < 0:
+		l = tw.levels[0][tw.current&level0Mask]
+	case delta < level0Size:
+		l = tw.levels[0][expires&level0Mask]
+	default:
+		if delta > maxDelayTicks {
+			delta = maxDelayTicks
+			expires = tw.current + maxDelayTicks
+		}
+		lvl := 1
+		for ; lvl < levelNum-1; lvl++ {
+			if delta < int64(1)<<(level0Bits+lvl*levelNBits) {
+				break
+			}
+		}
+		shift := level0Bits + (lvl-1)*levelNBits
+		l = tw.levels[lvl][(expires>>shift)&levelNMask]
+	}
+	t.slot = l
+	t.elem = l.PushBack(t)
 }
 
-// removeTask函数用于从时间轮的任务队列中移除任务
+// removeTask 从时间轮中移除 key 对应的任务
 func (tw *TimeWheel) removeTask(key string) {
-	pos, ok := tw.timer[key]
+	t, ok := tw.timer[key]
 	if !ok {
 		return
 	}
-	l := tw.slots[pos.slot]
-	l.Remove(pos.etask)
+	if t.slot != nil {
+		t.slot.Remove(t.elem)
+		t.slot, t.elem = nil, nil
+	}
 	delete(tw.timer, key)
 }
+
+func (tw *TimeWheel) runJob(job func()) {
+	if tw.jobQueue != nil {
+		tw.jobQueue <- job
+		return
+	}
+	go safeRun(job)
+}
+
+func (tw *TimeWheel) worker() {
+	for job := range tw.jobQueue {
+		safeRun(job)
+	}
+}
+
+func safeRun(job func()) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Error(err)
+		}
+	}()
+	job()
+}
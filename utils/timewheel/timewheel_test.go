@@ -0,0 +1,71 @@
+package timewheel
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDelay(t *testing.T) {
+	// 全局时间轮在第一次使用时才启动
+	Cancel("none")
+	if tw.Load() != nil {
+		t.Fatal("global time wheel started before the first Delay")
+	}
+	ch := make(chan time.Time, 1)
+	begin := time.Now()
+	Delay(50*time.Millisecond, "", func() {
+		ch <- time.Now()
+	})
+	execAt := <-ch
+	delayDuration := execAt.Sub(begin)
+	if delayDuration < 50*time.Millisecond || delayDuration > 70*time.Millisecond {
+		t.Errorf("wrong execute time: %v", delayDuration)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	var counter int32
+	At(time.Now().Add(30*time.Millisecond), "cancel", func() {
+		atomic.AddInt32(&counter, 1)
+	})
+	Cancel("cancel")
+	// 相同 key 的任务会被替换
+	Delay(20*time.Millisecond, "replace", func() {
+		atomic.AddInt32(&counter, 10)
+	})
+	Delay(40*time.Millisecond, "replace", func() {
+		atomic.AddInt32(&counter, 100)
+	})
+	time.Sleep(100 * time.Millisecond)
+	if c := atomic.LoadInt32(&counter); c != 100 {
+		t.Errorf("expect counter 100, actual %d", c)
+	}
+}
+
+// TestCascade 使用较小的 tick 验证跨层任务能够按时执行
+func TestCascade(t *testing.T) {
+	wheel := New(time.Microsecond * 100)
+	wheel.Start()
+	defer wheel.Stop()
+
+	delays := []time.Duration{
+		time.Millisecond,
+		30 * time.Millisecond, // 第 1 层
+		2 * time.Second,       // 第 2 层
+	}
+	ch := make(chan time.Duration, len(delays))
+	begin := time.Now()
+	for _, d := range delays {
+		expect := d
+		wheel.AddJob(d, "", func() {
+			ch <- time.Since(begin) - expect
+		})
+	}
+	for range delays {
+		diff := <-ch
+		if diff < 0 || diff > 20*time.Millisecond {
+			t.Errorf("wrong execute time, diff: %v", diff)
+		}
+	}
+}
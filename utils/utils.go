@@ -1,6 +1,9 @@
 package utils
 
 import (
+	"fmt"
+	"memgo/datastruct/dict"
+	"memgo/datastruct/set"
 	"memgo/interface/database"
 	"memgo/redis/RESP/protocol"
 	"strconv"
@@ -92,35 +95,36 @@ func ConvertRange(start int64, end int64, size int64) (int, int) {
 	return int(start), int(end)
 }
 
-var ExpireAtBytes = []byte("EXPIREAT")
+var PExpireAtBytes = []byte("PEXPIREAT")
 
+// MakeExpireCmd 生成 PEXPIREAT 命令, 以毫秒精度持久化过期时间点, 保证 aof重写 前后 ttl 一致
 func MakeExpireCmd(key string, expireAt time.Time) *protocol.MultiBulkReply {
 	args := make([][]byte, 3)
-	args[0] = ExpireAtBytes
+	args[0] = PExpireAtBytes
 	args[1] = []byte(key)
-	args[2] = []byte(strconv.FormatInt(expireAt.Unix(), 10))
+	args[2] = []byte(strconv.FormatInt(expireAt.UnixMilli(), 10))
 	return protocol.MakeMultiBulkReply(args)
 }
 
-func EntityToCmd(key string, entity *database.DataEntity) *protocol.MultiBulkReply {
+// aofRewriteItemsPerCmd 重写集合类型时 每条命令最多携带的元素个数, 防止生成过大的命令
+const aofRewriteItemsPerCmd = 64
+
+// EntityToCmd 生成重建 entity 所需的命令, 集合类型会被拆分为多条命令
+// NODE 遇到无法识别的类型时返回错误, 而不是静默跳过 (否则 aof重写 会丢数据)
+func EntityToCmd(key string, entity *database.DataEntity) ([]*protocol.MultiBulkReply, error) {
 	if entity == nil {
-		return nil
+		return nil, nil
 	}
-	var cmd *protocol.MultiBulkReply
 	switch val := entity.Data.(type) {
 	case []byte:
-		cmd = stringToCmd(key, val)
-		//case List.List:
-		//	cmd = listToCmd(key, val)
-		//case *set.Set:
-		//	cmd = setToCmd(key, val)
-		//case dict.Dict:
-		//	cmd = hashToCmd(key, val)
-		//case *SortedSet.SortedSet:
-		//	cmd = zSetToCmd(key, val)
-		//
+		return []*protocol.MultiBulkReply{stringToCmd(key, val)}, nil
+	case *set.Set:
+		return setToCmd(key, val), nil
+	case dict.DictIntf:
+		return hashToCmd(key, val)
+	default:
+		return nil, fmt.Errorf("unknown entity type %T of key %s", entity.Data, key)
 	}
-	return cmd
 }
 
 var setCmd = []byte("SET")
@@ -132,3 +136,60 @@ func stringToCmd(key string, bytes []byte) *protocol.MultiBulkReply {
 	args[2] = bytes
 	return protocol.MakeMultiBulkReply(args)
 }
+
+var sAddCmd = []byte("SADD")
+
+func setToCmd(key string, setObj *set.Set) []*protocol.MultiBulkReply {
+	var cmds []*protocol.MultiBulkReply
+	var args [][]byte
+	setObj.ForEach(func(member string) bool {
+		if args == nil {
+			args = make([][]byte, 2, 2+aofRewriteItemsPerCmd)
+			args[0] = sAddCmd
+			args[1] = []byte(key)
+		}
+		args = append(args, []byte(member))
+		if len(args)-2 == aofRewriteItemsPerCmd {
+			cmds = append(cmds, protocol.MakeMultiBulkReply(args))
+			args = nil
+		}
+		return true
+	})
+	if args != nil {
+		cmds = append(cmds, protocol.MakeMultiBulkReply(args))
+	}
+	return cmds
+}
+
+var hSetCmd = []byte("HSET")
+
+func hashToCmd(key string, hash dict.DictIntf) ([]*protocol.MultiBulkReply, error) {
+	var cmds []*protocol.MultiBulkReply
+	var args [][]byte
+	var err error
+	hash.ForEach(func(field string, raw interface{}) bool {
+		value, ok := raw.([]byte)
+		if !ok {
+			err = fmt.Errorf("unknown hash value type %T of key %s", raw, key)
+			return false
+		}
+		if args == nil {
+			args = make([][]byte, 2, 2+2*aofRewriteItemsPerCmd)
+			args[0] = hSetCmd
+			args[1] = []byte(key)
+		}
+		args = append(args, []byte(field), value)
+		if (len(args)-2)/2 == aofRewriteItemsPerCmd {
+			cmds = append(cmds, protocol.MakeMultiBulkReply(args))
+			args = nil
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if args != nil {
+		cmds = append(cmds, protocol.MakeMultiBulkReply(args))
+	}
+	return cmds, nil
+}